@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"filesync/models"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"path/filepath"
+	"server/pkg/cache"
+	"server/pkg/lockfile"
+	"server/services/account"
+	"server/services/file"
+	"server/services/user"
+)
+
+// remoteAccounts is an account.Service that manages the users of a running server through its admin socket.
+type remoteAccounts struct{}
+
+func (r *remoteAccounts) List() (users []models.UserInfo, err error) {
+	err = request(http.MethodGet, "/users", &users)
+	return users, err
+}
+
+func (r *remoteAccounts) Create(userRequest models.UserRequest) (credential models.Credential, err error) {
+	err = requestWithBody(http.MethodPost, "/users", userRequest, &credential)
+	return credential, err
+}
+
+func (r *remoteAccounts) Reset(username string) (credential models.Credential, err error) {
+	err = request(http.MethodPost, "/users/"+username+"/reset", &credential)
+	return credential, err
+}
+
+func (r *remoteAccounts) Delete(username string) (err error) {
+	return request(http.MethodDelete, "/users/"+username, nil)
+}
+
+func (r *remoteAccounts) Restore(username string) (err error) {
+	return request(http.MethodPost, "/users/"+username+"/restore", nil)
+}
+
+func (r *remoteAccounts) Disable(username string) (err error) {
+	return request(http.MethodPost, "/users/"+username+"/disable", nil)
+}
+
+func (r *remoteAccounts) Enable(username string) (err error) {
+	return request(http.MethodPost, "/users/"+username+"/enable", nil)
+}
+
+func (r *remoteAccounts) Usage(username string) (usage models.Usage, err error) {
+	err = request(http.MethodGet, "/users/"+username+"/quota", &usage)
+	return usage, err
+}
+
+// openDataDir returns an account.Service working directly on the user store in the data directory. A running server
+// keeps the users in memory and would overwrite the changes, so it refuses to open the store while the server holds
+// the lock of the data directory. The lock is held until the command exits.
+func openDataDir() (account.Service, error) {
+	_, err := os.Stat(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	dataLock, err := lockfile.Acquire(dataDir)
+	if errors.Is(err, lockfile.ErrLocked) {
+		return nil, errors.New("the server is running, omit -data to manage its users through the admin socket")
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The usage is reported against the default quota of the server that last used the data directory.
+	state, err := dataLock.State()
+	if err != nil {
+		return nil, err
+	}
+	// The user store logs at info level, which would clutter the output of the command.
+	log.SetLevel(log.WarnLevel)
+	// The file services only count the usage of the users, which needs no caches.
+	factory := file.NewFactory(dataDir, cache.NewCache(0), cache.NewCache(0))
+	userService, err := user.Open(&user.Config{
+		Path:         filepath.Join(dataDir, usersFile),
+		DefaultQuota: state.DefaultQuota,
+	}, factory)
+	if err != nil {
+		return nil, err
+	}
+	return account.New(userService), nil
+}
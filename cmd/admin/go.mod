@@ -0,0 +1,3 @@
+module admin
+
+go 1.22.1
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"filesync/models"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"server/services/account"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: filesync-admin [-socket path | -data dir [-users file]] <command> [arguments]
+
+With -data the user commands work directly on the data directory of a stopped server, the other commands
+need a running server.
+
+User commands:
+  users                  list users with their storage usage
+  create [-password] <username>
+                         create a user with a generated shared key, or password with -password
+  reset <username>       generate a new credential for a user and close their sessions
+  delete <username>      delete a user and close their sessions, their files are purged after the grace period
+  restore <username>     undo the deletion of a user that was not purged yet
+  disable <username>     disable a user and close their sessions
+  enable <username>      enable a disabled user
+
+Commands:
+  sessions               list active sessions and their in-flight transactions
+  disconnect <session>   close a session
+  stats                  show connection and cache statistics
+  quota <username>       show the storage usage and quota of a user
+  quota <username> <bytes> <files>
+                         set the quota of a user, 0 is unlimited
+  quota <username> clear restore the default quota of a user
+  devices <username>     list the devices of a user
+  revoke-device <username> <device>
+                         revoke a device and close its sessions
+  lockouts               list usernames and addresses with failed logins
+  unlock <user|address> <key>
+                         forget the failed logins of a username or address
+  audit [-user name] [-since time] [-until time]
+                         show the audit log, times are RFC 3339 or a duration ago
+  audit verify           check the hash chain of the audit log
+  invite                 create a single use registration invite
+  jobs                   list maintenance jobs
+  run <job>              run a maintenance job
+`
+
+// userCommands are the commands that also work directly on the data directory.
+var userCommands = map[string]bool{"users": true, "create": true, "reset": true, "delete": true, "restore": true, "disable": true, "enable": true}
+
+var (
+	socketPath string
+	dataDir    string
+	usersFile  string
+	client     *http.Client
+	// accounts manages the users through the admin socket, or directly on the data directory with -data.
+	accounts account.Service
+)
+
+func main() {
+	args := flag.Args()
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	if dataDir != "" {
+		if !userCommands[args[0]] {
+			fmt.Fprintf(os.Stderr, "filesync-admin: %s needs a running server, omit -data\n", args[0])
+			os.Exit(2)
+		}
+		accounts, err = openDataDir()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "filesync-admin:", err)
+			os.Exit(1)
+		}
+	}
+	switch {
+	case args[0] == "users" && len(args) == 1:
+		err = listUsers()
+	case args[0] == "create":
+		err = createUser(args[1:])
+	case args[0] == "reset" && len(args) == 2:
+		var credential models.Credential
+		credential, err = accounts.Reset(args[1])
+		if err == nil {
+			printCredential(credential)
+		}
+	case args[0] == "delete" && len(args) == 2:
+		err = accounts.Delete(args[1])
+	case args[0] == "restore" && len(args) == 2:
+		err = accounts.Restore(args[1])
+	case args[0] == "disable" && len(args) == 2:
+		err = accounts.Disable(args[1])
+	case args[0] == "enable" && len(args) == 2:
+		err = accounts.Enable(args[1])
+	case args[0] == "sessions" && len(args) == 1:
+		err = listSessions()
+	case args[0] == "disconnect" && len(args) == 2:
+		err = request(http.MethodDelete, "/sessions/"+args[1], nil)
+	case args[0] == "stats" && len(args) == 1:
+		err = showStats()
+	case args[0] == "quota" && len(args) == 2:
+		err = showQuota(args[1])
+	case args[0] == "quota" && len(args) == 3 && args[2] == "clear":
+		err = request(http.MethodDelete, "/users/"+args[1]+"/quota", nil)
+	case args[0] == "quota" && len(args) == 4:
+		err = setQuota(args[1], args[2], args[3])
+	case args[0] == "devices" && len(args) == 2:
+		err = listDevices(args[1])
+	case args[0] == "revoke-device" && len(args) == 3:
+		err = request(http.MethodDelete, "/users/"+args[1]+"/devices/"+url.PathEscape(args[2]), nil)
+	case args[0] == "lockouts" && len(args) == 1:
+		err = listLockouts()
+	case args[0] == "unlock" && len(args) == 3:
+		err = request(http.MethodDelete, "/lockouts/"+args[1]+"/"+url.PathEscape(args[2]), nil)
+	case args[0] == "audit" && len(args) == 2 && args[1] == "verify":
+		err = request(http.MethodGet, "/audit/verify", nil)
+		if err == nil {
+			fmt.Println("audit log hash chain intact")
+		}
+	case args[0] == "audit":
+		err = queryAudit(args[1:])
+	case args[0] == "invite" && len(args) == 1:
+		err = createInvite()
+	case args[0] == "jobs" && len(args) == 1:
+		err = listJobs()
+	case args[0] == "run" && len(args) == 2:
+		err = request(http.MethodPost, "/jobs/"+args[1], nil)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "filesync-admin:", err)
+		os.Exit(1)
+	}
+}
+
+func listSessions() error {
+	var sessions []models.SessionInfo
+	err := request(http.MethodGet, "/sessions", &sessions)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSER\tREMOTE\tSTARTED\tIN\tOUT\tTRANSACTIONS")
+	for _, s := range sessions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\n", s.ID, s.Username, s.RemoteAddr,
+			s.StartTime.Format(time.RFC3339), s.BytesIn, s.BytesOut, len(s.Transactions))
+		for _, t := range s.Transactions {
+			fmt.Fprintf(w, "  %s\t%s\t\t%s\t\t\t\n", t.ID, t.Action, t.StartTime.Format(time.RFC3339))
+		}
+	}
+	return w.Flush()
+}
+
+func showStats() error {
+	var stats models.ServerStats
+	err := request(http.MethodGet, "/stats", &stats)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Active connections:\t%d\n", stats.ActiveConnections)
+	fmt.Fprintf(w, "Rejected (server full):\t%d\n", stats.RejectedGlobal)
+	fmt.Fprintf(w, "Rejected (per address):\t%d\n", stats.RejectedPerIP)
+	fmt.Fprintf(w, "Rejected (rate limited):\t%d\n", stats.RejectedRate)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "CACHE\tSIZE\tCAPACITY\tHITS\tMISSES")
+	for name, c := range stats.Caches {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", name, c.Size, c.Capacity, c.Hits, c.Misses)
+	}
+	return w.Flush()
+}
+
+func listUsers() error {
+	users, err := accounts.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tCREDENTIAL\tSTATUS\tBYTES\tFILES\tQUOTA BYTES\tQUOTA FILES")
+	for _, u := range users {
+		credential, status := "shared key", "enabled"
+		if u.Password {
+			credential = "password"
+		}
+		if u.Disabled {
+			status = "disabled"
+		}
+		if !u.Deleted.IsZero() {
+			status = "deleted " + u.Deleted.Format(time.DateOnly)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n", u.Username, credential, status, u.Usage.Bytes, u.Usage.Files,
+			limit(u.Usage.Quota.MaxBytes), limit(int64(u.Usage.Quota.MaxFiles)))
+	}
+	return w.Flush()
+}
+
+func createUser(args []string) error {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	password := flags.Bool("password", false, "generate a password instead of a shared key")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	credential, err := accounts.Create(models.UserRequest{
+		Username: flags.Arg(0),
+		Password: *password,
+	})
+	if err != nil {
+		return err
+	}
+	printCredential(credential)
+	return nil
+}
+
+// printCredential prints a generated credential, which is not shown again.
+func printCredential(credential models.Credential) {
+	if credential.Password != "" {
+		fmt.Printf("password of %s: %s\n", credential.Username, credential.Password)
+		return
+	}
+	fmt.Printf("shared key of %s: %s\n", credential.Username, hex.EncodeToString(credential.SharedKey))
+}
+
+func showQuota(username string) error {
+	var usage models.Usage
+	err := request(http.MethodGet, "/users/"+username+"/quota", &usage)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "\tUSED\tQUOTA")
+	fmt.Fprintf(w, "Bytes\t%d\t%s\n", usage.Bytes, limit(usage.Quota.MaxBytes))
+	fmt.Fprintf(w, "Files\t%d\t%s\n", usage.Files, limit(int64(usage.Quota.MaxFiles)))
+	return w.Flush()
+}
+
+func setQuota(username string, maxBytes string, maxFiles string) error {
+	var (
+		quota models.Quota
+		err   error
+	)
+	quota.MaxBytes, err = strconv.ParseInt(maxBytes, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid bytes: %w", err)
+	}
+	quota.MaxFiles, err = strconv.Atoi(maxFiles)
+	if err != nil {
+		return fmt.Errorf("invalid files: %w", err)
+	}
+	return requestWithBody(http.MethodPut, "/users/"+username+"/quota", quota, nil)
+}
+
+// limit formats a quota limit, zero is unlimited.
+func limit(value int64) string {
+	if value == 0 {
+		return "unlimited"
+	}
+	return strconv.FormatInt(value, 10)
+}
+
+func listDevices(username string) error {
+	var devices []models.DeviceInfo
+	err := request(http.MethodGet, "/users/"+username+"/devices", &devices)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tVERSION\tFIRST SEEN\tLAST SEEN\tREVOKED")
+	for _, d := range devices {
+		revoked := "-"
+		if !d.RevokedAt.IsZero() {
+			revoked = d.RevokedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", d.ID, d.Name, d.ClientVersion,
+			d.FirstSeen.Format(time.RFC3339), d.LastSeen.Format(time.RFC3339), revoked)
+	}
+	return w.Flush()
+}
+
+func listLockouts() error {
+	var lockouts []models.LockoutInfo
+	err := request(http.MethodGet, "/lockouts", &lockouts)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tKEY\tFAILURES\tLAST FAILURE\tBLOCKED UNTIL")
+	for _, l := range lockouts {
+		blocked := "-"
+		if l.BlockedUntil.After(time.Now()) {
+			blocked = l.BlockedUntil.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", l.Kind, l.Key, l.Failures, l.LastFailure.Format(time.RFC3339), blocked)
+	}
+	return w.Flush()
+}
+
+func queryAudit(args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	username := flags.String("user", "", "only show entries of the user")
+	since := flags.String("since", "", "only show entries after the time")
+	until := flags.String("until", "", "only show entries before the time")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() > 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	query := url.Values{}
+	if *username != "" {
+		query.Set("user", *username)
+	}
+	for name, value := range map[string]string{"since": *since, "until": *until} {
+		if value == "" {
+			continue
+		}
+		bound, err := parseTime(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		query.Set(name, bound.Format(time.RFC3339))
+	}
+
+	var entries []models.AuditEntry
+	err := request(http.MethodGet, "/audit?"+query.Encode(), &entries)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tEVENT\tUSER\tDEVICE\tREMOTE\tMETHOD\tDETAIL")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.Event, dash(e.Username),
+			dash(e.Device), dash(e.RemoteAddr), dash(e.Method), dash(e.Detail))
+	}
+	return w.Flush()
+}
+
+// parseTime parses an RFC 3339 time or a duration before now.
+func parseTime(value string) (time.Time, error) {
+	if ago, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-ago), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// dash returns the value or a dash if it is empty.
+func dash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func createInvite() error {
+	var invite models.Invite
+	err := request(http.MethodPost, "/invites", &invite)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s (expires %s)\n", invite.Token, invite.Expires.Format(time.RFC3339))
+	return nil
+}
+
+func listJobs() error {
+	var jobs []string
+	err := request(http.MethodGet, "/jobs", &jobs)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		fmt.Println(job)
+	}
+	return nil
+}
+
+// request sends a request to the admin interface and decodes the JSON response into result, if given.
+func request(method string, path string, result interface{}) error {
+	return requestWithBody(method, path, nil, result)
+}
+
+// requestWithBody sends a request with body encoded as JSON, if given, to the admin interface and decodes the JSON
+// response into result, if given.
+func requestWithBody(method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://admin"+path, reader)
+	if err != nil {
+		return err
+	}
+	var res *http.Response
+	res, err = client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		message, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(message)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+func init() {
+	flag.StringVar(&socketPath, "socket", filepath.Join("_data", "admin.sock"), "path of the server admin socket")
+	flag.StringVar(&dataDir, "data", "", "data directory of a stopped server to manage users in")
+	flag.StringVar(&usersFile, "users", "users.json", "name of the user store file in the data directory")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flag.Parse()
+
+	client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+	accounts = &remoteAccounts{}
+}
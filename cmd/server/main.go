@@ -1,34 +1,93 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"filesync/constants"
 	"filesync/enums"
+	"filesync/models"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"os"
 	"path/filepath"
+	"runtime/debug"
+	"server/pkg/admin"
+	"server/pkg/audit"
 	"server/pkg/cache"
 	"server/pkg/fileserver"
 	"server/pkg/handlers"
+	"server/pkg/limiter"
+	"server/pkg/lockfile"
+	"server/pkg/lockout"
 	"server/pkg/mux"
+	"server/pkg/notifier"
+	"server/pkg/resume"
+	"server/services/account"
 	"server/services/auth"
+	"server/services/backend"
+	"server/services/device"
 	"server/services/file"
+	"server/services/registration"
+	"server/services/share"
+	"server/services/token"
 	"server/services/user"
+	"time"
 )
 
 var (
-	Environment   enums.Environment
-	Port          int
-	FileCacheSize int
-	MetaCacheSize int
-	CertDir       string
-	CertFile      string
-	KeyFile       string
-	BaseDir       string
-	ChallengeLen  int
-	LogLevel      log.Level
+	Environment        enums.Environment
+	Port               int
+	FileCacheSize      int
+	MetaCacheSize      int
+	NotifyBuffer       int
+	CertDir            string
+	CertFile           string
+	KeyFile            string
+	ClientCAFile       string
+	ClientCertMode     string
+	CertField          auth.CertificateField
+	RequireDevice      bool
+	BaseDir            string
+	UsersFile          string
+	SharesFile         string
+	DevicesFile        string
+	TokensFile         string
+	InvitesFile        string
+	FileIdleTimeout    time.Duration
+	QuotaBytes         int64
+	QuotaFiles         int
+	PurgeGracePeriod   time.Duration
+	PurgeInterval      time.Duration
+	ChallengeLen       int
+	AdminSocket        string
+	AuthTimeout        time.Duration
+	ResumeTTL          time.Duration
+	RegistrationPolicy registration.Policy
+	InviteTTL          time.Duration
+	LoginBaseDelay     time.Duration
+	LoginMaxDelay      time.Duration
+	LoginUserFailures  int
+	LoginAddrFailures  int
+	LockoutDuration    time.Duration
+	FailureWindow      time.Duration
+	AuthBackends       []string
+	HtpasswdFile       string
+	LDAPAddr           string
+	LDAPSecurity       backend.LDAPSecurity
+	LDAPBindDN         string
+	LDAPBindPassword   string
+	LDAPBaseDN         string
+	LDAPUserAttr       string
+	AuditFile          string
+	AuditChain         bool
+	MaxConns           int
+	MaxConnsPerIP      int
+	ConnRate           float64
+	ConnBurst          int
+	LogLevel           log.Level
 )
 
 func main() {
@@ -42,6 +101,8 @@ func main() {
 		cert               tls.Certificate
 		tlsConfig          *tls.Config
 		authConfig         *auth.Config
+		muxConfig          *mux.Config
+		limiterConfig      *limiter.Config
 		err                error
 	)
 
@@ -50,24 +111,151 @@ func main() {
 	metaCache = cache.NewCache(MetaCacheSize)
 
 	// Initialize services.
-	fileServiceFactory = file.NewFactory(BaseDir, fileCache, metaCache)
+	fileServiceFactory = file.NewFactoryWithConfig(&file.FactoryConfig{
+		BaseDir:     BaseDir,
+		IdleTimeout: FileIdleTimeout,
+	}, fileCache, metaCache)
 
-	userService = user.New(fileServiceFactory)
+	err = os.MkdirAll(BaseDir, 0700)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The lock keeps the admin CLI off the data directory while the server holds the users in memory. The default
+	// quota is recorded for the usage the CLI reports.
+	dataLock, err := lockfile.Acquire(BaseDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dataLock.Release()
+	defaultQuota := models.Quota{
+		MaxBytes: QuotaBytes,
+		MaxFiles: QuotaFiles,
+	}
+	err = dataLock.Record(lockfile.State{DefaultQuota: defaultQuota})
+	if err != nil {
+		log.Fatal(err)
+	}
+	userService, err = user.Open(&user.Config{
+		Path:         filepath.Join(BaseDir, UsersFile),
+		DefaultQuota: defaultQuota,
+		GracePeriod:  PurgeGracePeriod,
+	}, fileServiceFactory)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	shareService, err := share.Open(filepath.Join(BaseDir, SharesFile), userService, fileServiceFactory)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	resumeStore := resume.New(&resume.Config{
+		TTL: ResumeTTL,
+	})
+
+	registrationService, err := registration.Open(&registration.Config{
+		Policy:    RegistrationPolicy,
+		InviteTTL: InviteTTL,
+		Path:      filepath.Join(BaseDir, InvitesFile),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	authConfig = &auth.Config{
-		ChallengeLen: ChallengeLen,
+		ChallengeLen:     ChallengeLen,
+		TokenSize:        resume.TokenSize,
+		CertificateField: CertField,
+		RequireDevice:    RequireDevice,
+	}
+	failureTracker := lockout.New(&lockout.Config{
+		BaseDelay:          LoginBaseDelay,
+		MaxDelay:           LoginMaxDelay,
+		MaxUserFailures:    LoginUserFailures,
+		MaxAddressFailures: LoginAddrFailures,
+		LockoutDuration:    LockoutDuration,
+		FailureWindow:      FailureWindow,
+	})
+	// The audit log lives in the data directory like the other stores, an empty path disables it.
+	auditPath := AuditFile
+	if auditPath != "" {
+		auditPath = filepath.Join(BaseDir, auditPath)
 	}
-	authService := auth.New(userService, authConfig)
+	auditLog, err := audit.New(&audit.Config{
+		Path:      auditPath,
+		HashChain: AuditChain,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer auditLog.Close()
+	tokenService, err := token.Open(filepath.Join(BaseDir, TokensFile))
+	if err != nil {
+		log.Fatal(err)
+	}
+	deviceService, err := device.Open(filepath.Join(BaseDir, DevicesFile))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Chain the configured authentication backends in order. The accounts of the user store are not a backend, they
+	// log in with the password exchange and the server never sees their password.
+	var authenticators []backend.Authenticator
+	for _, name := range AuthBackends {
+		switch name {
+		case "htpasswd":
+			var htpasswd backend.Authenticator
+			htpasswd, err = backend.NewHtpasswd(HtpasswdFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			authenticators = append(authenticators, htpasswd)
+		case "ldap":
+			ldapConfig := &backend.LDAPConfig{
+				Address:       LDAPAddr,
+				Security:      LDAPSecurity,
+				BindDN:        LDAPBindDN,
+				BindPassword:  LDAPBindPassword,
+				BaseDN:        LDAPBaseDN,
+				UserAttribute: LDAPUserAttr,
+				Timeout:       AuthTimeout,
+			}
+			authenticators = append(authenticators, backend.NewLDAP(ldapConfig))
+		default:
+			log.Fatalf("Invalid authentication backend: %s", name)
+		}
+	}
+	authService := auth.New(userService, registrationService, tokenService, resumeStore, backend.NewChain(authenticators...), deviceService, failureTracker, auditLog, authConfig)
 
 	// Initialize the mux.
-	tcpMux := mux.NewMux(authService)
+	muxConfig = &mux.Config{
+		AuthTimeout: AuthTimeout,
+	}
+	hub := notifier.NewHub(NotifyBuffer)
+	tcpMux := mux.NewMux(authService, hub, resumeStore, muxConfig)
 
-	tcpMux.Handle(enums.Status, handlers.HandleStatus)
-	tcpMux.Handle(enums.Download, handlers.HandleDownload)
-	tcpMux.Handle(enums.Upload, handlers.HandleUpload)
-	tcpMux.Handle(enums.Delete, handlers.HandleDelete)
+	tcpMux.Handle(enums.Status, handlers.NewStatusHandler(userService, shareService))
+	tcpMux.Handle(enums.Download, handlers.NewDownloadHandler(userService, shareService))
+	tcpMux.Handle(enums.Upload, handlers.NewUploadHandler(userService, shareService))
+	tcpMux.Handle(enums.Delete, handlers.NewDeleteHandler(userService, shareService, auditLog))
 	tcpMux.Handle(enums.Chunk, handlers.HandleChunk)
 	tcpMux.Handle(enums.List, handlers.HandleList)
+	tcpMux.Handle(enums.RotateKey, handlers.NewRotateKeyHandler(authService, auditLog))
+	tcpMux.Handle(enums.CreateToken, handlers.NewCreateTokenHandler(tokenService, userService, auditLog))
+	tcpMux.Handle(enums.ListTokens, handlers.NewListTokensHandler(tokenService))
+	tcpMux.Handle(enums.RevokeToken, handlers.NewRevokeTokenHandler(tokenService, tcpMux, auditLog))
+	tcpMux.Handle(enums.ListDevices, handlers.NewListDevicesHandler(deviceService))
+	tcpMux.Handle(enums.RevokeDevice, handlers.NewRevokeDeviceHandler(deviceService, tcpMux, auditLog))
+	tcpMux.Handle(enums.CreateShare, handlers.NewCreateShareHandler(shareService, auditLog))
+	tcpMux.Handle(enums.ListShares, handlers.NewListSharesHandler(shareService))
+	tcpMux.Handle(enums.DeleteShare, handlers.NewDeleteShareHandler(shareService, auditLog))
+	tcpMux.Handle(enums.SetShareMember, handlers.NewSetShareMemberHandler(shareService, auditLog))
+	tcpMux.Handle(enums.RemoveShareMember, handlers.NewRemoveShareMemberHandler(shareService, auditLog))
+	tcpMux.HandleOrdered(enums.SelectShare, handlers.NewSelectShareHandler(shareService, hub))
+	tcpMux.Handle(enums.CreateLibrary, handlers.NewCreateLibraryHandler(userService, auditLog))
+	tcpMux.Handle(enums.ListLibraries, handlers.NewListLibrariesHandler(userService))
+	tcpMux.Handle(enums.DeleteLibrary, handlers.NewDeleteLibraryHandler(userService, auditLog))
+	tcpMux.HandleOrdered(enums.SelectLibrary, handlers.NewSelectLibraryHandler(userService, hub))
 
 	if Environment == enums.Development {
 		tcpMux.Handle(enums.Echo, handlers.HandleEcho)
@@ -88,7 +276,69 @@ func main() {
 	tlsConfig = &tls.Config{
 		Certificates: []tls.Certificate{cert},
 	}
-	server = fileserver.NewServer(tcpMux, tlsConfig)
+	// Clients with a certificate signed by the client CA skip the challenge.
+	switch ClientCertMode {
+	case "off":
+	case "optional", "required":
+		var caPEM []byte
+		caPEM, err = os.ReadFile(filepath.Join(certDir, ClientCAFile))
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(caPEM) {
+			log.Fatal(fmt.Errorf("no certificates found in %s", ClientCAFile))
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if ClientCertMode == "required" {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	default:
+		log.Fatal(fmt.Errorf("invalid client certificate mode: %s", ClientCertMode))
+	}
+	limiterConfig = &limiter.Config{
+		MaxConnections:      MaxConns,
+		MaxConnectionsPerIP: MaxConnsPerIP,
+		ConnectionRate:      ConnRate,
+		ConnectionBurst:     ConnBurst,
+	}
+	connLimiter := limiter.New(limiterConfig)
+	server = fileserver.NewServer(tcpMux, tlsConfig, connLimiter)
+
+	// Start the admin interface.
+	adminServer := admin.NewServer(&admin.Config{
+		SocketPath: AdminSocket,
+	}, tcpMux, userService, account.New(userService), registrationService, deviceService, connLimiter, failureTracker, auditLog, map[string]cache.Cache{
+		"file": fileCache,
+		"meta": metaCache,
+	})
+	adminServer.RegisterJob("gc", func(_ context.Context) error {
+		debug.FreeOSMemory()
+		return nil
+	})
+	// Deleted users are purged with everything the services keep about them once their grace period ended.
+	adminServer.RegisterJob("purge", func(_ context.Context) error {
+		purged, err := userService.Purge(time.Now())
+		for _, username := range purged {
+			err = errors.Join(err, tokenService.RemoveUser(username))
+			err = errors.Join(err, deviceService.RemoveUser(username))
+			err = errors.Join(err, shareService.RemoveUser(username))
+			auditLog.Record(models.AuditEntry{
+				Event:    audit.EventUserPurged,
+				Username: username,
+			})
+			log.Infof("Purged user %s", username)
+		}
+		return err
+	})
+	adminServer.ScheduleJob("purge", PurgeInterval)
+	go func() {
+		err := adminServer.ListenAndServe()
+		if err != nil {
+			log.Error("Admin interface stopped: ", err)
+		}
+	}()
+	defer adminServer.Shutdown(context.Background())
 
 	// Start the server.
 	err = server.ListenAndServe(Port)
@@ -109,11 +359,53 @@ func init() {
 	viper.SetDefault("port", 443)
 	viper.SetDefault("cache.file.size", 1_000)
 	viper.SetDefault("cache.meta.size", 100_000)
+	viper.SetDefault("notify.buffer", 64)
 	viper.SetDefault("tls.dir", "_certs")
 	viper.SetDefault("tls.cert", "server.crt")
 	viper.SetDefault("tls.key", "server.key")
+	viper.SetDefault("tls.client.mode", "off")
+	viper.SetDefault("tls.client.ca", "client-ca.crt")
+	viper.SetDefault("auth.cert.field", auth.CertificateCommonName)
+	viper.SetDefault("auth.device.required", true)
 	viper.SetDefault("data.dir", "_data")
+	viper.SetDefault("data.users", "users.json")
+	viper.SetDefault("data.shares", "shares.json")
+	viper.SetDefault("data.devices", "devices.json")
+	viper.SetDefault("data.tokens", "tokens.json")
+	viper.SetDefault("data.invites", "invites.json")
+	viper.SetDefault("data.idle.timeout", file.DefaultIdleTimeout)
+	viper.SetDefault("quota.bytes", 0)
+	viper.SetDefault("quota.files", 0)
+	viper.SetDefault("purge.grace", 30*24*time.Hour)
+	viper.SetDefault("purge.interval", time.Hour)
+	// The admin socket defaults to the data directory, which only the user running the server can enter.
+	viper.SetDefault("admin.socket", "")
 	viper.SetDefault("auth.challenge.len", 32)
+	viper.SetDefault("auth.timeout", 10*time.Second)
+	viper.SetDefault("auth.resume.ttl", 2*time.Minute)
+	viper.SetDefault("auth.lockout.delay", time.Second)
+	viper.SetDefault("auth.lockout.delay.max", time.Minute)
+	viper.SetDefault("auth.lockout.user.failures", 10)
+	viper.SetDefault("auth.lockout.ip.failures", 50)
+	viper.SetDefault("auth.lockout.duration", 15*time.Minute)
+	viper.SetDefault("auth.lockout.window", time.Hour)
+	// The backends of external accounts, tried in order when a client logs in with the password of its account.
+	viper.SetDefault("auth.backends", []string{})
+	viper.SetDefault("auth.htpasswd.file", "htpasswd")
+	viper.SetDefault("auth.ldap.addr", "localhost:389")
+	viper.SetDefault("auth.ldap.security", backend.LDAPStartTLS)
+	viper.SetDefault("auth.ldap.bind.dn", "")
+	viper.SetDefault("auth.ldap.bind.password", "")
+	viper.SetDefault("auth.ldap.base.dn", "")
+	viper.SetDefault("auth.ldap.user.attr", "uid")
+	viper.SetDefault("audit.file", "audit.log")
+	viper.SetDefault("audit.chain", false)
+	viper.SetDefault("register.policy", registration.PolicyOpen)
+	viper.SetDefault("register.invite.ttl", 72*time.Hour)
+	viper.SetDefault("conn.max", 1_000)
+	viper.SetDefault("conn.ip.max", 16)
+	viper.SetDefault("conn.ip.rate", 5)
+	viper.SetDefault("conn.ip.burst", 10)
 	viper.SetDefault("log.level", log.DebugLevel)
 
 	Environment = enums.Environment(viper.GetString("env"))
@@ -146,11 +438,54 @@ func init() {
 	Port = viper.GetInt("port")
 	FileCacheSize = viper.GetInt("cache.file.size")
 	MetaCacheSize = viper.GetInt("cache.meta.size")
+	NotifyBuffer = viper.GetInt("notify.buffer")
 	CertDir = viper.GetString("tls.dir")
 	CertFile = viper.GetString("tls.cert")
 	KeyFile = viper.GetString("tls.key")
+	ClientCertMode = viper.GetString("tls.client.mode")
+	ClientCAFile = viper.GetString("tls.client.ca")
+	CertField = auth.CertificateField(viper.GetString("auth.cert.field"))
+	RequireDevice = viper.GetBool("auth.device.required")
 	BaseDir = viper.GetString("data.dir")
+	UsersFile = viper.GetString("data.users")
+	SharesFile = viper.GetString("data.shares")
+	DevicesFile = viper.GetString("data.devices")
+	TokensFile = viper.GetString("data.tokens")
+	InvitesFile = viper.GetString("data.invites")
+	FileIdleTimeout = viper.GetDuration("data.idle.timeout")
+	QuotaBytes = viper.GetInt64("quota.bytes")
+	QuotaFiles = viper.GetInt("quota.files")
+	PurgeGracePeriod = viper.GetDuration("purge.grace")
+	PurgeInterval = viper.GetDuration("purge.interval")
+	AdminSocket = viper.GetString("admin.socket")
+	if AdminSocket == "" {
+		AdminSocket = filepath.Join(BaseDir, admin.SocketFile)
+	}
 	ChallengeLen = viper.GetInt("auth.challenge.len")
+	AuthTimeout = viper.GetDuration("auth.timeout")
+	ResumeTTL = viper.GetDuration("auth.resume.ttl")
+	LoginBaseDelay = viper.GetDuration("auth.lockout.delay")
+	LoginMaxDelay = viper.GetDuration("auth.lockout.delay.max")
+	LoginUserFailures = viper.GetInt("auth.lockout.user.failures")
+	LoginAddrFailures = viper.GetInt("auth.lockout.ip.failures")
+	LockoutDuration = viper.GetDuration("auth.lockout.duration")
+	FailureWindow = viper.GetDuration("auth.lockout.window")
+	AuthBackends = viper.GetStringSlice("auth.backends")
+	HtpasswdFile = viper.GetString("auth.htpasswd.file")
+	LDAPAddr = viper.GetString("auth.ldap.addr")
+	LDAPSecurity = backend.LDAPSecurity(viper.GetString("auth.ldap.security"))
+	LDAPBindDN = viper.GetString("auth.ldap.bind.dn")
+	LDAPBindPassword = viper.GetString("auth.ldap.bind.password")
+	LDAPBaseDN = viper.GetString("auth.ldap.base.dn")
+	LDAPUserAttr = viper.GetString("auth.ldap.user.attr")
+	AuditFile = viper.GetString("audit.file")
+	AuditChain = viper.GetBool("audit.chain")
+	RegistrationPolicy = registration.Policy(viper.GetString("register.policy"))
+	InviteTTL = viper.GetDuration("register.invite.ttl")
+	MaxConns = viper.GetInt("conn.max")
+	MaxConnsPerIP = viper.GetInt("conn.ip.max")
+	ConnRate = viper.GetFloat64("conn.ip.rate")
+	ConnBurst = viper.GetInt("conn.ip.burst")
 	LogLevel = viper.Get("log.level").(log.Level)
 
 	// Configure logging.
@@ -1,5 +1,7 @@
 package _mocks
 
+import "filesync/models"
+
 // MockCache is a mock implementation of the cache.Cache interface for testing purposes.
 type MockCache struct{}
 
@@ -12,3 +14,7 @@ func (c *MockCache) Set(_ string, _ interface{}) {
 
 func (c *MockCache) Delete(_ string) {
 }
+
+func (c *MockCache) Stats() models.CacheStats {
+	return models.CacheStats{}
+}
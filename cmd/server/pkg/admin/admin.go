@@ -0,0 +1,518 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"filesync/models"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"server/pkg/audit"
+	"server/pkg/cache"
+	"server/pkg/limiter"
+	"server/pkg/lockout"
+	"server/pkg/mux"
+	"server/services/account"
+	"server/services/device"
+	"server/services/registration"
+	"server/services/user"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SocketFile is the default name of the admin socket in the data directory of the server.
+const SocketFile = "admin.sock"
+
+type Config struct {
+	// SocketPath is the path of the unix socket the admin interface listens on. Its directory should only be
+	// accessible to the user running the server, the socket is only restricted to that user once it listens.
+	SocketPath string
+}
+
+// Job is a maintenance job that can be triggered through the admin interface.
+type Job func(ctx context.Context) error
+
+type Server interface {
+	// RegisterJob makes the job available under the given name.
+	RegisterJob(name string, job Job)
+	// ScheduleJob runs the registered job with the given name every interval until the server is shut down.
+	// An interval that is not positive disables the schedule.
+	ScheduleJob(name string, interval time.Duration)
+	// ListenAndServe serves the admin interface on the unix socket until the server is shut down.
+	ListenAndServe() error
+	Shutdown(ctx context.Context) error
+}
+
+type concreteServer struct {
+	config              *Config
+	mux                 mux.Mux
+	userService         user.Service
+	accountService      account.Service
+	registrationService registration.Service
+	deviceService       device.Service
+	limiter             limiter.Limiter
+	failureTracker      lockout.Tracker
+	auditLog            audit.Logger
+	caches              map[string]cache.Cache
+	jobs                map[string]Job
+	jobsMutex           sync.RWMutex
+	// jobsCtx is cancelled on shutdown, which stops the scheduled jobs.
+	jobsCtx    context.Context
+	stopJobs   context.CancelFunc
+	httpServer *http.Server
+}
+
+func NewServer(config *Config, tcpMux mux.Mux, userService user.Service, accountService account.Service, registrationService registration.Service, deviceService device.Service, connLimiter limiter.Limiter, failureTracker lockout.Tracker, auditLog audit.Logger, caches map[string]cache.Cache) Server {
+	s := &concreteServer{
+		config:              config,
+		mux:                 tcpMux,
+		userService:         userService,
+		accountService:      accountService,
+		registrationService: registrationService,
+		deviceService:       deviceService,
+		limiter:             connLimiter,
+		failureTracker:      failureTracker,
+		auditLog:            auditLog,
+		caches:              caches,
+		jobs:                make(map[string]Job),
+	}
+	s.jobsCtx, s.stopJobs = context.WithCancel(context.Background())
+
+	handler := http.NewServeMux()
+	handler.HandleFunc("GET /sessions", s.handleListSessions)
+	handler.HandleFunc("DELETE /sessions/{id}", s.handleDisconnect)
+	handler.HandleFunc("GET /stats", s.handleStats)
+	handler.HandleFunc("GET /users", s.handleListUsers)
+	handler.HandleFunc("POST /users", s.handleCreateUser)
+	handler.HandleFunc("DELETE /users/{username}", s.handleDeleteUser)
+	handler.HandleFunc("POST /users/{username}/reset", s.handleResetUser)
+	handler.HandleFunc("POST /users/{username}/restore", s.handleRestoreUser)
+	handler.HandleFunc("POST /users/{username}/disable", s.handleDisableUser)
+	handler.HandleFunc("POST /users/{username}/enable", s.handleEnableUser)
+	handler.HandleFunc("GET /users/{username}/quota", s.handleGetQuota)
+	handler.HandleFunc("PUT /users/{username}/quota", s.handleSetQuota)
+	handler.HandleFunc("DELETE /users/{username}/quota", s.handleSetQuota)
+	handler.HandleFunc("GET /users/{username}/devices", s.handleListDevices)
+	handler.HandleFunc("DELETE /users/{username}/devices/{id}", s.handleRevokeDevice)
+	handler.HandleFunc("GET /lockouts", s.handleListLockouts)
+	handler.HandleFunc("DELETE /lockouts/{kind}/{key}", s.handleUnlock)
+	handler.HandleFunc("POST /invites", s.handleCreateInvite)
+	handler.HandleFunc("GET /audit", s.handleQueryAudit)
+	handler.HandleFunc("GET /audit/verify", s.handleVerifyAudit)
+	handler.HandleFunc("GET /jobs", s.handleListJobs)
+	handler.HandleFunc("POST /jobs/{name}", s.handleRunJob)
+	s.httpServer = &http.Server{Handler: handler}
+
+	return s
+}
+
+func (s *concreteServer) RegisterJob(name string, job Job) {
+	s.jobsMutex.Lock()
+	defer s.jobsMutex.Unlock()
+	log.Debugf("Registering admin job %s", name)
+	s.jobs[name] = job
+}
+
+func (s *concreteServer) ScheduleJob(name string, interval time.Duration) {
+	if interval <= 0 {
+		log.Infof("Admin job %s is not scheduled", name)
+		return
+	}
+	log.Debugf("Scheduling admin job %s every %s", name, interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.jobsCtx.Done():
+				return
+			case <-ticker.C:
+				found, err := s.runJob(s.jobsCtx, name)
+				if !found {
+					log.Errorf("Scheduled admin job %s is not registered", name)
+				} else if err != nil {
+					log.Errorf("Scheduled admin job %s failed: %s", name, err)
+				}
+			}
+		}
+	}()
+}
+
+// runJob runs the registered job with the given name, found is false if there is none.
+func (s *concreteServer) runJob(ctx context.Context, name string) (found bool, err error) {
+	s.jobsMutex.RLock()
+	job, found := s.jobs[name]
+	s.jobsMutex.RUnlock()
+	if !found {
+		return false, nil
+	}
+	return true, job(ctx)
+}
+
+func (s *concreteServer) ListenAndServe() error {
+	// Remove the socket left behind by a previous run.
+	err := os.Remove(s.config.SocketPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var listener net.Listener
+	listener, err = listenPrivate(s.config.SocketPath)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Admin interface listening on %s", s.config.SocketPath)
+	err = s.httpServer.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// listenPrivate listens on a unix socket at path that only the user running the server may use. The socket is bound
+// in a directory only the user can enter and moved to path once its permissions are restricted, so it is never
+// reachable with the permissions of the umask.
+func listenPrivate(path string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".admin-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	bound := filepath.Join(dir, filepath.Base(path))
+	var listener *net.UnixListener
+	listener, err = net.ListenUnix("unix", &net.UnixAddr{Name: bound, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket is moved away from the path it was bound to, a socket left behind is removed on the next start.
+	listener.SetUnlinkOnClose(false)
+	err = os.Chmod(bound, 0600)
+	if err == nil {
+		err = os.Rename(bound, path)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (s *concreteServer) Shutdown(ctx context.Context) error {
+	s.stopJobs()
+	return s.httpServer.Shutdown(ctx)
+}
+
+func (s *concreteServer) handleListSessions(w http.ResponseWriter, _ *http.Request) {
+	sessions := s.mux.Sessions()
+	infos := make([]models.SessionInfo, 0, len(sessions))
+	for _, sessionData := range sessions {
+		infos = append(infos, sessionData.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartTime.Before(infos[j].StartTime)
+	})
+	writeJSON(w, infos)
+}
+
+func (s *concreteServer) handleDisconnect(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !s.mux.Disconnect(id) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	s.recordAdmin("", "disconnect session "+id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *concreteServer) handleStats(w http.ResponseWriter, _ *http.Request) {
+	limiterStats := s.limiter.Stats()
+	stats := models.ServerStats{
+		ActiveConnections: limiterStats.Active,
+		RejectedGlobal:    limiterStats.RejectedGlobal,
+		RejectedPerIP:     limiterStats.RejectedPerIP,
+		RejectedRate:      limiterStats.RejectedRate,
+		Caches:            make(map[string]models.CacheStats, len(s.caches)),
+	}
+	for name, c := range s.caches {
+		stats.Caches[name] = c.Stats()
+	}
+	writeJSON(w, stats)
+}
+
+func (s *concreteServer) handleListUsers(w http.ResponseWriter, _ *http.Request) {
+	users, err := s.accountService.List()
+	if err != nil {
+		log.Error("Error listing users: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, users)
+}
+
+// handleCreateUser creates the user of the models.UserRequest in the request body and returns its generated
+// credential.
+func (s *concreteServer) handleCreateUser(w http.ResponseWriter, r *http.Request) {
+	var request models.UserRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid user: %s", err), http.StatusBadRequest)
+		return
+	}
+	var credential models.Credential
+	credential, err = s.accountService.Create(request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	s.recordAdmin(request.Username, "create user")
+	log.Infof("Created user %s", request.Username)
+	writeJSON(w, credential)
+}
+
+func (s *concreteServer) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	err := s.accountService.Delete(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	count := s.mux.DisconnectUser(username)
+	s.recordAdmin(username, "delete user")
+	log.Infof("Deleted user %s, closed %d sessions, the data is kept until it is purged", username, count)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRestoreUser undoes the deletion of a user whose data was not purged yet.
+func (s *concreteServer) handleRestoreUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	err := s.accountService.Restore(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.recordAdmin(username, "restore user")
+	log.Infof("Restored user %s", username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleResetUser replaces the credential of the user, closes the sessions that used the old one and returns the
+// generated credential.
+func (s *concreteServer) handleResetUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	credential, err := s.accountService.Reset(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	count := s.mux.DisconnectUser(username)
+	s.recordAdmin(username, "reset credential")
+	log.Infof("Reset the credential of user %s, closed %d sessions", username, count)
+	writeJSON(w, credential)
+}
+
+func (s *concreteServer) handleDisableUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	err := s.userService.Disable(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	count := s.mux.DisconnectUser(username)
+	s.recordAdmin(username, "disable user")
+	log.Infof("Disabled user %s, closed %d sessions", username, count)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *concreteServer) handleEnableUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	err := s.userService.Enable(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.recordAdmin(username, "enable user")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetQuota returns the storage usage of the user and the quota it counts against.
+func (s *concreteServer) handleGetQuota(w http.ResponseWriter, r *http.Request) {
+	fileService, err := s.userService.GetFileService(r.PathValue("username"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer fileService.Close()
+	writeJSON(w, fileService.Usage())
+}
+
+// handleSetQuota sets the quota of the user to the models.Quota in the request body, or restores the default quota
+// for a DELETE request.
+func (s *concreteServer) handleSetQuota(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	var quota *models.Quota
+	detail := "clear quota"
+	if r.Method == http.MethodPut {
+		quota = &models.Quota{}
+		err := json.NewDecoder(r.Body).Decode(quota)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid quota: %s", err), http.StatusBadRequest)
+			return
+		}
+		detail = fmt.Sprintf("set quota %d bytes %d files", quota.MaxBytes, quota.MaxFiles)
+	}
+	err := s.userService.SetQuota(username, quota)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.recordAdmin(username, detail)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *concreteServer) handleListDevices(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.deviceService.List(r.PathValue("username")))
+}
+
+func (s *concreteServer) handleRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	username, id := r.PathValue("username"), r.PathValue("id")
+	err := s.deviceService.Revoke(username, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	count := s.mux.DisconnectDevice(username, id)
+	s.recordAdmin(username, "revoke device "+id)
+	log.Infof("Revoked device %s of user %s, closed %d sessions", id, username, count)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *concreteServer) handleListLockouts(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, s.failureTracker.Lockouts())
+}
+
+func (s *concreteServer) handleUnlock(w http.ResponseWriter, r *http.Request) {
+	kind, key := lockout.Kind(r.PathValue("kind")), r.PathValue("key")
+	if !s.failureTracker.Unlock(kind, key) {
+		http.Error(w, "lockout not found", http.StatusNotFound)
+		return
+	}
+	s.recordAdmin("", fmt.Sprintf("unlock %s %s", kind, key))
+	log.Infof("Unlocked %s %s", kind, key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *concreteServer) handleCreateInvite(w http.ResponseWriter, _ *http.Request) {
+	if s.registrationService.GetPolicy() != registration.PolicyInvite {
+		http.Error(w, "registration policy is not invite", http.StatusConflict)
+		return
+	}
+	token, expires, err := s.registrationService.CreateInvite()
+	if err != nil {
+		log.Error("Error creating invite: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.recordAdmin("", "create invite")
+	log.Infof("Created invite expiring at %s", expires)
+	writeJSON(w, models.Invite{
+		Token:   token,
+		Expires: expires,
+	})
+}
+
+func (s *concreteServer) handleListJobs(w http.ResponseWriter, _ *http.Request) {
+	s.jobsMutex.RLock()
+	names := make([]string, 0, len(s.jobs))
+	for name := range s.jobs {
+		names = append(names, name)
+	}
+	s.jobsMutex.RUnlock()
+	sort.Strings(names)
+	writeJSON(w, names)
+}
+
+func (s *concreteServer) handleRunJob(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	s.jobsMutex.RLock()
+	_, ok := s.jobs[name]
+	s.jobsMutex.RUnlock()
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	s.recordAdmin("", "run job "+name)
+	log.Infof("Running admin job %s", name)
+	_, err := s.runJob(r.Context(), name)
+	if err != nil {
+		log.Errorf("Admin job %s failed: %s", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleQueryAudit returns the audit log entries of the user query parameter between the since and until
+// query parameters, which are RFC 3339 times. Missing parameters match every entry.
+func (s *concreteServer) handleQueryAudit(w http.ResponseWriter, r *http.Request) {
+	filter := audit.Filter{
+		Username: r.URL.Query().Get("user"),
+	}
+	var err error
+	for _, bound := range []struct {
+		name string
+		time *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		value := r.URL.Query().Get(bound.name)
+		if value == "" {
+			continue
+		}
+		*bound.time, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s: %s", bound.name, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var entries []models.AuditEntry
+	entries, err = s.auditLog.Query(filter)
+	if err != nil {
+		log.Error("Error querying audit log: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+func (s *concreteServer) handleVerifyAudit(w http.ResponseWriter, _ *http.Request) {
+	err := s.auditLog.Verify()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// recordAdmin records an action taken on the admin interface in the audit log.
+func (s *concreteServer) recordAdmin(username string, detail string) {
+	s.auditLog.Record(models.AuditEntry{
+		Event:    audit.EventAdmin,
+		Username: username,
+		Detail:   detail,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Error("Error writing admin response: ", err)
+	}
+}
@@ -0,0 +1,458 @@
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"filesync/enums"
+	"filesync/models"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"server/pkg/_mocks"
+	"server/pkg/admin"
+	"server/pkg/audit"
+	"server/pkg/cache"
+	"server/pkg/limiter"
+	"server/pkg/lockout"
+	"server/pkg/mux"
+	"server/pkg/session"
+	"server/services/account"
+	"server/services/auth"
+	"server/services/device"
+	"server/services/file"
+	"server/services/registration"
+	"server/services/user"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testUser = "test1"
+
+// fakeMux is a mux.Mux with a fixed set of sessions.
+type fakeMux struct {
+	sessions     []*session.Session
+	disconnected []string
+}
+
+func (m *fakeMux) Handle(_ enums.MessageType, _ mux.HandlerFunc) {}
+
+func (m *fakeMux) HandleOrdered(_ enums.MessageType, _ mux.HandlerFunc) {}
+
+func (m *fakeMux) ServeConn(_ net.Conn) {}
+
+func (m *fakeMux) Shutdown() {}
+
+func (m *fakeMux) Sessions() []*session.Session {
+	return m.sessions
+}
+
+func (m *fakeMux) Disconnect(sessionID string) bool {
+	for _, s := range m.sessions {
+		if s.ID == sessionID {
+			m.disconnected = append(m.disconnected, sessionID)
+			return true
+		}
+	}
+	return false
+}
+
+func (m *fakeMux) DisconnectUser(username string) int {
+	count := 0
+	for _, s := range m.sessions {
+		if s.Username == username && m.Disconnect(s.ID) {
+			count++
+		}
+	}
+	return count
+}
+
+func (m *fakeMux) DisconnectDevice(username string, device string) int {
+	count := 0
+	for _, s := range m.sessions {
+		if s.Username == username && s.Principal != nil && s.Principal.Device == device && m.Disconnect(s.ID) {
+			count++
+		}
+	}
+	return count
+}
+
+func (m *fakeMux) DisconnectToken(username string, tokenID string) int {
+	count := 0
+	for _, s := range m.sessions {
+		if s.Username == username && s.Principal != nil && s.Principal.TokenID == tokenID && m.Disconnect(s.ID) {
+			count++
+		}
+	}
+	return count
+}
+
+func startTestServer(t *testing.T) (*http.Client, *fakeMux, user.Service, admin.Server) {
+	client, tcpMux, userService, server, _, _ := startTestServerWithServices(t)
+	return client, tcpMux, userService, server
+}
+
+func startTestServerWithServices(t *testing.T) (*http.Client, *fakeMux, user.Service, admin.Server, lockout.Tracker, device.Service) {
+	socketPath := filepath.Join(t.TempDir(), "admin.sock")
+	tcpMux := &fakeMux{
+		sessions: []*session.Session{
+			{
+				ID:           "session1",
+				Username:     testUser,
+				Principal:    &auth.Principal{Username: testUser, Device: "laptop"},
+				Requests:     &sync.Map{},
+				Transactions: &sync.Map{},
+				StartTime:    time.Now(),
+			},
+		},
+	}
+	userService := user.New(file.NewFactory(t.TempDir(), &_mocks.MockCache{}, &_mocks.MockCache{}))
+	caches := map[string]cache.Cache{"file": cache.NewCache(10)}
+
+	registrationService, err := registration.New(&registration.Config{
+		Policy:    registration.PolicyInvite,
+		InviteTTL: time.Hour,
+	})
+	assert.NoError(t, err)
+
+	failureTracker := lockout.New(&lockout.Config{
+		MaxUserFailures: 1,
+		LockoutDuration: time.Hour,
+		FailureWindow:   time.Hour,
+	})
+
+	deviceService := device.New()
+	auditLog, err := audit.New(&audit.Config{Path: filepath.Join(t.TempDir(), "audit.log"), HashChain: true})
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		_ = auditLog.Close()
+	})
+	server := admin.NewServer(&admin.Config{SocketPath: socketPath}, tcpMux, userService, account.New(userService), registrationService, deviceService, limiter.New(&limiter.Config{}), failureTracker, auditLog, caches)
+	go func() {
+		assert.NoError(t, server.ListenAndServe())
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown(context.Background())
+	})
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+	assert.Eventually(t, func() bool {
+		res, err := client.Get("http://admin/jobs")
+		if err != nil {
+			return false
+		}
+		res.Body.Close()
+		return true
+	}, time.Second, 10*time.Millisecond)
+	return client, tcpMux, userService, server, failureTracker, deviceService
+}
+
+func TestSocketPermissions(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "admin.sock")
+	server := admin.NewServer(&admin.Config{SocketPath: socketPath}, &fakeMux{}, nil, nil, nil, nil, nil, nil, nil, nil)
+	go func() {
+		assert.NoError(t, server.ListenAndServe())
+	}()
+	defer server.Shutdown(context.Background())
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(socketPath)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	info, err := os.Stat(socketPath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Expected only the owner to use the socket")
+	entries, err := os.ReadDir(filepath.Dir(socketPath))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1, "Expected the directory the socket was bound in to be removed")
+}
+
+func TestListSessions(t *testing.T) {
+	client, _, _, _ := startTestServer(t)
+
+	res, err := client.Get("http://admin/sessions")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	var sessions []models.SessionInfo
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&sessions))
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, "session1", sessions[0].ID)
+	assert.Equal(t, testUser, sessions[0].Username)
+}
+
+func TestDisconnect(t *testing.T) {
+	client, tcpMux, _, _ := startTestServer(t)
+
+	req, _ := http.NewRequest(http.MethodDelete, "http://admin/sessions/session1", nil)
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.Equal(t, []string{"session1"}, tcpMux.disconnected)
+
+	req, _ = http.NewRequest(http.MethodDelete, "http://admin/sessions/unknown", nil)
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestDisableUser(t *testing.T) {
+	client, tcpMux, userService, _ := startTestServer(t)
+	assert.NoError(t, userService.Create(testUser, []byte("secret1")))
+
+	res, err := client.Post("http://admin/users/"+testUser+"/disable", "", nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.True(t, userService.IsDisabled(testUser))
+	assert.Equal(t, []string{"session1"}, tcpMux.disconnected, "Expected sessions of the user to be closed")
+}
+
+func TestManageUsers(t *testing.T) {
+	client, tcpMux, userService, _ := startTestServer(t)
+
+	res, err := client.Post("http://admin/users", "application/json", strings.NewReader(`{"Username":"`+testUser+`"}`))
+	assert.NoError(t, err)
+	var created models.Credential
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&created))
+	res.Body.Close()
+	assert.Equal(t, testUser, created.Username)
+	sharedKey, _ := userService.GetSharedKey(testUser)
+	assert.Equal(t, created.SharedKey, sharedKey)
+
+	res, err = client.Post("http://admin/users", "application/json", strings.NewReader(`{"Username":"`+testUser+`"}`))
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+
+	res, err = client.Get("http://admin/users")
+	assert.NoError(t, err)
+	var users []models.UserInfo
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&users))
+	res.Body.Close()
+	assert.Equal(t, []models.UserInfo{{Username: testUser}}, users)
+
+	res, err = client.Post("http://admin/users/"+testUser+"/reset", "", nil)
+	assert.NoError(t, err)
+	var reset models.Credential
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&reset))
+	res.Body.Close()
+	sharedKey, _ = userService.GetSharedKey(testUser)
+	assert.Equal(t, reset.SharedKey, sharedKey)
+	assert.Equal(t, []string{"session1"}, tcpMux.disconnected, "Expected sessions with the old credential to be closed")
+
+	req, _ := http.NewRequest(http.MethodDelete, "http://admin/users/"+testUser, nil)
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.True(t, userService.IsDisabled(testUser), "Expected the deleted user to be disabled until it is purged")
+
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res, err = client.Post("http://admin/users/"+testUser+"/restore", "", nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.False(t, userService.IsDisabled(testUser))
+
+	res, err = client.Post("http://admin/users/"+testUser+"/restore", "", nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestQuota(t *testing.T) {
+	client, _, userService, _ := startTestServer(t)
+	assert.NoError(t, userService.Create(testUser, []byte("secret1")))
+
+	req, _ := http.NewRequest(http.MethodPut, "http://admin/users/"+testUser+"/quota", strings.NewReader(`{"MaxBytes":1024,"MaxFiles":10}`))
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	res, err = client.Get("http://admin/users/" + testUser + "/quota")
+	assert.NoError(t, err)
+	var usage models.Usage
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&usage))
+	res.Body.Close()
+	assert.Equal(t, models.Usage{Quota: models.Quota{MaxBytes: 1024, MaxFiles: 10}}, usage)
+
+	req, _ = http.NewRequest(http.MethodDelete, "http://admin/users/"+testUser+"/quota", nil)
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	fileService, err := userService.GetFileService(testUser)
+	assert.NoError(t, err)
+	assert.Equal(t, models.Quota{}, fileService.Usage().Quota)
+
+	res, err = client.Get("http://admin/users/unknown/quota")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestQueryAudit(t *testing.T) {
+	client, _, userService, _ := startTestServer(t)
+	assert.NoError(t, userService.Create(testUser, []byte("secret1")))
+	res, err := client.Post("http://admin/users/"+testUser+"/disable", "", nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	res, err = client.Get("http://admin/audit?user=" + testUser + "&since=" + time.Now().Add(-time.Hour).Format(time.RFC3339))
+	assert.NoError(t, err)
+	var entries []models.AuditEntry
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&entries))
+	res.Body.Close()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, audit.EventAdmin, entries[0].Event)
+	assert.Equal(t, "disable user", entries[0].Detail)
+
+	res, err = client.Get("http://admin/audit?until=yesterday")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, err = client.Get("http://admin/audit/verify")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+}
+
+func TestLockouts(t *testing.T) {
+	client, _, _, _, failureTracker, _ := startTestServerWithServices(t)
+	failureTracker.Failure(testUser, &net.TCPAddr{IP: net.ParseIP("10.0.0.1")})
+
+	res, err := client.Get("http://admin/lockouts")
+	assert.NoError(t, err)
+	var lockouts []models.LockoutInfo
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&lockouts))
+	res.Body.Close()
+	assert.Len(t, lockouts, 2)
+
+	req, _ := http.NewRequest(http.MethodDelete, "http://admin/lockouts/user/"+testUser, nil)
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.NoError(t, failureTracker.Check(testUser, &net.TCPAddr{IP: net.ParseIP("10.0.0.2")}))
+
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestRevokeDevice(t *testing.T) {
+	client, tcpMux, _, _, _, deviceService := startTestServerWithServices(t)
+	assert.NoError(t, deviceService.Seen(testUser, models.DeviceInfo{ID: "laptop", Name: "Laptop"}, ""))
+
+	res, err := client.Get("http://admin/users/" + testUser + "/devices")
+	assert.NoError(t, err)
+	var devices []models.DeviceInfo
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&devices))
+	res.Body.Close()
+	assert.Len(t, devices, 1)
+	assert.Equal(t, "Laptop", devices[0].Name)
+
+	req, _ := http.NewRequest(http.MethodDelete, "http://admin/users/"+testUser+"/devices/laptop", nil)
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.True(t, deviceService.IsRevoked(testUser, "laptop"))
+	assert.Equal(t, []string{"session1"}, tcpMux.disconnected, "Expected sessions of the device to be closed")
+
+	req, _ = http.NewRequest(http.MethodDelete, "http://admin/users/"+testUser+"/devices/unknown", nil)
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestCreateInvite(t *testing.T) {
+	client, _, _, _ := startTestServer(t)
+
+	res, err := client.Post("http://admin/invites", "", nil)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var invite models.Invite
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&invite))
+	assert.Len(t, invite.Token, registration.InviteSize)
+	assert.True(t, invite.Expires.After(time.Now()))
+}
+
+func TestRunJob(t *testing.T) {
+	client, _, _, server := startTestServer(t)
+	ran := false
+	server.RegisterJob("test", func(_ context.Context) error {
+		ran = true
+		return nil
+	})
+
+	res, err := client.Post("http://admin/jobs/test", "", nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.True(t, ran)
+
+	res, err = client.Post("http://admin/jobs/unknown", "", nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestScheduleJob(t *testing.T) {
+	_, _, _, server := startTestServer(t)
+	var runs atomic.Int32
+	server.RegisterJob("test", func(_ context.Context) error {
+		runs.Add(1)
+		return nil
+	})
+
+	server.ScheduleJob("test", 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return runs.Load() >= 2
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, server.Shutdown(context.Background()))
+	stopped := runs.Load()
+	time.Sleep(50 * time.Millisecond)
+	assert.LessOrEqual(t, runs.Load(), stopped+1, "Expected the job to stop with the server")
+}
+
+func TestScheduleJob_Disabled(t *testing.T) {
+	_, _, _, server := startTestServer(t)
+	var runs atomic.Int32
+	server.RegisterJob("test", func(_ context.Context) error {
+		runs.Add(1)
+		return nil
+	})
+
+	assert.NotPanics(t, func() {
+		server.ScheduleJob("test", 0)
+		server.ScheduleJob("test", -time.Second)
+	})
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(0), runs.Load(), "Expected a job without a positive interval to never run")
+}
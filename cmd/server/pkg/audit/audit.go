@@ -0,0 +1,217 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"filesync/models"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+// Events recorded in the audit log.
+const (
+	EventLogin          = "login"
+	EventLoginFailed    = "login.failed"
+	EventLockedOut      = "login.lockedout"
+	EventRegister       = "register"
+	EventKeyRotated     = "key.rotated"
+	EventTokenCreated   = "token.created"
+	EventTokenRevoked   = "token.revoked"
+	EventDeviceRevoked  = "device.revoked"
+	EventDelete         = "delete"
+	EventShareCreated   = "share.created"
+	EventShareDeleted   = "share.deleted"
+	EventShareMember    = "share.member"
+	EventLibraryCreated = "library.created"
+	EventLibraryDeleted = "library.deleted"
+	EventUserPurged     = "user.purged"
+	EventAdmin          = "admin"
+)
+
+// maxLineSize bounds the size of an entry read back from the log.
+const maxLineSize = 1 << 20
+
+var ErrChainBroken = errors.New("audit log hash chain broken")
+
+type Config struct {
+	// Path is the file the log is appended to. An empty path disables the audit log.
+	Path string
+	// HashChain links every entry to the hash of the previous one, so edits and deletions can be detected.
+	HashChain bool
+}
+
+// Filter selects entries of the log, zero fields match every entry.
+type Filter struct {
+	Username string
+	Since    time.Time
+	Until    time.Time
+}
+
+type Logger interface {
+	// Record appends the entry to the log, stamped with the current time. Errors are logged instead of returned,
+	// so a failing audit log never fails the operation it records.
+	Record(entry models.AuditEntry)
+	// Query returns the entries that match the filter, oldest first.
+	Query(filter Filter) ([]models.AuditEntry, error)
+	// Verify checks the hash chain of the log, it returns ErrChainBroken if an entry was altered or removed.
+	Verify() error
+	Close() error
+}
+
+type concreteLogger struct {
+	config   *Config
+	mutex    sync.Mutex
+	file     *os.File
+	lastHash string
+}
+
+func New(config *Config) (Logger, error) {
+	if config.Path == "" {
+		return &nopLogger{}, nil
+	}
+	l := &concreteLogger{config: config}
+	if config.HashChain {
+		// Continue the chain of an existing log.
+		err := readEntries(config.Path, func(_ int, entry models.AuditEntry) error {
+			l.lastHash = entry.Hash
+			return nil
+		})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	var err error
+	l.file, err = os.OpenFile(config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *concreteLogger) Record(entry models.AuditEntry) {
+	entry.Time = time.Now().UTC()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.config.HashChain {
+		entry.PrevHash = l.lastHash
+		hash, err := hashEntry(entry)
+		if err != nil {
+			log.Error("Error hashing audit entry: ", err)
+			return
+		}
+		entry.Hash = hash
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Error("Error encoding audit entry: ", err)
+		return
+	}
+	_, err = l.file.Write(append(line, '\n'))
+	if err != nil {
+		log.Error("Error writing audit entry: ", err)
+		return
+	}
+	l.lastHash = entry.Hash
+}
+
+func (l *concreteLogger) Query(filter Filter) ([]models.AuditEntry, error) {
+	entries := make([]models.AuditEntry, 0)
+	err := readEntries(l.config.Path, func(_ int, entry models.AuditEntry) error {
+		if filter.Username != "" && entry.Username != filter.Username {
+			return nil
+		}
+		if !filter.Since.IsZero() && entry.Time.Before(filter.Since) {
+			return nil
+		}
+		if !filter.Until.IsZero() && entry.Time.After(filter.Until) {
+			return nil
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+func (l *concreteLogger) Verify() error {
+	if !l.config.HashChain {
+		return fmt.Errorf("audit log is not hash chained")
+	}
+	prevHash := ""
+	return readEntries(l.config.Path, func(line int, entry models.AuditEntry) error {
+		if entry.PrevHash != prevHash {
+			return fmt.Errorf("%w: line %d does not follow the previous entry", ErrChainBroken, line)
+		}
+		hash, err := hashEntry(entry)
+		if err != nil {
+			return err
+		}
+		if hash != entry.Hash {
+			return fmt.Errorf("%w: line %d was altered", ErrChainBroken, line)
+		}
+		prevHash = entry.Hash
+		return nil
+	})
+}
+
+func (l *concreteLogger) Close() error {
+	return l.file.Close()
+}
+
+// hashEntry returns the hash of the entry without its own hash, which covers the hash of the previous entry.
+func hashEntry(entry models.AuditEntry) (string, error) {
+	entry.Hash = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// readEntries calls fn with every entry of the log and its line number.
+func readEntries(path string, fn func(line int, entry models.AuditEntry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		var entry models.AuditEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		err = fn(line, entry)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// nopLogger discards the entries when the audit log is disabled.
+type nopLogger struct{}
+
+func (nopLogger) Record(_ models.AuditEntry) {}
+
+func (nopLogger) Query(_ Filter) ([]models.AuditEntry, error) {
+	return make([]models.AuditEntry, 0), nil
+}
+
+func (nopLogger) Verify() error {
+	return fmt.Errorf("audit log is disabled")
+}
+
+func (nopLogger) Close() error {
+	return nil
+}
@@ -0,0 +1,77 @@
+package audit_test
+
+import (
+	"filesync/models"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"server/pkg/audit"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	auditLog, err := audit.New(&audit.Config{Path: filepath.Join(t.TempDir(), "audit.log")})
+	assert.NoError(t, err)
+	defer auditLog.Close()
+
+	start := time.Now()
+	auditLog.Record(models.AuditEntry{Event: audit.EventLogin, Username: "test1", Device: "laptop", RemoteAddr: "10.0.0.1:1234"})
+	auditLog.Record(models.AuditEntry{Event: audit.EventLoginFailed, Username: "test2"})
+	auditLog.Record(models.AuditEntry{Event: audit.EventDelete, Username: "test1", Detail: "a.txt"})
+
+	entries, err := auditLog.Query(audit.Filter{})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, "laptop", entries[0].Device)
+	assert.False(t, entries[0].Time.Before(start.Add(-time.Second)))
+	assert.Empty(t, entries[0].Hash, "Expected no hashes without the hash chain")
+
+	entries, err = auditLog.Query(audit.Filter{Username: "test1"})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, audit.EventDelete, entries[1].Event)
+
+	entries, err = auditLog.Query(audit.Filter{Until: start.Add(-time.Hour)})
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	entries, err = auditLog.Query(audit.Filter{Since: start.Add(-time.Hour), Until: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+}
+
+func TestVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	config := &audit.Config{Path: path, HashChain: true}
+	auditLog, err := audit.New(config)
+	assert.NoError(t, err)
+	auditLog.Record(models.AuditEntry{Event: audit.EventLogin, Username: "test1"})
+	auditLog.Record(models.AuditEntry{Event: audit.EventLogin, Username: "test2"})
+	assert.NoError(t, auditLog.Close())
+
+	// A reopened log continues the chain.
+	auditLog, err = audit.New(config)
+	assert.NoError(t, err)
+	defer auditLog.Close()
+	auditLog.Record(models.AuditEntry{Event: audit.EventKeyRotated, Username: "test1"})
+	assert.NoError(t, auditLog.Verify())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.SplitAfter(string(data), "\n")
+	assert.NoError(t, os.WriteFile(path, []byte(strings.Replace(string(data), "test2", "test3", 1)), 0600))
+	assert.ErrorIs(t, auditLog.Verify(), audit.ErrChainBroken, "Expected an altered entry to break the chain")
+
+	assert.NoError(t, os.WriteFile(path, []byte(lines[0]+lines[2]), 0600))
+	assert.ErrorIs(t, auditLog.Verify(), audit.ErrChainBroken, "Expected a removed entry to break the chain")
+}
+
+func TestDisabled(t *testing.T) {
+	auditLog, err := audit.New(&audit.Config{})
+	assert.NoError(t, err)
+	auditLog.Record(models.AuditEntry{Event: audit.EventLogin, Username: "test1"})
+	entries, err := auditLog.Query(audit.Filter{})
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -2,7 +2,9 @@ package cache
 
 import (
 	"container/list"
+	"filesync/models"
 	"sync"
+	"sync/atomic"
 )
 
 type Entry struct {
@@ -14,6 +16,7 @@ type Cache interface {
 	Get(key string) (entry interface{}, exists bool)
 	Set(key string, value interface{})
 	Delete(key string)
+	Stats() models.CacheStats
 }
 
 type cache struct {
@@ -21,15 +24,16 @@ type cache struct {
 	mutexes  sync.Map
 	lruList  *list.List
 	capacity int
+	hits     atomic.Uint64
+	misses   atomic.Uint64
 }
 
 // NewCache creates a new cache instance with the specified capacity.
 func NewCache(capacity int) Cache {
 	return &cache{
-		make(map[string]*list.Element),
-		sync.Map{},
-		list.New(),
-		capacity,
+		cache:    make(map[string]*list.Element),
+		lruList:  list.New(),
+		capacity: capacity,
 	}
 }
 
@@ -41,9 +45,11 @@ func (c *cache) Get(key string) (entry interface{}, ok bool) {
 
 	var element *list.Element
 	if element, ok = c.cache[key]; ok {
+		c.hits.Add(1)
 		c.lruList.MoveToFront(element)
 		return element.Value.(*Entry).value, true
 	}
+	c.misses.Add(1)
 	return nil, false
 }
 
@@ -79,3 +85,13 @@ func (c *cache) Delete(key string) {
 	delete(c.cache, key)
 	c.lruList.Remove(c.cache[key])
 }
+
+// Stats returns the size, capacity and hit counters of the cache.
+func (c *cache) Stats() models.CacheStats {
+	return models.CacheStats{
+		Size:     c.lruList.Len(),
+		Capacity: c.capacity,
+		Hits:     c.hits.Load(),
+		Misses:   c.misses.Load(),
+	}
+}
@@ -1 +1,25 @@
 package cache_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"server/pkg/cache"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	c := cache.NewCache(2)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3)
+
+	_, found := c.Get("a")
+	assert.False(t, found, "Expected least recently used entry to be evicted")
+	_, found = c.Get("c")
+	assert.True(t, found)
+
+	stats := c.Stats()
+	assert.Equal(t, 2, stats.Size)
+	assert.Equal(t, 2, stats.Capacity)
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+}
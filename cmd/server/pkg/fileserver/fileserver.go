@@ -3,25 +3,41 @@ package fileserver
 import (
 	"crypto/tls"
 	"errors"
+	"filesync/enums"
+	"filesync/models"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"server/pkg/limiter"
 	"server/pkg/mux"
+	"time"
 )
 
+// rejectTimeout bounds the time spent on the TLS handshake and rejection message of a refused connection.
+const rejectTimeout = 5 * time.Second
+
+// maxRejecting bounds the refused connections that are told the reason at once, the others are closed without a
+// handshake so a flood of connections cannot pile up handshakes.
+const maxRejecting = 64
+
 type Server interface {
 	ListenAndServe(port int) error
 }
 
 type concreteServer struct {
-	mux    mux.Mux
-	config *tls.Config
+	mux     mux.Mux
+	config  *tls.Config
+	limiter limiter.Limiter
+	// rejecting holds a slot for every refused connection that is being told the reason.
+	rejecting chan struct{}
 }
 
-func NewServer(mux mux.Mux, config *tls.Config) Server {
+func NewServer(mux mux.Mux, config *tls.Config, limiter limiter.Limiter) Server {
 	return &concreteServer{
 		mux,
 		config,
+		limiter,
+		make(chan struct{}, maxRejecting),
 	}
 }
 
@@ -42,8 +58,6 @@ func (s *concreteServer) ListenAndServe(port int) error {
 	for {
 		var conn net.Conn
 		conn, err = tlsListener.Accept()
-		log.Debugf("Accepted connection from %s", conn.RemoteAddr().String())
-		conn.RemoteAddr().String()
 		if err != nil {
 			var ne net.Error
 			if errors.As(err, &ne) && ne.Timeout() {
@@ -55,6 +69,66 @@ func (s *concreteServer) ListenAndServe(port int) error {
 			}
 			return err
 		}
-		go s.mux.ServeConn(conn)
+		log.Debugf("Accepted connection from %s", conn.RemoteAddr().String())
+
+		// Admission happens before the TLS handshake, which is deferred until the first read or write.
+		var release func()
+		release, err = s.limiter.Admit(conn.RemoteAddr())
+		if err != nil {
+			log.Warnf("Rejected connection from %s: %s", conn.RemoteAddr().String(), err)
+			s.reject(conn, err)
+			continue
+		}
+		go func() {
+			defer release()
+			s.mux.ServeConn(conn)
+		}()
+	}
+}
+
+// reject closes the refused connection, telling the client the reason if a rejection slot is free.
+func (s *concreteServer) reject(conn net.Conn, reason error) {
+	select {
+	case s.rejecting <- struct{}{}:
+	default:
+		conn.Close()
+		return
+	}
+	go func() {
+		defer func() { <-s.rejecting }()
+		sendRejection(conn, reason)
+	}()
+}
+
+// sendRejection sends the rejection reason to the client and closes the connection.
+func sendRejection(conn net.Conn, reason error) {
+	defer conn.Close()
+
+	var result enums.AuthResult
+	switch {
+	case errors.Is(reason, limiter.ErrTooManyConnections):
+		result = enums.ServerFull
+	case errors.Is(reason, limiter.ErrTooManyConnectionsFromIP):
+		result = enums.TooManyConnections
+	case errors.Is(reason, limiter.ErrRateLimited):
+		result = enums.RateLimited
+	default:
+		result = enums.Unauthorized
+	}
+
+	err := conn.SetDeadline(time.Now().Add(rejectTimeout))
+	if err != nil {
+		return
+	}
+	rejectMessage := models.Message{
+		Header: models.Header{
+			Action: enums.Auth,
+			Sender: enums.Server,
+		},
+		Body: result,
+	}
+	_, err = rejectMessage.Send(conn)
+	if err != nil {
+		log.Debugf("Error sending rejection to %s: %s", conn.RemoteAddr().String(), err)
 	}
 }
@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"filesync/models"
+	"server/pkg/session"
+)
+
+// auditEntry returns the audit log entry of an event of the session's user.
+func auditEntry(sessionData *session.Session, event string, detail string) models.AuditEntry {
+	entry := models.AuditEntry{
+		Event:      event,
+		Username:   sessionData.Username,
+		RemoteAddr: sessionData.RemoteAddr(),
+		Detail:     detail,
+	}
+	if sessionData.Principal != nil {
+		entry.Device = sessionData.Principal.Device
+		entry.Method = string(sessionData.Principal.Method)
+	}
+	return entry
+}
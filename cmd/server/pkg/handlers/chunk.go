@@ -1,13 +1,12 @@
 package handlers
 
 import (
-	"filesync/models"
 	log "github.com/sirupsen/logrus"
 	"server/pkg/mux"
 )
 
 // HandleChunk is a mux.HandlerFunc
-func HandleChunk(resChan chan models.Message, req *mux.Request) error {
+func HandleChunk(w mux.ResponseWriter, req *mux.Request) error {
 	log.Debug("HandleChunk")
 	return nil
 }
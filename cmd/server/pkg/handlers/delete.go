@@ -1,13 +1,56 @@
 package handlers
 
 import (
-	"filesync/models"
+	"errors"
+	"filesync/enums"
 	log "github.com/sirupsen/logrus"
+	"server/pkg/audit"
 	"server/pkg/mux"
+	"server/pkg/session"
+	"server/services/file"
+	"server/services/share"
+	"server/services/user"
+	"strings"
 )
 
-// HandleDelete is a mux.HandlerFunc
-func HandleDelete(resChan chan models.Message, req *mux.Request) error {
-	log.Debug("HandleDelete")
-	return nil
+// NewDeleteHandler returns a mux.HandlerFunc that deletes a file in the library selected for the request and records the
+// deletion in the audit log. The request body is the hash of the file.
+func NewDeleteHandler(userService user.Service, shareService share.Service, auditLog audit.Logger) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleDelete")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		fileService, writable, err := library(sessionData, req.Library, userService, shareService)
+		if err != nil {
+			return w.Error(enums.NotFound, err.Error())
+		}
+		if !writable {
+			return w.Error(enums.Forbidden, "no write access to the share")
+		}
+		body, _ := req.Message.Body.([]byte)
+		hash := strings.TrimRight(string(body), "\x00")
+
+		err = fileService.DeleteFile(hash)
+		if errors.Is(err, file.ErrInvalidHash) {
+			return w.Error(enums.BadRequest, err.Error())
+		}
+		if errors.Is(err, file.ErrFileNotFound) {
+			return w.Error(enums.NotFound, err.Error())
+		}
+		if err != nil {
+			log.Error("Error deleting file: ", err)
+			return w.Error(enums.InternalError, "error deleting file")
+		}
+		detail := hash
+		switch {
+		case req.Library.Share != "":
+			detail = "share " + req.Library.Share + ": " + detail
+		case req.Library.Name != "":
+			detail = "library " + req.Library.Name + ": " + detail
+		}
+		auditLog.Record(auditEntry(sessionData, audit.EventDelete, detail))
+		return w.Reply(nil)
+	}
 }
@@ -0,0 +1,39 @@
+package handlers_test
+
+import (
+	"filesync/enums"
+	"filesync/models"
+	"github.com/stretchr/testify/assert"
+	"server/pkg/audit"
+	"server/pkg/handlers"
+	"testing"
+)
+
+func TestDelete_ReadOnlyMember(t *testing.T) {
+	userService, shareService := newTestServices(t)
+	created, err := shareService.Create(owner, "team")
+	assert.NoError(t, err)
+	assert.NoError(t, shareService.SetMember(owner, models.ShareMember{ShareID: created.ID, Username: member, Access: enums.ReadAccess}))
+	sessionData := newTestSession(t, userService, member)
+	library := selectShare(t, shareService, created.ID)
+	assert.NoError(t, library.Files.CreateFile("hash", testChecksum, []byte("content")))
+	auditLog, err := audit.New(&audit.Config{})
+	assert.NoError(t, err)
+	handler := handlers.NewDeleteHandler(userService, shareService, auditLog)
+
+	resChan, done := serve(sessionData, handler, enums.Delete, []byte("hash"), library)
+	assert.Equal(t, enums.Forbidden, errorCode(t, receive(t, resChan)))
+	assert.NoError(t, <-done)
+	assert.Equal(t, 1, library.Files.Usage().Files, "Expected the file to be kept")
+
+	assert.NoError(t, shareService.SetMember(owner, models.ShareMember{ShareID: created.ID, Username: member, Access: enums.ReadWriteAccess}))
+	resChan, done = serve(sessionData, handler, enums.Delete, []byte("../hash"), library)
+	assert.Equal(t, enums.BadRequest, errorCode(t, receive(t, resChan)))
+	assert.NoError(t, <-done)
+
+	resChan, done = serve(sessionData, handler, enums.Delete, []byte("hash"), library)
+	response := receive(t, resChan)
+	assert.Equal(t, enums.Delete, response.Header.Action)
+	assert.NoError(t, <-done)
+	assert.Equal(t, 0, library.Files.Usage().Files)
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"errors"
+	"filesync/enums"
+	log "github.com/sirupsen/logrus"
+	"server/pkg/audit"
+	"server/pkg/mux"
+	"server/pkg/session"
+	"server/services/device"
+)
+
+// NewListDevicesHandler returns a mux.HandlerFunc that lists the devices of the session's user.
+func NewListDevicesHandler(deviceService device.Service) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleListDevices")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		return w.Reply(deviceService.List(sessionData.Username))
+	}
+}
+
+// NewRevokeDeviceHandler returns a mux.HandlerFunc that revokes a device of the session's user and closes its sessions.
+// The request body is the device ID.
+func NewRevokeDeviceHandler(deviceService device.Service, tcpMux mux.Mux, auditLog audit.Logger) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleRevokeDevice")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		id, _ := req.Message.Body.([]byte)
+		if sessionData.Principal != nil && sessionData.Principal.Device == string(id) {
+			return w.Error(enums.BadRequest, "cannot revoke the current device")
+		}
+
+		err := deviceService.Revoke(sessionData.Username, string(id))
+		if err != nil {
+			return w.Error(enums.NotFound, err.Error())
+		}
+		auditLog.Record(auditEntry(sessionData, audit.EventDeviceRevoked, string(id)))
+		tcpMux.DisconnectDevice(sessionData.Username, string(id))
+		return w.Reply(nil)
+	}
+}
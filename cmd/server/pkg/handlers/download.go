@@ -1,13 +1,65 @@
 package handlers
 
 import (
+	"encoding/binary"
+	"errors"
+	"filesync/enums"
 	"filesync/models"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"server/pkg/mux"
+	"server/pkg/session"
+	"server/services/file"
+	"server/services/share"
+	"server/services/user"
+	"strings"
 )
 
-// HandleDownload is a mux.HandlerFunc
-func HandleDownload(resChan chan models.Message, req *mux.Request) error {
-	log.Debug("HandleDownload")
-	return nil
+// rangeSize is the size of the optional range of a download request, the offset and length as big endian integers.
+const rangeSize = 16
+
+// NewDownloadHandler returns a mux.HandlerFunc that streams a file of the library selected for the request. The
+// request body is the hash of the file, optionally followed by the offset and length of the range to read. The
+// response is the models.FileInfoBytes of the file followed by chunks of its content.
+func NewDownloadHandler(userService user.Service, shareService share.Service) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleDownload")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		fileService, _, err := library(sessionData, req.Library, userService, shareService)
+		if err != nil {
+			return w.Error(enums.NotFound, err.Error())
+		}
+		body, _ := req.Message.Body.([]byte)
+		if len(body) != models.FileHashSize && len(body) != models.FileHashSize+rangeSize {
+			return w.Error(enums.BadRequest, "invalid download request")
+		}
+		hash := strings.TrimRight(string(body[:models.FileHashSize]), "\x00")
+		offset, length := int64(0), int64(-1)
+		if len(body) > models.FileHashSize {
+			offset = int64(binary.BigEndian.Uint64(body[models.FileHashSize:]))
+			length = int64(binary.BigEndian.Uint64(body[models.FileHashSize+8:]))
+		}
+
+		reader, fileInfo, err := fileService.OpenFileRange(hash, offset, length)
+		if errors.Is(err, file.ErrInvalidHash) {
+			return w.Error(enums.BadRequest, err.Error())
+		}
+		if err != nil {
+			return w.Error(enums.NotFound, err.Error())
+		}
+		defer reader.Close()
+		err = w.Reply(fileInfo.ToBytes())
+		if err != nil {
+			return err
+		}
+		stream := w.Stream()
+		_, err = io.Copy(stream, reader)
+		if err != nil {
+			return err
+		}
+		return stream.Close()
+	}
 }
@@ -0,0 +1,106 @@
+package handlers_test
+
+import (
+	"context"
+	"filesync/enums"
+	"filesync/models"
+	"github.com/stretchr/testify/assert"
+	"server/pkg/_mocks"
+	"server/pkg/mux"
+	"server/pkg/session"
+	"server/services/file"
+	"server/services/share"
+	"server/services/user"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	owner  = "alice"
+	member = "bob"
+)
+
+var testTransactionID = [32]byte{1, 2, 3}
+
+// testChecksum has the size of the checksums the file service stores.
+const testChecksum = "checksum123456789012345678901234"
+
+func newTestServices(t *testing.T) (user.Service, share.Service) {
+	factory := file.NewFactory(t.TempDir(), &_mocks.MockCache{}, &_mocks.MockCache{})
+	userService := user.New(factory)
+	assert.NoError(t, userService.Create(owner, []byte("secret1")))
+	assert.NoError(t, userService.Create(member, []byte("secret2")))
+	return userService, share.New(userService, factory)
+}
+
+// newTestSession opens a session of the user on its default files.
+func newTestSession(t *testing.T, userService user.Service, username string) *session.Session {
+	fileService, err := userService.GetFileService(username)
+	assert.NoError(t, err)
+	sessionData := &session.Session{
+		ID:           username + "-session",
+		Username:     username,
+		Transactions: &sync.Map{},
+		Requests:     &sync.Map{},
+		FileService:  fileService,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sessionData.Open(ctx)
+	t.Cleanup(func() {
+		cancel()
+		fileService.Close()
+	})
+	return sessionData
+}
+
+// selectShare makes the requests of the session work on the files of the share.
+func selectShare(t *testing.T, shareService share.Service, id string) session.Library {
+	fileService, err := shareService.GetFileService(id)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		fileService.Close()
+	})
+	return session.Library{Share: id, Files: fileService}
+}
+
+// serve runs the handler on a request of the session and returns the channel of its responses and of its result.
+func serve(sessionData *session.Session, handler mux.HandlerFunc, action enums.MessageType, body interface{}, library session.Library) (chan models.Message, chan error) {
+	req := &mux.Request{
+		Message: models.Message{
+			Header: models.Header{
+				Action:        action,
+				Sender:        enums.Client,
+				TransactionID: testTransactionID,
+			},
+			Body: body,
+		},
+		Ctx:     sessionData.Context(),
+		Library: library,
+	}
+	resChan := make(chan models.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- handler(mux.NewResponseWriter(resChan, req), req)
+	}()
+	return resChan, done
+}
+
+func receive(t *testing.T, resChan chan models.Message) models.Message {
+	select {
+	case message := <-resChan:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a response")
+		return models.Message{}
+	}
+}
+
+func errorCode(t *testing.T, message models.Message) enums.ErrorCode {
+	assert.Equal(t, enums.Error, message.Header.Action)
+	body, ok := message.Body.(models.ErrorResponse)
+	if !assert.True(t, ok, "Expected an error response") {
+		return 0
+	}
+	return body.Code
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"errors"
+	"filesync/enums"
+	"filesync/models"
+	log "github.com/sirupsen/logrus"
+	"server/pkg/audit"
+	"server/pkg/mux"
+	"server/pkg/notifier"
+	"server/pkg/session"
+	"server/services/user"
+)
+
+var errLibraryNotFound = errors.New("library not found")
+
+// NewCreateLibraryHandler returns a mux.HandlerFunc that creates a named library of the session's user.
+// The request body is a models.LibraryRequest and the response the models.LibraryInfo of the library.
+func NewCreateLibraryHandler(userService user.Service, auditLog audit.Logger) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleCreateLibrary")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		request, ok := req.Message.Body.(models.LibraryRequest)
+		if !ok {
+			return w.Error(enums.BadRequest, "invalid library request")
+		}
+
+		info, err := userService.CreateLibrary(sessionData.Username, request)
+		if err != nil {
+			return w.Error(enums.BadRequest, err.Error())
+		}
+		auditLog.Record(auditEntry(sessionData, audit.EventLibraryCreated, info.Name))
+		return w.Reply(info)
+	}
+}
+
+// NewListLibrariesHandler returns a mux.HandlerFunc that lists the libraries of the session's user with their usage.
+func NewListLibrariesHandler(userService user.Service) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleListLibraries")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		libraries, err := userService.ListLibraries(sessionData.Username)
+		if err != nil {
+			return w.Error(enums.InternalError, err.Error())
+		}
+		return w.Reply(libraries)
+	}
+}
+
+// NewDeleteLibraryHandler returns a mux.HandlerFunc that deletes a library of the session's user and its files.
+// The request body is the name of the library.
+func NewDeleteLibraryHandler(userService user.Service, auditLog audit.Logger) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleDeleteLibrary")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		name, _ := req.Message.Body.([]byte)
+		if _, found := userService.GetLibrary(sessionData.Username, string(name)); !found {
+			return w.Error(enums.NotFound, errLibraryNotFound.Error())
+		}
+
+		if err := userService.DeleteLibrary(sessionData.Username, string(name)); err != nil {
+			return w.Error(enums.InternalError, err.Error())
+		}
+		auditLog.Record(auditEntry(sessionData, audit.EventLibraryDeleted, string(name)))
+		return w.Reply(nil)
+	}
+}
+
+// NewSelectLibraryHandler returns a mux.HandlerFunc that makes the following requests of the session work on the
+// files of a library of the session's user, it is registered as an ordered handler. The request body is the name of
+// the library, an empty body selects the default files of the user again. The changes the session makes to the
+// library are published to the other sessions of the user.
+func NewSelectLibraryHandler(userService user.Service, hub notifier.Hub) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleSelectLibrary")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		body, _ := req.Message.Body.([]byte)
+		name := string(body)
+		if name == "" {
+			sessionData.Select(session.Library{}, nil)
+			return w.Reply(nil)
+		}
+
+		info, found := userService.GetLibrary(sessionData.Username, name)
+		if !found {
+			return w.Error(enums.NotFound, errLibraryNotFound.Error())
+		}
+		fileService, err := userService.GetLibraryService(sessionData.Username, name)
+		if err != nil {
+			return w.Error(enums.InternalError, err.Error())
+		}
+		unwatchChanges := fileService.Watch(func(change models.FileChange) {
+			change.Library = name
+			hub.Publish(sessionData.Username, sessionData.ID, change)
+		})
+		unwatch := func() {
+			unwatchChanges()
+			fileService.Close()
+		}
+		sessionData.Select(session.Library{Name: name, Files: fileService}, unwatch)
+		info.Usage = fileService.Usage()
+		return w.Reply(info)
+	}
+}
@@ -1,13 +1,12 @@
 package handlers
 
 import (
-	"filesync/models"
 	log "github.com/sirupsen/logrus"
 	"server/pkg/mux"
 )
 
 // HandleList is a mux.HandlerFunc
-func HandleList(resChan chan models.Message, req *mux.Request) error {
+func HandleList(w mux.ResponseWriter, req *mux.Request) error {
 	log.Debug("HandleList")
 	return nil
 }
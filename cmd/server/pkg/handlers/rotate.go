@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"errors"
+	"filesync/enums"
+	"filesync/models"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"server/pkg/audit"
+	"server/pkg/mux"
+	"server/pkg/session"
+	"server/services/auth"
+)
+
+// NewRotateKeyHandler returns a mux.HandlerFunc that replaces the shared key of the session's user.
+// The handler replies with a challenge, the client answers on the same transaction with the response computed
+// with its current key followed by the new key, and receives the resulting enums.AuthResult.
+func NewRotateKeyHandler(authService auth.Service, auditLog audit.Logger) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleRotateKey")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+
+		challenge, err := authService.NewChallenge()
+		if err != nil {
+			return err
+		}
+		transactionChan := sessionData.NewTransaction(req.Message.Header.TransactionID)
+		err = w.Reply(challenge)
+		if err != nil {
+			return err
+		}
+
+		var message models.Message
+		select {
+		case <-req.Ctx.Done():
+			return req.Ctx.Err()
+		case message = <-transactionChan:
+		}
+		body, ok := message.Body.([]byte)
+		if !ok || len(body) <= sha256.Size {
+			return w.Error(enums.BadRequest, fmt.Sprintf("expected more than %d bytes", sha256.Size))
+		}
+
+		err = authService.RotateKey(sessionData.Principal, challenge, body[:sha256.Size], body[sha256.Size:])
+		if errors.Is(err, auth.ErrChallengeFailed) {
+			return w.Reply(enums.Unauthorized)
+		}
+		if err != nil {
+			replyErr := w.Error(enums.InternalError, "key rotation failed")
+			if replyErr != nil {
+				return replyErr
+			}
+			return err
+		}
+		auditLog.Record(auditEntry(sessionData, audit.EventKeyRotated, ""))
+		return w.Reply(enums.Authenticated)
+	}
+}
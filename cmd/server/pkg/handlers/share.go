@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"filesync/enums"
+	"filesync/models"
+	log "github.com/sirupsen/logrus"
+	"server/pkg/audit"
+	"server/pkg/mux"
+	"server/pkg/notifier"
+	"server/pkg/session"
+	"server/services/file"
+	"server/services/share"
+	"server/services/user"
+)
+
+// library returns the file service of the library selected for the request and whether the session may change its
+// files. The library is checked on every request, so removed members and deleted libraries lose access at once.
+func library(sessionData *session.Session, selected session.Library, userService user.Service, shareService share.Service) (fileService file.Service, writable bool, err error) {
+	switch {
+	case selected.Share != "":
+		access, found := shareService.Access(sessionData.Username, selected.Share)
+		if !found {
+			return nil, false, share.ErrShareNotFound
+		}
+		return selected.Files, access == enums.ReadWriteAccess, nil
+	case selected.Name != "":
+		if _, found := userService.GetLibrary(sessionData.Username, selected.Name); !found {
+			return nil, false, errLibraryNotFound
+		}
+		return selected.Files, true, nil
+	default:
+		return sessionData.FileService, true, nil
+	}
+}
+
+// shareError replies with the error code of an error of the share service.
+func shareError(w mux.ResponseWriter, err error) error {
+	switch {
+	case errors.Is(err, share.ErrShareNotFound):
+		return w.Error(enums.NotFound, err.Error())
+	case errors.Is(err, share.ErrNotOwner):
+		return w.Error(enums.Forbidden, err.Error())
+	default:
+		return w.Error(enums.BadRequest, err.Error())
+	}
+}
+
+// NewCreateShareHandler returns a mux.HandlerFunc that creates a shared library owned by the session's user.
+// The request body is the name of the library and the response its models.ShareInfo.
+func NewCreateShareHandler(shareService share.Service, auditLog audit.Logger) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleCreateShare")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		name, _ := req.Message.Body.([]byte)
+
+		info, err := shareService.Create(sessionData.Username, string(name))
+		if err != nil {
+			return w.Error(enums.BadRequest, err.Error())
+		}
+		auditLog.Record(auditEntry(sessionData, audit.EventShareCreated, info.ID+" ("+info.Name+")"))
+		return w.Reply(info)
+	}
+}
+
+// NewListSharesHandler returns a mux.HandlerFunc that lists the shared libraries the session's user owns or is
+// a member of.
+func NewListSharesHandler(shareService share.Service) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleListShares")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		return w.Reply(shareService.List(sessionData.Username))
+	}
+}
+
+// NewDeleteShareHandler returns a mux.HandlerFunc that deletes a shared library of the session's user and its files.
+// The request body is the share ID.
+func NewDeleteShareHandler(shareService share.Service, auditLog audit.Logger) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleDeleteShare")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		id, _ := req.Message.Body.([]byte)
+
+		err := shareService.Delete(sessionData.Username, string(id))
+		if err != nil {
+			return shareError(w, err)
+		}
+		auditLog.Record(auditEntry(sessionData, audit.EventShareDeleted, string(id)))
+		return w.Reply(nil)
+	}
+}
+
+// NewSetShareMemberHandler returns a mux.HandlerFunc that grants a user access to a shared library of the session's
+// user. The request body is a models.ShareMember.
+func NewSetShareMemberHandler(shareService share.Service, auditLog audit.Logger) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleSetShareMember")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		member, ok := req.Message.Body.(models.ShareMember)
+		if !ok {
+			return w.Error(enums.BadRequest, "expected a share member")
+		}
+
+		err := shareService.SetMember(sessionData.Username, member)
+		if err != nil {
+			return shareError(w, err)
+		}
+		auditLog.Record(auditEntry(sessionData, audit.EventShareMember, member.ShareID+": "+member.Username+" "+member.Access.String()))
+		return w.Reply(nil)
+	}
+}
+
+// NewRemoveShareMemberHandler returns a mux.HandlerFunc that revokes the access of a member to a shared library.
+// The owner removes any member and a member removes itself to leave. The request body is the share ID and the
+// username of the member separated by a NUL byte.
+func NewRemoveShareMemberHandler(shareService share.Service, auditLog audit.Logger) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleRemoveShareMember")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		body, _ := req.Message.Body.([]byte)
+		id, member, found := bytes.Cut(body, []byte{0})
+		if !found {
+			return w.Error(enums.BadRequest, "expected a share ID and member")
+		}
+
+		err := shareService.RemoveMember(sessionData.Username, string(id), string(member))
+		if err != nil {
+			return shareError(w, err)
+		}
+		auditLog.Record(auditEntry(sessionData, audit.EventShareMember, string(id)+": "+string(member)+" removed"))
+		return w.Reply(nil)
+	}
+}
+
+// NewSelectShareHandler returns a mux.HandlerFunc that makes the following requests of the session work on the files
+// of a shared library the session's user has access to, it is registered as an ordered handler. The request body is
+// the share ID, an empty body selects the default files of the user again. The changes the session makes to the
+// shared library are published to every member.
+func NewSelectShareHandler(shareService share.Service, hub notifier.Hub) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleSelectShare")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		body, _ := req.Message.Body.([]byte)
+		id := string(body)
+		if id == "" {
+			sessionData.Select(session.Library{}, nil)
+			return w.Reply(nil)
+		}
+
+		if _, found := shareService.Access(sessionData.Username, id); !found {
+			return w.Error(enums.NotFound, share.ErrShareNotFound.Error())
+		}
+		fileService, err := shareService.GetFileService(id)
+		if err != nil {
+			return shareError(w, err)
+		}
+		unwatchChanges := fileService.Watch(func(change models.FileChange) {
+			info, found := shareService.Get(id)
+			if !found {
+				return
+			}
+			change.Share = id
+			hub.Publish(info.Owner, sessionData.ID, change)
+			for member := range info.Members {
+				hub.Publish(member, sessionData.ID, change)
+			}
+		})
+		unwatch := func() {
+			unwatchChanges()
+			fileService.Close()
+		}
+		sessionData.Select(session.Library{Share: id, Files: fileService}, unwatch)
+		info, _ := shareService.Get(id)
+		return w.Reply(info)
+	}
+}
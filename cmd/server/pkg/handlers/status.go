@@ -1,13 +1,28 @@
 package handlers
 
 import (
-	"filesync/models"
+	"errors"
+	"filesync/enums"
 	log "github.com/sirupsen/logrus"
 	"server/pkg/mux"
+	"server/pkg/session"
+	"server/services/share"
+	"server/services/user"
 )
 
-// HandleStatus is a mux.HandlerFunc
-func HandleStatus(resChan chan models.Message, req *mux.Request) error {
-	log.Debug("HandleStatus")
-	return nil
+// NewStatusHandler returns a mux.HandlerFunc that replies with the storage usage and quota of the files the session
+// works on.
+func NewStatusHandler(userService user.Service, shareService share.Service) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleStatus")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		fileService, _, err := library(sessionData, req.Library, userService, shareService)
+		if err != nil {
+			return w.Error(enums.NotFound, err.Error())
+		}
+		return w.Reply(fileService.Usage())
+	}
 }
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"errors"
+	"filesync/enums"
+	"filesync/models"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"server/pkg/audit"
+	"server/pkg/mux"
+	"server/pkg/session"
+	"server/services/token"
+	"server/services/user"
+)
+
+// NewCreateTokenHandler returns a mux.HandlerFunc that mints an API token for the session's user.
+// The request body is a models.TokenRequest and the response a models.NewToken.
+func NewCreateTokenHandler(tokenService token.Service, userService user.Service, auditLog audit.Logger) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleCreateToken")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		request, ok := req.Message.Body.(models.TokenRequest)
+		if !ok {
+			return w.Error(enums.BadRequest, "expected a token request")
+		}
+		if request.Library != "" {
+			if _, found := userService.GetLibrary(sessionData.Username, request.Library); !found {
+				return w.Error(enums.NotFound, errLibraryNotFound.Error())
+			}
+		}
+
+		apiToken, info, err := tokenService.Create(sessionData.Username, request)
+		if err != nil {
+			return w.Error(enums.BadRequest, err.Error())
+		}
+		auditLog.Record(auditEntry(sessionData, audit.EventTokenCreated, fmt.Sprintf("%s (%s)", info.ID, info.Name)))
+		return w.Reply(models.NewToken{
+			TokenInfo: info,
+			Token:     apiToken,
+		})
+	}
+}
+
+// NewListTokensHandler returns a mux.HandlerFunc that lists the API tokens of the session's user.
+func NewListTokensHandler(tokenService token.Service) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleListTokens")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		return w.Reply(tokenService.List(sessionData.Username))
+	}
+}
+
+// NewRevokeTokenHandler returns a mux.HandlerFunc that revokes an API token of the session's user and closes the
+// sessions that logged in with it. The request body is the token ID.
+func NewRevokeTokenHandler(tokenService token.Service, tcpMux mux.Mux, auditLog audit.Logger) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleRevokeToken")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		id, _ := req.Message.Body.([]byte)
+
+		err := tokenService.Revoke(sessionData.Username, string(id))
+		if err != nil {
+			return w.Error(enums.NotFound, err.Error())
+		}
+		auditLog.Record(auditEntry(sessionData, audit.EventTokenRevoked, string(id)))
+		tcpMux.DisconnectToken(sessionData.Username, string(id))
+		return w.Reply(nil)
+	}
+}
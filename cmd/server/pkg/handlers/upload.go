@@ -1,13 +1,70 @@
 package handlers
 
 import (
+	"errors"
+	"filesync/enums"
 	"filesync/models"
 	log "github.com/sirupsen/logrus"
 	"server/pkg/mux"
+	"server/pkg/session"
+	"server/services/file"
+	"server/services/share"
+	"server/services/user"
+	"strings"
 )
 
-// HandleUpload is a mux.HandlerFunc
-func HandleUpload(resChan chan models.Message, req *mux.Request) error {
-	log.Debug("HandleUpload")
-	return nil
+// NewUploadHandler returns a mux.HandlerFunc that stores a file in the library selected for the request. The request body
+// is the models.FileInfoBytes of the file. An empty reply accepts the upload, the client then streams the content as
+// chunk messages on the same transaction, ending with an empty chunk, and receives another empty reply once the file
+// is stored. Every chunk is acknowledged with the offset of the content received so far, so the client can resume the
+// upload from there after a reconnect, see mux.Request.AcknowledgedStream. Replacing an existing file needs full access, API tokens with the upload scope only add files.
+func NewUploadHandler(userService user.Service, shareService share.Service) mux.HandlerFunc {
+	return func(w mux.ResponseWriter, req *mux.Request) error {
+		log.Debug("HandleUpload")
+		sessionData, ok := session.FromContext(req.Ctx)
+		if !ok {
+			return errors.New("no session data in context")
+		}
+		fileService, writable, err := library(sessionData, req.Library, userService, shareService)
+		if err != nil {
+			return w.Error(enums.NotFound, err.Error())
+		}
+		if !writable {
+			return w.Error(enums.Forbidden, "no write access to the share")
+		}
+		body, _ := req.Message.Body.([]byte)
+		if len(body) != models.FileInfoSize {
+			return w.Error(enums.BadRequest, "expected the file info")
+		}
+		fileInfo := models.FileInfoBytes(body[:models.FileInfoSize])
+		hash := strings.TrimRight(fileInfo.GetHash(), "\x00")
+		// The hash is checked before the client streams the content.
+		err = file.ValidateHash(hash)
+		if err != nil {
+			return w.Error(enums.BadRequest, err.Error())
+		}
+		_, exists := fileService.GetFileInfo(hash)
+		if exists && !sessionData.Principal.Replaces() {
+			return w.Error(enums.Forbidden, "token scopes do not allow replacing files")
+		}
+
+		transactionChan := sessionData.NewTransaction(req.Message.Header.TransactionID)
+		err = w.Reply(nil)
+		if err != nil {
+			return err
+		}
+
+		err = fileService.CreateFileFromReader(hash, fileInfo.GetChecksum(), req.AcknowledgedStream(transactionChan, w))
+		if errors.Is(err, file.ErrQuotaExceeded) {
+			return w.Error(enums.QuotaExceeded, err.Error())
+		}
+		if errors.Is(err, mux.ErrResumeOffset) {
+			return w.Error(enums.BadRequest, err.Error())
+		}
+		if err != nil {
+			log.Error("Error storing file: ", err)
+			return w.Error(enums.InternalError, "error storing file")
+		}
+		return w.Reply(nil)
+	}
 }
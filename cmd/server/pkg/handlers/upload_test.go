@@ -0,0 +1,201 @@
+package handlers_test
+
+import (
+	"filesync/enums"
+	"filesync/models"
+	"github.com/stretchr/testify/assert"
+	"server/pkg/handlers"
+	"server/pkg/mux"
+	"server/pkg/session"
+	"server/services/auth"
+	"testing"
+	"time"
+)
+
+// receiveReply returns the next response that is not the acknowledgement of a chunk.
+func receiveReply(t *testing.T, resChan chan models.Message) models.Message {
+	for {
+		response := receive(t, resChan)
+		if response.Header.Action != enums.Chunk {
+			return response
+		}
+	}
+}
+
+// upload sends the file info, streams the content once the upload is accepted and returns the final response.
+func upload(t *testing.T, sessionData *session.Session, handler mux.HandlerFunc, hash string, content []byte, library session.Library) models.Message {
+	fileInfo := models.NewFileInfoBytes(hash, testChecksum, time.Now())
+	resChan, done := serve(sessionData, handler, enums.Upload, fileInfo[:], library)
+	response := receive(t, resChan)
+	if response.Header.Action != enums.Upload {
+		return response
+	}
+
+	transactionChan, found := sessionData.GetTransaction(testTransactionID)
+	assert.True(t, found, "Expected the upload to wait for the content")
+	for _, chunk := range [][]byte{content, {}} {
+		select {
+		case transactionChan <- models.Message{
+			Header: models.Header{
+				Action:        enums.Chunk,
+				Sender:        enums.Client,
+				TransactionID: testTransactionID,
+			},
+			Body: chunk,
+		}:
+		case err := <-done:
+			// The handler stopped reading, its response is queued already.
+			assert.NoError(t, err)
+			return receiveReply(t, resChan)
+		}
+	}
+	return receiveReply(t, resChan)
+}
+
+func TestUpload(t *testing.T) {
+	userService, shareService := newTestServices(t)
+	sessionData := newTestSession(t, userService, owner)
+	handler := handlers.NewUploadHandler(userService, shareService)
+
+	response := upload(t, sessionData, handler, "hash", []byte("content"), session.Library{})
+	assert.Equal(t, enums.Upload, response.Header.Action)
+	assert.Nil(t, response.Body)
+	assert.Equal(t, 1, sessionData.FileService.Usage().Files)
+}
+
+func TestUpload_ResumeAfterDrop(t *testing.T) {
+	userService, shareService := newTestServices(t)
+	sessionData := newTestSession(t, userService, owner)
+	handler := handlers.NewUploadHandler(userService, shareService)
+	fileInfo := models.NewFileInfoBytes("hash", testChecksum, time.Now())
+	resChan, done := serve(sessionData, handler, enums.Upload, fileInfo[:], session.Library{})
+	assert.Equal(t, enums.Upload, receive(t, resChan).Header.Action)
+	transactionChan, found := sessionData.GetTransaction(testTransactionID)
+	assert.True(t, found)
+	send := func(action enums.MessageType, body interface{}) {
+		transactionChan <- models.Message{
+			Header: models.Header{Action: action, Sender: enums.Client, TransactionID: testTransactionID},
+			Body:   body,
+		}
+	}
+	acknowledged := func() int64 {
+		response := receive(t, resChan)
+		assert.Equal(t, enums.Chunk, response.Header.Action)
+		return response.Body.(models.StreamOffset).Offset
+	}
+
+	send(enums.Chunk, []byte("first "))
+	assert.Equal(t, int64(6), acknowledged())
+	// The connection drops after the server received the second chunk but before its acknowledgement arrived.
+	send(enums.Chunk, []byte("second "))
+	<-resChan
+
+	// The resumed client continues from the last offset it saw acknowledged and sends the second chunk again.
+	send(enums.Resume, models.StreamOffset{Offset: 6})
+	assert.Equal(t, int64(13), acknowledged(), "Expected the received offset to be acknowledged")
+	send(enums.Chunk, []byte("second third"))
+	assert.Equal(t, int64(18), acknowledged())
+	send(enums.Chunk, []byte{})
+	assert.Equal(t, enums.Upload, receive(t, resChan).Header.Action)
+	assert.NoError(t, <-done)
+
+	content, err := sessionData.FileService.GetFile("hash")
+	assert.NoError(t, err)
+	assert.Equal(t, "first second third", content.String())
+}
+
+func TestUpload_ResumePastReceived(t *testing.T) {
+	userService, shareService := newTestServices(t)
+	sessionData := newTestSession(t, userService, owner)
+	handler := handlers.NewUploadHandler(userService, shareService)
+	fileInfo := models.NewFileInfoBytes("hash", testChecksum, time.Now())
+	resChan, done := serve(sessionData, handler, enums.Upload, fileInfo[:], session.Library{})
+	assert.Equal(t, enums.Upload, receive(t, resChan).Header.Action)
+	transactionChan, _ := sessionData.GetTransaction(testTransactionID)
+
+	transactionChan <- models.Message{
+		Header: models.Header{Action: enums.Resume, Sender: enums.Client, TransactionID: testTransactionID},
+		Body:   models.StreamOffset{Offset: 10},
+	}
+	assert.Equal(t, enums.BadRequest, errorCode(t, receive(t, resChan)), "Expected a gap in the content to be rejected")
+	assert.NoError(t, <-done)
+	_, found := sessionData.FileService.GetFileInfo("hash")
+	assert.False(t, found)
+}
+
+func TestUpload_InvalidHash(t *testing.T) {
+	userService, shareService := newTestServices(t)
+	sessionData := newTestSession(t, userService, owner)
+	handler := handlers.NewUploadHandler(userService, shareService)
+
+	for _, hash := range []string{"../../x", "a/b", ".."} {
+		response := upload(t, sessionData, handler, hash, []byte("content"), session.Library{})
+		assert.Equal(t, enums.BadRequest, errorCode(t, response), "Expected hash %q to be rejected", hash)
+	}
+	_, found := sessionData.GetTransaction(testTransactionID)
+	assert.False(t, found, "Expected the content not to be requested")
+	assert.Equal(t, 0, sessionData.FileService.Usage().Files)
+}
+
+func TestUpload_ReplaceWithUploadScope(t *testing.T) {
+	userService, shareService := newTestServices(t)
+	sessionData := newTestSession(t, userService, owner)
+	sessionData.Principal = &auth.Principal{Username: owner, Scopes: []enums.Scope{enums.UploadScope}}
+	handler := handlers.NewUploadHandler(userService, shareService)
+
+	response := upload(t, sessionData, handler, "hash", []byte("content"), session.Library{})
+	assert.Equal(t, enums.Upload, response.Header.Action, "Expected an upload token to add files")
+	response = upload(t, sessionData, handler, "hash", []byte("replaced"), session.Library{})
+	assert.Equal(t, enums.Forbidden, errorCode(t, response), "Expected an upload token not to replace files")
+	content, err := sessionData.FileService.GetFile("hash")
+	assert.NoError(t, err)
+	assert.Contains(t, content.String(), "content")
+
+	sessionData.Principal = &auth.Principal{Username: owner}
+	response = upload(t, sessionData, handler, "hash", []byte("replaced"), session.Library{})
+	assert.Equal(t, enums.Upload, response.Header.Action, "Expected full access to replace files")
+}
+
+func TestUpload_ReadOnlyMember(t *testing.T) {
+	userService, shareService := newTestServices(t)
+	created, err := shareService.Create(owner, "team")
+	assert.NoError(t, err)
+	assert.NoError(t, shareService.SetMember(owner, models.ShareMember{ShareID: created.ID, Username: member, Access: enums.ReadAccess}))
+	sessionData := newTestSession(t, userService, member)
+	library := selectShare(t, shareService, created.ID)
+	handler := handlers.NewUploadHandler(userService, shareService)
+
+	response := upload(t, sessionData, handler, "hash", []byte("content"), library)
+	assert.Equal(t, enums.Forbidden, errorCode(t, response))
+	assert.Equal(t, 0, library.Files.Usage().Files)
+
+	assert.NoError(t, shareService.SetMember(owner, models.ShareMember{ShareID: created.ID, Username: member, Access: enums.ReadWriteAccess}))
+	response = upload(t, sessionData, handler, "hash", []byte("content"), library)
+	assert.Equal(t, enums.Upload, response.Header.Action, "Expected a writer to upload")
+	assert.Equal(t, 1, library.Files.Usage().Files)
+}
+
+func TestUpload_QuotaExceeded(t *testing.T) {
+	userService, shareService := newTestServices(t)
+	assert.NoError(t, userService.SetQuota(owner, &models.Quota{MaxFiles: 1}))
+	created, err := shareService.Create(owner, "team")
+	assert.NoError(t, err)
+	assert.NoError(t, shareService.SetMember(owner, models.ShareMember{ShareID: created.ID, Username: member, Access: enums.ReadWriteAccess}))
+	ownerSession := newTestSession(t, userService, owner)
+	memberSession := newTestSession(t, userService, member)
+	library := selectShare(t, shareService, created.ID)
+	handler := handlers.NewUploadHandler(userService, shareService)
+
+	response := upload(t, ownerSession, handler, "hash", []byte("content"), session.Library{})
+	assert.Equal(t, enums.Upload, response.Header.Action)
+
+	// The files of the share count against the quota of the owner.
+	response = upload(t, memberSession, handler, "other", []byte("content"), library)
+	assert.Equal(t, enums.QuotaExceeded, errorCode(t, response))
+	assert.Equal(t, 0, library.Files.Usage().Files)
+
+	// The content is rejected once it no longer fits in the bytes left to the owner.
+	assert.NoError(t, userService.SetQuota(owner, &models.Quota{MaxBytes: 100}))
+	response = upload(t, memberSession, handler, "other", make([]byte, 100), library)
+	assert.Equal(t, enums.QuotaExceeded, errorCode(t, response))
+}
@@ -0,0 +1,167 @@
+package limiter
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrTooManyConnections       = errors.New("too many connections")
+	ErrTooManyConnectionsFromIP = errors.New("too many connections from address")
+	ErrRateLimited              = errors.New("connection rate limit exceeded")
+)
+
+// pruneInterval is how often idle per-IP entries are swept from the limiter.
+const pruneInterval = time.Minute
+
+type Config struct {
+	// MaxConnections is the maximum number of concurrent connections. Zero disables the limit.
+	MaxConnections int
+	// MaxConnectionsPerIP is the maximum number of concurrent connections per remote IP. Zero disables the limit.
+	MaxConnectionsPerIP int
+	// ConnectionRate is the number of new connections per second allowed per remote IP. Zero disables the limit.
+	ConnectionRate float64
+	// ConnectionBurst is the number of new connections a remote IP may open at once before being rate limited.
+	ConnectionBurst int
+}
+
+// Stats holds the current number of admitted connections and the rejection counters.
+type Stats struct {
+	Active         int64
+	RejectedGlobal uint64
+	RejectedPerIP  uint64
+	RejectedRate   uint64
+}
+
+type Limiter interface {
+	// Admit reserves a connection slot for the remote address. The returned release function must be
+	// called once the connection is closed.
+	Admit(addr net.Addr) (release func(), err error)
+	// Stats returns a snapshot of the limiter counters.
+	Stats() Stats
+}
+
+type ipEntry struct {
+	active int
+	tokens float64
+	last   time.Time
+}
+
+type concreteLimiter struct {
+	config         *Config
+	mutex          sync.Mutex
+	entries        map[string]*ipEntry
+	lastPrune      time.Time
+	active         atomic.Int64
+	rejectedGlobal atomic.Uint64
+	rejectedPerIP  atomic.Uint64
+	rejectedRate   atomic.Uint64
+}
+
+func New(config *Config) Limiter {
+	return &concreteLimiter{
+		config:    config,
+		entries:   make(map[string]*ipEntry),
+		lastPrune: time.Now(),
+	}
+}
+
+func (l *concreteLimiter) Admit(addr net.Addr) (release func(), err error) {
+	ip := HostFromAddr(addr)
+	now := time.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.lastPrune) >= pruneInterval {
+		l.prune(now)
+	}
+
+	entry, ok := l.entries[ip]
+	if !ok {
+		entry = &ipEntry{
+			tokens: float64(l.config.ConnectionBurst),
+			last:   now,
+		}
+		l.entries[ip] = entry
+	}
+
+	// Refill the token bucket before checking the rate, so a rejected attempt still spends its time.
+	if l.config.ConnectionRate > 0 {
+		entry.tokens += now.Sub(entry.last).Seconds() * l.config.ConnectionRate
+		if entry.tokens > float64(l.config.ConnectionBurst) {
+			entry.tokens = float64(l.config.ConnectionBurst)
+		}
+		entry.last = now
+		if entry.tokens < 1 {
+			l.rejectedRate.Add(1)
+			return nil, ErrRateLimited
+		}
+	}
+
+	if l.config.MaxConnections > 0 && l.active.Load() >= int64(l.config.MaxConnections) {
+		l.rejectedGlobal.Add(1)
+		return nil, ErrTooManyConnections
+	}
+	if l.config.MaxConnectionsPerIP > 0 && entry.active >= l.config.MaxConnectionsPerIP {
+		l.rejectedPerIP.Add(1)
+		return nil, ErrTooManyConnectionsFromIP
+	}
+
+	if l.config.ConnectionRate > 0 {
+		entry.tokens--
+	}
+	entry.active++
+	l.active.Add(1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+			entry.active--
+			l.active.Add(-1)
+		})
+	}, nil
+}
+
+func (l *concreteLimiter) Stats() Stats {
+	return Stats{
+		Active:         l.active.Load(),
+		RejectedGlobal: l.rejectedGlobal.Load(),
+		RejectedPerIP:  l.rejectedPerIP.Load(),
+		RejectedRate:   l.rejectedRate.Load(),
+	}
+}
+
+// prune removes entries without active connections whose token bucket has refilled. Must be called with the mutex held.
+func (l *concreteLimiter) prune(now time.Time) {
+	l.lastPrune = now
+	for ip, entry := range l.entries {
+		if entry.active > 0 {
+			continue
+		}
+		if l.config.ConnectionRate > 0 {
+			refilled := entry.tokens + now.Sub(entry.last).Seconds()*l.config.ConnectionRate
+			if refilled < float64(l.config.ConnectionBurst) {
+				continue
+			}
+		}
+		delete(l.entries, ip)
+	}
+}
+
+// HostFromAddr returns the IP part of the address, falling back to the full address string.
+func HostFromAddr(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,78 @@
+package limiter_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"server/pkg/limiter"
+	"testing"
+)
+
+var (
+	testAddr1 = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50001}
+	testAddr2 = &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 50002}
+)
+
+func TestAdmit_MaxConnections(t *testing.T) {
+	l := limiter.New(&limiter.Config{MaxConnections: 2})
+
+	release1, err := l.Admit(testAddr1)
+	assert.NoError(t, err)
+	_, err = l.Admit(testAddr2)
+	assert.NoError(t, err)
+
+	_, err = l.Admit(testAddr2)
+	assert.ErrorIs(t, err, limiter.ErrTooManyConnections)
+	assert.Equal(t, uint64(1), l.Stats().RejectedGlobal)
+
+	release1()
+	_, err = l.Admit(testAddr1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), l.Stats().Active)
+}
+
+func TestAdmit_MaxConnectionsPerIP(t *testing.T) {
+	l := limiter.New(&limiter.Config{MaxConnectionsPerIP: 1})
+
+	release, err := l.Admit(testAddr1)
+	assert.NoError(t, err)
+
+	_, err = l.Admit(&net.TCPAddr{IP: testAddr1.IP, Port: 50003})
+	assert.ErrorIs(t, err, limiter.ErrTooManyConnectionsFromIP)
+	assert.Equal(t, uint64(1), l.Stats().RejectedPerIP)
+
+	_, err = l.Admit(testAddr2)
+	assert.NoError(t, err, "Expected other addresses to be unaffected")
+
+	release()
+	release()
+	_, err = l.Admit(testAddr1)
+	assert.NoError(t, err, "Expected release to free the slot exactly once")
+	assert.Equal(t, int64(2), l.Stats().Active)
+}
+
+func TestAdmit_ConnectionRate(t *testing.T) {
+	l := limiter.New(&limiter.Config{ConnectionRate: 0.001, ConnectionBurst: 2})
+
+	for i := 0; i < 2; i++ {
+		release, err := l.Admit(testAddr1)
+		assert.NoError(t, err)
+		release()
+	}
+
+	_, err := l.Admit(testAddr1)
+	assert.ErrorIs(t, err, limiter.ErrRateLimited)
+	assert.Equal(t, uint64(1), l.Stats().RejectedRate)
+
+	_, err = l.Admit(testAddr2)
+	assert.NoError(t, err, "Expected other addresses to be unaffected")
+}
+
+func TestAdmit_NoLimits(t *testing.T) {
+	l := limiter.New(&limiter.Config{})
+
+	for i := 0; i < 100; i++ {
+		_, err := l.Admit(testAddr1)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int64(100), l.Stats().Active)
+}
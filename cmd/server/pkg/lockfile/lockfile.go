@@ -0,0 +1,82 @@
+package lockfile
+
+import (
+	"encoding/json"
+	"errors"
+	"filesync/models"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// FileName is the name of the lock file in the data directory.
+const FileName = "server.lock"
+
+var ErrLocked = errors.New("the data directory is locked by another process")
+
+// State is what the server records in the lock file for the tools that work on the data directory while it is
+// stopped. It outlives the lock.
+type State struct {
+	DefaultQuota models.Quota `json:"defaultQuota"`
+}
+
+type Lock interface {
+	// State returns the state recorded by the last server that held the lock, it is zero if none did.
+	State() (state State, err error)
+	// Record replaces the state in the lock file.
+	Record(state State) (err error)
+	// Release unlocks the data directory. The lock is also released when the process exits.
+	Release() (err error)
+}
+
+type concreteLock struct {
+	file *os.File
+}
+
+// Acquire locks the data directory, it returns ErrLocked if another process holds the lock.
+func Acquire(dir string) (Lock, error) {
+	file, err := os.OpenFile(filepath.Join(dir, FileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return &concreteLock{file: file}, nil
+}
+
+func (l *concreteLock) State() (state State, err error) {
+	data, err := io.ReadAll(io.NewSectionReader(l.file, 0, 1<<20))
+	if err != nil || len(data) == 0 {
+		return State{}, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func (l *concreteLock) Record(state State) (err error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	err = l.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.WriteAt(data, 0)
+	if err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+func (l *concreteLock) Release() (err error) {
+	err = syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	return errors.Join(err, l.file.Close())
+}
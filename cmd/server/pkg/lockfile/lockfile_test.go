@@ -0,0 +1,42 @@
+package lockfile_test
+
+import (
+	"filesync/models"
+	"github.com/stretchr/testify/assert"
+	"server/pkg/lockfile"
+	"testing"
+)
+
+func TestAcquire(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := lockfile.Acquire(dir)
+	assert.NoError(t, err)
+	_, err = lockfile.Acquire(dir)
+	assert.ErrorIs(t, err, lockfile.ErrLocked)
+
+	assert.NoError(t, lock.Release())
+	lock, err = lockfile.Acquire(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Release())
+}
+
+func TestState(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := lockfile.Acquire(dir)
+	assert.NoError(t, err)
+	state, err := lock.State()
+	assert.NoError(t, err)
+	assert.Equal(t, lockfile.State{}, state)
+
+	assert.NoError(t, lock.Record(lockfile.State{DefaultQuota: models.Quota{MaxBytes: 1 << 30, MaxFiles: 1000}}))
+	assert.NoError(t, lock.Record(lockfile.State{DefaultQuota: models.Quota{MaxFiles: 5}}))
+	assert.NoError(t, lock.Release())
+
+	// The state outlives the lock.
+	lock, err = lockfile.Acquire(dir)
+	assert.NoError(t, err)
+	state, err = lock.State()
+	assert.NoError(t, err)
+	assert.Equal(t, lockfile.State{DefaultQuota: models.Quota{MaxFiles: 5}}, state)
+	assert.NoError(t, lock.Release())
+}
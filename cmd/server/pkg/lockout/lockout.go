@@ -0,0 +1,197 @@
+package lockout
+
+import (
+	"errors"
+	"filesync/models"
+	"net"
+	"server/pkg/limiter"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrLockedOut = errors.New("too many failed attempts")
+
+// pruneInterval is how often forgotten entries are swept from the tracker.
+const pruneInterval = time.Minute
+
+// Kind is the kind of key failures are tracked for.
+type Kind string
+
+const (
+	KindUser    Kind = "user"
+	KindAddress Kind = "address"
+)
+
+type Config struct {
+	// BaseDelay is the backoff after the first failure, it doubles with every further failure up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// MaxUserFailures is the number of failures after which a username is locked out. Zero disables the lockout.
+	MaxUserFailures int
+	// MaxAddressFailures is the number of failures after which a remote address is locked out. Zero disables the lockout.
+	MaxAddressFailures int
+	LockoutDuration    time.Duration
+	// FailureWindow is how long failures are remembered after the last one.
+	FailureWindow time.Duration
+}
+
+type Tracker interface {
+	// Check returns ErrLockedOut if the username or the address has to wait before the next attempt.
+	// An empty username only checks the address.
+	Check(username string, addr net.Addr) error
+	// Failure records a failed attempt of the username from the address. An empty username only counts towards the address.
+	Failure(username string, addr net.Addr)
+	// Success forgets the failures of the username. The failures of the address are not forgotten, anyone can log in
+	// to an account of their own between guesses, they expire after the failure window.
+	Success(username string)
+	// Lockouts returns the tracked usernames and addresses.
+	Lockouts() []models.LockoutInfo
+	// Unlock forgets the failures of the key, it returns false if the key is not tracked.
+	Unlock(kind Kind, key string) bool
+}
+
+type entry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+type concreteTracker struct {
+	config    *Config
+	mutex     sync.Mutex
+	users     map[string]*entry
+	addresses map[string]*entry
+	lastPrune time.Time
+}
+
+func New(config *Config) Tracker {
+	return &concreteTracker{
+		config:    config,
+		users:     make(map[string]*entry),
+		addresses: make(map[string]*entry),
+		lastPrune: time.Now(),
+	}
+}
+
+func (t *concreteTracker) Check(username string, addr net.Addr) error {
+	now := time.Now()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if e, ok := t.addresses[limiter.HostFromAddr(addr)]; ok && now.Before(e.blockedUntil) {
+		return ErrLockedOut
+	}
+	if username == "" {
+		return nil
+	}
+	if e, ok := t.users[username]; ok && now.Before(e.blockedUntil) {
+		return ErrLockedOut
+	}
+	return nil
+}
+
+func (t *concreteTracker) Failure(username string, addr net.Addr) {
+	now := time.Now()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if now.Sub(t.lastPrune) >= pruneInterval {
+		t.prune(now)
+	}
+	if username != "" {
+		t.fail(t.users, username, t.config.MaxUserFailures, now)
+	}
+	t.fail(t.addresses, limiter.HostFromAddr(addr), t.config.MaxAddressFailures, now)
+}
+
+func (t *concreteTracker) Success(username string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.users, username)
+}
+
+func (t *concreteTracker) Lockouts() []models.LockoutInfo {
+	now := time.Now()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.prune(now)
+	lockouts := make([]models.LockoutInfo, 0, len(t.users)+len(t.addresses))
+	for kind, entries := range map[Kind]map[string]*entry{KindUser: t.users, KindAddress: t.addresses} {
+		for key, e := range entries {
+			lockouts = append(lockouts, models.LockoutInfo{
+				Kind:         string(kind),
+				Key:          key,
+				Failures:     e.failures,
+				LastFailure:  e.lastFailure,
+				BlockedUntil: e.blockedUntil,
+			})
+		}
+	}
+	sort.Slice(lockouts, func(i, j int) bool {
+		return lockouts[i].LastFailure.After(lockouts[j].LastFailure)
+	})
+	return lockouts
+}
+
+func (t *concreteTracker) Unlock(kind Kind, key string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var entries map[string]*entry
+	switch kind {
+	case KindUser:
+		entries = t.users
+	case KindAddress:
+		entries = t.addresses
+	default:
+		return false
+	}
+	if _, ok := entries[key]; !ok {
+		return false
+	}
+	delete(entries, key)
+	return true
+}
+
+// fail records a failure of the key and blocks it for the backoff, or for the lockout duration once it
+// reached maxFailures. Must be called with the mutex held.
+func (t *concreteTracker) fail(entries map[string]*entry, key string, maxFailures int, now time.Time) {
+	e, ok := entries[key]
+	if !ok || now.Sub(e.lastFailure) > t.config.FailureWindow {
+		e = &entry{}
+		entries[key] = e
+	}
+	e.failures++
+	e.lastFailure = now
+
+	if maxFailures > 0 && e.failures >= maxFailures {
+		e.blockedUntil = now.Add(t.config.LockoutDuration)
+		return
+	}
+	delay := t.config.BaseDelay
+	for i := 1; i < e.failures && delay < t.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.config.MaxDelay {
+		delay = t.config.MaxDelay
+	}
+	e.blockedUntil = now.Add(delay)
+}
+
+// prune removes the entries that are no longer blocked and whose failures are forgotten. Must be called with the mutex held.
+func (t *concreteTracker) prune(now time.Time) {
+	t.lastPrune = now
+	for _, entries := range []map[string]*entry{t.users, t.addresses} {
+		for key, e := range entries {
+			if now.After(e.blockedUntil) && now.Sub(e.lastFailure) > t.config.FailureWindow {
+				delete(entries, key)
+			}
+		}
+	}
+}
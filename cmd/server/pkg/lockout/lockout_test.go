@@ -0,0 +1,93 @@
+package lockout_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"server/pkg/lockout"
+	"testing"
+	"time"
+)
+
+var (
+	testAddr1 = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50001}
+	testAddr2 = &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 50002}
+)
+
+func TestFailure_Backoff(t *testing.T) {
+	tracker := lockout.New(&lockout.Config{
+		BaseDelay:     50 * time.Millisecond,
+		MaxDelay:      time.Second,
+		FailureWindow: time.Minute,
+	})
+
+	assert.NoError(t, tracker.Check("test1", testAddr1))
+	tracker.Failure("test1", testAddr1)
+	assert.ErrorIs(t, tracker.Check("test1", testAddr2), lockout.ErrLockedOut, "Expected username to back off")
+	assert.ErrorIs(t, tracker.Check("", testAddr1), lockout.ErrLockedOut, "Expected address to back off")
+	assert.NoError(t, tracker.Check("test2", testAddr2))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, tracker.Check("test1", testAddr1))
+
+	// The second failure doubles the delay.
+	tracker.Failure("test1", testAddr1)
+	time.Sleep(60 * time.Millisecond)
+	assert.ErrorIs(t, tracker.Check("test1", testAddr1), lockout.ErrLockedOut)
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, tracker.Check("test1", testAddr1))
+}
+
+func TestFailure_Lockout(t *testing.T) {
+	tracker := lockout.New(&lockout.Config{
+		MaxUserFailures:    3,
+		MaxAddressFailures: 10,
+		LockoutDuration:    time.Hour,
+		FailureWindow:      time.Minute,
+	})
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, tracker.Check("test1", testAddr1))
+		tracker.Failure("test1", testAddr1)
+	}
+	assert.ErrorIs(t, tracker.Check("test1", testAddr2), lockout.ErrLockedOut)
+	assert.NoError(t, tracker.Check("", testAddr1), "Expected address below its threshold")
+
+	lockouts := tracker.Lockouts()
+	assert.Len(t, lockouts, 2)
+	for _, info := range lockouts {
+		assert.Equal(t, 3, info.Failures)
+	}
+
+	assert.True(t, tracker.Unlock(lockout.KindUser, "test1"))
+	assert.False(t, tracker.Unlock(lockout.KindUser, "test1"))
+	assert.NoError(t, tracker.Check("test1", testAddr1))
+}
+
+func TestSuccess(t *testing.T) {
+	tracker := lockout.New(&lockout.Config{
+		MaxUserFailures: 2,
+		LockoutDuration: time.Hour,
+		FailureWindow:   time.Minute,
+	})
+
+	tracker.Failure("test1", testAddr1)
+	tracker.Success("test1")
+	tracker.Failure("test1", testAddr1)
+	assert.NoError(t, tracker.Check("test1", testAddr1), "Expected success to reset the failures")
+	assert.Len(t, tracker.Lockouts(), 2)
+}
+
+func TestSuccess_KeepsAddress(t *testing.T) {
+	tracker := lockout.New(&lockout.Config{
+		MaxAddressFailures: 2,
+		LockoutDuration:    time.Hour,
+		FailureWindow:      time.Minute,
+	})
+
+	// Logging in to an account of their own between guesses does not reset the failures of the address.
+	tracker.Failure("victim", testAddr1)
+	tracker.Success("attacker")
+	tracker.Failure("victim", testAddr1)
+	assert.ErrorIs(t, tracker.Check("attacker", testAddr1), lockout.ErrLockedOut)
+	assert.NoError(t, tracker.Check("attacker", testAddr2))
+}
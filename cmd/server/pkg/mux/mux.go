@@ -5,39 +5,112 @@ import (
 	"errors"
 	"filesync/enums"
 	"filesync/models"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"math"
 	"net"
+	"server/pkg/notifier"
+	"server/pkg/resume"
 	"server/pkg/session"
 	"server/services/auth"
 	"sync"
 	"time"
 )
 
+// RequestTimeout is how long a request may go without progress before it is cancelled. A stream makes progress with
+// every chunk it sends or receives, so a transfer can take as long as it needs while data keeps flowing. The requests
+// of a parked session do not time out, they wait for the session to be resumed or to expire.
+const RequestTimeout = 5 * time.Second
+
 type Request struct {
 	Message models.Message
 	Ctx     context.Context
+	// Library is the library the session had selected when the request was received.
+	Library session.Library
+	// idle cancels the request once it made no progress for RequestTimeout, it is nil for requests without a timeout.
+	idle *time.Timer
+}
+
+// NewRequest returns a request for the message whose context is derived from the parent context. The request is
+// cancelled with context.DeadlineExceeded as its cause once it made no progress for RequestTimeout.
+func NewRequest(parent context.Context, message models.Message, library session.Library) (*Request, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	req := &Request{
+		Message: message,
+		Ctx:     ctx,
+		Library: library,
+	}
+	req.idle = time.AfterFunc(math.MaxInt64, func() {
+		if sessionData, ok := session.FromContext(ctx); ok && sessionData.Parked() {
+			req.progress()
+			return
+		}
+		cancel(context.DeadlineExceeded)
+	})
+	// The timer is armed once it is assigned, its function restarts it.
+	req.progress()
+	return req, func() {
+		req.idle.Stop()
+		cancel(context.Canceled)
+	}
+}
+
+// progress restarts the idle timeout of the request.
+func (r *Request) progress() {
+	if r.idle != nil {
+		r.idle.Reset(RequestTimeout)
+	}
 }
 
-type HandlerFunc func(chan models.Message, *Request) error
+type HandlerFunc func(ResponseWriter, *Request) error
 
 type Mux interface {
 	Handle(action enums.MessageType, handler HandlerFunc)
+	// HandleOrdered registers a handler that completes before the next message of the connection is handled,
+	// for actions that change the state the following requests depend on.
+	HandleOrdered(action enums.MessageType, handler HandlerFunc)
 	ServeConn(net.Conn)
 	Shutdown()
+	// Sessions returns the open sessions, including resumable sessions without a connection.
+	Sessions() []*session.Session
+	// Disconnect closes the session with the given ID, it returns false if no such session exists.
+	Disconnect(sessionID string) bool
+	// DisconnectUser closes every session of the user and returns the number of closed sessions.
+	DisconnectUser(username string) int
+	// DisconnectDevice closes every session of the device of the user and returns the number of closed sessions.
+	DisconnectDevice(username string, device string) int
+	// DisconnectToken closes every session that logged in with the API token of the user and returns the number of
+	// closed sessions. Closed sessions can not be resumed, so their resumption tokens are invalidated too.
+	DisconnectToken(username string, tokenID string) int
+}
+
+type Config struct {
+	// AuthTimeout bounds the TLS handshake and authentication of a new connection.
+	AuthTimeout time.Duration
 }
 
 type concreteMux struct {
 	handlers      map[enums.MessageType]HandlerFunc
+	ordered       map[enums.MessageType]bool
 	authenticator auth.Service
+	notifier      notifier.Hub
+	resumer       resume.Store
+	config        *Config
+	sessions      *sync.Map
 	ctx           context.Context
 	cancel        context.CancelFunc
 }
 
-func NewMux(authenticator auth.Service) Mux {
+func NewMux(authenticator auth.Service, notifier notifier.Hub, resumer resume.Store, config *Config) Mux {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &concreteMux{
 		make(map[enums.MessageType]HandlerFunc),
+		make(map[enums.MessageType]bool),
 		authenticator,
+		notifier,
+		resumer,
+		config,
+		&sync.Map{},
 		ctx,
 		cancel,
 	}
@@ -52,24 +125,110 @@ func (m *concreteMux) Handle(action enums.MessageType, handlerFunc HandlerFunc)
 	m.handlers[action] = handlerFunc
 }
 
+func (m *concreteMux) HandleOrdered(action enums.MessageType, handlerFunc HandlerFunc) {
+	m.Handle(action, handlerFunc)
+	m.ordered[action] = true
+}
+
+func (m *concreteMux) Sessions() []*session.Session {
+	var sessions []*session.Session
+	m.sessions.Range(func(_, value any) bool {
+		sessions = append(sessions, value.(*session.Session))
+		return true
+	})
+	return sessions
+}
+
+func (m *concreteMux) Disconnect(sessionID string) bool {
+	value, ok := m.sessions.Load(sessionID)
+	if !ok {
+		return false
+	}
+	log.Infof("Disconnecting session %s", sessionID)
+	value.(*session.Session).Close()
+	return true
+}
+
+func (m *concreteMux) DisconnectUser(username string) int {
+	count := 0
+	for _, sessionData := range m.Sessions() {
+		if sessionData.Username == username && m.Disconnect(sessionData.ID) {
+			count++
+		}
+	}
+	return count
+}
+
+func (m *concreteMux) DisconnectDevice(username string, device string) int {
+	count := 0
+	for _, sessionData := range m.Sessions() {
+		if sessionData.Username == username && sessionData.Principal != nil && sessionData.Principal.Device == device && m.Disconnect(sessionData.ID) {
+			count++
+		}
+	}
+	return count
+}
+
+func (m *concreteMux) DisconnectToken(username string, tokenID string) int {
+	count := 0
+	for _, sessionData := range m.Sessions() {
+		if sessionData.Username == username && sessionData.Principal != nil && sessionData.Principal.TokenID == tokenID && m.Disconnect(sessionData.ID) {
+			count++
+		}
+	}
+	return count
+}
+
 func (m *concreteMux) ServeConn(conn net.Conn) {
 	defer conn.Close()
 
 	log.Debugf("Serving connection from %s", conn.RemoteAddr().String())
 
-	sessionData := &session.Session{
-		Transactions: &sync.Map{},
-	}
-
-	err := m.authenticateClient(conn, sessionData)
+	sessionData, err := m.authenticateClient(conn)
 	if err != nil {
 		return
 	}
+	sessionData.SetRemoteAddr(conn.RemoteAddr())
+	conn = session.NewCountingConn(conn, sessionData)
 
-	ctx, cancel := session.NewContext(m.ctx, sessionData)
+	// The session outlives the connection while it is resumable, so the connection gets its own context.
+	ctx, cancel := context.WithCancel(sessionData.Context())
 	defer cancel()
+	// Unblock the receive loop when the session is closed from elsewhere.
+	context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
 
-	resChan := handleResponses(conn, ctx)
+	var token []byte
+	token, err = m.resumer.Issue(sessionData, func() {
+		conn.Close()
+	})
+	if err != nil {
+		log.Error("Error issuing resumption token: ", err)
+		sessionData.Close()
+		return
+	}
+	closeSession := false
+	defer func() {
+		if closeSession || sessionData.Context().Err() != nil {
+			m.resumer.Revoke(token)
+			sessionData.Close()
+			return
+		}
+		if !m.resumer.Park(token) {
+			sessionData.Close()
+		}
+	}()
+
+	resChan := sessionData.Responses
+	go handleResponses(conn, ctx, resChan)
+	queue(ctx, resChan, models.Message{
+		Header: models.Header{
+			Action: enums.Resume,
+			Sender: enums.Server,
+		},
+		Body: token,
+	})
 
 	for {
 		select {
@@ -93,15 +252,37 @@ func (m *concreteMux) ServeConn(conn net.Conn) {
 		}
 
 		if message.Header.Action == enums.Cancel {
-			log.Info("Received cancel message, shutting down connection")
-			return
+			// A cancel message without a transaction ID closes the whole session.
+			if message.Header.TransactionID == ([32]byte{}) {
+				log.Info("Received cancel message, shutting down connection")
+				closeSession = true
+				return
+			}
+			cancelRequest(ctx, resChan, sessionData, message.Header.TransactionID)
+			continue
+		}
+
+		if message.Header.Action == enums.Subscribe || message.Header.Action == enums.Unsubscribe {
+			if !sessionData.Principal.Allows(message.Header.Action) {
+				forbid(ctx, resChan, message)
+				continue
+			}
 		}
 
-		reqCtx, cancelReq := context.WithTimeout(ctx, time.Second*5)
-		req := &Request{
-			Message: message,
-			Ctx:     reqCtx,
+		if message.Header.Action == enums.Subscribe {
+			m.subscribe(resChan, sessionData)
+			acknowledge(ctx, resChan, message)
+			continue
 		}
+
+		if message.Header.Action == enums.Unsubscribe {
+			m.notifier.Unsubscribe(sessionData.Username, sessionData.ID)
+			acknowledge(ctx, resChan, message)
+			continue
+		}
+
+		// Requests belong to the session, so they survive a reconnect of a resumed session.
+		req, cancelReq := NewRequest(sessionData.Context(), message, sessionData.Selected())
 		err = m.handleRequest(resChan, req, cancelReq)
 		if err != nil {
 			log.Error("Error handling request: ", err)
@@ -109,40 +290,77 @@ func (m *concreteMux) ServeConn(conn net.Conn) {
 	}
 }
 
-func (m *concreteMux) authenticateClient(conn net.Conn, session *session.Session) error {
-	err := m.authenticator.AuthenticateClient(conn)
+// authenticateClient authenticates the client and returns its new or resumed session.
+func (m *concreteMux) authenticateClient(conn net.Conn) (*session.Session, error) {
+	if m.config.AuthTimeout > 0 {
+		err := conn.SetDeadline(time.Now().Add(m.config.AuthTimeout))
+		if err != nil {
+			return nil, err
+		}
+	}
+	principal, err := m.authenticator.AuthenticateClient(conn)
 	if err != nil {
-		return err
+		log.Warnf("Authentication of %s failed: %s", conn.RemoteAddr().String(), err)
+		return nil, err
 	}
-	session.FileService, err = m.authenticator.GetFileService()
+	err = conn.SetDeadline(time.Time{})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	session.Username = m.authenticator.GetUsername()
-	return nil
+
+	if principal.ResumptionToken != nil {
+		return m.resumer.Resume(principal.ResumptionToken, principal.Username)
+	}
+
+	var sessionID string
+	sessionID, err = session.NewID()
+	if err != nil {
+		return nil, err
+	}
+	sessionData := &session.Session{
+		ID:           sessionID,
+		Username:     principal.Username,
+		Principal:    principal,
+		Transactions: &sync.Map{},
+		Requests:     &sync.Map{},
+		Responses:    make(chan models.Message, 5),
+		StartTime:    time.Now(),
+	}
+	sessionData.FileService, err = m.authenticator.GetFileService(principal)
+	if err != nil {
+		return nil, err
+	}
+	sessionData.Open(m.ctx)
+
+	// Publish the changes made by this session to the other sessions of the user.
+	unwatch := sessionData.FileService.Watch(func(change models.FileChange) {
+		// The files of a session restricted to a library are the files of the library.
+		change.Library = principal.Library
+		m.notifier.Publish(sessionData.Username, sessionData.ID, change)
+	})
+	m.sessions.Store(sessionData.ID, sessionData)
+	context.AfterFunc(sessionData.Context(), func() {
+		unwatch()
+		sessionData.FileService.Close()
+		m.notifier.Unsubscribe(sessionData.Username, sessionData.ID)
+		m.sessions.Delete(sessionData.ID)
+	})
+	return sessionData, nil
 }
 
-func handleResponses(conn net.Conn, ctx context.Context) chan models.Message {
-	responseChan := make(chan models.Message, 5)
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				close(responseChan)
-				return
-			case message, ok := <-responseChan:
-				if !ok {
-					log.Error("Response channel closed")
-					return
-				}
-				_, err := message.Send(conn)
-				if err != nil {
-					log.Error("Error sending response: ", err)
-				}
+// handleResponses sends the queued responses of the session to the connection until the connection is closed.
+func handleResponses(conn net.Conn, ctx context.Context, responseChan chan models.Message) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message := <-responseChan:
+			_, err := message.Send(conn)
+			if err != nil {
+				log.Error("Error sending response: ", err)
 			}
 		}
-	}()
-	return responseChan
+	}
 }
 
 func (m *concreteMux) handleRequest(resChan chan models.Message, req *Request, cancel context.CancelFunc) error {
@@ -159,18 +377,128 @@ func (m *concreteMux) handleRequest(resChan chan models.Message, req *Request, c
 	var transactionChan chan models.Message
 	transactionChan, ok = sessionData.GetTransaction(req.Message.Header.TransactionID)
 	if ok {
+		defer cancel()
+		transactionCtx, found := sessionData.GetRequestContext(req.Message.Header.TransactionID)
+		if !found {
+			return errors.New("transaction has no in-flight request")
+		}
 		log.Debug("Transaction found for request, forwarding message to transaction channel")
-		transactionChan <- req.Message
+		select {
+		case transactionChan <- req.Message:
+		case <-transactionCtx.Done():
+			return errors.New("transaction cancelled")
+		}
 		return nil
 	}
-	go func() {
-		defer sessionData.Transactions.Delete(req.Message.Header.TransactionID)
+	// Messages of an ongoing transaction were authorized with its first message.
+	if !sessionData.Principal.Allows(req.Message.Header.Action) {
+		forbid(req.Ctx, resChan, req.Message)
+		cancel()
+		return nil
+	}
+	generation := sessionData.AddRequest(req.Message.Header.TransactionID, req.Message.Header.Action, req.Ctx, cancel)
+	handle := func() {
+		defer sessionData.RemoveRequest(req.Message.Header.TransactionID, generation)
 		defer cancel()
 
-		err := handler(resChan, req)
+		err := handler(NewResponseWriter(resChan, req), req)
 		if err != nil {
 			log.Error("Error handling request: ", err)
 		}
-	}()
+	}
+	if m.ordered[req.Message.Header.Action] {
+		handle()
+		return nil
+	}
+	go handle()
 	return nil
 }
+
+// cancelRequest cancels the in-flight request with the given transaction ID and acknowledges the cancellation.
+func cancelRequest(ctx context.Context, resChan chan models.Message, sessionData *session.Session, transactionID [32]byte) {
+	if !sessionData.CancelRequest(transactionID) {
+		log.Debugf("Received cancel message for unknown transaction %x", transactionID)
+		return
+	}
+	log.Debugf("Cancelled transaction %x", transactionID)
+	queue(ctx, resChan, models.Message{
+		Header: models.Header{
+			Action:        enums.Cancel,
+			Sender:        enums.Server,
+			TransactionID: transactionID,
+		},
+	})
+}
+
+// subscribe subscribes the session to the changes of its user and pushes them to the client
+// until the session unsubscribes or is closed.
+func (m *concreteMux) subscribe(resChan chan models.Message, sessionData *session.Session) {
+	subscriber, created := m.notifier.Subscribe(sessionData.Username, sessionData.ID)
+	if !created {
+		return
+	}
+	log.Debugf("Session %s subscribed to changes of user %s", sessionData.ID, sessionData.Username)
+	go func() {
+		for {
+			select {
+			case <-sessionData.Context().Done():
+				return
+			case change, ok := <-subscriber.Changes:
+				if !ok {
+					return
+				}
+				if !sessionData.Principal.Sees(change) {
+					continue
+				}
+				// The changes wait in the queue while the session is parked, they are dropped with the session.
+				if !queue(sessionData.Context(), resChan, models.Message{
+					Header: models.Header{
+						Action: enums.Notify,
+						Sender: enums.Server,
+					},
+					Body: change,
+				}) {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// forbid tells the client that the scopes of its API token do not allow the action.
+func forbid(ctx context.Context, resChan chan models.Message, message models.Message) {
+	log.Debugf("Rejected action %s outside the token scopes", message.Header.Action)
+	queue(ctx, resChan, models.Message{
+		Header: models.Header{
+			Action:        enums.Error,
+			Sender:        enums.Server,
+			TransactionID: message.Header.TransactionID,
+		},
+		Body: models.ErrorResponse{
+			Code:    enums.Forbidden,
+			Message: fmt.Sprintf("token scopes do not allow %s", message.Header.Action),
+		},
+	})
+}
+
+// acknowledge echoes the action and transaction ID of a connection level message back to the client.
+func acknowledge(ctx context.Context, resChan chan models.Message, message models.Message) {
+	queue(ctx, resChan, models.Message{
+		Header: models.Header{
+			Action:        message.Header.Action,
+			Sender:        enums.Server,
+			TransactionID: message.Header.TransactionID,
+		},
+	})
+}
+
+// queue queues the message on the response channel unless the context is done first, the queue is not drained
+// while the session is parked. It returns whether the message was queued.
+func queue(ctx context.Context, resChan chan models.Message, message models.Message) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case resChan <- message:
+		return true
+	}
+}
@@ -1 +1,149 @@
 package mux_test
+
+import (
+	"bytes"
+	"context"
+	"filesync/enums"
+	"filesync/models"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"server/pkg/mux"
+	"server/pkg/session"
+	"testing"
+	"time"
+)
+
+var testTransactionID = [32]byte{1, 2, 3}
+
+func newTestRequest(ctx context.Context) *mux.Request {
+	return &mux.Request{
+		Message: models.Message{
+			Header: models.Header{
+				Action:        enums.Download,
+				Sender:        enums.Client,
+				TransactionID: testTransactionID,
+			},
+		},
+		Ctx: ctx,
+	}
+}
+
+func TestResponseWriter_Reply(t *testing.T) {
+	resChan := make(chan models.Message, 1)
+	w := mux.NewResponseWriter(resChan, newTestRequest(context.Background()))
+
+	err := w.Reply("hello")
+	assert.NoError(t, err)
+
+	message := <-resChan
+	assert.Equal(t, enums.Download, message.Header.Action)
+	assert.Equal(t, enums.Server, message.Header.Sender)
+	assert.Equal(t, testTransactionID, message.Header.TransactionID)
+	assert.Equal(t, "hello", message.Body)
+}
+
+func TestResponseWriter_Error(t *testing.T) {
+	resChan := make(chan models.Message, 1)
+	w := mux.NewResponseWriter(resChan, newTestRequest(context.Background()))
+
+	err := w.Error(enums.NotFound, "file not found")
+	assert.NoError(t, err)
+
+	message := <-resChan
+	assert.Equal(t, enums.Error, message.Header.Action)
+	assert.Equal(t, testTransactionID, message.Header.TransactionID)
+	assert.Equal(t, models.ErrorResponse{Code: enums.NotFound, Message: "file not found"}, message.Body)
+}
+
+func TestResponseWriter_Stream(t *testing.T) {
+	resChan := make(chan models.Message, 10)
+	w := mux.NewResponseWriter(resChan, newTestRequest(context.Background()))
+
+	content := bytes.Repeat([]byte("a"), mux.StreamChunkSize*2+10)
+	stream := w.Stream()
+	n, err := stream.Write(content)
+	assert.NoError(t, err)
+	assert.Equal(t, len(content), n)
+	assert.NoError(t, stream.Close())
+	close(resChan)
+
+	var received []byte
+	var sizes []int
+	for message := range resChan {
+		assert.Equal(t, enums.Chunk, message.Header.Action)
+		assert.Equal(t, testTransactionID, message.Header.TransactionID)
+		received = append(received, message.Body.([]byte)...)
+		sizes = append(sizes, len(message.Body.([]byte)))
+	}
+	assert.Equal(t, content, received)
+	assert.Equal(t, []int{mux.StreamChunkSize, mux.StreamChunkSize, 10, 0}, sizes)
+}
+
+func TestResponseWriter_Cancelled(t *testing.T) {
+	resChan := make(chan models.Message)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := mux.NewResponseWriter(resChan, newTestRequest(ctx))
+
+	err := w.Reply("hello")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestRequest_Stream(t *testing.T) {
+	transactionChan := make(chan models.Message, 3)
+	for _, chunk := range []string{"hello ", "world", ""} {
+		transactionChan <- models.Message{
+			Header: models.Header{Action: enums.Chunk},
+			Body:   []byte(chunk),
+		}
+	}
+
+	received, err := io.ReadAll(newTestRequest(context.Background()).Stream(transactionChan))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello world"), received)
+}
+
+func TestRequest_StreamInvalid(t *testing.T) {
+	transactionChan := make(chan models.Message, 1)
+	transactionChan <- models.Message{
+		Header: models.Header{Action: enums.Upload},
+	}
+	_, err := io.ReadAll(newTestRequest(context.Background()).Stream(transactionChan))
+	assert.Error(t, err, "Expected a message that is not a chunk to fail the stream")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = io.ReadAll(newTestRequest(ctx).Stream(transactionChan))
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestRequest_StreamPastTimeout(t *testing.T) {
+	t.Parallel()
+	req, cancel := mux.NewRequest(context.Background(), newTestRequest(nil).Message, session.Library{})
+	defer cancel()
+	transactionChan := make(chan models.Message)
+	go func() {
+		// Every chunk arrives well within the timeout, the whole stream takes longer than it.
+		deadline := time.Now().Add(mux.RequestTimeout + time.Second)
+		for time.Now().Before(deadline) {
+			time.Sleep(mux.RequestTimeout / 10)
+			transactionChan <- models.Message{Header: models.Header{Action: enums.Chunk}, Body: []byte("a")}
+		}
+		transactionChan <- models.Message{Header: models.Header{Action: enums.Chunk}, Body: []byte{}}
+	}()
+
+	received, err := io.ReadAll(req.Stream(transactionChan))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, received)
+}
+
+func TestRequest_StreamIdle(t *testing.T) {
+	t.Parallel()
+	req, cancel := mux.NewRequest(context.Background(), newTestRequest(nil).Message, session.Library{})
+	defer cancel()
+
+	start := time.Now()
+	_, err := io.ReadAll(req.Stream(make(chan models.Message)))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.GreaterOrEqual(t, time.Since(start), mux.RequestTimeout)
+}
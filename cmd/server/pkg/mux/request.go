@@ -0,0 +1,111 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"filesync/enums"
+	"filesync/models"
+	"fmt"
+	"io"
+)
+
+// ErrResumeOffset fails a stream that is resumed from an offset past the content received so far.
+var ErrResumeOffset = errors.New("resume offset is past the received content")
+
+// Stream returns a reader of the chunk messages the client sends on the transaction of the request, the counterpart
+// of ResponseWriter.Stream. An empty chunk ends the stream and reading fails once the request is cancelled. Every chunk
+// received restarts the idle timeout of the request.
+func (r *Request) Stream(transactionChan chan models.Message) io.Reader {
+	return &streamReader{
+		req:             r,
+		transactionChan: transactionChan,
+	}
+}
+
+// AcknowledgedStream is Stream that acknowledges every chunk with the offset of the content received so far. A client
+// whose connection dropped resumes the stream on its resumed session with a resume message whose body is the
+// models.StreamOffset it continues from, usually the last offset it saw acknowledged. The content it sends again up
+// to the received offset is skipped, and the received offset is acknowledged once more.
+func (r *Request) AcknowledgedStream(transactionChan chan models.Message, w ResponseWriter) io.Reader {
+	return &streamReader{
+		req:             r,
+		transactionChan: transactionChan,
+		writer:          w,
+	}
+}
+
+type streamReader struct {
+	req             *Request
+	transactionChan chan models.Message
+	// writer acknowledges the received chunks, it is nil if they are not acknowledged.
+	writer ResponseWriter
+	// received is the size of the content received so far and skip the size of the content that is sent again.
+	received int64
+	skip     int64
+	// chunk holds the part of the last chunk that was not read yet.
+	chunk []byte
+	ended bool
+}
+
+func (s *streamReader) Read(p []byte) (n int, err error) {
+	for len(s.chunk) == 0 {
+		if s.ended {
+			return 0, io.EOF
+		}
+		var message models.Message
+		select {
+		case <-s.req.Ctx.Done():
+			return 0, context.Cause(s.req.Ctx)
+		case message = <-s.transactionChan:
+		}
+		s.req.progress()
+		if message.Header.Action == enums.Resume {
+			err = s.resume(message)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if message.Header.Action != enums.Chunk {
+			return 0, fmt.Errorf("expected a chunk in the stream, got %s", message.Header.Action)
+		}
+		chunk, ok := message.Body.([]byte)
+		if !ok {
+			return 0, fmt.Errorf("expected bytes in the chunk")
+		}
+		s.ended = len(chunk) == 0
+		skipped := min(s.skip, int64(len(chunk)))
+		s.chunk, s.skip = chunk[skipped:], s.skip-skipped
+		if len(s.chunk) > 0 {
+			s.received += int64(len(s.chunk))
+			err = s.acknowledge()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	n = copy(p, s.chunk)
+	s.chunk = s.chunk[n:]
+	return n, nil
+}
+
+// resume continues the stream from the offset of the resume message.
+func (s *streamReader) resume(message models.Message) error {
+	offset, ok := message.Body.(models.StreamOffset)
+	if !ok || offset.Offset < 0 {
+		return fmt.Errorf("expected the offset to resume the stream from")
+	}
+	if offset.Offset > s.received {
+		return fmt.Errorf("%w: %d > %d", ErrResumeOffset, offset.Offset, s.received)
+	}
+	s.skip = s.received - offset.Offset
+	return s.acknowledge()
+}
+
+// acknowledge sends the received offset if the stream is acknowledged.
+func (s *streamReader) acknowledge() error {
+	if s.writer == nil {
+		return nil
+	}
+	return s.writer.Acknowledge(s.received)
+}
@@ -0,0 +1,124 @@
+package mux
+
+import (
+	"context"
+	"filesync/enums"
+	"filesync/models"
+	"io"
+)
+
+// StreamChunkSize is the maximum body size of a single chunk written by a response stream.
+const StreamChunkSize = 32 * 1024
+
+// ResponseWriter sends the responses of a request, echoing its action and transaction ID.
+type ResponseWriter interface {
+	// Reply sends a response with the given body.
+	Reply(body interface{}) error
+	// Error sends an error response with the given code and message.
+	Error(code enums.ErrorCode, msg string) error
+	// Stream returns a writer that sends the written bytes as chunk messages. Closing it sends an empty
+	// chunk to mark the end of the stream. Every chunk sent restarts the idle timeout of the request.
+	Stream() io.WriteCloser
+	// Acknowledge sends a chunk message with the offset of the content received from the client so far.
+	Acknowledge(offset int64) error
+}
+
+type responseWriter struct {
+	resChan chan models.Message
+	req     *Request
+}
+
+// NewResponseWriter creates a ResponseWriter that queues the responses to the request on resChan.
+func NewResponseWriter(resChan chan models.Message, req *Request) ResponseWriter {
+	return &responseWriter{
+		resChan,
+		req,
+	}
+}
+
+func (w *responseWriter) Reply(body interface{}) error {
+	return w.send(w.req.Message.Header.Action, body)
+}
+
+func (w *responseWriter) Error(code enums.ErrorCode, msg string) error {
+	return w.send(enums.Error, models.ErrorResponse{
+		Code:    code,
+		Message: msg,
+	})
+}
+
+func (w *responseWriter) Stream() io.WriteCloser {
+	return &streamWriter{
+		w,
+		make([]byte, 0, StreamChunkSize),
+	}
+}
+
+func (w *responseWriter) Acknowledge(offset int64) error {
+	return w.send(enums.Chunk, models.StreamOffset{Offset: offset})
+}
+
+// send queues a response unless the request has been cancelled.
+func (w *responseWriter) send(action enums.MessageType, body interface{}) error {
+	message := models.Message{
+		Header: models.Header{
+			Action:        action,
+			Sender:        enums.Server,
+			TransactionID: w.req.Message.Header.TransactionID,
+		},
+		Body: body,
+	}
+	select {
+	case <-w.req.Ctx.Done():
+		return context.Cause(w.req.Ctx)
+	case w.resChan <- message:
+		return nil
+	}
+}
+
+type streamWriter struct {
+	writer *responseWriter
+	buf    []byte
+}
+
+func (s *streamWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		free := StreamChunkSize - len(s.buf)
+		if free > len(p) {
+			free = len(p)
+		}
+		s.buf = append(s.buf, p[:free]...)
+		p = p[free:]
+		n += free
+		if len(s.buf) == StreamChunkSize {
+			err = s.flush()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (s *streamWriter) Close() error {
+	if len(s.buf) > 0 {
+		err := s.flush()
+		if err != nil {
+			return err
+		}
+	}
+	return s.writer.send(enums.Chunk, []byte{})
+}
+
+// flush sends the buffered bytes as a chunk.
+func (s *streamWriter) flush() error {
+	chunk := make([]byte, len(s.buf))
+	copy(chunk, s.buf)
+	s.buf = s.buf[:0]
+	err := s.writer.send(enums.Chunk, chunk)
+	if err != nil {
+		return err
+	}
+	s.writer.req.progress()
+	return nil
+}
@@ -0,0 +1,114 @@
+package notifier
+
+import (
+	"filesync/enums"
+	"filesync/models"
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+// Subscriber receives the file changes of a user made by the user's other sessions.
+type Subscriber struct {
+	Username  string
+	SessionID string
+	Changes   chan models.FileChange
+}
+
+type Hub interface {
+	// Subscribe registers the session as a subscriber to the changes of the user. If the session is already
+	// subscribed, the existing subscriber is returned and created is false.
+	Subscribe(username string, sessionID string) (subscriber *Subscriber, created bool)
+	// Unsubscribe removes the session from the subscribers of the user and closes its channel.
+	Unsubscribe(username string, sessionID string)
+	// Publish sends the change to every subscribed session of the user except the origin session.
+	Publish(username string, originSessionID string, change models.FileChange)
+}
+
+type concreteHub struct {
+	subscribers map[string]map[string]*Subscriber
+	mutex       sync.Mutex
+	bufferSize  int
+}
+
+// NewHub creates a new hub where every subscriber buffers up to bufferSize changes.
+func NewHub(bufferSize int) Hub {
+	return &concreteHub{
+		make(map[string]map[string]*Subscriber),
+		sync.Mutex{},
+		bufferSize,
+	}
+}
+
+func (h *concreteHub) Subscribe(username string, sessionID string) (subscriber *Subscriber, created bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	sessions, ok := h.subscribers[username]
+	if !ok {
+		sessions = make(map[string]*Subscriber)
+		h.subscribers[username] = sessions
+	}
+	if subscriber, exists := sessions[sessionID]; exists {
+		return subscriber, false
+	}
+	subscriber = &Subscriber{
+		username,
+		sessionID,
+		make(chan models.FileChange, h.bufferSize),
+	}
+	sessions[sessionID] = subscriber
+	return subscriber, true
+}
+
+func (h *concreteHub) Unsubscribe(username string, sessionID string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	sessions, ok := h.subscribers[username]
+	if !ok {
+		return
+	}
+	subscriber, ok := sessions[sessionID]
+	if !ok {
+		return
+	}
+	close(subscriber.Changes)
+	delete(sessions, sessionID)
+	if len(sessions) == 0 {
+		delete(h.subscribers, username)
+	}
+}
+
+func (h *concreteHub) Publish(username string, originSessionID string, change models.FileChange) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for sessionID, subscriber := range h.subscribers[username] {
+		if sessionID == originSessionID {
+			continue
+		}
+		select {
+		case subscriber.Changes <- change:
+		default:
+			log.Warnf("Change buffer of session %s is full, requesting resync", sessionID)
+			overflow(subscriber)
+		}
+	}
+}
+
+// overflow replaces the buffered changes of the subscriber with a single resync signal,
+// since the subscriber can no longer rebuild its view from the individual changes.
+func overflow(subscriber *Subscriber) {
+drain:
+	for {
+		select {
+		case <-subscriber.Changes:
+		default:
+			break drain
+		}
+	}
+	select {
+	case subscriber.Changes <- models.FileChange{Operation: enums.ResyncNeeded}:
+	default:
+	}
+}
@@ -0,0 +1,63 @@
+package notifier_test
+
+import (
+	"filesync/enums"
+	"filesync/models"
+	"github.com/stretchr/testify/assert"
+	"server/pkg/notifier"
+	"testing"
+)
+
+const (
+	testUser1 = "test1"
+	testUser2 = "test2"
+)
+
+var testChange = models.FileChange{
+	Hash:      "hash1234",
+	Checksum:  "checksum123456789012345678901234",
+	Operation: enums.FileCreated,
+}
+
+func TestPublish_SkipsOrigin(t *testing.T) {
+	hub := notifier.NewHub(4)
+	origin, _ := hub.Subscribe(testUser1, "session1")
+	other, _ := hub.Subscribe(testUser1, "session2")
+	otherUser, _ := hub.Subscribe(testUser2, "session3")
+
+	hub.Publish(testUser1, "session1", testChange)
+
+	assert.Len(t, origin.Changes, 0, "Expected origin session not to be notified")
+	assert.Len(t, otherUser.Changes, 0, "Expected other users not to be notified")
+	assert.Equal(t, testChange, <-other.Changes)
+}
+
+func TestPublish_Overflow(t *testing.T) {
+	hub := notifier.NewHub(2)
+	subscriber, _ := hub.Subscribe(testUser1, "session1")
+
+	for i := 0; i < 3; i++ {
+		hub.Publish(testUser1, "session2", testChange)
+	}
+
+	assert.Len(t, subscriber.Changes, 1)
+	change := <-subscriber.Changes
+	assert.Equal(t, enums.ResyncNeeded, change.Operation)
+}
+
+func TestUnsubscribe(t *testing.T) {
+	hub := notifier.NewHub(2)
+	subscriber, created := hub.Subscribe(testUser1, "session1")
+	assert.True(t, created)
+	again, created := hub.Subscribe(testUser1, "session1")
+	assert.False(t, created)
+	assert.Same(t, subscriber, again)
+
+	hub.Unsubscribe(testUser1, "session1")
+	_, ok := <-subscriber.Changes
+	assert.False(t, ok, "Expected changes channel to be closed")
+
+	// Publishing after unsubscribing must not panic on the closed channel.
+	hub.Publish(testUser1, "session2", testChange)
+	hub.Unsubscribe(testUser1, "session1")
+}
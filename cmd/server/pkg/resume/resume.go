@@ -0,0 +1,167 @@
+package resume
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"server/pkg/session"
+	"sync"
+	"time"
+)
+
+// TokenSize is the size of a resumption token in bytes.
+const TokenSize = 32
+
+var ErrInvalidToken = errors.New("invalid resumption token")
+
+type Config struct {
+	// TTL is how long a session stays resumable after its connection dropped.
+	TTL time.Duration
+}
+
+type Store interface {
+	// Issue creates a resumption token for the session attached to a connection. detach is called to close
+	// the connection if the session is resumed elsewhere before the drop is noticed.
+	Issue(sessionData *session.Session, detach func()) (token []byte, err error)
+	// Claim reserves the token of an open session of the user on the device for one resumption, it returns false if
+	// the token does not resume such a session or was claimed already. A claim that is not redeemed keeps the token
+	// from being used again, the session still expires once it is parked.
+	Claim(token []byte, username string, device string) bool
+	// Resume redeems the claimed token and returns its session. The token can not be used again.
+	Resume(token []byte, username string) (*session.Session, error)
+	// Park keeps the session of a dropped connection resumable for the configured TTL and closes it afterwards.
+	// It returns false if the token is unknown, in which case the caller is responsible for closing the session.
+	Park(token []byte) bool
+	// Revoke invalidates the token without closing its session.
+	Revoke(token []byte)
+}
+
+type entry struct {
+	session *session.Session
+	// device is the device the session was opened on, the token only resumes the session on the same device.
+	device  string
+	detach  func()
+	timer   *time.Timer
+	claimed bool
+}
+
+type concreteStore struct {
+	config   *Config
+	mutex    sync.Mutex
+	entries  map[string]*entry
+	redeemed map[string]struct{}
+}
+
+func New(config *Config) Store {
+	return &concreteStore{
+		config,
+		sync.Mutex{},
+		make(map[string]*entry),
+		make(map[string]struct{}),
+	}
+}
+
+func (s *concreteStore) Issue(sessionData *session.Session, detach func()) (token []byte, err error) {
+	token = make([]byte, TokenSize)
+	_, err = rand.Read(token)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var device string
+	if sessionData.Principal != nil {
+		device = sessionData.Principal.Device
+	}
+	s.entries[hex.EncodeToString(token)] = &entry{
+		session: sessionData,
+		device:  device,
+		detach:  detach,
+	}
+	return token, nil
+}
+
+func (s *concreteStore) Claim(token []byte, username string, device string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	e, ok := s.entries[hex.EncodeToString(token)]
+	if !ok || e.claimed || e.session.Username != username || e.device != device || e.session.Context().Err() != nil {
+		return false
+	}
+	e.claimed = true
+	return true
+}
+
+func (s *concreteStore) Resume(token []byte, username string) (*session.Session, error) {
+	key := hex.EncodeToString(token)
+
+	s.mutex.Lock()
+	e, ok := s.entries[key]
+	// A session closed while it was parked, e.g. because its device was revoked, can not be resumed.
+	if !ok || !e.claimed || e.session.Username != username || e.session.Context().Err() != nil {
+		s.mutex.Unlock()
+		return nil, ErrInvalidToken
+	}
+	delete(s.entries, key)
+	e.session.SetParked(false)
+	attached := e.timer == nil
+	if attached {
+		// The old connection has not noticed the drop yet, remember the redemption so it does not close the session.
+		s.redeemed[key] = struct{}{}
+	} else {
+		e.timer.Stop()
+	}
+	s.mutex.Unlock()
+
+	if attached {
+		e.detach()
+	}
+	log.Debugf("Resumed session %s of user %s", e.session.ID, username)
+	return e.session, nil
+}
+
+func (s *concreteStore) Park(token []byte) bool {
+	key := hex.EncodeToString(token)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.redeemed[key]; ok {
+		delete(s.redeemed, key)
+		return true
+	}
+	e, ok := s.entries[key]
+	if !ok {
+		return false
+	}
+	e.session.SetParked(true)
+	e.timer = time.AfterFunc(s.config.TTL, func() {
+		s.expire(key, e)
+	})
+	log.Debugf("Parked session %s for %s", e.session.ID, s.config.TTL)
+	return true
+}
+
+func (s *concreteStore) Revoke(token []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.entries, hex.EncodeToString(token))
+}
+
+// expire closes the parked session if it was not resumed in time.
+func (s *concreteStore) expire(key string, e *entry) {
+	s.mutex.Lock()
+	current, ok := s.entries[key]
+	if !ok || current != e {
+		s.mutex.Unlock()
+		return
+	}
+	delete(s.entries, key)
+	s.mutex.Unlock()
+
+	log.Debugf("Resumption of session %s expired", e.session.ID)
+	e.session.Close()
+}
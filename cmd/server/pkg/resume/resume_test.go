@@ -0,0 +1,133 @@
+package resume_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"server/pkg/resume"
+	"server/pkg/session"
+	"server/services/auth"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testUser = "test1"
+
+func newTestSession() *session.Session {
+	s := &session.Session{
+		ID:           "session1",
+		Username:     testUser,
+		Transactions: &sync.Map{},
+		Requests:     &sync.Map{},
+	}
+	s.Open(context.Background())
+	return s
+}
+
+func TestResume_Parked(t *testing.T) {
+	store := resume.New(&resume.Config{TTL: time.Minute})
+	sessionData := newTestSession()
+
+	token, err := store.Issue(sessionData, func() {
+		t.Error("Expected parked session not to be detached")
+	})
+	assert.NoError(t, err)
+	assert.Len(t, token, resume.TokenSize)
+	assert.True(t, store.Park(token))
+	assert.True(t, sessionData.Parked(), "Expected the requests of a parked session to wait")
+
+	_, err = store.Resume(token, testUser)
+	assert.ErrorIs(t, err, resume.ErrInvalidToken, "Expected an unclaimed token to be rejected")
+	assert.False(t, store.Claim(token, "other", ""))
+	assert.False(t, store.Claim(token, testUser, "other-device"))
+	assert.True(t, store.Claim(token, testUser, ""))
+	assert.False(t, store.Claim(token, testUser, ""), "Expected a token to be claimed once")
+
+	resumed, err := store.Resume(token, testUser)
+	assert.NoError(t, err)
+	assert.Same(t, sessionData, resumed)
+	assert.NoError(t, resumed.Context().Err())
+	assert.False(t, resumed.Parked())
+
+	_, err = store.Resume(token, testUser)
+	assert.ErrorIs(t, err, resume.ErrInvalidToken, "Expected token to be single use")
+}
+
+func TestResume_Attached(t *testing.T) {
+	store := resume.New(&resume.Config{TTL: time.Minute})
+	sessionData := newTestSession()
+
+	detached := false
+	token, err := store.Issue(sessionData, func() {
+		detached = true
+	})
+	assert.NoError(t, err)
+
+	assert.True(t, store.Claim(token, testUser, ""))
+	_, err = store.Resume(token, testUser)
+	assert.NoError(t, err)
+	assert.True(t, detached, "Expected old connection to be detached")
+
+	// The old connection noticing the drop must not close the resumed session.
+	assert.True(t, store.Park(token))
+	assert.NoError(t, sessionData.Context().Err())
+}
+
+func TestResume_Closed(t *testing.T) {
+	store := resume.New(&resume.Config{TTL: time.Minute})
+	sessionData := newTestSession()
+
+	token, err := store.Issue(sessionData, func() {})
+	assert.NoError(t, err)
+	assert.True(t, store.Park(token))
+	sessionData.Close()
+
+	assert.False(t, store.Claim(token, testUser, ""), "Expected the token of a closed session to be rejected")
+	_, err = store.Resume(token, testUser)
+	assert.ErrorIs(t, err, resume.ErrInvalidToken)
+}
+
+func TestPark_Expired(t *testing.T) {
+	store := resume.New(&resume.Config{TTL: 10 * time.Millisecond})
+	sessionData := newTestSession()
+
+	token, err := store.Issue(sessionData, func() {})
+	assert.NoError(t, err)
+	assert.True(t, store.Park(token))
+
+	assert.Eventually(t, func() bool {
+		return sessionData.Context().Err() != nil
+	}, time.Second, 5*time.Millisecond, "Expected expired session to be closed")
+
+	_, err = store.Resume(token, testUser)
+	assert.ErrorIs(t, err, resume.ErrInvalidToken)
+}
+
+func TestPark_Revoked(t *testing.T) {
+	store := resume.New(&resume.Config{TTL: time.Minute})
+	sessionData := newTestSession()
+
+	token, err := store.Issue(sessionData, func() {})
+	assert.NoError(t, err)
+	store.Revoke(token)
+
+	assert.False(t, store.Park(token))
+	assert.False(t, store.Claim(token, testUser, ""))
+}
+
+func TestClaim_Device(t *testing.T) {
+	store := resume.New(&resume.Config{TTL: time.Minute})
+	sessionData := newTestSession()
+	sessionData.Principal = &auth.Principal{Username: testUser, Device: "laptop"}
+
+	token, err := store.Issue(sessionData, func() {})
+	assert.NoError(t, err)
+	assert.True(t, store.Park(token))
+
+	assert.False(t, store.Claim(token, testUser, ""), "Expected the token to be bound to the device")
+	assert.False(t, store.Claim(token, testUser, "phone"))
+	assert.True(t, store.Claim(token, testUser, "laptop"))
+	resumed, err := store.Resume(token, testUser)
+	assert.NoError(t, err)
+	assert.Same(t, sessionData, resumed)
+}
@@ -2,15 +2,69 @@ package session
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"filesync/enums"
 	"filesync/models"
+	"net"
+	"server/services/auth"
 	"server/services/file"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Session struct {
+	ID           string
 	Username     string
+	Principal    *auth.Principal
 	Transactions *sync.Map
+	Requests     *sync.Map
 	FileService  file.Service
+	// Responses queues the responses of the session. It outlives the connection while the session is resumable.
+	Responses  chan models.Message
+	StartTime  time.Time
+	BytesIn    atomic.Uint64
+	BytesOut   atomic.Uint64
+	remoteAddr atomic.Value
+	ctx        context.Context
+	cancel     context.CancelFunc
+	// parked is set while the session waits to be resumed without a connection.
+	parked atomic.Bool
+	// lastRequest numbers the requests, so a request that ended late does not remove a newer one with its ID.
+	lastRequest atomic.Uint64
+	// library is the library the session works on and unwatchLibrary stops publishing its changes.
+	libraryMutex   sync.Mutex
+	library        Library
+	unwatchLibrary func()
+}
+
+// Library is the set of files the requests of a session work on. The zero Library is the default files of the user.
+type Library struct {
+	// Share is the ID of a shared library and Name the name of a library of the user, at most one is set.
+	Share string
+	Name  string
+	// Files is the file service of the library, it is nil for the default files of the user.
+	Files file.Service
+}
+
+// request is an in-flight request, tracked so it can be cancelled by its transaction ID.
+type request struct {
+	generation uint64
+	action     enums.MessageType
+	startTime  time.Time
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// NewID generates a random session ID.
+func NewID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
 }
 
 func NewContext(ctx context.Context, session *Session) (context.Context, context.CancelFunc) {
@@ -23,6 +77,21 @@ func FromContext(ctx context.Context) (*Session, bool) {
 	return d, ok
 }
 
+// Open derives the session context from the parent context. It must be called before the session is used.
+func (d *Session) Open(parent context.Context) {
+	d.ctx, d.cancel = NewContext(parent, d)
+}
+
+// Context returns the session context, which is cancelled when the session is closed.
+func (d *Session) Context() context.Context {
+	return d.ctx
+}
+
+// Close cancels the session context, aborting every in-flight request of the session.
+func (d *Session) Close() {
+	d.cancel()
+}
+
 func (d *Session) GetTransaction(transactionID [32]byte) (chan models.Message, bool) {
 	if v, ok := d.Transactions.Load(transactionID); ok {
 		return v.(chan models.Message), true
@@ -35,3 +104,146 @@ func (d *Session) NewTransaction(transactionID [32]byte) chan models.Message {
 	d.Transactions.Store(transactionID, ch)
 	return ch
 }
+
+// AddRequest registers an in-flight request under its transaction ID. It returns the generation of the request, which
+// RemoveRequest takes to only remove this request.
+func (d *Session) AddRequest(transactionID [32]byte, action enums.MessageType, ctx context.Context, cancel context.CancelFunc) (generation uint64) {
+	generation = d.lastRequest.Add(1)
+	d.Requests.Store(transactionID, &request{generation, action, time.Now(), ctx, cancel})
+	return generation
+}
+
+// ListRequests returns the in-flight requests of the session.
+func (d *Session) ListRequests() []models.TransactionInfo {
+	var transactions []models.TransactionInfo
+	d.Requests.Range(func(key, value any) bool {
+		transactionID := key.([32]byte)
+		req := value.(*request)
+		transactions = append(transactions, models.TransactionInfo{
+			ID:        hex.EncodeToString(transactionID[:]),
+			Action:    req.action.String(),
+			StartTime: req.startTime,
+		})
+		return true
+	})
+	return transactions
+}
+
+// GetRequestContext returns the context of the in-flight request with the given transaction ID.
+func (d *Session) GetRequestContext(transactionID [32]byte) (context.Context, bool) {
+	if v, ok := d.Requests.Load(transactionID); ok {
+		return v.(*request).ctx, true
+	}
+	return nil, false
+}
+
+// CancelRequest cancels the in-flight request with the given transaction ID and drops its transaction.
+// It returns false if no such request exists.
+func (d *Session) CancelRequest(transactionID [32]byte) bool {
+	v, ok := d.Requests.LoadAndDelete(transactionID)
+	if !ok {
+		return false
+	}
+	d.Transactions.Delete(transactionID)
+	v.(*request).cancel()
+	return true
+}
+
+// RemoveRequest removes the request of the given generation and its transaction. A newer request that reuses the
+// transaction ID is kept.
+func (d *Session) RemoveRequest(transactionID [32]byte, generation uint64) {
+	v, ok := d.Requests.Load(transactionID)
+	if !ok || v.(*request).generation != generation {
+		return
+	}
+	if d.Requests.CompareAndDelete(transactionID, v) {
+		d.Transactions.Delete(transactionID)
+	}
+}
+
+// Select makes the session work on the files of the library. The unwatch function is called when another library
+// is selected or the session is closed.
+func (d *Session) Select(library Library, unwatch func()) {
+	var stop func() bool
+	if unwatch != nil {
+		stop = context.AfterFunc(d.ctx, unwatch)
+	}
+	d.libraryMutex.Lock()
+	previous := d.unwatchLibrary
+	d.library, d.unwatchLibrary = library, nil
+	if unwatch != nil {
+		d.unwatchLibrary = func() {
+			if stop() {
+				unwatch()
+			}
+		}
+	}
+	d.libraryMutex.Unlock()
+	if previous != nil {
+		previous()
+	}
+}
+
+// Selected returns the library the session works on.
+func (d *Session) Selected() Library {
+	d.libraryMutex.Lock()
+	defer d.libraryMutex.Unlock()
+	return d.library
+}
+
+// SetRemoteAddr records the address of the connection the session is attached to.
+func (d *Session) SetRemoteAddr(addr net.Addr) {
+	d.remoteAddr.Store(addr.String())
+}
+
+// SetParked records whether the session waits to be resumed without a connection.
+func (d *Session) SetParked(parked bool) {
+	d.parked.Store(parked)
+}
+
+// Parked returns whether the session waits to be resumed without a connection, its requests make no progress then.
+func (d *Session) Parked() bool {
+	return d.parked.Load()
+}
+
+// RemoteAddr returns the address of the last connection the session was attached to.
+func (d *Session) RemoteAddr() string {
+	addr, _ := d.remoteAddr.Load().(string)
+	return addr
+}
+
+// Info returns a description of the session for the admin interface.
+func (d *Session) Info() models.SessionInfo {
+	return models.SessionInfo{
+		ID:           d.ID,
+		Username:     d.Username,
+		RemoteAddr:   d.RemoteAddr(),
+		StartTime:    d.StartTime,
+		BytesIn:      d.BytesIn.Load(),
+		BytesOut:     d.BytesOut.Load(),
+		Transactions: d.ListRequests(),
+	}
+}
+
+// countingConn counts the bytes read and written on a connection towards the session.
+type countingConn struct {
+	net.Conn
+	session *Session
+}
+
+// NewCountingConn wraps the connection so its traffic is counted in the session statistics.
+func NewCountingConn(conn net.Conn, session *Session) net.Conn {
+	return &countingConn{conn, session}
+}
+
+func (c *countingConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.session.BytesIn.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	c.session.BytesOut.Add(uint64(n))
+	return n, err
+}
@@ -1 +1,125 @@
 package session_test
+
+import (
+	"context"
+	"filesync/enums"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"server/pkg/session"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testTransactionID = [32]byte{1, 2, 3}
+
+func newTestSession() *session.Session {
+	return &session.Session{
+		Transactions: &sync.Map{},
+		Requests:     &sync.Map{},
+	}
+}
+
+func TestCancelRequest(t *testing.T) {
+	s := newTestSession()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.AddRequest(testTransactionID, enums.Download, ctx, cancel)
+	s.NewTransaction(testTransactionID)
+
+	assert.True(t, s.CancelRequest(testTransactionID))
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+
+	_, found := s.GetTransaction(testTransactionID)
+	assert.False(t, found, "Expected transaction to be removed")
+	_, found = s.GetRequestContext(testTransactionID)
+	assert.False(t, found, "Expected request to be removed")
+}
+
+func TestCancelRequest_Unknown(t *testing.T) {
+	s := newTestSession()
+	otherCtx, otherCancel := context.WithCancel(context.Background())
+	defer otherCancel()
+	s.AddRequest([32]byte{9}, enums.Upload, otherCtx, otherCancel)
+
+	assert.False(t, s.CancelRequest(testTransactionID))
+	assert.NoError(t, otherCtx.Err(), "Expected other requests to be unaffected")
+}
+
+func TestRemoveRequest(t *testing.T) {
+	s := newTestSession()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancelled := s.AddRequest(testTransactionID, enums.Upload, ctx, cancel)
+	assert.True(t, s.CancelRequest(testTransactionID))
+
+	// The cancelled request ends after a new request reused its transaction ID.
+	current := s.AddRequest(testTransactionID, enums.Upload, ctx, cancel)
+	transaction := s.NewTransaction(testTransactionID)
+	s.RemoveRequest(testTransactionID, cancelled)
+	_, found := s.GetRequestContext(testTransactionID)
+	assert.True(t, found, "Expected the newer request to be kept")
+	kept, found := s.GetTransaction(testTransactionID)
+	assert.True(t, found, "Expected the transaction of the newer request to be kept")
+	assert.Equal(t, transaction, kept)
+
+	s.RemoveRequest(testTransactionID, current)
+	_, found = s.GetRequestContext(testTransactionID)
+	assert.False(t, found)
+	_, found = s.GetTransaction(testTransactionID)
+	assert.False(t, found)
+}
+
+func TestInfo(t *testing.T) {
+	s := newTestSession()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.AddRequest(testTransactionID, enums.Download, ctx, cancel)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := session.NewCountingConn(server, s)
+	defer conn.Close()
+	s.SetRemoteAddr(conn.RemoteAddr())
+
+	go func() {
+		buf := make([]byte, 5)
+		_, _ = client.Read(buf)
+		_, _ = client.Write([]byte("abc"))
+	}()
+	_, err := conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_, err = conn.Read(make([]byte, 3))
+	assert.NoError(t, err)
+
+	info := s.Info()
+	assert.Equal(t, uint64(3), info.BytesIn)
+	assert.Equal(t, uint64(5), info.BytesOut)
+	assert.Equal(t, "pipe", info.RemoteAddr)
+	assert.Len(t, info.Transactions, 1)
+	assert.Equal(t, "Download", info.Transactions[0].Action)
+}
+
+func TestSelect(t *testing.T) {
+	s := newTestSession()
+	s.Open(context.Background())
+	unwatched := make(chan string, 2)
+
+	s.Select(session.Library{Share: "share1"}, func() { unwatched <- "share1" })
+	assert.Equal(t, "share1", s.Selected().Share)
+	assert.Empty(t, unwatched)
+
+	s.Select(session.Library{Name: "photos"}, func() { unwatched <- "photos" })
+	assert.Equal(t, "share1", <-unwatched, "Expected the previous library to be unwatched")
+	assert.Equal(t, session.Library{Name: "photos"}, s.Selected())
+
+	s.Close()
+	assert.Eventually(t, func() bool {
+		return len(unwatched) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "photos", <-unwatched, "Expected the library to be unwatched when the session is closed")
+
+	// Selecting the default files after the session was closed does not unwatch twice.
+	s.Select(session.Library{}, nil)
+	assert.Equal(t, session.Library{}, s.Selected())
+	assert.Empty(t, unwatched)
+}
@@ -0,0 +1,163 @@
+package account
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"filesync/models"
+	"filesync/srp"
+	"fmt"
+	"server/services/user"
+)
+
+const (
+	// passwordSize and sharedKeySize are the sizes in bytes of generated credentials.
+	passwordSize  = 18
+	sharedKeySize = 32
+)
+
+// Service manages the accounts of the user store for operators. It backs the admin interface of a running server
+// and the admin CLI working directly on the data directory of a stopped server.
+type Service interface {
+	// List returns every user with its storage usage.
+	List() (users []models.UserInfo, err error)
+	// Create creates a user with a generated password or shared key and returns the credential.
+	Create(request models.UserRequest) (credential models.Credential, err error)
+	// Reset replaces the password or shared key of the user with a generated one and returns the credential.
+	Reset(username string) (credential models.Credential, err error)
+	// Delete disables the user and keeps its data for the grace period of the user store, after which it is purged.
+	Delete(username string) (err error)
+	// Restore undoes the deletion of a user that was not purged yet.
+	Restore(username string) (err error)
+	// Disable prevents the user from authenticating.
+	Disable(username string) (err error)
+	// Enable allows a disabled user to authenticate again.
+	Enable(username string) (err error)
+	// Usage returns the storage usage of the user and the quota it counts against.
+	Usage(username string) (usage models.Usage, err error)
+}
+
+type concreteService struct {
+	userService user.Service
+}
+
+func New(userService user.Service) Service {
+	return &concreteService{
+		userService: userService,
+	}
+}
+
+func (a *concreteService) List() (users []models.UserInfo, err error) {
+	users = make([]models.UserInfo, 0)
+	for _, username := range a.userService.List() {
+		var usage models.Usage
+		usage, err = a.Usage(username)
+		if err != nil {
+			return nil, err
+		}
+		_, _, password := a.userService.GetVerifier(username)
+		deleted, _ := a.userService.DeletedAt(username)
+		users = append(users, models.UserInfo{
+			Username: username,
+			Disabled: a.userService.IsDisabled(username),
+			Password: password,
+			Deleted:  deleted,
+			Usage:    usage,
+		})
+	}
+	return users, nil
+}
+
+func (a *concreteService) Create(request models.UserRequest) (credential models.Credential, err error) {
+	if request.Username == "" {
+		return models.Credential{}, fmt.Errorf("username is required")
+	}
+	credential, err = newCredential(request.Username, request.Password)
+	if err != nil {
+		return models.Credential{}, err
+	}
+	if request.Password {
+		var salt, verifier []byte
+		salt, verifier, err = srp.NewVerifier(request.Username, credential.Password)
+		if err != nil {
+			return models.Credential{}, err
+		}
+		err = a.userService.CreateWithVerifier(request.Username, salt, verifier)
+	} else {
+		err = a.userService.Create(request.Username, credential.SharedKey)
+	}
+	if err != nil {
+		return models.Credential{}, err
+	}
+	return credential, nil
+}
+
+func (a *concreteService) Reset(username string) (credential models.Credential, err error) {
+	if _, found := a.userService.GetStorageID(username); !found {
+		return models.Credential{}, fmt.Errorf("user not found")
+	}
+	// The user keeps the kind of credential it registered with.
+	_, _, password := a.userService.GetVerifier(username)
+	credential, err = newCredential(username, password)
+	if err != nil {
+		return models.Credential{}, err
+	}
+	if password {
+		var salt, verifier []byte
+		salt, verifier, err = srp.NewVerifier(username, credential.Password)
+		if err != nil {
+			return models.Credential{}, err
+		}
+		err = a.userService.SetVerifier(username, salt, verifier)
+	} else {
+		err = a.userService.SetSharedKey(username, credential.SharedKey)
+	}
+	if err != nil {
+		return models.Credential{}, err
+	}
+	return credential, nil
+}
+
+func (a *concreteService) Delete(username string) (err error) {
+	return a.userService.Delete(username)
+}
+
+func (a *concreteService) Restore(username string) (err error) {
+	return a.userService.Restore(username)
+}
+
+func (a *concreteService) Disable(username string) (err error) {
+	return a.userService.Disable(username)
+}
+
+func (a *concreteService) Enable(username string) (err error) {
+	return a.userService.Enable(username)
+}
+
+func (a *concreteService) Usage(username string) (usage models.Usage, err error) {
+	fileService, err := a.userService.GetFileService(username)
+	if err != nil {
+		return models.Usage{}, err
+	}
+	defer fileService.Close()
+	return fileService.Usage(), nil
+}
+
+// newCredential generates a random password or shared key for the user.
+func newCredential(username string, password bool) (credential models.Credential, err error) {
+	size := sharedKeySize
+	if password {
+		size = passwordSize
+	}
+	random := make([]byte, size)
+	_, err = rand.Read(random)
+	if err != nil {
+		return models.Credential{}, err
+	}
+	credential.Username = username
+	if password {
+		credential.Password = base64.RawURLEncoding.EncodeToString(random)
+	} else {
+		credential.SharedKey = random
+	}
+	return credential, nil
+}
@@ -0,0 +1,87 @@
+package account_test
+
+import (
+	"filesync/models"
+	"filesync/srp"
+	"github.com/stretchr/testify/assert"
+	"server/pkg/_mocks"
+	"server/services/account"
+	"server/services/file"
+	"server/services/user"
+	"testing"
+)
+
+func newTestService(t *testing.T) (account.Service, user.Service) {
+	userService := user.New(file.NewFactory(t.TempDir(), &_mocks.MockCache{}, &_mocks.MockCache{}))
+	return account.New(userService), userService
+}
+
+func TestCreate(t *testing.T) {
+	accountService, userService := newTestService(t)
+
+	credential, err := accountService.Create(models.UserRequest{Username: "alice"})
+	assert.NoError(t, err)
+	assert.Len(t, credential.SharedKey, 32)
+	assert.Empty(t, credential.Password)
+	sharedKey, _ := userService.GetSharedKey("alice")
+	assert.Equal(t, credential.SharedKey, sharedKey)
+
+	credential, err = accountService.Create(models.UserRequest{Username: "bob", Password: true})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, credential.Password)
+	salt, verifier, found := userService.GetVerifier("bob")
+	assert.True(t, found)
+	assert.Equal(t, srp.ComputeVerifier("bob", credential.Password, salt), verifier)
+
+	_, err = accountService.Create(models.UserRequest{Username: "bob"})
+	assert.Error(t, err)
+	_, err = accountService.Create(models.UserRequest{})
+	assert.Error(t, err)
+
+	users, err := accountService.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []models.UserInfo{{Username: "alice"}, {Username: "bob", Password: true}}, users)
+}
+
+func TestReset(t *testing.T) {
+	accountService, userService := newTestService(t)
+	created, err := accountService.Create(models.UserRequest{Username: "alice"})
+	assert.NoError(t, err)
+	storageID, _ := userService.GetStorageID("alice")
+
+	reset, err := accountService.Reset("alice")
+	assert.NoError(t, err)
+	assert.NotEqual(t, created.SharedKey, reset.SharedKey)
+	sharedKey, _ := userService.GetSharedKey("alice")
+	assert.Equal(t, reset.SharedKey, sharedKey)
+	resetID, _ := userService.GetStorageID("alice")
+	assert.Equal(t, storageID, resetID, "Expected the user to keep its files")
+
+	_, err = accountService.Create(models.UserRequest{Username: "bob", Password: true})
+	assert.NoError(t, err)
+	reset, err = accountService.Reset("bob")
+	assert.NoError(t, err)
+	salt, verifier, _ := userService.GetVerifier("bob")
+	assert.Equal(t, srp.ComputeVerifier("bob", reset.Password, salt), verifier)
+
+	_, err = accountService.Reset("missing")
+	assert.Error(t, err)
+}
+
+func TestDelete(t *testing.T) {
+	accountService, userService := newTestService(t)
+	_, err := accountService.Create(models.UserRequest{Username: "alice"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, accountService.Delete("alice"))
+	users, err := accountService.List()
+	assert.NoError(t, err)
+	assert.True(t, users[0].Disabled)
+	assert.False(t, users[0].Deleted.IsZero(), "Expected the user to be kept until it is purged")
+	assert.Error(t, accountService.Delete("alice"))
+
+	assert.NoError(t, accountService.Restore("alice"))
+	assert.False(t, userService.IsDisabled("alice"))
+	assert.Error(t, accountService.Restore("alice"))
+	assert.Error(t, accountService.Delete("missing"))
+}
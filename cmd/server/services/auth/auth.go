@@ -5,50 +5,209 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"filesync/enums"
 	"filesync/models"
+	"filesync/srp"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"server/pkg/audit"
+	"server/pkg/lockout"
+	"server/services/backend"
+	"server/services/device"
 	"server/services/file"
+	"server/services/registration"
+	"server/services/token"
 	"server/services/user"
+	"slices"
+	"time"
 )
 
 type Service interface {
-	AuthenticateClient(net.Conn) error
-	GetFileService() (file.Service, error)
-	IsAuthenticated() bool
-	GetUsername() string
+	// AuthenticateClient authenticates the client on the connection and returns its identity.
+	AuthenticateClient(net.Conn) (*Principal, error)
+	// GetFileService returns the file service of the authenticated user, or of the library the principal is
+	// restricted to.
+	GetFileService(principal *Principal) (file.Service, error)
+	// NewChallenge returns a fresh challenge for an authenticated client to prove its shared key.
+	NewChallenge() ([]byte, error)
+	// RotateKey replaces the shared key of the authenticated user once the response proves the current key.
+	RotateKey(principal *Principal, challenge []byte, response []byte, newKey []byte) error
+}
+
+var ErrChallengeFailed = errors.New("challenge failed")
+
+const (
+	// ChannelBindingLabel is the TLS exporter label of the keying material challenge responses are bound to.
+	ChannelBindingLabel = "EXPORTER-filesync-channel-binding"
+	// ChannelBindingSize is the size of the keying material in bytes.
+	ChannelBindingSize = 32
+)
+
+// Method is the way a client proved its identity.
+type Method string
+
+const (
+	MethodChallenge   Method = "challenge"
+	MethodResume      Method = "resume"
+	MethodCertificate Method = "certificate"
+	MethodPassword    Method = "password"
+	MethodToken       Method = "token"
+	MethodLogin       Method = "login"
+)
+
+// Principal is the identity of an authenticated connection.
+type Principal struct {
+	Username string
+	// Device identifies the client device, it is empty for clients that do not report one.
+	Device          string
+	Method          Method
+	AuthenticatedAt time.Time
+	// ResumptionToken is the token the client presented to resume a session, or nil if it answered the challenge.
+	ResumptionToken []byte
+	// SessionKey is the key agreed on by a password login, it is nil for the other methods.
+	SessionKey []byte
+	// TokenID identifies the API token the client logged in with.
+	TokenID string
+	// Scopes limits what a client that logged in with an API token may do, nil grants full access.
+	Scopes []enums.Scope
+	// Library restricts a client that logged in with an API token to the library of the user with this name, its
+	// files are the files of the session. It is empty for clients that are not restricted to a library.
+	Library string
+}
+
+// actionScopes is the scope an API token needs for each action. Actions missing here need full access.
+var actionScopes = map[enums.MessageType]enums.Scope{
+	enums.Status:        enums.ReadScope,
+	enums.List:          enums.ReadScope,
+	enums.Download:      enums.ReadScope,
+	enums.Subscribe:     enums.ReadScope,
+	enums.Unsubscribe:   enums.ReadScope,
+	enums.ListShares:    enums.ReadScope,
+	enums.SelectShare:   enums.ReadScope,
+	enums.ListLibraries: enums.ReadScope,
+	enums.SelectLibrary: enums.ReadScope,
+	enums.Upload:        enums.UploadScope,
+	enums.Chunk:         enums.UploadScope,
+	enums.Delete:        enums.DeleteScope,
+}
+
+// libraryActions are the actions that reach the files outside the session's library, a principal restricted to a
+// library may not perform them.
+var libraryActions = map[enums.MessageType]bool{
+	enums.ListShares:    true,
+	enums.SelectShare:   true,
+	enums.ListLibraries: true,
+	enums.SelectLibrary: true,
+}
+
+// Allows returns whether the principal may perform the action.
+func (p *Principal) Allows(action enums.MessageType) bool {
+	if p == nil {
+		return true
+	}
+	if p.Library != "" && libraryActions[action] {
+		return false
+	}
+	if p.Scopes == nil {
+		return true
+	}
+	scope, ok := actionScopes[action]
+	return ok && slices.Contains(p.Scopes, scope)
+}
+
+// Replaces returns whether the principal may replace existing files. The upload scope only allows adding files, so
+// replacing them needs full access.
+func (p *Principal) Replaces() bool {
+	return p == nil || p.Scopes == nil
+}
+
+// Sees returns whether the change is in the files the principal may access.
+func (p *Principal) Sees(change models.FileChange) bool {
+	return p == nil || p.Library == "" || (change.Share == "" && change.Library == p.Library)
+}
+
+// TokenValidator validates the resumption tokens clients present instead of answering the challenge. A claimed
+// token is reserved for the connection that claimed it, concurrent resumptions with the same token fail.
+type TokenValidator interface {
+	Claim(token []byte, username string, device string) bool
 }
 
 type Config struct {
 	ChallengeLen int
+	// TokenSize is the size of a resumption token in bytes.
+	TokenSize int
+	// CertificateField is the field of a verified client certificate that holds the username.
+	CertificateField CertificateField
+	// RequireDevice rejects clients that do not identify their device, so a revoked device cannot connect by leaving
+	// its device out. Clients with a certificate are identified by the certificate.
+	RequireDevice bool
 }
 
+// concreteService holds no per-connection state, so a single instance is shared by every connection.
 type concreteService struct {
-	userService   user.Service
-	config        *Config
-	authenticated bool
-	userName      string
+	userService         user.Service
+	registrationService registration.Service
+	tokenService        token.Service
+	tokenValidator      TokenValidator
+	authenticator       backend.Authenticator
+	deviceService       device.Service
+	failureTracker      lockout.Tracker
+	auditLog            audit.Logger
+	config              *Config
 }
 
-func New(userService user.Service, config *Config) Service {
+func New(userService user.Service, registrationService registration.Service, tokenService token.Service, tokenValidator TokenValidator, authenticator backend.Authenticator, deviceService device.Service, failureTracker lockout.Tracker, auditLog audit.Logger, config *Config) Service {
 	return &concreteService{
 		userService,
+		registrationService,
+		tokenService,
+		tokenValidator,
+		authenticator,
+		deviceService,
+		failureTracker,
+		auditLog,
 		config,
-		false,
-		"",
 	}
 }
 
-// AuthenticateClient authenticates the client, creating a new user if necessary.
-func (a *concreteService) AuthenticateClient(conn net.Conn) (err error) {
+// AuthenticateClient authenticates the client with its certificate or the challenge, registering a new user if the registration policy allows it.
+func (a *concreteService) AuthenticateClient(conn net.Conn) (principal *Principal, err error) {
+	principal, err = a.authenticateClient(conn)
+	if principal != nil {
+		a.auditLog.Record(models.AuditEntry{
+			Event:      audit.EventLogin,
+			Username:   principal.Username,
+			Device:     principal.Device,
+			RemoteAddr: conn.RemoteAddr().String(),
+			Method:     string(principal.Method),
+		})
+	}
+	return principal, err
+}
+
+func (a *concreteService) authenticateClient(conn net.Conn) (principal *Principal, err error) {
+	// Clients with a verified certificate skip the challenge.
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		principal, err = a.authenticateCertificate(tlsConn)
+		if err != nil || principal != nil {
+			return principal, err
+		}
+	}
+
+	// Addresses that are backing off or locked out are rejected before they get a challenge.
+	if a.failureTracker.Check("", conn.RemoteAddr()) != nil {
+		return nil, a.rejectLockedOut(conn, "")
+	}
+
 	var challenge []byte
 	challenge, err = generateChallenge(a.config.ChallengeLen)
-	log.Debugf("Generated challenge: %s", challenge)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	challengeMessage := models.Message{
 		Header: models.Header{
@@ -59,69 +218,108 @@ func (a *concreteService) AuthenticateClient(conn net.Conn) (err error) {
 	}
 	_, err = challengeMessage.Send(conn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var n int
 	var challengeResponseMessage models.Message
 	n, err = challengeResponseMessage.Receive(conn)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// The client may identify its device before it authenticates.
+	var clientDevice *models.DeviceInfo
+	if challengeResponseMessage.Header.Action == enums.Device {
+		clientDevice, err = parseDevice(challengeResponseMessage)
+		if err != nil {
+			return nil, err
+		}
+		n, err = challengeResponseMessage.Receive(conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The client may present a resumption token instead of answering the challenge.
+	if challengeResponseMessage.Header.Action == enums.Resume {
+		principal, err = a.resumeClient(conn, challengeResponseMessage, clientDevice)
+		if err != nil || principal != nil {
+			return principal, err
+		}
+		// Resumption was rejected, the client falls back to answering the challenge or a password login.
+		n, err = challengeResponseMessage.Receive(conn)
+		if err != nil {
+			return nil, err
+		}
 	}
-	if n < 1+sha256.Size {
-		return fmt.Errorf("expected at least %d bytes in challengeResponseMessage, got %d", 1+sha256.Size, n)
+
+	// The client may log in with a password, an API token or the authentication backends instead of answering the challenge.
+	switch challengeResponseMessage.Header.Action {
+	case enums.Password:
+		return a.passwordLogin(conn, challengeResponseMessage, clientDevice)
+	case enums.Token:
+		return a.tokenLogin(conn, challengeResponseMessage, clientDevice)
+	case enums.Login:
+		return a.backendLogin(conn, challengeResponseMessage, clientDevice)
+	}
+
+	body, ok := challengeResponseMessage.Body.([]byte)
+	if !ok || n < 1+sha256.Size || len(body) < 1+sha256.Size {
+		return nil, fmt.Errorf("expected at least %d bytes in challengeResponseMessage, got %d", 1+sha256.Size, n)
+	}
+	challengeResponse := body[0:sha256.Size]
+	userName := string(body[sha256.Size:])
+	log.Debugf("Received challenge response of user %s", userName)
+
+	if a.failureTracker.Check(userName, conn.RemoteAddr()) != nil {
+		return nil, a.rejectLockedOut(conn, userName)
 	}
-	challengeResponse := challengeResponseMessage.Body.([]byte)[0:sha256.Size]
-	userName := string(challengeResponseMessage.Body.([]byte)[sha256.Size:])
-	log.Debugf("Received challenge response, response: %s, username: %s", string(challengeResponse), userName)
 
 	// Get the shared key for the user.
 	sharedKey, found := a.userService.GetSharedKey(userName)
-	// If the user is not found, create a new user and receive the shared key.
+	// If the user is not found, register a new user if the registration policy allows it.
 	if !found {
-		log.Debugf("User %s not found, creating new user", userName)
-		newUserMessage := models.Message{
-			Header: models.Header{
-				Action: enums.Auth,
-				Sender: enums.Server,
-			},
-			Body: enums.NewUser,
-		}
-		_, err = newUserMessage.Send(conn)
+		log.Debugf("User %s not found, registering new user", userName)
+		sharedKey, err = a.registerClient(conn, userName, 0)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		var sharedKeyMessage models.Message
-		_, err = sharedKeyMessage.Receive(conn)
-		if err != nil {
-			return err
-		}
-		sharedKey = sharedKeyMessage.Body.([]byte)
 		err = a.userService.Create(userName, sharedKey)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		log.Debugf("Created new user %s", userName)
+		a.record(conn, audit.EventRegister, userName, MethodChallenge, "")
+		log.Debugf("Registered new user %s", userName)
 	}
 
-	// Compare the expected response with the received response.
+	// The response covers the TLS session, so a response relayed from another TLS session does not match.
+	var binding []byte
+	binding, err = ChannelBinding(conn)
+	if err != nil {
+		return nil, err
+	}
+	// Compare the expected response with the received response in constant time.
 	var expectedResponse []byte
-	expectedResponse, err = CalculateResponse(challenge, sharedKey)
-	if !bytes.Equal(expectedResponse, challengeResponse) {
-		// Send the authenticated message to the client.
-		authFailedMessage := models.Message{
-			Header: models.Header{
-				Action: enums.Auth,
-				Sender: enums.Server,
-			},
-			Body: enums.Unauthorized,
-		}
-		_, err = authFailedMessage.Send(conn)
+	expectedResponse, err = CalculateResponse(challenge, sharedKey, binding)
+	if err != nil {
+		return nil, err
+	}
+	// Users registered with a password have no shared key and cannot answer the challenge.
+	if len(sharedKey) == 0 || !hmac.Equal(expectedResponse, challengeResponse) {
+		a.recordFailure(conn, userName, MethodChallenge, "invalid challenge response")
+		err = sendResult(conn, enums.Unauthorized)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		log.Debugf("Authentication failed for user %s", userName)
-		return fmt.Errorf("challenge failed")
+		return nil, ErrChallengeFailed
+	}
+	a.failureTracker.Success(userName)
+
+	err = a.admit(conn, userName, clientDevice, fingerprint("key", sharedKey))
+	if err != nil {
+		return nil, err
 	}
 
 	// Send the authenticated message to the client.
@@ -133,31 +331,537 @@ func (a *concreteService) AuthenticateClient(conn net.Conn) (err error) {
 		Body: enums.Authenticated,
 	}
 	_, err = authenticatedMessage.Send(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Authenticated user %s", userName)
+
+	return &Principal{
+		Username:        userName,
+		Device:          deviceID(clientDevice),
+		Method:          MethodChallenge,
+		AuthenticatedAt: time.Now(),
+	}, nil
+}
+
+// GetFileService returns the file service of the authenticated user, or of the library the principal is
+// restricted to.
+func (a *concreteService) GetFileService(principal *Principal) (file.Service, error) {
+	if principal == nil {
+		return nil, fmt.Errorf("not authenticated")
+	}
+	if principal.Library != "" {
+		return a.userService.GetLibraryService(principal.Username, principal.Library)
+	}
+	return a.userService.GetFileService(principal.Username)
+}
+
+func (a *concreteService) NewChallenge() ([]byte, error) {
+	return generateChallenge(a.config.ChallengeLen)
+}
+
+func (a *concreteService) RotateKey(principal *Principal, challenge []byte, response []byte, newKey []byte) error {
+	if principal == nil {
+		return fmt.Errorf("not authenticated")
+	}
+	if len(newKey) == 0 {
+		return fmt.Errorf("empty shared key")
+	}
+	sharedKey, found := a.userService.GetSharedKey(principal.Username)
+	if !found {
+		return fmt.Errorf("user not found")
+	}
+	if len(sharedKey) == 0 {
+		return fmt.Errorf("user has no shared key")
+	}
+	// The challenge was issued inside the authenticated session, so it needs no channel binding.
+	expectedResponse, err := CalculateResponse(challenge, sharedKey, nil)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expectedResponse, response) {
+		log.Debugf("Key rotation failed for user %s", principal.Username)
+		return ErrChallengeFailed
+	}
+
+	err = a.userService.SetSharedKey(principal.Username, newKey)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Rotated shared key of user %s", principal.Username)
+	return nil
+}
+
+// passwordLogin authenticates the client with SRP-6a, the message body is the client public key followed by the username.
+// The server replies with the salt and its public key, the client sends its proof and receives the server proof.
+func (a *concreteService) passwordLogin(conn net.Conn, loginMessage models.Message, clientDevice *models.DeviceInfo) (principal *Principal, err error) {
+	body, _ := loginMessage.Body.([]byte)
+	if len(body) <= srp.KeySize {
+		return nil, fmt.Errorf("expected more than %d bytes in password login message, got %d", srp.KeySize, len(body))
+	}
+	clientPublicKey := body[:srp.KeySize]
+	userName := string(body[srp.KeySize:])
+
+	if a.failureTracker.Check(userName, conn.RemoteAddr()) != nil {
+		return nil, a.rejectLockedOut(conn, userName)
+	}
+
+	salt, verifier, found := a.userService.GetVerifier(userName)
+	if !found {
+		if _, exists := a.userService.GetSharedKey(userName); exists {
+			err = sendResult(conn, enums.Unauthorized)
+			if err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("user %s has no password", userName)
+		}
+		// The new user registers with the salt followed by the verifier, the password never leaves the client.
+		log.Debugf("User %s not found, registering new user", userName)
+		var credential []byte
+		credential, err = a.registerClient(conn, userName, srp.SaltSize+srp.KeySize)
+		if err != nil {
+			return nil, err
+		}
+		salt, verifier = credential[:srp.SaltSize], credential[srp.SaltSize:]
+		err = a.userService.CreateWithVerifier(userName, salt, verifier)
+		if err != nil {
+			return nil, err
+		}
+		a.record(conn, audit.EventRegister, userName, MethodPassword, "")
+		log.Debugf("Registered new user %s", userName)
+	}
+
+	var server *srp.Server
+	server, err = srp.NewServer(userName, salt, verifier, clientPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	err = sendPassword(conn, append(append([]byte{}, salt...), server.PublicKey()...))
+	if err != nil {
+		return nil, err
+	}
+
+	var proofMessage models.Message
+	_, err = proofMessage.Receive(conn)
+	if err != nil {
+		return nil, err
+	}
+	clientProof, _ := proofMessage.Body.([]byte)
+	var serverProof []byte
+	serverProof, err = server.Verify(clientProof)
+	if err != nil {
+		a.recordFailure(conn, userName, MethodPassword, "invalid password proof")
+		err = sendResult(conn, enums.Unauthorized)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("Password login failed for user %s", userName)
+		return nil, ErrChallengeFailed
+	}
+	a.failureTracker.Success(userName)
+
+	err = a.admit(conn, userName, clientDevice, fingerprint("verifier", verifier))
+	if err != nil {
+		return nil, err
+	}
+
+	err = sendPassword(conn, serverProof)
+	if err != nil {
+		return nil, err
+	}
+	err = sendResult(conn, enums.Authenticated)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Authenticated user %s with password", userName)
+	return &Principal{
+		Username:        userName,
+		Device:          deviceID(clientDevice),
+		Method:          MethodPassword,
+		AuthenticatedAt: time.Now(),
+		SessionKey:      server.SessionKey(),
+	}, nil
+}
+
+// tokenLogin authenticates the client with an API token, the message body is the token.
+func (a *concreteService) tokenLogin(conn net.Conn, loginMessage models.Message, clientDevice *models.DeviceInfo) (principal *Principal, err error) {
+	body, _ := loginMessage.Body.([]byte)
+	var info models.TokenInfo
+	info, err = a.tokenService.Validate(string(body))
+	if err != nil {
+		// The owner of an invalid token is unknown, so the failure only counts towards the address.
+		a.recordFailure(conn, info.Username, MethodToken, err.Error())
+		sendErr := sendResult(conn, enums.Unauthorized)
+		if sendErr != nil {
+			return nil, sendErr
+		}
+		log.Debugf("Token login from %s failed: %s", conn.RemoteAddr().String(), err)
+		return nil, err
+	}
+	if a.failureTracker.Check(info.Username, conn.RemoteAddr()) != nil {
+		return nil, a.rejectLockedOut(conn, info.Username)
+	}
+	// The library of a restricted token may have been deleted since the token was minted.
+	if info.Library != "" {
+		if _, found := a.userService.GetLibrary(info.Username, info.Library); !found {
+			a.record(conn, audit.EventLoginFailed, info.Username, MethodToken, "token library not found")
+			err = sendResult(conn, enums.Unauthorized)
+			if err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("library %s of token %s not found", info.Library, info.ID)
+		}
+	}
+	err = a.admit(conn, info.Username, clientDevice, "token:"+info.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sendResult(conn, enums.Authenticated)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Authenticated user %s with token %s", info.Username, info.Name)
+	return &Principal{
+		Username:        info.Username,
+		Device:          deviceID(clientDevice),
+		Method:          MethodToken,
+		AuthenticatedAt: time.Now(),
+		TokenID:         info.ID,
+		Scopes:          info.Scopes,
+		Library:         info.Library,
+	}, nil
+}
+
+// backendLogin authenticates the client against the authentication backends, the message body is the password,
+// a zero byte and the username. Users the backends recognise are provisioned in the user store on their first login.
+func (a *concreteService) backendLogin(conn net.Conn, loginMessage models.Message, clientDevice *models.DeviceInfo) (principal *Principal, err error) {
+	body, _ := loginMessage.Body.([]byte)
+	separator := bytes.LastIndexByte(body, 0)
+	if separator < 0 || separator == len(body)-1 {
+		return nil, fmt.Errorf("expected password and username in login message")
+	}
+	password := string(body[:separator])
+	userName := string(body[separator+1:])
+
+	if a.failureTracker.Check(userName, conn.RemoteAddr()) != nil {
+		return nil, a.rejectLockedOut(conn, userName)
+	}
+
+	err = ErrChallengeFailed
+	var backendName string
+	if a.authenticator != nil {
+		backendName, err = a.authenticator.Authenticate(userName, password)
+	}
+	if err != nil {
+		a.recordFailure(conn, userName, MethodLogin, err.Error())
+		sendErr := sendResult(conn, enums.Unauthorized)
+		if sendErr != nil {
+			return nil, sendErr
+		}
+		log.Debugf("Backend login failed for user %s: %s", userName, err)
+		return nil, err
+	}
+	a.failureTracker.Success(userName)
+
+	err = a.provisionUser(conn, userName, MethodLogin, backendName)
+	if err != nil {
+		return nil, err
+	}
+	// The backends keep the password, the device is bound to the account key that resetting the user replaces.
+	accountKey, _ := a.userService.GetSharedKey(userName)
+	err = a.admit(conn, userName, clientDevice, fingerprint("key", accountKey))
+	if err != nil {
+		return nil, err
+	}
+
+	err = sendResult(conn, enums.Authenticated)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Authenticated user %s with the authentication backends", userName)
+	return &Principal{
+		Username:        userName,
+		Device:          deviceID(clientDevice),
+		Method:          MethodLogin,
+		AuthenticatedAt: time.Now(),
+	}, nil
+}
+
+// sendPassword sends a step of the password login to the client.
+func sendPassword(conn net.Conn, body []byte) (err error) {
+	passwordMessage := models.Message{
+		Header: models.Header{
+			Action: enums.Password,
+			Sender: enums.Server,
+		},
+		Body: body,
+	}
+	_, err = passwordMessage.Send(conn)
+	return err
+}
+
+// resumeClient authenticates the client with a resumption token, the message body is the token followed by the username.
+// The token only resumes a session of the same device. It returns a nil principal if the resumption was rejected.
+func (a *concreteService) resumeClient(conn net.Conn, resumeMessage models.Message, clientDevice *models.DeviceInfo) (principal *Principal, err error) {
+	body, ok := resumeMessage.Body.([]byte)
+	if !ok || len(body) <= a.config.TokenSize {
+		return nil, fmt.Errorf("expected more than %d bytes in resume message", a.config.TokenSize)
+	}
+	resumptionToken := body[:a.config.TokenSize]
+	userName := string(body[a.config.TokenSize:])
+
+	if a.failureTracker.Check(userName, conn.RemoteAddr()) != nil {
+		return nil, a.rejectLockedOut(conn, userName)
+	}
+
+	// Claiming the token reserves the session, so a concurrent resumption with the same token is rejected.
+	if a.tokenValidator == nil || !a.tokenValidator.Claim(resumptionToken, userName, deviceID(clientDevice)) {
+		a.recordFailure(conn, userName, MethodResume, "invalid resumption token")
+		err = sendResult(conn, enums.ResumeRejected)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("Rejected resumption for user %s", userName)
+		return nil, nil
+	}
+	a.failureTracker.Success(userName)
+
+	// The token is bound to the device, which proves the device without a credential.
+	err = a.admit(conn, userName, clientDevice, "")
+	if err != nil {
+		return nil, err
+	}
+	err = sendResult(conn, enums.Authenticated)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Resumed session of user %s", userName)
+	return &Principal{
+		Username:        userName,
+		Device:          deviceID(clientDevice),
+		Method:          MethodResume,
+		AuthenticatedAt: time.Now(),
+		ResumptionToken: resumptionToken,
+	}, nil
+}
+
+// registerClient checks the registration policy and returns the credential of the new user, the caller creates the user.
+// With the open policy the client sends the credential, with the invite policy the invite token followed by the credential.
+// A credentialSize of zero accepts a credential of any non-zero size.
+func (a *concreteService) registerClient(conn net.Conn, userName string, credentialSize int) (credential []byte, err error) {
+	policy := a.registrationService.GetPolicy()
+	if policy == registration.PolicyDisabled {
+		err = sendResult(conn, enums.RegistrationDisabled)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("Rejected registration of user %s, registration is disabled", userName)
+		return nil, fmt.Errorf("registration disabled")
+	}
+
+	result := enums.NewUser
+	if policy == registration.PolicyInvite {
+		result = enums.InviteRequired
+	}
+	err = sendResult(conn, result)
+	if err != nil {
+		return nil, err
+	}
+	var registrationMessage models.Message
+	_, err = registrationMessage.Receive(conn)
+	if err != nil {
+		return nil, err
+	}
+	credential, ok := registrationMessage.Body.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("expected bytes in registration message")
+	}
+	var invite []byte
+	if policy == registration.PolicyInvite {
+		if len(credential) < registration.InviteSize {
+			return nil, fmt.Errorf("expected at least %d bytes in registration message, got %d", registration.InviteSize, len(credential))
+		}
+		invite, credential = credential[:registration.InviteSize], credential[registration.InviteSize:]
+	}
+	if len(credential) == 0 || (credentialSize > 0 && len(credential) != credentialSize) {
+		return nil, fmt.Errorf("invalid credential of %d bytes in registration message", len(credential))
+	}
+
+	if policy == registration.PolicyInvite {
+		err = a.registrationService.RedeemInvite(string(invite))
+		if err != nil {
+			result = enums.InvalidInvite
+			if errors.Is(err, registration.ErrInviteExpired) {
+				result = enums.InviteExpired
+			}
+			sendErr := sendResult(conn, result)
+			if sendErr != nil {
+				return nil, sendErr
+			}
+			log.Debugf("Rejected registration of user %s: %s", userName, err)
+			return nil, err
+		}
+	}
+	return credential, nil
+}
+
+// provisionUser creates a user that was authenticated outside the user store by the provider, with a random shared key
+// it never uses. An existing user is only linked to the provider that created it.
+func (a *concreteService) provisionUser(conn net.Conn, userName string, method Method, provider string) error {
+	if existingProvider, found := a.userService.GetProvider(userName); found {
+		// A certificate signed by the client CA is issued for the account, any other provider only vouches for its own
+		// users and must not take over an account of the same name.
+		if method == MethodCertificate || existingProvider == provider {
+			return nil
+		}
+		a.record(conn, audit.EventLoginFailed, userName, method, fmt.Sprintf("account not provisioned by %s", provider))
+		err := sendResult(conn, enums.Unauthorized)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("account %s was not provisioned by %s", userName, provider)
+	}
+	sharedKey := make([]byte, 32)
+	_, err := rand.Read(sharedKey)
 	if err != nil {
 		return err
 	}
+	err = a.userService.Provision(userName, sharedKey, provider)
+	if err != nil {
+		return err
+	}
+	a.record(conn, audit.EventRegister, userName, method, "provisioned")
+	log.Debugf("Provisioned user %s", userName)
+	return nil
+}
 
-	a.userName = userName
-	a.authenticated = true
-	log.Debugf("Authenticated user %s", a.userName)
+// sendResult sends the authentication result to the client.
+func sendResult(conn net.Conn, result enums.AuthResult) (err error) {
+	resultMessage := models.Message{
+		Header: models.Header{
+			Action: enums.Auth,
+			Sender: enums.Server,
+		},
+		Body: result,
+	}
+	_, err = resultMessage.Send(conn)
+	return err
+}
 
+// admit rejects disabled users and revoked devices before the client is told it is authenticated, and records the
+// connection of the device with the credential it authenticated with.
+func (a *concreteService) admit(conn net.Conn, userName string, clientDevice *models.DeviceInfo, credential string) (err error) {
+	if a.userService.IsDisabled(userName) {
+		return a.rejectDisabled(conn, userName)
+	}
+	if clientDevice == nil {
+		if !a.config.RequireDevice {
+			return nil
+		}
+		err = sendResult(conn, enums.Unauthorized)
+		if err != nil {
+			return err
+		}
+		a.record(conn, audit.EventLoginFailed, userName, "", "device required")
+		log.Debugf("Rejected user %s without a device", userName)
+		return fmt.Errorf("device required")
+	}
+	err = a.deviceService.Seen(userName, *clientDevice, credential)
+	if err != nil {
+		result := enums.Unauthorized
+		if errors.Is(err, device.ErrDeviceRevoked) {
+			result = enums.DeviceRevoked
+		}
+		sendErr := sendResult(conn, result)
+		if sendErr != nil {
+			return sendErr
+		}
+		a.record(conn, audit.EventLoginFailed, userName, "", fmt.Sprintf("device %s: %s", clientDevice.ID, err))
+		log.Debugf("Rejected device %s of user %s: %s", clientDevice.ID, userName, err)
+		return err
+	}
 	return nil
 }
 
-// GetFileService returns the file service of the authenticated user.
-func (a *concreteService) GetFileService() (file.Service, error) {
-	if !a.authenticated {
-		return nil, fmt.Errorf("not authenticated")
+// parseDevice parses the device a client identifies itself with, the message body is the device ID, a zero byte,
+// the client version, a zero byte and the device name.
+func parseDevice(deviceMessage models.Message) (*models.DeviceInfo, error) {
+	body, _ := deviceMessage.Body.([]byte)
+	fields := bytes.SplitN(body, []byte{0}, 3)
+	if len(fields) != 3 || len(fields[0]) == 0 {
+		return nil, fmt.Errorf("expected device ID, client version and name in device message")
 	}
-	return a.userService.GetFileService(a.userName)
+	return &models.DeviceInfo{
+		ID:            string(fields[0]),
+		ClientVersion: string(fields[1]),
+		Name:          string(fields[2]),
+	}, nil
+}
+
+// fingerprint identifies a credential of the given kind without revealing it.
+func fingerprint(kind string, credential []byte) string {
+	sum := sha256.Sum256(credential)
+	return kind + ":" + hex.EncodeToString(sum[:])
 }
 
-func (a *concreteService) IsAuthenticated() bool {
-	return a.authenticated
+// deviceID returns the ID of the device, or an empty string for clients that did not identify their device.
+func deviceID(clientDevice *models.DeviceInfo) string {
+	if clientDevice == nil {
+		return ""
+	}
+	return clientDevice.ID
 }
 
-func (a *concreteService) GetUsername() string {
-	return a.userName
+// rejectDisabled tells the client that its user is disabled.
+func (a *concreteService) rejectDisabled(conn net.Conn, userName string) (err error) {
+	disabledMessage := models.Message{
+		Header: models.Header{
+			Action: enums.Auth,
+			Sender: enums.Server,
+		},
+		Body: enums.Disabled,
+	}
+	_, err = disabledMessage.Send(conn)
+	if err != nil {
+		return err
+	}
+	a.record(conn, audit.EventLoginFailed, userName, "", "user disabled")
+	log.Debugf("Rejected disabled user %s", userName)
+	return fmt.Errorf("user disabled")
+}
+
+// rejectLockedOut tells the client to wait before the next attempt.
+func (a *concreteService) rejectLockedOut(conn net.Conn, userName string) (err error) {
+	err = sendResult(conn, enums.LockedOut)
+	if err != nil {
+		return err
+	}
+	a.record(conn, audit.EventLockedOut, userName, "", "")
+	log.Debugf("Rejected locked out attempt from %s for user %s", conn.RemoteAddr().String(), userName)
+	return lockout.ErrLockedOut
+}
+
+// recordFailure counts a failed attempt of the user towards its lockout and records it in the audit log.
+func (a *concreteService) recordFailure(conn net.Conn, userName string, method Method, reason string) {
+	a.failureTracker.Failure(userName, conn.RemoteAddr())
+	a.record(conn, audit.EventLoginFailed, userName, method, reason)
+}
+
+// record records an authentication event of the client on the connection.
+func (a *concreteService) record(conn net.Conn, event string, userName string, method Method, detail string) {
+	a.auditLog.Record(models.AuditEntry{
+		Event:      event,
+		Username:   userName,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Method:     string(method),
+		Detail:     detail,
+	})
 }
 
 // generateChallenge generates a random challenge of the specified length.
@@ -172,8 +876,24 @@ func generateChallenge(length int) (challenge []byte, err error) {
 	return challenge, nil
 }
 
-// CalculateResponse calculates the expected response to the challenge using the shared key.
-func CalculateResponse(challenge []byte, sharedKey []byte) (response []byte, err error) {
+// ChannelBinding returns the keying material exported from the TLS session of the connection, which clients mix
+// into their challenge response. It returns nil for connections without TLS.
+func ChannelBinding(conn net.Conn) ([]byte, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	err := tlsConn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	return state.ExportKeyingMaterial(ChannelBindingLabel, nil, ChannelBindingSize)
+}
+
+// CalculateResponse calculates the expected response to the challenge using the shared key. The HMAC covers the
+// challenge followed by the channel binding of the connection, see ChannelBinding.
+func CalculateResponse(challenge []byte, sharedKey []byte, binding []byte) (response []byte, err error) {
 	challengeBytes := make([]byte, base64.StdEncoding.DecodedLen(len(challenge)))
 	_, err = base64.StdEncoding.Decode(challengeBytes, challenge)
 	if err != nil {
@@ -186,6 +906,10 @@ func CalculateResponse(challenge []byte, sharedKey []byte) (response []byte, err
 	if err != nil {
 		return nil, err
 	}
+	_, err = mac.Write(binding)
+	if err != nil {
+		return nil, err
+	}
 
 	return mac.Sum(nil), nil
 }
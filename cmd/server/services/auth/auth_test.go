@@ -1,16 +1,36 @@
 package auth_test
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"filesync/enums"
 	"filesync/models"
+	"filesync/srp"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"math/big"
 	"net"
 	"os"
+	"path/filepath"
+	"server/pkg/audit"
 	"server/pkg/cache"
+	"server/pkg/lockout"
 	"server/services/auth"
+	"server/services/backend"
+	"server/services/device"
 	"server/services/file"
+	"server/services/registration"
+	"server/services/token"
 	"server/services/user"
+	"sync"
 	"testing"
+	"time"
 )
 
 const (
@@ -19,17 +39,23 @@ const (
 )
 
 var (
-	userService        user.Service
-	authConfig         *auth.Config
-	fileServiceFactory file.Factory
-	client             net.Conn
-	server             net.Conn
+	userService         user.Service
+	registrationService registration.Service
+	failureTracker      lockout.Tracker
+	tokenService        token.Service
+	deviceService       device.Service
+	auditLog            audit.Logger
+	authConfig          *auth.Config
+	fileServiceFactory  file.Factory
+	client              net.Conn
+	server              net.Conn
 
 	// Test users
 	testUser1   = "test1"
 	testSecret1 = []byte("secret1")
 	testUser2   = "test2"
 	testSecret2 = []byte("secret2")
+	testToken   = []byte("token123456789012345678901234567")
 )
 
 func TestMain(m *testing.M) {
@@ -37,8 +63,18 @@ func TestMain(m *testing.M) {
 	metaCache := cache.NewCache(100)
 	fileServiceFactory = file.NewFactory(BaseDir, fileCache, metaCache)
 	userService = user.New(fileServiceFactory)
+	registrationService, _ = registration.New(&registration.Config{
+		Policy: registration.PolicyOpen,
+	})
+	// The zero config neither backs off nor locks out, the tests share the pipe address.
+	failureTracker = lockout.New(&lockout.Config{})
+	tokenService = token.New()
+	deviceService = device.New()
+	// The shared audit log is disabled, tests that check the audit log create their own.
+	auditLog, _ = audit.New(&audit.Config{})
 	authConfig = &auth.Config{
 		ChallengeLen: ChallengeLen,
+		TokenSize:    32,
 	}
 
 	client, server = net.Pipe()
@@ -54,53 +90,817 @@ func TestMain(m *testing.M) {
 func TestAuthenticateClientNewUser(t *testing.T) {
 	go testClient(client, t, testUser1, testSecret1)
 
-	authenticator := auth.New(userService, authConfig)
+	authenticator := auth.New(userService, registrationService, tokenService, nil, nil, deviceService, failureTracker, auditLog, authConfig)
 
-	err := authenticator.AuthenticateClient(server)
+	principal, err := authenticator.AuthenticateClient(server)
 	assert.NoError(t, err, "Error authenticating client")
-	assert.True(t, authenticator.IsAuthenticated(), "Expected authenticated to be true")
-	assert.Equal(t, testUser1, authenticator.GetUsername(), "Expected user name to be %s, got %s", testUser1, authenticator.GetUsername())
+	assert.NotNil(t, principal, "Expected principal")
+	assert.Equal(t, testUser1, principal.Username, "Expected user name to be %s, got %s", testUser1, principal.Username)
+	assert.Equal(t, auth.MethodChallenge, principal.Method)
 }
 
 // TestAuthenticateClientExistingUser tests the authentication of an existing user.
 func TestAuthenticateClientExistingUser(t *testing.T) {
 	go testClient(client, t, testUser1, testSecret1)
 
-	authenticator := auth.New(userService, authConfig)
+	authenticator := auth.New(userService, registrationService, tokenService, nil, nil, deviceService, failureTracker, auditLog, authConfig)
 
-	err := authenticator.AuthenticateClient(server)
+	principal, err := authenticator.AuthenticateClient(server)
 	assert.NoError(t, err, "Error authenticating client")
-	assert.True(t, authenticator.IsAuthenticated(), "Expected authenticated to be true")
-	assert.Equal(t, testUser1, authenticator.GetUsername(), "Expected user name to be %s, got %s", testUser1, authenticator.GetUsername())
+	assert.NotNil(t, principal, "Expected principal")
+	assert.Equal(t, testUser1, principal.Username, "Expected user name to be %s, got %s", testUser1, principal.Username)
+	assert.Equal(t, auth.MethodChallenge, principal.Method)
 }
 
 // TestAuthenticateClientFailed tests the authentication of a client with an incorrect secret.
 func TestAuthenticateClientFailed(t *testing.T) {
 	go testClient(client, t, testUser1, testSecret2)
 
-	authenticator := auth.New(userService, authConfig)
+	authenticator := auth.New(userService, registrationService, tokenService, nil, nil, deviceService, failureTracker, auditLog, authConfig)
 
-	err := authenticator.AuthenticateClient(server)
+	principal, err := authenticator.AuthenticateClient(server)
 	assert.Error(t, err, "Expected authentication error")
-	assert.False(t, authenticator.IsAuthenticated(), "Expected authenticated to be false")
-	assert.Equal(t, "", authenticator.GetUsername(), "Expected user name to be empty, got %s", authenticator.GetUsername())
+	assert.Nil(t, principal, "Expected no principal")
+}
+
+// TestAuthenticateClientAudit tests that logins and failures are recorded in the audit log.
+func TestAuthenticateClientAudit(t *testing.T) {
+	const auditUser = "audit"
+	auditSecret := []byte("audit-secret")
+	assert.NoError(t, userService.Create(auditUser, auditSecret))
+	testAuditLog, err := audit.New(&audit.Config{Path: filepath.Join(t.TempDir(), "audit.log")})
+	assert.NoError(t, err)
+	defer testAuditLog.Close()
+	authenticator := auth.New(userService, registrationService, tokenService, nil, nil, deviceService, failureTracker, testAuditLog, authConfig)
+
+	go testClient(client, t, auditUser, auditSecret)
+	_, err = authenticator.AuthenticateClient(server)
+	assert.NoError(t, err, "Error authenticating client")
+	go testClient(client, t, auditUser, testSecret2)
+	_, err = authenticator.AuthenticateClient(server)
+	assert.Error(t, err, "Expected authentication error")
+
+	entries, err := testAuditLog.Query(audit.Filter{Username: auditUser})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, audit.EventLogin, entries[0].Event)
+	assert.Equal(t, string(auth.MethodChallenge), entries[0].Method)
+	assert.NotEmpty(t, entries[0].RemoteAddr)
+	assert.Equal(t, audit.EventLoginFailed, entries[1].Event)
+}
+
+// TestAuthenticateClientLockedOut tests that a user is locked out after too many failed attempts.
+func TestAuthenticateClientLockedOut(t *testing.T) {
+	userTracker := lockout.New(&lockout.Config{
+		MaxUserFailures: 2,
+		LockoutDuration: time.Hour,
+		FailureWindow:   time.Hour,
+	})
+	authenticator := auth.New(userService, registrationService, tokenService, nil, nil, deviceService, userTracker, auditLog, authConfig)
+
+	for i := 0; i < 2; i++ {
+		go testClient(client, t, testUser1, testSecret2)
+		_, err := authenticator.AuthenticateClient(server)
+		assert.ErrorIs(t, err, auth.ErrChallengeFailed)
+	}
+
+	go testClient(client, t, testUser1, testSecret1)
+	principal, err := authenticator.AuthenticateClient(server)
+	assert.ErrorIs(t, err, lockout.ErrLockedOut, "Expected the correct secret to be rejected while locked out")
+	assert.Nil(t, principal, "Expected no principal")
+	assert.Len(t, userTracker.Lockouts(), 2)
 }
 
 // TestAuthenticateClientNewUser2 tests the authentication of a new user.
 func TestAuthenticateClientNewUser2(t *testing.T) {
 	go testClient(client, t, testUser2, testSecret2)
 
-	authenticator := auth.New(userService, authConfig)
+	authenticator := auth.New(userService, registrationService, tokenService, nil, nil, deviceService, failureTracker, auditLog, authConfig)
 
-	err := authenticator.AuthenticateClient(server)
+	principal, err := authenticator.AuthenticateClient(server)
 	assert.NoError(t, err, "Error authenticating client")
-	assert.Equal(t, testUser2, authenticator.GetUsername(), "Expected user name to be %s, got %s", testUser2, authenticator.GetUsername())
+	assert.Equal(t, testUser2, principal.Username, "Expected user name to be %s, got %s", testUser2, principal.Username)
 
 	secret, found := userService.GetSharedKey(testUser2)
 	assert.True(t, found, "Expected shared key to be found")
 	assert.Equal(t, testSecret2, secret, "Expected shared key to be %v, got %v", testSecret2, secret)
 }
 
+// TestAuthenticateClientRegistrationDisabled tests that unknown users are rejected when registration is disabled.
+func TestAuthenticateClientRegistrationDisabled(t *testing.T) {
+	disabledService, err := registration.New(&registration.Config{Policy: registration.PolicyDisabled})
+	assert.NoError(t, err)
+	go testRegisterClient(client, t, "unregistered", nil, enums.RegistrationDisabled)
+
+	authenticator := auth.New(userService, disabledService, tokenService, nil, nil, deviceService, failureTracker, auditLog, authConfig)
+
+	principal, err := authenticator.AuthenticateClient(server)
+	assert.Error(t, err, "Expected registration error")
+	assert.Nil(t, principal, "Expected no principal")
+	_, found := userService.GetSharedKey("unregistered")
+	assert.False(t, found, "Expected user not to be created")
+}
+
+// TestAuthenticateClientInvite tests registering with an invite token, which can only be used once.
+func TestAuthenticateClientInvite(t *testing.T) {
+	inviteService, err := registration.New(&registration.Config{
+		Policy:    registration.PolicyInvite,
+		InviteTTL: time.Hour,
+	})
+	assert.NoError(t, err)
+	token, _, err := inviteService.CreateInvite()
+	assert.NoError(t, err)
+	authenticator := auth.New(userService, inviteService, tokenService, nil, nil, deviceService, failureTracker, auditLog, authConfig)
+
+	go testRegisterClient(client, t, "invited", []byte(token), enums.Authenticated)
+	principal, err := authenticator.AuthenticateClient(server)
+	assert.NoError(t, err, "Error authenticating client")
+	assert.Equal(t, "invited", principal.Username)
+
+	go testRegisterClient(client, t, "invited2", []byte(token), enums.InvalidInvite)
+	principal, err = authenticator.AuthenticateClient(server)
+	assert.ErrorIs(t, err, registration.ErrInvalidInvite)
+	assert.Nil(t, principal, "Expected no principal")
+}
+
+// TestAuthenticateClientInviteExpired tests registering with an expired invite token.
+func TestAuthenticateClientInviteExpired(t *testing.T) {
+	inviteService, err := registration.New(&registration.Config{
+		Policy:    registration.PolicyInvite,
+		InviteTTL: -time.Second,
+	})
+	assert.NoError(t, err)
+	token, _, err := inviteService.CreateInvite()
+	assert.NoError(t, err)
+	go testRegisterClient(client, t, "expired", []byte(token), enums.InviteExpired)
+
+	authenticator := auth.New(userService, inviteService, tokenService, nil, nil, deviceService, failureTracker, auditLog, authConfig)
+
+	principal, err := authenticator.AuthenticateClient(server)
+	assert.ErrorIs(t, err, registration.ErrInviteExpired)
+	assert.Nil(t, principal, "Expected no principal")
+}
+
+// TestAuthenticateClientCertificate tests that a client with a certificate signed by the client CA skips the challenge.
+func TestAuthenticateClientCertificate(t *testing.T) {
+	caCert, caKey := testCertificate(t, "ca", nil, nil)
+	clientCert, _ := testCertificate(t, "certuser", caCert.Leaf, caKey)
+	serverCert, _ := testCertificate(t, "server", nil, nil)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert.Leaf)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	go func() {
+		tlsClient := tls.Client(clientConn, &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{clientCert},
+		})
+		var resultMessage models.Message
+		_, err := resultMessage.Receive(tlsClient)
+		assert.NoError(t, err)
+		assert.Equal(t, enums.Authenticated, enums.AuthResult(resultMessage.Body.([]byte)[0]))
+	}()
+
+	authenticator := auth.New(userService, registrationService, tokenService, nil, nil, deviceService, failureTracker, auditLog, authConfig)
+
+	principal, err := authenticator.AuthenticateClient(tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}))
+	assert.NoError(t, err, "Error authenticating client")
+	assert.Equal(t, "certuser", principal.Username)
+	assert.Equal(t, auth.MethodCertificate, principal.Method)
+	devices := deviceService.List("certuser")
+	if assert.Len(t, devices, 1, "Expected the certificate to identify the device") {
+		assert.Equal(t, principal.Device, devices[0].ID)
+		assert.Equal(t, "certuser", devices[0].Name)
+	}
+}
+
+// TestAuthenticateClientChannelBinding tests that the challenge response is bound to the TLS session.
+func TestAuthenticateClientChannelBinding(t *testing.T) {
+	const boundUser = "bound"
+	boundSecret := []byte("bound-secret")
+	assert.NoError(t, userService.Create(boundUser, boundSecret))
+	serverCert, _ := testCertificate(t, "server", nil, nil)
+	authenticator := auth.New(userService, registrationService, tokenService, nil, nil, deviceService, failureTracker, auditLog, authConfig)
+
+	for _, test := range []struct {
+		name     string
+		binding  func(conn net.Conn) []byte
+		expected enums.AuthResult
+	}{
+		{"same session", func(conn net.Conn) []byte {
+			binding, err := auth.ChannelBinding(conn)
+			assert.NoError(t, err)
+			return binding
+		}, enums.Authenticated},
+		{"unbound", func(_ net.Conn) []byte { return nil }, enums.Unauthorized},
+		{"other session", func(_ net.Conn) []byte { return bytes.Repeat([]byte{1}, auth.ChannelBindingSize) }, enums.Unauthorized},
+	} {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			tlsClient := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+			var message models.Message
+			_, err := message.Receive(tlsClient)
+			assert.NoError(t, err, "Error receiving challenge message")
+			response, err := auth.CalculateResponse(message.Body.([]byte), boundSecret, test.binding(tlsClient))
+			assert.NoError(t, err)
+			responseMessage := models.Message{
+				Header: models.Header{
+					Action: enums.Auth,
+				},
+				Body: append(response, boundUser...),
+			}
+			_, err = responseMessage.Send(tlsClient)
+			assert.NoError(t, err)
+			_, err = message.Receive(tlsClient)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, enums.AuthResult(message.Body.([]byte)[0]), test.name)
+		}()
+
+		principal, err := authenticator.AuthenticateClient(tls.Server(serverConn, &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+		}))
+		if test.expected == enums.Authenticated {
+			assert.NoError(t, err, test.name)
+			assert.NotNil(t, principal, test.name)
+		} else {
+			assert.ErrorIs(t, err, auth.ErrChallengeFailed, test.name)
+		}
+		clientConn.Close()
+		serverConn.Close()
+	}
+}
+
+// TestCertificateUsername tests mapping the certificate fields to a username.
+func TestCertificateUsername(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "common"},
+		EmailAddresses: []string{"user@example.com"},
+	}
+
+	username, err := auth.CertificateUsername(cert, auth.CertificateCommonName)
+	assert.NoError(t, err)
+	assert.Equal(t, "common", username)
+
+	username, err = auth.CertificateUsername(cert, auth.CertificateSAN)
+	assert.NoError(t, err)
+	assert.Equal(t, "user@example.com", username)
+
+	_, err = auth.CertificateUsername(&x509.Certificate{}, auth.CertificateSAN)
+	assert.Error(t, err, "Expected error for certificate without alternative names")
+}
+
+// TestAuthenticateClientPassword tests registering and logging in with a password.
+func TestAuthenticateClientPassword(t *testing.T) {
+	const passwordUser = "password"
+	authenticator := auth.New(userService, registrationService, tokenService, nil, nil, deviceService, failureTracker, auditLog, authConfig)
+
+	go testPasswordClient(client, t, passwordUser, "password1", enums.Authenticated)
+	principal, err := authenticator.AuthenticateClient(server)
+	assert.NoError(t, err, "Error registering client")
+	assert.Equal(t, auth.MethodPassword, principal.Method)
+	_, _, found := userService.GetVerifier(passwordUser)
+	assert.True(t, found, "Expected verifier to be stored")
+
+	go testPasswordClient(client, t, passwordUser, "password1", enums.Authenticated)
+	principal, err = authenticator.AuthenticateClient(server)
+	assert.NoError(t, err, "Error authenticating client")
+	assert.Equal(t, passwordUser, principal.Username)
+	assert.Len(t, principal.SessionKey, sha256.Size)
+
+	go testPasswordClient(client, t, passwordUser, "password2", enums.Unauthorized)
+	principal, err = authenticator.AuthenticateClient(server)
+	assert.ErrorIs(t, err, auth.ErrChallengeFailed)
+	assert.Nil(t, principal, "Expected no principal")
+
+	// A password user cannot answer the challenge with an empty key.
+	go testClient(client, t, passwordUser, nil)
+	principal, err = authenticator.AuthenticateClient(server)
+	assert.ErrorIs(t, err, auth.ErrChallengeFailed)
+	assert.Nil(t, principal, "Expected no principal")
+}
+
+// TestAuthenticateClientToken tests logging in with a scoped API token.
+func TestAuthenticateClientToken(t *testing.T) {
+	apiToken, info, err := tokenService.Create(testUser1, models.TokenRequest{
+		Name:   "backup",
+		Scopes: []enums.Scope{enums.ReadScope},
+	})
+	assert.NoError(t, err)
+	authenticator := auth.New(userService, registrationService, tokenService, nil, nil, deviceService, failureTracker, auditLog, authConfig)
+
+	go testTokenClient(client, t, apiToken, enums.Authenticated)
+	principal, err := authenticator.AuthenticateClient(server)
+	assert.NoError(t, err, "Error authenticating client")
+	assert.Equal(t, testUser1, principal.Username)
+	assert.Equal(t, auth.MethodToken, principal.Method)
+	assert.Equal(t, info.ID, principal.TokenID)
+	assert.True(t, principal.Allows(enums.Download))
+	assert.False(t, principal.Allows(enums.Upload), "Expected read-only token not to upload")
+	assert.False(t, principal.Allows(enums.CreateToken), "Expected token not to mint tokens")
+
+	assert.NoError(t, tokenService.Revoke(testUser1, info.ID))
+	go testTokenClient(client, t, apiToken, enums.Unauthorized)
+	principal, err = authenticator.AuthenticateClient(server)
+	assert.ErrorIs(t, err, token.ErrInvalidToken)
+	assert.Nil(t, principal, "Expected no principal")
+}
+
+// TestAuthenticateClientTokenLibrary tests that a token restricted to a library only reaches the library.
+func TestAuthenticateClientTokenLibrary(t *testing.T) {
+	_, err := userService.CreateLibrary(testUser1, models.LibraryRequest{Name: "camera", Quota: &models.Quota{MaxFiles: 7}})
+	assert.NoError(t, err)
+	apiToken, _, err := tokenService.Create(testUser1, models.TokenRequest{
+		Name:    "camera",
+		Scopes:  []enums.Scope{enums.UploadScope},
+		Library: "camera",
+	})
+	assert.NoError(t, err)
+	authenticator := auth.New(userService, registrationService, tokenService, nil, nil, deviceService, failureTracker, auditLog, authConfig)
+
+	go testTokenClient(client, t, apiToken, enums.Authenticated)
+	principal, err := authenticator.AuthenticateClient(server)
+	assert.NoError(t, err, "Error authenticating client")
+	assert.Equal(t, "camera", principal.Library)
+	assert.True(t, principal.Allows(enums.Upload))
+	assert.False(t, principal.Allows(enums.SelectLibrary), "Expected token not to leave its library")
+	assert.False(t, principal.Allows(enums.SelectShare), "Expected token not to leave its library")
+	assert.True(t, principal.Sees(models.FileChange{Library: "camera"}))
+	assert.False(t, principal.Sees(models.FileChange{}), "Expected token not to see the default files")
+
+	fileService, err := authenticator.GetFileService(principal)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, fileService.Usage().Quota.MaxFiles, "Expected the files of the library")
+	fileService.Close()
+
+	assert.NoError(t, userService.DeleteLibrary(testUser1, "camera"))
+	go testTokenClient(client, t, apiToken, enums.Unauthorized)
+	principal, err = authenticator.AuthenticateClient(server)
+	assert.Error(t, err, "Expected the token of a deleted library to be rejected")
+	assert.Nil(t, principal, "Expected no principal")
+}
+
+// TestAuthenticateClientBackend tests logging in against the authentication backends.
+func TestAuthenticateClientBackend(t *testing.T) {
+	const backendUser = "backend"
+	authenticator := auth.New(userService, registrationService, tokenService, nil, testAuthenticator{backendUser: "hunter2"}, deviceService, failureTracker, auditLog, authConfig)
+
+	go testLoginClient(client, t, backendUser, "hunter2", enums.Authenticated)
+	principal, err := authenticator.AuthenticateClient(server)
+	assert.NoError(t, err, "Error authenticating client")
+	assert.Equal(t, backendUser, principal.Username)
+	assert.Equal(t, auth.MethodLogin, principal.Method)
+	_, found := userService.GetSharedKey(backendUser)
+	assert.True(t, found, "Expected the user to be provisioned")
+
+	go testLoginClient(client, t, backendUser, "wrong", enums.Unauthorized)
+	principal, err = authenticator.AuthenticateClient(server)
+	assert.ErrorIs(t, err, backend.ErrInvalidCredentials)
+	assert.Nil(t, principal, "Expected no principal")
+
+	go testLoginClient(client, t, "nobody", "hunter2", enums.Unauthorized)
+	_, err = authenticator.AuthenticateClient(server)
+	assert.ErrorIs(t, err, backend.ErrUnknownUser)
+	provider, _ := userService.GetProvider(backendUser)
+	assert.Equal(t, "test", provider)
+}
+
+// TestAuthenticateClientBackendTakeover tests that a backend cannot log in to an account it did not provision.
+func TestAuthenticateClientBackendTakeover(t *testing.T) {
+	const takeoverUser = "takeover"
+	assert.NoError(t, userService.Create(takeoverUser, []byte("takeover-secret")))
+	authenticator := auth.New(userService, registrationService, tokenService, nil, testAuthenticator{takeoverUser: "hunter2"}, deviceService, failureTracker, auditLog, authConfig)
+
+	go testLoginClient(client, t, takeoverUser, "hunter2", enums.Unauthorized)
+	principal, err := authenticator.AuthenticateClient(server)
+	assert.Error(t, err, "Expected the backend not to take over the account")
+	assert.Nil(t, principal, "Expected no principal")
+	sharedKey, _ := userService.GetSharedKey(takeoverUser)
+	assert.Equal(t, []byte("takeover-secret"), sharedKey)
+}
+
+// TestAuthenticateClientDevice tests that a client identifies its device and a revoked device is rejected.
+func TestAuthenticateClientDevice(t *testing.T) {
+	const deviceUser = "device"
+	deviceSecret := []byte("device-secret")
+	assert.NoError(t, userService.Create(deviceUser, deviceSecret))
+	authenticator := auth.New(userService, registrationService, tokenService, nil, nil, deviceService, failureTracker, auditLog, authConfig)
+
+	go testDeviceClient(client, t, deviceUser, deviceSecret, "laptop", enums.Authenticated)
+	principal, err := authenticator.AuthenticateClient(server)
+	assert.NoError(t, err, "Error authenticating client")
+	assert.Equal(t, "laptop", principal.Device)
+	devices := deviceService.List(deviceUser)
+	assert.Len(t, devices, 1)
+	assert.Equal(t, "Laptop", devices[0].Name)
+	assert.Equal(t, "1.0.0", devices[0].ClientVersion)
+
+	assert.NoError(t, deviceService.Revoke(deviceUser, "laptop"))
+	go testDeviceClient(client, t, deviceUser, deviceSecret, "laptop", enums.DeviceRevoked)
+	principal, err = authenticator.AuthenticateClient(server)
+	assert.ErrorIs(t, err, device.ErrDeviceRevoked)
+	assert.Nil(t, principal, "Expected no principal")
+
+	// The revoked device does not get in by changing its device ID, the key it logged in with is revoked too.
+	go testDeviceClient(client, t, deviceUser, deviceSecret, "laptop2", enums.DeviceRevoked)
+	principal, err = authenticator.AuthenticateClient(server)
+	assert.ErrorIs(t, err, device.ErrDeviceRevoked)
+	assert.Nil(t, principal, "Expected no principal")
+}
+
+// TestAuthenticateClientDeviceRequired tests that a client that does not identify its device is rejected.
+func TestAuthenticateClientDeviceRequired(t *testing.T) {
+	const requiredUser = "required"
+	authenticator := auth.New(userService, registrationService, tokenService, nil, nil, deviceService, failureTracker, auditLog, &auth.Config{
+		ChallengeLen:  ChallengeLen,
+		TokenSize:     32,
+		RequireDevice: true,
+	})
+
+	go testPasswordClient(client, t, requiredUser, "password1", enums.Unauthorized)
+	principal, err := authenticator.AuthenticateClient(server)
+	assert.Error(t, err, "Expected a device to be required")
+	assert.Nil(t, principal, "Expected no principal")
+}
+
+// TestRotateKey tests replacing the shared key after proving the current one.
+func TestRotateKey(t *testing.T) {
+	const rotateUser = "rotate"
+	oldSecret, newSecret := []byte("old-secret"), []byte("new-secret")
+	assert.NoError(t, userService.Create(rotateUser, oldSecret))
+	storageID, _ := userService.GetStorageID(rotateUser)
+	principal := &auth.Principal{Username: rotateUser}
+	authenticator := auth.New(userService, registrationService, tokenService, nil, nil, deviceService, failureTracker, auditLog, authConfig)
+
+	challenge, err := authenticator.NewChallenge()
+	assert.NoError(t, err)
+	response, err := auth.CalculateResponse(challenge, newSecret, nil)
+	assert.NoError(t, err)
+	err = authenticator.RotateKey(principal, challenge, response, newSecret)
+	assert.ErrorIs(t, err, auth.ErrChallengeFailed, "Expected a response with the wrong key to be rejected")
+
+	response, err = auth.CalculateResponse(challenge, oldSecret, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, authenticator.RotateKey(principal, challenge, response, newSecret))
+
+	sharedKey, _ := userService.GetSharedKey(rotateUser)
+	assert.Equal(t, newSecret, sharedKey)
+	rotatedID, _ := userService.GetStorageID(rotateUser)
+	assert.Equal(t, storageID, rotatedID, "Expected the files to stay with the user")
+}
+
+// TestAuthenticateClientResume tests resuming a session with a valid resumption token.
+func TestAuthenticateClientResume(t *testing.T) {
+	go testResumeClient(client, t, testUser1, testToken, nil)
+
+	authenticator := auth.New(userService, registrationService, tokenService, testTokenValidator{}, nil, deviceService, failureTracker, auditLog, authConfig)
+
+	principal, err := authenticator.AuthenticateClient(server)
+	assert.NoError(t, err, "Error authenticating client")
+	assert.Equal(t, testUser1, principal.Username)
+	assert.Equal(t, auth.MethodResume, principal.Method)
+	assert.Equal(t, testToken, principal.ResumptionToken)
+}
+
+// TestAuthenticateClientResumeRejected tests falling back to the challenge after an invalid resumption token.
+func TestAuthenticateClientResumeRejected(t *testing.T) {
+	go testResumeClient(client, t, testUser1, make([]byte, len(testToken)), testSecret1)
+
+	testAuditLog, err := audit.New(&audit.Config{Path: filepath.Join(t.TempDir(), "audit.log")})
+	assert.NoError(t, err)
+	defer testAuditLog.Close()
+	authenticator := auth.New(userService, registrationService, tokenService, testTokenValidator{}, nil, deviceService, failureTracker, testAuditLog, authConfig)
+
+	principal, err := authenticator.AuthenticateClient(server)
+	assert.NoError(t, err, "Error authenticating client")
+	assert.Equal(t, testUser1, principal.Username)
+	assert.Nil(t, principal.ResumptionToken, "Expected no resumption token")
+
+	// The rejected token counts as a failed attempt.
+	entries, err := testAuditLog.Query(audit.Filter{Username: testUser1})
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, audit.EventLoginFailed, entries[0].Event)
+		assert.Equal(t, string(auth.MethodResume), entries[0].Method)
+	}
+}
+
+// TestAuthenticateClientConcurrent tests many simultaneous logins sharing one service, run it with -race.
+func TestAuthenticateClientConcurrent(t *testing.T) {
+	const (
+		users  = 10
+		logins = 50
+	)
+	authenticator := auth.New(userService, registrationService, tokenService, nil, nil, deviceService, failureTracker, auditLog, authConfig)
+	for i := 0; i < users; i++ {
+		err := userService.Create(fmt.Sprintf("concurrent%d", i), []byte(fmt.Sprintf("secret%d", i)))
+		assert.NoError(t, err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < logins; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			testUser := fmt.Sprintf("concurrent%d", i%users)
+			testSecret := []byte(fmt.Sprintf("secret%d", i%users))
+
+			// The client logs to the test, so the test waits for it to finish once the pipe is closed.
+			clientDone := make(chan struct{})
+			defer func() { <-clientDone }()
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+			go func() {
+				defer close(clientDone)
+				testClient(clientConn, t, testUser, testSecret)
+			}()
+
+			principal, err := authenticator.AuthenticateClient(serverConn)
+			assert.NoError(t, err, "Error authenticating client")
+			assert.Equal(t, testUser, principal.Username, "Expected principal of the connection's own user")
+
+			var fileService file.Service
+			fileService, err = authenticator.GetFileService(principal)
+			assert.NoError(t, err)
+			assert.NotNil(t, fileService)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// testCertificate creates a certificate with the common name, signed by the parent or self-signed if parent is nil.
+func testCertificate(t *testing.T, commonName string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (tls.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, key
+}
+
+// testTokenValidator accepts testToken for testUser1.
+type testTokenValidator struct{}
+
+func (testTokenValidator) Claim(token []byte, username string, device string) bool {
+	return bytes.Equal(token, testToken) && username == testUser1 && device == ""
+}
+
+// testPasswordClient logs in with the password, registering the user if it does not exist, and checks the result.
+func testPasswordClient(conn net.Conn, t *testing.T, testUser string, password string, expected enums.AuthResult) {
+	var challengeMessage models.Message
+	_, err := challengeMessage.Receive(conn)
+	assert.NoError(t, err, "Error receiving challenge message")
+
+	srpClient, err := srp.NewClient(testUser, password)
+	assert.NoError(t, err)
+	loginMessage := models.Message{
+		Header: models.Header{
+			Action: enums.Password,
+		},
+		Body: append(srpClient.PublicKey(), []byte(testUser)...),
+	}
+	_, err = loginMessage.Send(conn)
+	assert.NoError(t, err, "Error sending password login message")
+
+	var message models.Message
+	_, err = message.Receive(conn)
+	assert.NoError(t, err)
+	if message.Header.Action == enums.Auth {
+		assert.Equal(t, enums.NewUser, enums.AuthResult(message.Body.([]byte)[0]))
+		var salt, verifier []byte
+		salt, verifier, err = srp.NewVerifier(testUser, password)
+		assert.NoError(t, err)
+		registrationMessage := models.Message{
+			Header: models.Header{
+				Action: enums.Auth,
+			},
+			Body: append(salt, verifier...),
+		}
+		_, err = registrationMessage.Send(conn)
+		assert.NoError(t, err, "Error sending registration message")
+		_, err = message.Receive(conn)
+		assert.NoError(t, err)
+	}
+
+	body := message.Body.([]byte)
+	var proof []byte
+	proof, err = srpClient.Proof(body[:srp.SaltSize], body[srp.SaltSize:])
+	assert.NoError(t, err)
+	proofMessage := models.Message{
+		Header: models.Header{
+			Action: enums.Password,
+		},
+		Body: proof,
+	}
+	_, err = proofMessage.Send(conn)
+	assert.NoError(t, err, "Error sending proof message")
+
+	_, err = message.Receive(conn)
+	assert.NoError(t, err)
+	if message.Header.Action == enums.Password {
+		assert.True(t, srpClient.VerifyServer(message.Body.([]byte)), "Expected valid server proof")
+		_, err = message.Receive(conn)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, expected, enums.AuthResult(message.Body.([]byte)[0]))
+}
+
+// testDeviceClient identifies its device, answers the challenge with the secret and checks the result.
+func testDeviceClient(conn net.Conn, t *testing.T, testUser string, testSecret []byte, deviceID string, expected enums.AuthResult) {
+	var message models.Message
+	_, err := message.Receive(conn)
+	assert.NoError(t, err, "Error receiving challenge message")
+
+	deviceMessage := models.Message{
+		Header: models.Header{
+			Action: enums.Device,
+		},
+		Body: []byte(deviceID + "\x001.0.0\x00Laptop"),
+	}
+	_, err = deviceMessage.Send(conn)
+	assert.NoError(t, err, "Error sending device message")
+
+	var challengeResponse []byte
+	challengeResponse, err = auth.CalculateResponse(message.Body.([]byte), testSecret, nil)
+	assert.NoError(t, err, "Error calculating response")
+	responseMessage := models.Message{
+		Header: models.Header{
+			Action: enums.Auth,
+		},
+		Body: append(challengeResponse, testUser...),
+	}
+	_, err = responseMessage.Send(conn)
+	assert.NoError(t, err, "Error sending challenge response message")
+
+	_, err = message.Receive(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, enums.AuthResult(message.Body.([]byte)[0]))
+}
+
+// testTokenClient logs in with the API token and checks the result.
+func testTokenClient(conn net.Conn, t *testing.T, apiToken string, expected enums.AuthResult) {
+	var message models.Message
+	_, err := message.Receive(conn)
+	assert.NoError(t, err, "Error receiving challenge message")
+
+	loginMessage := models.Message{
+		Header: models.Header{
+			Action: enums.Token,
+		},
+		Body: []byte(apiToken),
+	}
+	_, err = loginMessage.Send(conn)
+	assert.NoError(t, err, "Error sending token login message")
+
+	_, err = message.Receive(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, enums.AuthResult(message.Body.([]byte)[0]))
+}
+
+// testAuthenticator is a backend with fixed passwords.
+type testAuthenticator map[string]string
+
+func (testAuthenticator) Name() string {
+	return "test"
+}
+
+func (a testAuthenticator) Authenticate(username string, password string) (backendName string, err error) {
+	expected, found := a[username]
+	if !found {
+		return "", backend.ErrUnknownUser
+	}
+	if expected != password {
+		return "", backend.ErrInvalidCredentials
+	}
+	return a.Name(), nil
+}
+
+// testLoginClient logs in with the password against the authentication backends and checks the result.
+func testLoginClient(conn net.Conn, t *testing.T, testUser string, password string, expected enums.AuthResult) {
+	var message models.Message
+	_, err := message.Receive(conn)
+	assert.NoError(t, err, "Error receiving challenge message")
+
+	loginMessage := models.Message{
+		Header: models.Header{
+			Action: enums.Login,
+		},
+		Body: append([]byte(password+"\x00"), testUser...),
+	}
+	_, err = loginMessage.Send(conn)
+	assert.NoError(t, err, "Error sending login message")
+
+	_, err = message.Receive(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, enums.AuthResult(message.Body.([]byte)[0]))
+}
+
+// testResumeClient presents the token and answers the challenge with the secret if the resumption is rejected.
+func testResumeClient(conn net.Conn, t *testing.T, testUser string, token []byte, testSecret []byte) {
+	var challengeMessage models.Message
+	_, err := challengeMessage.Receive(conn)
+	assert.NoError(t, err, "Error receiving challenge message")
+
+	resumeMessage := models.Message{
+		Header: models.Header{
+			Action: enums.Resume,
+		},
+		Body: append(append([]byte{}, token...), []byte(testUser)...),
+	}
+	_, err = resumeMessage.Send(conn)
+	assert.NoError(t, err, "Error sending resume message")
+
+	var resultMessage models.Message
+	_, err = resultMessage.Receive(conn)
+	assert.NoError(t, err)
+	result := enums.AuthResult(resultMessage.Body.([]byte)[0])
+	if testSecret == nil {
+		assert.Equal(t, enums.Authenticated, result)
+		return
+	}
+	assert.Equal(t, enums.ResumeRejected, result)
+
+	var challengeResponse []byte
+	challengeResponse, err = auth.CalculateResponse(challengeMessage.Body.([]byte), testSecret, nil)
+	assert.NoError(t, err, "Error calculating response")
+	challengeResponseMessage := models.Message{
+		Header: models.Header{
+			Action: enums.Auth,
+		},
+		Body: append(challengeResponse, []byte(testUser)...),
+	}
+	_, err = challengeResponseMessage.Send(conn)
+	assert.NoError(t, err, "Error sending challenge response message")
+
+	_, err = resultMessage.Receive(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, enums.Authenticated, enums.AuthResult(resultMessage.Body.([]byte)[0]))
+}
+
+// testRegisterClient registers a new user with the invite token and checks the final result.
+// A nil invite expects registration to be refused before the client can send anything.
+func testRegisterClient(conn net.Conn, t *testing.T, testUser string, invite []byte, expected enums.AuthResult) {
+	var challengeMessage models.Message
+	_, err := challengeMessage.Receive(conn)
+	assert.NoError(t, err, "Error receiving challenge message")
+
+	testSecret := []byte("secret-" + testUser)
+	var challengeResponse []byte
+	challengeResponse, err = auth.CalculateResponse(challengeMessage.Body.([]byte), testSecret, nil)
+	assert.NoError(t, err, "Error calculating response")
+	challengeResponseMessage := models.Message{
+		Header: models.Header{
+			Action: enums.Auth,
+		},
+		Body: append(challengeResponse, []byte(testUser)...),
+	}
+	_, err = challengeResponseMessage.Send(conn)
+	assert.NoError(t, err, "Error sending challenge response message")
+
+	var resultMessage models.Message
+	_, err = resultMessage.Receive(conn)
+	assert.NoError(t, err)
+	result := enums.AuthResult(resultMessage.Body.([]byte)[0])
+	if invite == nil {
+		assert.Equal(t, expected, result)
+		return
+	}
+	assert.Equal(t, enums.InviteRequired, result)
+
+	registrationMessage := models.Message{
+		Header: models.Header{
+			Action: enums.Auth,
+		},
+		Body: append(append([]byte{}, invite...), testSecret...),
+	}
+	_, err = registrationMessage.Send(conn)
+	assert.NoError(t, err, "Error sending registration message")
+
+	_, err = resultMessage.Receive(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, enums.AuthResult(resultMessage.Body.([]byte)[0]))
+}
+
 func testClient(conn net.Conn, t *testing.T, testUser string, testSecret []byte) {
 	var challengeMessage models.Message
 	var err error
@@ -109,7 +909,7 @@ func testClient(conn net.Conn, t *testing.T, testUser string, testSecret []byte)
 
 	// Calculate the challenge response.
 	var challengeResponse []byte
-	challengeResponse, err = auth.CalculateResponse(challengeMessage.Body.([]byte), testSecret)
+	challengeResponse, err = auth.CalculateResponse(challengeMessage.Body.([]byte), testSecret, nil)
 	assert.NoError(t, err, "Error calculating response")
 
 	// Send the challenge response to the server.
@@ -152,6 +952,8 @@ func testClient(conn net.Conn, t *testing.T, testUser string, testSecret []byte)
 		assert.Equal(t, enums.Authenticated, result, "Expected authenticated message, got %v", result)
 	case enums.Unauthorized:
 		t.Logf("Client: Received authentication failed message: %v\n", authResponseMessage)
+	case enums.LockedOut:
+		t.Logf("Client: Received locked out message: %v\n", authResponseMessage)
 	default:
 		t.Errorf("Client: Received unexpected message: %v\n", authResponseMessage)
 	}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"filesync/enums"
+	"filesync/models"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// CertificateField selects the field of a client certificate that holds the username.
+type CertificateField string
+
+const (
+	// CertificateCommonName maps the subject common name to the username.
+	CertificateCommonName CertificateField = "cn"
+	// CertificateSAN maps the first email, DNS or URI subject alternative name to the username.
+	CertificateSAN CertificateField = "san"
+)
+
+// authenticateCertificate authenticates the client with the certificate it presented during the TLS handshake.
+// It returns a nil principal if the client presented no verified certificate, the client then answers the challenge.
+func (a *concreteService) authenticateCertificate(conn *tls.Conn) (principal *Principal, err error) {
+	err = conn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	// The TLS config only verifies certificates signed by the client CA, unverified certificates never get here.
+	chains := conn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil, nil
+	}
+
+	var userName string
+	userName, err = CertificateUsername(chains[0][0], a.config.CertificateField)
+	if err != nil {
+		sendErr := sendResult(conn, enums.Unauthorized)
+		if sendErr != nil {
+			return nil, sendErr
+		}
+		return nil, err
+	}
+
+	// A certificate signed by the client CA is proof enough to provision the user.
+	err = a.provisionUser(conn, userName, MethodCertificate, string(MethodCertificate))
+	if err != nil {
+		return nil, err
+	}
+
+	// Clients with a certificate authenticate before they could identify their device, the certificate identifies it.
+	certificateDevice := &models.DeviceInfo{
+		ID:   certificateDeviceID(chains[0][0]),
+		Name: chains[0][0].Subject.CommonName,
+	}
+	err = a.admit(conn, userName, certificateDevice, fingerprint("certificate", chains[0][0].Raw))
+	if err != nil {
+		return nil, err
+	}
+
+	err = sendResult(conn, enums.Authenticated)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Authenticated user %s with client certificate", userName)
+	return &Principal{
+		Username:        userName,
+		Device:          certificateDevice.ID,
+		Method:          MethodCertificate,
+		AuthenticatedAt: time.Now(),
+	}, nil
+}
+
+// CertificateUsername returns the username the certificate maps to.
+func CertificateUsername(cert *x509.Certificate, field CertificateField) (string, error) {
+	switch field {
+	case CertificateCommonName, "":
+		if cert.Subject.CommonName != "" {
+			return cert.Subject.CommonName, nil
+		}
+	case CertificateSAN:
+		switch {
+		case len(cert.EmailAddresses) > 0:
+			return cert.EmailAddresses[0], nil
+		case len(cert.DNSNames) > 0:
+			return cert.DNSNames[0], nil
+		case len(cert.URIs) > 0:
+			return cert.URIs[0].String(), nil
+		}
+	default:
+		return "", fmt.Errorf("invalid certificate field: %s", field)
+	}
+	return "", fmt.Errorf("client certificate has no %s", field)
+}
+
+// certificateDeviceID returns the ID of the device that holds the certificate.
+func certificateDeviceID(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return "certificate-" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,54 @@
+package backend
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrUnknownUser is returned by a backend that does not recognise the user, the chain then tries the next backend.
+	ErrUnknownUser = errors.New("unknown user")
+	// ErrInvalidCredentials is returned by a backend that recognises the user but rejects the password.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Authenticator verifies the password of a user against a credential backend.
+type Authenticator interface {
+	// Name identifies the backend in logs and in the user store.
+	Name() string
+	// Authenticate returns the name of the backend that accepted the password if it is correct, ErrUnknownUser if
+	// the backend does not know the user and ErrInvalidCredentials if the password is wrong.
+	Authenticate(username string, password string) (backendName string, err error)
+}
+
+type chain struct {
+	authenticators []Authenticator
+}
+
+// NewChain returns an Authenticator that asks the authenticators in order, the first one that recognises the user
+// decides.
+func NewChain(authenticators ...Authenticator) Authenticator {
+	return &chain{
+		authenticators,
+	}
+}
+
+func (c *chain) Name() string {
+	return "chain"
+}
+
+func (c *chain) Authenticate(username string, password string) (backendName string, err error) {
+	for _, authenticator := range c.authenticators {
+		backendName, err = authenticator.Authenticate(username, password)
+		if errors.Is(err, ErrUnknownUser) {
+			continue
+		}
+		if err != nil {
+			log.Debugf("Backend %s rejected user %s: %s", authenticator.Name(), username, err)
+			return "", err
+		}
+		log.Debugf("Backend %s authenticated user %s", authenticator.Name(), username)
+		return backendName, nil
+	}
+	return "", ErrUnknownUser
+}
@@ -0,0 +1,323 @@
+package backend_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"server/services/backend"
+	"testing"
+	"time"
+)
+
+const (
+	testUser     = "test1"
+	testPassword = "hunter2"
+
+	serviceDN       = "cn=service,dc=example,dc=com"
+	servicePassword = "service-secret"
+	baseDN          = "ou=people,dc=example,dc=com"
+)
+
+func TestHtpasswd(t *testing.T) {
+	htpasswd := newTestHtpasswd(t, testUser, testPassword)
+	backendName, err := htpasswd.Authenticate(testUser, testPassword)
+	assert.NoError(t, err)
+	assert.Equal(t, "htpasswd", backendName)
+	_, err = htpasswd.Authenticate(testUser, "wrong")
+	assert.ErrorIs(t, err, backend.ErrInvalidCredentials)
+	_, err = htpasswd.Authenticate("nobody", testPassword)
+	assert.ErrorIs(t, err, backend.ErrUnknownUser)
+}
+
+func TestHtpasswd_Unsupported(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	assert.NoError(t, os.WriteFile(path, []byte(testUser+":$apr1$salt$hash\n"), 0600))
+
+	_, err := backend.NewHtpasswd(path)
+	assert.Error(t, err, "Expected only bcrypt hashes to be accepted")
+}
+
+func TestLDAP(t *testing.T) {
+	addr := startFakeLDAP(t, map[string]string{
+		serviceDN:             servicePassword,
+		"uid=test1," + baseDN: testPassword,
+	}, nil)
+	ldap := backend.NewLDAP(&backend.LDAPConfig{
+		Address:       addr,
+		Security:      backend.LDAPPlain,
+		BindDN:        serviceDN,
+		BindPassword:  servicePassword,
+		BaseDN:        baseDN,
+		UserAttribute: "uid",
+	})
+
+	backendName, err := ldap.Authenticate(testUser, testPassword)
+	assert.NoError(t, err)
+	assert.Equal(t, "ldap", backendName)
+	_, err = ldap.Authenticate(testUser, "wrong")
+	assert.ErrorIs(t, err, backend.ErrInvalidCredentials)
+	_, err = ldap.Authenticate(testUser, "")
+	assert.ErrorIs(t, err, backend.ErrInvalidCredentials, "Expected an empty password to be rejected")
+	_, err = ldap.Authenticate("nobody", testPassword)
+	assert.ErrorIs(t, err, backend.ErrUnknownUser)
+
+	misconfigured := backend.NewLDAP(&backend.LDAPConfig{
+		Address:       addr,
+		Security:      backend.LDAPPlain,
+		BindDN:        serviceDN,
+		BindPassword:  "wrong",
+		BaseDN:        baseDN,
+		UserAttribute: "uid",
+	})
+	_, err = misconfigured.Authenticate(testUser, testPassword)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, backend.ErrInvalidCredentials, "Expected a failed service bind not to blame the user")
+}
+
+func TestLDAP_StartTLS(t *testing.T) {
+	serverCert := testServerCertificate(t)
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(serverCert.Leaf)
+	directory := map[string]string{
+		serviceDN:             servicePassword,
+		"uid=test1," + baseDN: testPassword,
+	}
+	config := &backend.LDAPConfig{
+		Address:       startFakeLDAP(t, directory, &tls.Config{Certificates: []tls.Certificate{serverCert}}),
+		TLSConfig:     &tls.Config{RootCAs: rootCAs},
+		BindDN:        serviceDN,
+		BindPassword:  servicePassword,
+		BaseDN:        baseDN,
+		UserAttribute: "uid",
+	}
+
+	// The zero security upgrades the connection before the passwords are sent.
+	_, err := backend.NewLDAP(config).Authenticate(testUser, testPassword)
+	assert.NoError(t, err)
+
+	config.Address = startFakeLDAP(t, directory, nil)
+	_, err = backend.NewLDAP(config).Authenticate(testUser, testPassword)
+	assert.Error(t, err, "Expected a server without StartTLS to be rejected")
+	assert.NotErrorIs(t, err, backend.ErrInvalidCredentials)
+}
+
+func TestChain(t *testing.T) {
+	first := newTestHtpasswd(t, testUser, testPassword)
+	hash, err := bcrypt.GenerateFromPassword([]byte("other"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	assert.NoError(t, os.WriteFile(path, []byte(testUser+":"+string(hash)+"\ntest2:"+string(hash)+"\n"), 0600))
+	second, err := backend.NewHtpasswd(path)
+	assert.NoError(t, err)
+
+	chain := backend.NewChain(first, second)
+	backendName, err := chain.Authenticate(testUser, testPassword)
+	assert.NoError(t, err)
+	assert.Equal(t, "htpasswd", backendName)
+	_, err = chain.Authenticate(testUser, "other")
+	assert.ErrorIs(t, err, backend.ErrInvalidCredentials, "Expected the first backend that knows the user to decide")
+	_, err = chain.Authenticate("test2", "other")
+	assert.NoError(t, err, "Expected unknown users to fall through")
+	_, err = chain.Authenticate("nobody", testPassword)
+	assert.ErrorIs(t, err, backend.ErrUnknownUser)
+}
+
+// newTestHtpasswd returns an htpasswd backend that knows the user with the password.
+func newTestHtpasswd(t *testing.T, username string, password string) backend.Authenticator {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	assert.NoError(t, os.WriteFile(path, []byte("# users\n"+username+":"+string(hash)+"\n"), 0600))
+	htpasswd, err := backend.NewHtpasswd(path)
+	assert.NoError(t, err)
+	return htpasswd
+}
+
+// testServerCertificate returns a self-signed certificate for the loopback address.
+func testServerCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ldap"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// fakeLDAP answers simple binds and equality searches on the DNs of the directory, whose first RDN holds the username.
+type fakeLDAP struct {
+	directory map[string]string
+	// tlsConfig is used to upgrade connections with StartTLS, the fake does not support StartTLS if it is nil.
+	tlsConfig *tls.Config
+}
+
+type fakeMessage struct {
+	MessageID  int
+	ProtocolOp asn1.RawValue
+}
+
+type fakeBindRequest struct {
+	Version  int
+	Name     []byte
+	Password []byte `asn1:"tag:0"`
+}
+
+type fakeSearchRequest struct {
+	BaseObject   []byte
+	Scope        asn1.Enumerated
+	DerefAliases asn1.Enumerated
+	SizeLimit    int
+	TimeLimit    int
+	TypesOnly    bool
+	Filter       asn1.RawValue
+	Attributes   [][]byte
+}
+
+type fakeAttributeValueAssertion struct {
+	AttributeDesc  []byte
+	AssertionValue []byte
+}
+
+type fakeResult struct {
+	ResultCode        asn1.Enumerated
+	MatchedDN         []byte
+	DiagnosticMessage []byte
+}
+
+type fakeSearchResultEntry struct {
+	ObjectName []byte
+	Attributes []asn1.RawValue
+}
+
+func startFakeLDAP(t *testing.T, directory map[string]string, tlsConfig *tls.Config) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	server := &fakeLDAP{directory, tlsConfig}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func (f *fakeLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := readPacket(conn)
+		if err != nil {
+			return
+		}
+		var message fakeMessage
+		_, err = asn1.Unmarshal(packet, &message)
+		if err != nil {
+			return
+		}
+		switch message.ProtocolOp.Tag {
+		case 0:
+			var request fakeBindRequest
+			_, err = asn1.UnmarshalWithParams(message.ProtocolOp.FullBytes, &request, "application,tag:0")
+			if err != nil {
+				return
+			}
+			var code asn1.Enumerated = 49
+			if password, found := f.directory[string(request.Name)]; found && password == string(request.Password) {
+				code = 0
+			}
+			f.send(conn, message.MessageID, 1, fakeResult{ResultCode: code})
+		case 3:
+			var request fakeSearchRequest
+			_, err = asn1.UnmarshalWithParams(message.ProtocolOp.FullBytes, &request, "application,tag:3")
+			if err != nil {
+				return
+			}
+			var filter fakeAttributeValueAssertion
+			_, err = asn1.UnmarshalWithParams(request.Filter.FullBytes, &filter, "tag:3")
+			if err != nil {
+				return
+			}
+			for dn := range f.directory {
+				if dn == fmt.Sprintf("%s=%s,%s", filter.AttributeDesc, filter.AssertionValue, request.BaseObject) {
+					f.send(conn, message.MessageID, 4, fakeSearchResultEntry{ObjectName: []byte(dn), Attributes: []asn1.RawValue{}})
+				}
+			}
+			f.send(conn, message.MessageID, 5, fakeResult{})
+		case 23:
+			// StartTLS is the only extended operation, it is refused with protocolError if TLS is not configured.
+			if f.tlsConfig == nil {
+				f.send(conn, message.MessageID, 24, fakeResult{ResultCode: 2})
+				continue
+			}
+			f.send(conn, message.MessageID, 24, fakeResult{})
+			conn = tls.Server(conn, f.tlsConfig)
+		default:
+			return
+		}
+	}
+}
+
+func (f *fakeLDAP) send(conn net.Conn, messageID int, tag int, op interface{}) {
+	opBytes, err := asn1.MarshalWithParams(op, fmt.Sprintf("application,tag:%d", tag))
+	if err != nil {
+		return
+	}
+	packet, err := asn1.Marshal(fakeMessage{messageID, asn1.RawValue{FullBytes: opBytes}})
+	if err != nil {
+		return
+	}
+	_, _ = conn.Write(packet)
+}
+
+// readPacket reads a BER element with a one byte tag.
+func readPacket(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		lengthBytes := make([]byte, length&0x7f)
+		_, err = io.ReadFull(r, lengthBytes)
+		if err != nil {
+			return nil, err
+		}
+		length = 0
+		for _, b := range lengthBytes {
+			length = length<<8 | int(b)
+		}
+		header = append(header, lengthBytes...)
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, body...), nil
+}
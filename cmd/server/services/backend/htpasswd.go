@@ -0,0 +1,62 @@
+package backend
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+)
+
+type htpasswd struct {
+	hashes map[string][]byte
+}
+
+// NewHtpasswd returns an Authenticator for an htpasswd file with bcrypt hashes, as written by `htpasswd -B`.
+func NewHtpasswd(path string) (Authenticator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hashes := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected username:hash", path, line)
+		}
+		_, err = bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: only bcrypt hashes are supported: %w", path, line, err)
+		}
+		hashes[username] = []byte(hash)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return &htpasswd{
+		hashes,
+	}, nil
+}
+
+func (h *htpasswd) Name() string {
+	return "htpasswd"
+}
+
+func (h *htpasswd) Authenticate(username string, password string) (backendName string, err error) {
+	hash, found := h.hashes[username]
+	if !found {
+		return "", ErrUnknownUser
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", ErrInvalidCredentials
+	}
+	return h.Name(), nil
+}
@@ -0,0 +1,160 @@
+package backend
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"net"
+	"time"
+)
+
+// LDAPSecurity selects how the connection to the LDAP server is protected.
+type LDAPSecurity string
+
+const (
+	// LDAPStartTLS upgrades a plain connection with StartTLS before binding, it is the default.
+	LDAPStartTLS LDAPSecurity = "starttls"
+	// LDAPS connects with TLS from the start.
+	LDAPS LDAPSecurity = "ldaps"
+	// LDAPPlain sends the passwords in the clear, it is only meant for servers on a trusted network.
+	LDAPPlain LDAPSecurity = "none"
+)
+
+type LDAPConfig struct {
+	// Address is the host:port of the LDAP server.
+	Address string
+	// Security protects the connection, the zero value uses StartTLS.
+	Security LDAPSecurity
+	// TLSConfig configures TLS for LDAPS and StartTLS, the server name defaults to the host of the address.
+	TLSConfig *tls.Config
+	// BindDN and BindPassword are the service account that searches for users, empty binds anonymously.
+	BindDN       string
+	BindPassword string
+	// BaseDN is the subtree users are searched in.
+	BaseDN string
+	// UserAttribute is the attribute that holds the username, usually uid.
+	UserAttribute string
+	Timeout       time.Duration
+}
+
+type ldapBackend struct {
+	config *LDAPConfig
+}
+
+// NewLDAP returns an Authenticator that looks the user up with the service account and binds as the user
+// with the password.
+func NewLDAP(config *LDAPConfig) Authenticator {
+	return &ldapBackend{
+		config,
+	}
+}
+
+func (l *ldapBackend) Name() string {
+	return "ldap"
+}
+
+func (l *ldapBackend) Authenticate(username string, password string) (backendName string, err error) {
+	// An empty password would be an unauthenticated bind, which LDAP servers accept.
+	if password == "" {
+		return "", ErrInvalidCredentials
+	}
+
+	conn, err := l.dial()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if l.config.BindDN == "" {
+		err = conn.UnauthenticatedBind("")
+	} else {
+		err = conn.Bind(l.config.BindDN, l.config.BindPassword)
+	}
+	if err != nil {
+		return "", fmt.Errorf("ldap service bind: %w", err)
+	}
+	var userDN string
+	userDN, err = l.findUser(conn, username)
+	if err != nil {
+		return "", err
+	}
+	err = conn.Bind(userDN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return "", ErrInvalidCredentials
+	}
+	if err != nil {
+		return "", err
+	}
+	return l.Name(), nil
+}
+
+// dial connects to the LDAP server and protects the connection as configured.
+func (l *ldapBackend) dial() (*ldap.Conn, error) {
+	host, _, err := net.SplitHostPort(l.config.Address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if l.config.TLSConfig != nil {
+		tlsConfig = l.config.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	dialer := &net.Dialer{Timeout: l.config.Timeout}
+
+	var conn *ldap.Conn
+	switch l.config.Security {
+	case LDAPS:
+		conn, err = ldap.DialURL("ldaps://"+l.config.Address, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(tlsConfig))
+	case LDAPPlain:
+		conn, err = ldap.DialURL("ldap://"+l.config.Address, ldap.DialWithDialer(dialer))
+	case LDAPStartTLS, "":
+		conn, err = ldap.DialURL("ldap://"+l.config.Address, ldap.DialWithDialer(dialer))
+		if err == nil {
+			err = conn.StartTLS(tlsConfig)
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("ldap starttls: %w", err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid ldap security: %s", l.config.Security)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if l.config.Timeout > 0 {
+		conn.SetTimeout(l.config.Timeout)
+	}
+	return conn, nil
+}
+
+// findUser returns the DN of the single entry below the base DN whose user attribute equals the username.
+func (l *ldapBackend) findUser(conn *ldap.Conn, username string) (string, error) {
+	result, err := conn.Search(ldap.NewSearchRequest(
+		l.config.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		int(l.config.Timeout/time.Second),
+		false,
+		fmt.Sprintf("(%s=%s)", ldap.EscapeFilter(l.config.UserAttribute), ldap.EscapeFilter(username)),
+		// No attributes, only the DN is needed.
+		[]string{"1.1"},
+		nil,
+	))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return "", fmt.Errorf("ldap: several entries match %s=%s", l.config.UserAttribute, username)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(result.Entries) == 0 {
+		return "", ErrUnknownUser
+	}
+	if len(result.Entries) > 1 {
+		return "", fmt.Errorf("ldap: %d entries match %s=%s", len(result.Entries), l.config.UserAttribute, username)
+	}
+	return result.Entries[0].DN, nil
+}
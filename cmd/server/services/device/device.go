@@ -0,0 +1,192 @@
+package device
+
+import (
+	"errors"
+	"filesync/models"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxFieldSize bounds the length of the ID, name and client version a device reports.
+const MaxFieldSize = 256
+
+var (
+	ErrDeviceRevoked  = errors.New("device revoked")
+	ErrDeviceNotFound = errors.New("device not found")
+)
+
+type Service interface {
+	// Seen records a connection of the device of the user, registering the device on its first connection. The
+	// credential identifies what the device authenticated with, it is empty if the device proved itself otherwise.
+	// It returns ErrDeviceRevoked if the device was revoked or the credential was used by a revoked device.
+	Seen(username string, device models.DeviceInfo, credential string) (err error)
+	// IsRevoked returns whether the device of the user was revoked.
+	IsRevoked(username string, id string) bool
+	// List returns the devices of the user, including revoked devices.
+	List(username string) []models.DeviceInfo
+	// Revoke rejects future connections of the device of the user and of every device that uses its credential.
+	Revoke(username string, id string) (err error)
+	// RemoveUser forgets every device of the user, including revoked devices.
+	RemoveUser(username string) (err error)
+}
+
+// record is a device in the registry.
+type record struct {
+	info models.DeviceInfo
+	// credential identifies the credential the device last authenticated with.
+	credential string
+}
+
+type concreteService struct {
+	// devices maps a username to the devices of the user by ID.
+	devices map[string]map[string]*record
+	mutex   sync.RWMutex
+	// path is the store file the devices are persisted to, the devices only live in memory if it is empty.
+	path string
+}
+
+// New returns a device service that keeps the devices in memory.
+func New() Service {
+	return &concreteService{
+		devices: make(map[string]map[string]*record),
+	}
+}
+
+// Open returns a device service that persists the devices to the store file at path, loading the devices it
+// already holds, so revocations survive a restart.
+func Open(path string) (Service, error) {
+	devices, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Loaded the devices of %d users from %s", len(devices), path)
+	return &concreteService{
+		devices: devices,
+		path:    path,
+	}, nil
+}
+
+func (d *concreteService) Seen(username string, device models.DeviceInfo, credential string) (err error) {
+	if device.ID == "" {
+		return fmt.Errorf("device ID is required")
+	}
+	if len(device.ID) > MaxFieldSize || len(device.Name) > MaxFieldSize || len(device.ClientVersion) > MaxFieldSize {
+		return fmt.Errorf("device fields are limited to %d bytes", MaxFieldSize)
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	userDevices, found := d.devices[username]
+	// The credential of a revoked device is compromised, a device that changed its ID does not get in with it.
+	if credential != "" {
+		for _, known := range userDevices {
+			if !known.info.RevokedAt.IsZero() && known.credential == credential {
+				return fmt.Errorf("%w: the credential was used by revoked device %s", ErrDeviceRevoked, known.info.ID)
+			}
+		}
+	}
+	if !found {
+		userDevices = make(map[string]*record)
+		d.devices[username] = userDevices
+	}
+	now := time.Now()
+	known, found := userDevices[device.ID]
+	if !found {
+		userDevices[device.ID] = &record{
+			info: models.DeviceInfo{
+				ID:            device.ID,
+				Name:          device.Name,
+				Username:      username,
+				ClientVersion: device.ClientVersion,
+				FirstSeen:     now,
+				LastSeen:      now,
+			},
+			credential: credential,
+		}
+		err = d.persist()
+		if err != nil {
+			delete(userDevices, device.ID)
+		}
+		return err
+	}
+	if !known.info.RevokedAt.IsZero() {
+		return ErrDeviceRevoked
+	}
+	previous := *known
+	known.info.Name = device.Name
+	known.info.ClientVersion = device.ClientVersion
+	known.info.LastSeen = now
+	if credential != "" {
+		known.credential = credential
+	}
+	err = d.persist()
+	if err != nil {
+		*known = previous
+	}
+	return err
+}
+
+func (d *concreteService) IsRevoked(username string, id string) bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	known, found := d.devices[username][id]
+	return found && !known.info.RevokedAt.IsZero()
+}
+
+func (d *concreteService) List(username string) []models.DeviceInfo {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	infos := make([]models.DeviceInfo, 0, len(d.devices[username]))
+	for _, known := range d.devices[username] {
+		infos = append(infos, known.info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].FirstSeen.Before(infos[j].FirstSeen)
+	})
+	return infos
+}
+
+func (d *concreteService) Revoke(username string, id string) (err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	known, found := d.devices[username][id]
+	if !found {
+		return ErrDeviceNotFound
+	}
+	if !known.info.RevokedAt.IsZero() {
+		return nil
+	}
+	known.info.RevokedAt = time.Now()
+	err = d.persist()
+	if err != nil {
+		known.info.RevokedAt = time.Time{}
+	}
+	return err
+}
+
+func (d *concreteService) RemoveUser(username string) (err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	userDevices, found := d.devices[username]
+	if !found {
+		return nil
+	}
+	delete(d.devices, username)
+	err = d.persist()
+	if err != nil {
+		d.devices[username] = userDevices
+	}
+	return err
+}
+
+// persist writes the devices to the store file, the caller holds the write lock so concurrent changes are
+// serialised.
+func (d *concreteService) persist() error {
+	if d.path == "" {
+		return nil
+	}
+	return save(d.path, d.devices)
+}
@@ -0,0 +1,93 @@
+package device_test
+
+import (
+	"filesync/models"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"server/services/device"
+	"strings"
+	"testing"
+)
+
+const testUser = "test1"
+
+func TestSeen(t *testing.T) {
+	deviceService := device.New()
+	assert.NoError(t, deviceService.Seen(testUser, models.DeviceInfo{ID: "laptop", Name: "Laptop", ClientVersion: "1.0.0"}, ""))
+	assert.NoError(t, deviceService.Seen(testUser, models.DeviceInfo{ID: "laptop", Name: "Work laptop", ClientVersion: "1.1.0"}, ""))
+	assert.NoError(t, deviceService.Seen(testUser, models.DeviceInfo{ID: "phone"}, ""))
+
+	devices := deviceService.List(testUser)
+	assert.Len(t, devices, 2)
+	assert.Equal(t, "laptop", devices[0].ID)
+	assert.Equal(t, "Work laptop", devices[0].Name)
+	assert.Equal(t, "1.1.0", devices[0].ClientVersion)
+	assert.Equal(t, testUser, devices[0].Username)
+	assert.False(t, devices[0].LastSeen.Before(devices[0].FirstSeen))
+	assert.Empty(t, deviceService.List("test2"), "Expected devices to belong to their user")
+
+	assert.Error(t, deviceService.Seen(testUser, models.DeviceInfo{}, ""), "Expected a device ID to be required")
+	assert.Error(t, deviceService.Seen(testUser, models.DeviceInfo{ID: strings.Repeat("x", device.MaxFieldSize+1)}, ""))
+}
+
+func TestRevoke(t *testing.T) {
+	deviceService := device.New()
+	assert.NoError(t, deviceService.Seen(testUser, models.DeviceInfo{ID: "laptop"}, ""))
+
+	assert.NoError(t, deviceService.Revoke(testUser, "laptop"))
+	assert.True(t, deviceService.IsRevoked(testUser, "laptop"))
+	assert.ErrorIs(t, deviceService.Seen(testUser, models.DeviceInfo{ID: "laptop"}, ""), device.ErrDeviceRevoked)
+	assert.False(t, deviceService.List(testUser)[0].RevokedAt.IsZero())
+
+	assert.False(t, deviceService.IsRevoked("test2", "laptop"), "Expected revocation to apply to the user only")
+	assert.NoError(t, deviceService.Seen("test2", models.DeviceInfo{ID: "laptop"}, ""))
+	assert.ErrorIs(t, deviceService.Revoke(testUser, "unknown"), device.ErrDeviceNotFound)
+}
+
+func TestRemoveUser(t *testing.T) {
+	deviceService := device.New()
+	assert.NoError(t, deviceService.Seen(testUser, models.DeviceInfo{ID: "laptop"}, ""))
+	assert.NoError(t, deviceService.Revoke(testUser, "laptop"))
+	assert.NoError(t, deviceService.Seen("test2", models.DeviceInfo{ID: "laptop"}, ""))
+
+	assert.NoError(t, deviceService.RemoveUser(testUser))
+	assert.Empty(t, deviceService.List(testUser))
+	assert.False(t, deviceService.IsRevoked(testUser, "laptop"))
+	assert.Len(t, deviceService.List("test2"), 1)
+}
+
+func TestRevoke_Credential(t *testing.T) {
+	deviceService := device.New()
+	assert.NoError(t, deviceService.Seen(testUser, models.DeviceInfo{ID: "laptop"}, "key:1"))
+	assert.NoError(t, deviceService.Seen(testUser, models.DeviceInfo{ID: "phone"}, "key:2"))
+	assert.NoError(t, deviceService.Revoke(testUser, "laptop"))
+
+	// A revoked device does not get in by changing its ID, nor does another device with the same credential.
+	assert.ErrorIs(t, deviceService.Seen(testUser, models.DeviceInfo{ID: "laptop2"}, "key:1"), device.ErrDeviceRevoked)
+	assert.ErrorIs(t, deviceService.Seen(testUser, models.DeviceInfo{ID: "phone"}, "key:1"), device.ErrDeviceRevoked)
+	assert.NoError(t, deviceService.Seen(testUser, models.DeviceInfo{ID: "phone"}, "key:2"))
+	assert.NoError(t, deviceService.Seen(testUser, models.DeviceInfo{ID: "laptop2"}, "key:3"), "Expected a new credential to get in")
+	assert.NoError(t, deviceService.Seen("test2", models.DeviceInfo{ID: "laptop"}, "key:1"), "Expected revocation to apply to the user only")
+}
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	deviceService, err := device.Open(path)
+	assert.NoError(t, err)
+	assert.NoError(t, deviceService.Seen(testUser, models.DeviceInfo{ID: "laptop", Name: "Laptop"}, "key:1"))
+	assert.NoError(t, deviceService.Seen(testUser, models.DeviceInfo{ID: "phone"}, "key:2"))
+	assert.NoError(t, deviceService.Revoke(testUser, "laptop"))
+
+	// A restarted server still rejects the revoked device and its credential.
+	reopened, err := device.Open(path)
+	assert.NoError(t, err)
+	devices := reopened.List(testUser)
+	if assert.Len(t, devices, 2) {
+		assert.Equal(t, "laptop", devices[0].ID)
+		assert.Equal(t, "Laptop", devices[0].Name)
+		assert.True(t, devices[0].RevokedAt.Equal(deviceService.List(testUser)[0].RevokedAt))
+	}
+	assert.True(t, reopened.IsRevoked(testUser, "laptop"))
+	assert.ErrorIs(t, reopened.Seen(testUser, models.DeviceInfo{ID: "tablet"}, "key:1"), device.ErrDeviceRevoked)
+	assert.NoError(t, reopened.Seen(testUser, models.DeviceInfo{ID: "phone"}, "key:2"))
+}
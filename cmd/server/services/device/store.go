@@ -0,0 +1,95 @@
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"filesync/models"
+	"fmt"
+	"os"
+	"server/pkg/atomicfile"
+	"time"
+)
+
+// schemaVersion is the version of the store file written by this server.
+const schemaVersion = 1
+
+// storeFile is the on-disk format of the device store.
+type storeFile struct {
+	Version int
+	// Devices maps a username to the devices of the user by ID.
+	Devices map[string]map[string]storedDevice
+}
+
+type storedDevice struct {
+	Name          string
+	ClientVersion string
+	FirstSeen     time.Time
+	LastSeen      time.Time
+	RevokedAt     time.Time
+	Credential    string
+}
+
+// load reads the store file at path. A missing file is an empty store.
+func load(path string) (devices map[string]map[string]*record, err error) {
+	devices = make(map[string]map[string]*record)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return devices, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stored storeFile
+	err = json.Unmarshal(data, &stored)
+	if err != nil {
+		return nil, fmt.Errorf("device store %s: %w", path, err)
+	}
+	if stored.Version != schemaVersion {
+		return nil, fmt.Errorf("device store %s: unsupported schema version %d", path, stored.Version)
+	}
+	for username, userDevices := range stored.Devices {
+		devices[username] = make(map[string]*record, len(userDevices))
+		for id, d := range userDevices {
+			devices[username][id] = &record{
+				info: models.DeviceInfo{
+					ID:            id,
+					Name:          d.Name,
+					Username:      username,
+					ClientVersion: d.ClientVersion,
+					FirstSeen:     d.FirstSeen,
+					LastSeen:      d.LastSeen,
+					RevokedAt:     d.RevokedAt,
+				},
+				credential: d.Credential,
+			}
+		}
+	}
+	return devices, nil
+}
+
+// save replaces the store file at path, a crash leaves either the old or the new store.
+func save(path string, devices map[string]map[string]*record) error {
+	stored := storeFile{
+		Version: schemaVersion,
+		Devices: make(map[string]map[string]storedDevice, len(devices)),
+	}
+	for username, userDevices := range devices {
+		stored.Devices[username] = make(map[string]storedDevice, len(userDevices))
+		for id, r := range userDevices {
+			stored.Devices[username][id] = storedDevice{
+				Name:          r.info.Name,
+				ClientVersion: r.info.ClientVersion,
+				FirstSeen:     r.info.FirstSeen,
+				LastSeen:      r.info.LastSeen,
+				RevokedAt:     r.info.RevokedAt,
+				Credential:    r.credential,
+			}
+		}
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, data, 0600)
+}
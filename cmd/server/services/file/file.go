@@ -1,16 +1,24 @@
 package file
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
+	"filesync/enums"
 	"filesync/models"
 	"fmt"
 	"io"
 	"io/fs"
+	"maps"
 	"os"
 	"path/filepath"
+	"regexp"
 	"server/pkg/cache"
 	"server/pkg/fileparser"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Service interface {
@@ -18,129 +26,628 @@ type Service interface {
 	GetFileInfo(hash string) (fileInfo *models.FileInfoBytes, found bool)
 	// GetFile returns a file reader for the file with the given TransactionID.
 	GetFile(hash string) (file *bytes.Buffer, err error)
+	// OpenFile returns a reader of the content of the file with the given hash, the caller closes it. The reader keeps
+	// the content the file had when it was opened.
+	OpenFile(hash string) (reader io.ReadCloser, fileInfo *models.FileInfo, err error)
+	// OpenFileRange is OpenFile limited to length bytes of the content starting at offset. A negative length or one
+	// past the end of the content reads to the end.
+	OpenFileRange(hash string, offset int64, length int64) (reader io.ReadCloser, fileInfo *models.FileInfo, err error)
 	// CreateFile adds a new file to the file service.
 	CreateFile(hash string, checksum string, stream []byte) (err error)
+	// CreateFileFromReader adds a new file to the file service with the content read from the reader. The file is
+	// replaced once the content was read completely, so a failed write keeps the previous file.
+	CreateFileFromReader(hash string, checksum string, reader io.Reader) (err error)
 	// DeleteFile deletes the file with the given TransactionID.
 	DeleteFile(hash string) (err error)
 	// GetFileMap returns the file map.
 	GetFileMap() map[string]*models.FileInfoBytes
+	// Watch registers a handler that is called after every committed change. The returned function removes it.
+	Watch(handler ChangeHandler) (unwatch func())
+	// Usage returns the bytes and files stored in the directory and the quota they count against.
+	Usage() models.Usage
+	// SetQuota limits the storage of the directory. It applies to every service of the same factory directory.
+	SetQuota(quota models.Quota)
+	// Close releases the service. The factory keeps the shared service of the directory open until it has been idle
+	// for the idle timeout.
+	Close()
 }
 
+// ChangeHandler is called with every change committed by a file service.
+type ChangeHandler func(change models.FileChange)
+
 type Factory interface {
+	// New returns a service for the directory. Every service of a directory shares one view of its files, it is read
+	// from the disk when the first service is opened.
 	New(dir string) (Service, error)
+	// NewLibrary returns a service for the named library of the directory, a separate set of files whose usage also
+	// counts against the quota of the directory.
+	NewLibrary(dir string, library string) (Service, error)
+	// Exists returns whether the directory already exists in the base directory.
+	Exists(dir string) bool
+	// Remove deletes the directory and every file in it, including its libraries and shares, from the base directory.
+	Remove(dir string) (err error)
+	// RemoveLibrary deletes the named library of the directory and every file in it.
+	RemoveLibrary(dir string, library string) (err error)
+	// NewShare returns a service for the shared library of the directory, it counts against the quota of the
+	// directory like a library.
+	NewShare(dir string, share string) (Service, error)
+	// RemoveShare deletes the shared library of the directory and every file in it.
+	RemoveShare(dir string, share string) (err error)
+	// MoveShare moves a directory of the base directory into the shared libraries of another directory.
+	MoveShare(from string, dir string, share string) (err error)
+}
+
+// librariesDir is the subdirectory of a directory that holds its libraries, files are never stored in
+// subdirectories.
+const librariesDir = ".libraries"
+
+// sharesDir is the subdirectory of a directory that holds the libraries it shares with other users.
+const sharesDir = ".shares"
+
+// tempPrefix starts the names of the temporary files written before they replace a file.
+const tempPrefix = ".tmp-"
+
+var libraryNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$`)
+
+// hashPattern matches the hashes that name files. They cannot leave the directory or collide with the libraries and
+// temporary files, whose names start with a dot.
+var hashPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$`)
+
+var ErrFileNotFound = errors.New("file not found")
+
+var ErrInvalidHash = errors.New("file hashes have 1 to 64 letters, digits, dashes or underscores")
+
+// ValidateHash returns ErrInvalidHash if the hash cannot name a file.
+func ValidateHash(hash string) error {
+	if !hashPattern.MatchString(hash) {
+		return fmt.Errorf("%w: %q", ErrInvalidHash, hash)
+	}
+	return nil
+}
+
+// ValidateLibraryName returns an error if the name cannot name a library.
+func ValidateLibraryName(name string) error {
+	if !libraryNamePattern.MatchString(name) {
+		return fmt.Errorf("library names have 1 to 64 letters, digits, dashes or underscores: %q", name)
+	}
+	return nil
 }
 
 type concreteFactory struct {
 	baseDir   string
 	fileCache cache.Cache
 	metaCache cache.Cache
+	// usages holds the usage of every directory, so the services of a directory share one quota.
+	usages map[string]*usage
+	// services holds the open service of every directory, which is shared by its users until it is idle.
+	services    map[string]*openService
+	idleTimeout time.Duration
+	mutex       sync.Mutex
+}
+
+// openService is the shared service of a directory, refs counts its handles that were not closed yet.
+type openService struct {
+	service *concreteService
+	refs    int
+	// idleTimer closes the service once it has been idle for the idle timeout.
+	idleTimer *time.Timer
+}
+
+// DefaultIdleTimeout is how long the factories of NewFactory keep the service of a directory open after it was closed.
+const DefaultIdleTimeout = 5 * time.Minute
+
+type FactoryConfig struct {
+	BaseDir string
+	// IdleTimeout is how long the service of a directory stays open after its last user closed it.
+	IdleTimeout time.Duration
 }
 
 func NewFactory(baseDir string, fileCache cache.Cache, metaCache cache.Cache) Factory {
+	return NewFactoryWithConfig(&FactoryConfig{
+		BaseDir:     baseDir,
+		IdleTimeout: DefaultIdleTimeout,
+	}, fileCache, metaCache)
+}
+
+func NewFactoryWithConfig(config *FactoryConfig, fileCache cache.Cache, metaCache cache.Cache) Factory {
 	return &concreteFactory{
-		baseDir,
-		fileCache,
-		metaCache,
+		baseDir:     config.BaseDir,
+		idleTimeout: config.IdleTimeout,
+		fileCache:   fileCache,
+		metaCache:   metaCache,
+		usages:      make(map[string]*usage),
+		services:    make(map[string]*openService),
 	}
 }
 
 func (f *concreteFactory) New(userDir string) (Service, error) {
-	return New(filepath.Join(f.baseDir, userDir))
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	service, err := f.open(filepath.Join(f.baseDir, userDir), nil)
+	if err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+func (f *concreteFactory) NewLibrary(userDir string, library string) (Service, error) {
+	err := ValidateLibraryName(library)
+	if err != nil {
+		return nil, err
+	}
+	return f.openChild(userDir, librariesDir, library)
+}
+
+func (f *concreteFactory) NewShare(userDir string, share string) (Service, error) {
+	err := validateShare(share)
+	if err != nil {
+		return nil, err
+	}
+	return f.openChild(userDir, sharesDir, share)
+}
+
+// validateShare returns an error if the name cannot name a shared library.
+func validateShare(share string) error {
+	if !libraryNamePattern.MatchString(share) {
+		return fmt.Errorf("invalid share: %q", share)
+	}
+	return nil
+}
+
+// openChild returns a service for the named subdirectory of the given kind, its usage counts against the usage of
+// the directory.
+func (f *concreteFactory) openChild(userDir string, kind string, name string) (Service, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	// The usage of the directory counts the files of its libraries, it has to be known before a library is changed.
+	dir := filepath.Join(f.baseDir, userDir)
+	parentUsage, err := f.usageOf(dir)
+	if err != nil {
+		return nil, err
+	}
+	service, err := f.open(filepath.Join(dir, kind, name), parentUsage)
+	if err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// usageOf returns the usage of the directory, reading the directory if it was not read yet. The caller holds the
+// lock.
+func (f *concreteFactory) usageOf(dir string) (*usage, error) {
+	dirUsage, found := f.usages[dir]
+	if found {
+		return dirUsage, nil
+	}
+	parent := &openService{}
+	var err error
+	parent.service, err = f.newService(dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	// The service of the directory is kept for a while, it is likely opened next.
+	f.services[dir] = parent
+	f.idle(dir, parent)
+	return parent.service.usage, nil
+}
+
+// open returns a handle of the shared service of the directory, reading the directory if its service is not open.
+// The caller holds the lock.
+func (f *concreteFactory) open(dir string, parent *usage) (*handle, error) {
+	opened, found := f.services[dir]
+	if !found {
+		service, err := f.newService(dir, parent)
+		if err != nil {
+			return nil, err
+		}
+		opened = &openService{service: service}
+		f.services[dir] = opened
+	}
+	if opened.idleTimer != nil {
+		opened.idleTimer.Stop()
+		opened.idleTimer = nil
+	}
+	opened.refs++
+	return newHandle(opened.service, func() {
+		f.release(dir, opened)
+	}), nil
+}
+
+// release drops a handle of the shared service of the directory.
+func (f *concreteFactory) release(dir string, opened *openService) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	opened.refs--
+	// A removed directory has no open service to close.
+	if opened.refs > 0 || f.services[dir] != opened {
+		return
+	}
+	f.idle(dir, opened)
+}
+
+// idle closes the service of the directory once it has been idle for the idle timeout, the caller holds the lock.
+func (f *concreteFactory) idle(dir string, opened *openService) {
+	var idleTimer *time.Timer
+	idleTimer = time.AfterFunc(f.idleTimeout, func() {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		// The timer may fire after the service was opened again, only the timer of the last release closes it.
+		if opened.idleTimer == idleTimer && f.services[dir] == opened {
+			delete(f.services, dir)
+		}
+	})
+	opened.idleTimer = idleTimer
+}
+
+// newService creates a service for the directory that shares the usage of the other services of the directory,
+// the caller holds the lock. The usage of a new directory counts against the parent usage, if given.
+func (f *concreteFactory) newService(dir string, parent *usage) (*concreteService, error) {
+	dirUsage, found := f.usages[dir]
+	// The temporary files of an open service may belong to writes that are still running.
+	_, open := f.services[dir]
+	service, err := newService(dir, dirUsage, !open)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		service.usage.parent = parent
+		f.usages[dir] = service.usage
+	}
+	return service, nil
+}
+
+func (f *concreteFactory) Exists(userDir string) bool {
+	info, err := os.Stat(filepath.Join(f.baseDir, userDir))
+	return err == nil && info.IsDir()
+}
+
+func (f *concreteFactory) Remove(userDir string) (err error) {
+	dir := filepath.Join(f.baseDir, userDir)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	for path := range f.usages {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			delete(f.usages, path)
+		}
+	}
+	for path, opened := range f.services {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			f.close(path, opened)
+		}
+	}
+	return nil
+}
+
+// close closes the service of the directory at once, the handles that are still open keep working on the removed
+// directory. The caller holds the lock.
+func (f *concreteFactory) close(dir string, opened *openService) {
+	if opened.idleTimer != nil {
+		opened.idleTimer.Stop()
+	}
+	delete(f.services, dir)
+}
+
+func (f *concreteFactory) RemoveLibrary(userDir string, library string) (err error) {
+	err = ValidateLibraryName(library)
+	if err != nil {
+		return err
+	}
+	return f.removeChild(userDir, librariesDir, library)
+}
+
+func (f *concreteFactory) RemoveShare(userDir string, share string) (err error) {
+	err = validateShare(share)
+	if err != nil {
+		return err
+	}
+	return f.removeChild(userDir, sharesDir, share)
+}
+
+// removeChild deletes the named subdirectory of the given kind and releases its files from the usage of the
+// directory.
+func (f *concreteFactory) removeChild(userDir string, kind string, name string) (err error) {
+	dir := filepath.Join(f.baseDir, userDir, kind, name)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	// Release the files from the usage of the directory, whether or not the subdirectory was opened.
+	childUsage, found := f.usages[dir]
+	if !found {
+		var service *concreteService
+		service, err = f.newService(dir, f.usages[filepath.Join(f.baseDir, userDir)])
+		if err != nil {
+			return err
+		}
+		childUsage = service.usage
+	}
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	current := childUsage.get()
+	childUsage.release(current.Bytes, current.Files)
+	delete(f.usages, dir)
+	if opened, found := f.services[dir]; found {
+		f.close(dir, opened)
+	}
+	return nil
+}
+
+func (f *concreteFactory) MoveShare(from string, userDir string, share string) (err error) {
+	err = validateShare(share)
+	if err != nil {
+		return err
+	}
+	source := filepath.Join(f.baseDir, from)
+	parentDir := filepath.Join(f.baseDir, userDir)
+	dir := filepath.Join(parentDir, sharesDir, share)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err = os.MkdirAll(filepath.Dir(dir), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(source, dir)
+	if err != nil {
+		return err
+	}
+	delete(f.usages, source)
+	if opened, found := f.services[source]; found {
+		f.close(source, opened)
+	}
+	// A directory that was read already does not count the moved files yet.
+	parentUsage, found := f.usages[parentDir]
+	if found {
+		service, err := f.newService(dir, parentUsage)
+		if err != nil {
+			return err
+		}
+		current := service.usage.get()
+		parentUsage.add(current.Bytes, current.Files)
+	}
+	return nil
 }
 
+// concreteService holds the files of a directory, the handles of the directory share it.
 type concreteService struct {
 	dir           string
 	syncedFileMap map[string]*models.FileInfoBytes
-	mutexes       *sync.Map
+	// mapMutex guards the file map, the mutexes guard the files.
+	mapMutex sync.RWMutex
+	mutexes  *sync.Map
+	usage    *usage
+}
+
+// handle is a reference to the service of a directory. The watchers belong to the handle, so they are only called
+// with the changes made through it and every session publishes its own changes.
+type handle struct {
+	*concreteService
+	watchers      *sync.Map
+	nextWatcherID atomic.Uint64
+	closeOnce     sync.Once
+	release       func()
 }
 
 func New(dir string) (Service, error) {
-	fileMap, mutexes, err := initFileMap(dir)
+	service, err := newService(dir, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	return newHandle(service, func() {}), nil
+}
+
+func newHandle(service *concreteService, release func()) *handle {
+	return &handle{
+		concreteService: service,
+		watchers:        &sync.Map{},
+		release:         release,
+	}
+}
+
+// newService creates a service for the directory that counts against the given usage. A nil usage is
+// initialized from the files in the directory and its libraries. Interrupted writes are cleaned up if removeTemp is
+// set.
+func newService(dir string, dirUsage *usage, removeTemp bool) (*concreteService, error) {
+	fileMap, mutexes, size, count, err := initFileMap(dir, removeTemp)
 	if err != nil {
 		return nil, err
 	}
+	if dirUsage == nil {
+		dirUsage = &usage{
+			bytes: size,
+			files: count,
+		}
+	}
 	return &concreteService{
-		dir,
-		fileMap,
-		mutexes,
+		dir:           dir,
+		syncedFileMap: fileMap,
+		mutexes:       mutexes,
+		usage:         dirUsage,
 	}, nil
 }
 
 func (s *concreteService) GetFileInfo(hash string) (fileInfo *models.FileInfoBytes, found bool) {
+	s.mapMutex.RLock()
+	defer s.mapMutex.RUnlock()
 	fileInfo, found = s.syncedFileMap[hash]
 	return fileInfo, found
 }
 
 func (s *concreteService) GetFile(hash string) (fileBuffer *bytes.Buffer, err error) {
-	syncedFile, found := s.syncedFileMap[hash]
-	if !found {
-		return nil, fmt.Errorf("file not found")
+	reader, _, err := s.OpenFile(hash)
+	if err != nil {
+		return nil, err
 	}
+	defer reader.Close()
 
-	// Lock the file
-	mutex, _ := s.mutexes.LoadOrStore(syncedFile.GetHash(), &sync.Mutex{})
-	mutex.(*sync.Mutex).Lock()
-	defer mutex.(*sync.Mutex).Unlock()
+	var buffer bytes.Buffer
+	_, err = io.Copy(&buffer, reader)
+	if err != nil {
+		return nil, err
+	}
+	return &buffer, nil
+}
+
+func (s *concreteService) OpenFile(hash string) (reader io.ReadCloser, fileInfo *models.FileInfo, err error) {
+	return s.OpenFileRange(hash, 0, -1)
+}
+
+func (s *concreteService) OpenFileRange(hash string, offset int64, length int64) (reader io.ReadCloser, fileInfo *models.FileInfo, err error) {
+	err = ValidateHash(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	syncedFile, found := s.GetFileInfo(hash)
+	if !found {
+		return nil, nil, ErrFileNotFound
+	}
 
-	// Open the file
+	// Writes replace the file instead of changing it, so the open file keeps its content without a lock.
 	var file *os.File
 	file, err = os.Open(filepath.Join(s.dir, hash))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer file.Close()
-
-	// Read the file into a buffer
-	var buffer bytes.Buffer
-	_, err = io.Copy(&buffer, file)
+	defer func() {
+		if err != nil {
+			file.Close()
+		}
+	}()
+	var info os.FileInfo
+	info, err = file.Stat()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Discard the checksum
-	_, err = buffer.ReadString('\n')
+	// The content follows the checksum and its newline and is followed by a newline.
+	var checksumLine string
+	checksumLine, err = bufio.NewReader(file).ReadString('\n')
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	start := int64(len(checksumLine))
+	size := info.Size() - start - 1
+	if offset < 0 || offset > size {
+		return nil, nil, fmt.Errorf("offset %d is outside of the file", offset)
+	}
+	if length < 0 || length > size-offset {
+		length = size - offset
+	}
+	return &fileReader{io.NewSectionReader(file, start+offset, length), file}, syncedFile.GetFileInfo(), nil
+}
 
-	return &buffer, nil
+// fileReader reads a section of an open file and closes the file.
+type fileReader struct {
+	*io.SectionReader
+	io.Closer
 }
 
 func (s *concreteService) CreateFile(hash string, checksum string, stream []byte) (err error) {
-	mutex, _ := s.mutexes.LoadOrStore(hash, &sync.Mutex{})
-	mutex.(*sync.Mutex).Lock()
-	defer mutex.(*sync.Mutex).Unlock()
+	return s.CreateFileFromReader(hash, checksum, bytes.NewReader(stream))
+}
 
-	var file *os.File
-	file, err = os.Create(filepath.Join(s.dir, hash))
+func (s *concreteService) CreateFileFromReader(hash string, checksum string, reader io.Reader) (err error) {
+	err = ValidateHash(hash)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	mutex, _ := s.mutexes.LoadOrStore(hash, &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	defer mutex.(*sync.Mutex).Unlock()
 
+	path := filepath.Join(s.dir, hash)
 	checksumBytes := []byte(fmt.Sprintf("%s\n", checksum))
-	_, err = file.Write(checksumBytes)
 
-	_, err = file.Write(stream)
+	// Replacing a file only counts the difference in size.
+	var existingSize int64
+	filesDelta := 1
+	var existing os.FileInfo
+	existing, err = os.Stat(path)
+	if err == nil {
+		if existing.IsDir() {
+			return fmt.Errorf("file is a directory")
+		}
+		existingSize, filesDelta = existing.Size(), 0
+	}
+
+	// The size of the content is not known before it is read, so reading stops as soon as it exceeds the quota.
+	// A file that shrinks is always accepted, the reservation below has the final say.
+	maxSize := int64(-1)
+	if available, limited := s.usage.available(); limited {
+		maxSize = max(max(available, 0)+existingSize-int64(len(checksumBytes))-1, 0)
+		reader = io.LimitReader(reader, maxSize+1)
+	}
+
+	var temp *os.File
+	temp, err = os.CreateTemp(s.dir, tempPrefix+"*")
 	if err != nil {
 		return err
 	}
-	_, err = file.Write([]byte("\n"))
+	defer func() {
+		if err != nil {
+			os.Remove(temp.Name())
+		}
+	}()
+	var written int64
+	written, err = writeFile(temp, checksumBytes, reader)
 	if err != nil {
 		return err
 	}
+	if maxSize >= 0 && written > maxSize {
+		return ErrQuotaExceeded
+	}
 
 	var fileInfo os.FileInfo
-	fileInfo, err = file.Stat()
+	fileInfo, err = os.Stat(temp.Name())
+	if err != nil {
+		return err
+	}
+	bytesDelta := fileInfo.Size() - existingSize
+	err = s.usage.reserve(bytesDelta, filesDelta)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(temp.Name(), path)
 	if err != nil {
+		s.usage.release(bytesDelta, filesDelta)
 		return err
 	}
 
+	s.mapMutex.Lock()
 	s.syncedFileMap[hash] = models.NewFileInfoBytes(hash, checksum, fileInfo.ModTime())
+	s.mapMutex.Unlock()
 	return nil
 }
 
+// writeFile writes the checksum line and the content followed by a newline to the file and closes it. It returns the
+// size of the content.
+func writeFile(file *os.File, checksumBytes []byte, reader io.Reader) (written int64, err error) {
+	defer func() {
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	_, err = file.Write(checksumBytes)
+	if err != nil {
+		return 0, err
+	}
+	written, err = io.Copy(file, reader)
+	if err != nil {
+		return written, err
+	}
+	_, err = file.Write([]byte("\n"))
+	return written, err
+}
+
 func (s *concreteService) DeleteFile(hash string) (err error) {
+	err = ValidateHash(hash)
+	if err != nil {
+		return err
+	}
 	mutex, _ := s.mutexes.LoadOrStore(hash, &sync.Mutex{})
 	mutex.(*sync.Mutex).Lock()
 	defer func(mutex *sync.Mutex) {
@@ -151,7 +658,10 @@ func (s *concreteService) DeleteFile(hash string) (err error) {
 	var info os.FileInfo
 	info, err = os.Stat(filepath.Join(s.dir, hash))
 	if os.IsNotExist(err) {
-		return fmt.Errorf("file not found")
+		return ErrFileNotFound
+	}
+	if err != nil {
+		return err
 	}
 
 	if info.IsDir() {
@@ -162,20 +672,86 @@ func (s *concreteService) DeleteFile(hash string) (err error) {
 	if err != nil {
 		return err
 	}
+	s.usage.release(info.Size(), 1)
 
+	s.mapMutex.Lock()
 	delete(s.syncedFileMap, hash)
+	s.mapMutex.Unlock()
 	return nil
 }
 
+// GetFileMap returns a copy of the file map, the files of the directory may change while it is used.
 func (s *concreteService) GetFileMap() map[string]*models.FileInfoBytes {
-	return s.syncedFileMap
+	s.mapMutex.RLock()
+	defer s.mapMutex.RUnlock()
+	return maps.Clone(s.syncedFileMap)
+}
+
+func (s *concreteService) Usage() models.Usage {
+	return s.usage.get()
+}
+
+func (s *concreteService) SetQuota(quota models.Quota) {
+	s.usage.setQuota(quota)
+}
+
+func (h *handle) CreateFile(hash string, checksum string, stream []byte) (err error) {
+	return h.CreateFileFromReader(hash, checksum, bytes.NewReader(stream))
+}
+
+func (h *handle) CreateFileFromReader(hash string, checksum string, reader io.Reader) (err error) {
+	err = h.concreteService.CreateFileFromReader(hash, checksum, reader)
+	if err != nil {
+		return err
+	}
+	h.notify(models.FileChange{
+		Hash:      hash,
+		Checksum:  checksum,
+		Operation: enums.FileCreated,
+	})
+	return nil
 }
 
-func initFileMap(baseDir string) (fileMap map[string]*models.FileInfoBytes, mutexes *sync.Map, err error) {
+func (h *handle) DeleteFile(hash string) (err error) {
+	err = h.concreteService.DeleteFile(hash)
+	if err != nil {
+		return err
+	}
+	h.notify(models.FileChange{
+		Hash:      hash,
+		Operation: enums.FileDeleted,
+	})
+	return nil
+}
+
+func (h *handle) Watch(handler ChangeHandler) (unwatch func()) {
+	id := h.nextWatcherID.Add(1)
+	h.watchers.Store(id, handler)
+	return func() {
+		h.watchers.Delete(id)
+	}
+}
+
+func (h *handle) Close() {
+	h.closeOnce.Do(h.release)
+}
+
+// notify calls every watcher of the handle with the change.
+func (h *handle) notify(change models.FileChange) {
+	h.watchers.Range(func(_, handler any) bool {
+		handler.(ChangeHandler)(change)
+		return true
+	})
+}
+
+// initFileMap reads the files in the directory. It also returns the total size and number of the files, including
+// the files of its libraries. The temporary files of the directory itself are removed if removeTemp is set, the
+// temporary files of its libraries and shares belong to their own services.
+func initFileMap(baseDir string, removeTemp bool) (fileMap map[string]*models.FileInfoBytes, mutexes *sync.Map, size int64, count int, err error) {
 	var normalizedBaseDir string
 	normalizedBaseDir, err = filepath.Abs(baseDir)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, 0, 0, err
 	}
 	normalizedBaseDir = filepath.Clean(normalizedBaseDir)
 
@@ -183,7 +759,7 @@ func initFileMap(baseDir string) (fileMap map[string]*models.FileInfoBytes, mute
 	if os.IsNotExist(err) {
 		err = os.MkdirAll(normalizedBaseDir, os.ModePerm)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, 0, 0, err
 		}
 	}
 
@@ -198,6 +774,20 @@ func initFileMap(baseDir string) (fileMap map[string]*models.FileInfoBytes, mute
 			// Skip directories
 			return nil
 		}
+		if strings.HasPrefix(info.Name(), tempPrefix) {
+			if removeTemp && filepath.Dir(path) == normalizedBaseDir {
+				// The write of the temporary file was interrupted, the file it was meant to replace is intact.
+				return os.Remove(path)
+			}
+			// Temporary files are not files of the directory until they replace one.
+			return nil
+		}
+		size += info.Size()
+		count++
+		if filepath.Dir(path) != normalizedBaseDir {
+			// Files in subdirectories belong to libraries and shares, which have their own services.
+			return nil
+		}
 
 		mutex, _ := mutexes.LoadOrStore(info.Name(), &sync.Mutex{})
 		mutex.(*sync.Mutex).Lock()
@@ -226,7 +816,7 @@ func initFileMap(baseDir string) (fileMap map[string]*models.FileInfoBytes, mute
 		return nil
 	})
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, 0, 0, err
 	}
-	return fileMap, mutexes, nil
+	return fileMap, mutexes, size, count, nil
 }
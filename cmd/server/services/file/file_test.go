@@ -2,11 +2,18 @@ package file_test
 
 import (
 	"bytes"
+	"filesync/enums"
+	"filesync/models"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"os"
+	"path/filepath"
 	"server/pkg/_mocks"
 	"server/services/file"
+	"sync"
 	"testing"
+	"time"
 )
 
 var (
@@ -46,6 +53,8 @@ func TestNewFileServiceFactory(t *testing.T) {
 	fileService, err := factory.New(testUserDir)
 	assert.NoError(t, err)
 	assert.NotNil(t, fileService)
+	assert.True(t, factory.Exists(testUserDir))
+	assert.False(t, factory.Exists("missing"))
 }
 
 func TestCreateFile(t *testing.T) {
@@ -95,6 +104,79 @@ func TestGetFile_NotFound(t *testing.T) {
 	assert.Equal(t, "file not found", err.Error())
 }
 
+func TestInvalidHash(t *testing.T) {
+	baseDir := t.TempDir()
+	fileService, err := file.New(filepath.Join(baseDir, testUserDir))
+	assert.NoError(t, err)
+
+	for _, hash := range []string{"", "../escape", "a/b", "..", ".libraries", ".tmp-1"} {
+		assert.ErrorIs(t, fileService.CreateFile(hash, testChecksum, testContent), file.ErrInvalidHash, hash)
+		assert.ErrorIs(t, fileService.DeleteFile(hash), file.ErrInvalidHash, hash)
+		_, _, err = fileService.OpenFile(hash)
+		assert.ErrorIs(t, err, file.ErrInvalidHash, hash)
+	}
+	_, err = os.Stat(filepath.Join(baseDir, "escape"))
+	assert.True(t, os.IsNotExist(err), "Expected no file outside of the directory")
+}
+
+func TestOpenFile(t *testing.T) {
+	dir := t.TempDir()
+	fileService, err := file.New(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, fileService.CreateFileFromReader(testHash, testChecksum, bytes.NewReader(testContent)))
+
+	reader, fileInfo, err := fileService.OpenFile(testHash)
+	assert.NoError(t, err)
+	assert.Equal(t, testChecksum, fileInfo.Checksum)
+	// Replacing the file leaves the open reader with the content it had when it was opened.
+	assert.NoError(t, fileService.CreateFile(testHash, testChecksum, []byte("replaced")))
+	content, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, testContent, content)
+
+	reader, _, err = fileService.OpenFileRange(testHash, 2, 3)
+	assert.NoError(t, err)
+	content, err = io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, []byte("pla"), content)
+	reader, _, err = fileService.OpenFileRange(testHash, 5, 100)
+	assert.NoError(t, err)
+	content, err = io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, []byte("ced"), content)
+	_, _, err = fileService.OpenFileRange(testHash, 9, -1)
+	assert.Error(t, err)
+
+	fileBuf, err := fileService.GetFile(testHash)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("replaced"), fileBuf.Bytes())
+}
+
+func TestCreateFileFromReader_Quota(t *testing.T) {
+	dir := t.TempDir()
+	fileService, err := file.New(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, fileService.CreateFile(testHash, testChecksum, testContent))
+	size := int64(len(testChecksum) + len(testContent) + 2)
+	fileService.SetQuota(models.Quota{MaxBytes: size + 10})
+
+	// The content is read until it exceeds the quota, the previous file stays intact.
+	tooLarge := bytes.Repeat([]byte("a"), len(testContent)+11)
+	assert.ErrorIs(t, fileService.CreateFileFromReader(testHash, testChecksum, bytes.NewReader(tooLarge)), file.ErrQuotaExceeded)
+	fileBuf, err := fileService.GetFile(testHash)
+	assert.NoError(t, err)
+	assert.Equal(t, testContent, fileBuf.Bytes())
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1, "Expected the temporary file to be removed")
+
+	assert.NoError(t, fileService.CreateFileFromReader(testHash, testChecksum, bytes.NewReader(tooLarge[:len(testContent)+10])))
+	assert.Equal(t, size+10, fileService.Usage().Bytes)
+}
+
 func TestCreateFile_Error(t *testing.T) {
 	fileService, err := file.New(testDir)
 	assert.NoError(t, err)
@@ -119,3 +201,224 @@ func TestDeleteFile_Error(t *testing.T) {
 	err = fileService.DeleteFile("")
 	assert.Error(t, err)
 }
+
+func TestWatch(t *testing.T) {
+	fileService, err := file.New(testDir)
+	assert.NoError(t, err)
+
+	var changes []models.FileChange
+	unwatch := fileService.Watch(func(change models.FileChange) {
+		changes = append(changes, change)
+	})
+
+	err = fileService.CreateFile(testHash, testChecksum, testContent)
+	assert.NoError(t, err)
+	err = fileService.DeleteFile(testHash)
+	assert.NoError(t, err)
+
+	unwatch()
+	err = fileService.CreateFile(testHash, testChecksum, testContent)
+	assert.NoError(t, err)
+	err = fileService.DeleteFile(testHash)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []models.FileChange{
+		{Hash: testHash, Checksum: testChecksum, Operation: enums.FileCreated},
+		{Hash: testHash, Operation: enums.FileDeleted},
+	}, changes)
+}
+
+func TestQuota(t *testing.T) {
+	factory := file.NewFactory(t.TempDir(), &_mocks.MockCache{}, &_mocks.MockCache{})
+	fileService, err := factory.New(testUserDir)
+	assert.NoError(t, err)
+	// Every stored file holds the checksum and content, each followed by a newline.
+	size := int64(len(testChecksum) + len(testContent) + 2)
+
+	fileService.SetQuota(models.Quota{MaxBytes: 2 * size, MaxFiles: 2})
+	assert.NoError(t, fileService.CreateFile("a", testChecksum, testContent))
+	// Replacing a file only counts the difference in size.
+	assert.NoError(t, fileService.CreateFile("a", testChecksum, testContent))
+	assert.ErrorIs(t, fileService.CreateFile("b", testChecksum, append(testContent, 'x')), file.ErrQuotaExceeded)
+	_, found := fileService.GetFileInfo("b")
+	assert.False(t, found)
+
+	// Another service of the same directory shares the usage and quota.
+	otherService, err := factory.New(testUserDir)
+	assert.NoError(t, err)
+	assert.NoError(t, otherService.CreateFile("b", testChecksum, testContent))
+	assert.Equal(t, models.Usage{Bytes: 2 * size, Files: 2, Quota: models.Quota{MaxBytes: 2 * size, MaxFiles: 2}}, fileService.Usage())
+
+	otherService.SetQuota(models.Quota{MaxFiles: 2})
+	assert.ErrorIs(t, fileService.CreateFile("c", testChecksum, nil), file.ErrQuotaExceeded)
+	assert.NoError(t, fileService.DeleteFile("b"))
+	assert.NoError(t, fileService.CreateFile("c", testChecksum, nil))
+	assert.Equal(t, 2, otherService.Usage().Files)
+}
+
+func TestFactoryShared(t *testing.T) {
+	baseDir := t.TempDir()
+	factory := file.NewFactoryWithConfig(&file.FactoryConfig{
+		BaseDir:     baseDir,
+		IdleTimeout: 20 * time.Millisecond,
+	}, &_mocks.MockCache{}, &_mocks.MockCache{})
+	fileService, err := factory.New(testUserDir)
+	assert.NoError(t, err)
+	otherService, err := factory.New(testUserDir)
+	assert.NoError(t, err)
+
+	var changes []models.FileChange
+	fileService.Watch(func(change models.FileChange) {
+		changes = append(changes, change)
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, otherService.CreateFile(fmt.Sprintf("hash%d", i), testChecksum, testContent))
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, fileService.GetFileMap(), 10, "Expected the services of a directory to share their files")
+	assert.Empty(t, changes, "Expected watchers to only see the changes made through their service")
+
+	// Files written behind the back of the factory show up once its service was idle and is read again.
+	outside, err := file.New(filepath.Join(baseDir, testUserDir))
+	assert.NoError(t, err)
+	assert.NoError(t, outside.CreateFile(testHash, testChecksum, testContent))
+	fileService.Close()
+	reopened, err := factory.New(testUserDir)
+	assert.NoError(t, err)
+	_, found := reopened.GetFileInfo(testHash)
+	assert.False(t, found, "Expected the open service to be reused")
+
+	reopened.Close()
+	otherService.Close()
+	otherService.Close()
+	assert.Eventually(t, func() bool {
+		service, err := factory.New(testUserDir)
+		assert.NoError(t, err)
+		defer service.Close()
+		_, found := service.GetFileInfo(testHash)
+		return found
+	}, time.Second, 30*time.Millisecond)
+}
+
+func TestFactoryTempFiles(t *testing.T) {
+	baseDir := t.TempDir()
+	factory := file.NewFactoryWithConfig(&file.FactoryConfig{
+		BaseDir:     baseDir,
+		IdleTimeout: 20 * time.Millisecond,
+	}, &_mocks.MockCache{}, &_mocks.MockCache{})
+	fileService, err := factory.New(testUserDir)
+	assert.NoError(t, err)
+	fileService.Close()
+	team, err := factory.NewShare(testUserDir, "team")
+	assert.NoError(t, err)
+	defer team.Close()
+	leftover := filepath.Join(baseDir, testUserDir, ".tmp-interrupted")
+	assert.NoError(t, os.WriteFile(leftover, testContent, 0600))
+
+	// A member uploads into the share while the service of the owner is closed and opened again.
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- team.CreateFileFromReader(testHash, testChecksum, reader)
+	}()
+	_, err = writer.Write(testContent[:4])
+	assert.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	reopened, err := factory.New(testUserDir)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	_, err = os.Stat(leftover)
+	assert.True(t, os.IsNotExist(err), "Expected the interrupted write of the directory to be removed")
+
+	_, err = writer.Write(testContent[4:])
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	assert.NoError(t, <-done, "Expected the upload into the share to keep its temporary file")
+	_, found := team.GetFileInfo(testHash)
+	assert.True(t, found)
+	assert.Equal(t, 1, reopened.Usage().Files)
+}
+
+func TestFactoryRemove(t *testing.T) {
+	factory := file.NewFactory(t.TempDir(), &_mocks.MockCache{}, &_mocks.MockCache{})
+	fileService, err := factory.New(testUserDir)
+	assert.NoError(t, err)
+	assert.NoError(t, fileService.CreateFile(testHash, testChecksum, testContent))
+
+	assert.NoError(t, factory.Remove(testUserDir))
+	assert.False(t, factory.Exists(testUserDir))
+	fileService, err = factory.New(testUserDir)
+	assert.NoError(t, err)
+	assert.Equal(t, models.Usage{}, fileService.Usage(), "Expected the usage of the removed files to be dropped")
+}
+
+func TestLibraries(t *testing.T) {
+	baseDir := t.TempDir()
+	factory := file.NewFactory(baseDir, &_mocks.MockCache{}, &_mocks.MockCache{})
+	size := int64(len(testChecksum) + len(testContent) + 2)
+	fileService, err := factory.New(testUserDir)
+	assert.NoError(t, err)
+	fileService.SetQuota(models.Quota{MaxFiles: 3})
+
+	photos, err := factory.NewLibrary(testUserDir, "photos")
+	assert.NoError(t, err)
+	photos.SetQuota(models.Quota{MaxFiles: 1})
+	assert.NoError(t, photos.CreateFile(testHash, testChecksum, testContent))
+	assert.ErrorIs(t, photos.CreateFile("other", testChecksum, testContent), file.ErrQuotaExceeded)
+	_, found := fileService.GetFileInfo(testHash)
+	assert.False(t, found, "Expected the files of a library to be separate from the files of the directory")
+
+	// The files of a library count against the quota of the directory.
+	work, err := factory.NewLibrary(testUserDir, "work")
+	assert.NoError(t, err)
+	assert.NoError(t, work.CreateFile(testHash, testChecksum, testContent))
+	assert.NoError(t, fileService.CreateFile(testHash, testChecksum, testContent))
+	assert.ErrorIs(t, work.CreateFile("other", testChecksum, testContent), file.ErrQuotaExceeded)
+	assert.Equal(t, models.Usage{Bytes: size, Files: 1, Quota: models.Quota{MaxFiles: 1}}, photos.Usage())
+
+	// A restarted server counts the files of the libraries but does not list them.
+	restarted, err := file.NewFactory(baseDir, &_mocks.MockCache{}, &_mocks.MockCache{}).New(testUserDir)
+	assert.NoError(t, err)
+	assert.Equal(t, models.Usage{Bytes: 3 * size, Files: 3}, restarted.Usage())
+	assert.Len(t, restarted.GetFileMap(), 1)
+
+	assert.NoError(t, factory.RemoveLibrary(testUserDir, "photos"))
+	assert.Equal(t, 2, fileService.Usage().Files)
+	assert.NoError(t, work.CreateFile("other", testChecksum, testContent))
+
+	_, err = factory.NewLibrary(testUserDir, "../escape")
+	assert.Error(t, err)
+}
+
+func TestShares(t *testing.T) {
+	factory := file.NewFactory(t.TempDir(), &_mocks.MockCache{}, &_mocks.MockCache{})
+	size := int64(len(testChecksum) + len(testContent) + 2)
+	legacy, err := factory.New("legacy")
+	assert.NoError(t, err)
+	assert.NoError(t, legacy.CreateFile(testHash, testChecksum, testContent))
+	legacy.Close()
+	fileService, err := factory.New(testUserDir)
+	assert.NoError(t, err)
+	fileService.SetQuota(models.Quota{MaxFiles: 2})
+
+	// A share moved into the directory counts against its quota.
+	assert.NoError(t, factory.MoveShare("legacy", testUserDir, "team"))
+	assert.False(t, factory.Exists("legacy"))
+	assert.Equal(t, models.Usage{Bytes: size, Files: 1, Quota: models.Quota{MaxFiles: 2}}, fileService.Usage())
+	team, err := factory.NewShare(testUserDir, "team")
+	assert.NoError(t, err)
+	_, found := team.GetFileInfo(testHash)
+	assert.True(t, found, "Expected the moved share to keep its files")
+	assert.NoError(t, team.CreateFile("other", testChecksum, testContent))
+	assert.ErrorIs(t, fileService.CreateFile(testHash, testChecksum, testContent), file.ErrQuotaExceeded)
+
+	assert.NoError(t, factory.RemoveShare(testUserDir, "team"))
+	assert.Equal(t, 0, fileService.Usage().Files)
+	_, err = factory.NewShare(testUserDir, "../escape")
+	assert.Error(t, err)
+}
@@ -0,0 +1,92 @@
+package file
+
+import (
+	"errors"
+	"filesync/models"
+	"sync"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// usage tracks the bytes and files stored in a directory. The services of a directory share it, so the quota
+// holds across every session of the user.
+type usage struct {
+	mutex sync.Mutex
+	bytes int64
+	files int
+	quota models.Quota
+	// parent is the usage of the directory a library belongs to, every change also counts against it.
+	parent *usage
+}
+
+// reserve accounts for a change before it is committed, it returns ErrQuotaExceeded if the change does not fit
+// in the quota of the usage or its parent. Changes that free space are always accepted.
+func (u *usage) reserve(bytesDelta int64, filesDelta int) error {
+	// The lock of a library is taken before the lock of its directory, never the other way around.
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if bytesDelta > 0 && u.quota.MaxBytes > 0 && u.bytes+bytesDelta > u.quota.MaxBytes {
+		return ErrQuotaExceeded
+	}
+	if filesDelta > 0 && u.quota.MaxFiles > 0 && u.files+filesDelta > u.quota.MaxFiles {
+		return ErrQuotaExceeded
+	}
+	if u.parent != nil {
+		err := u.parent.reserve(bytesDelta, filesDelta)
+		if err != nil {
+			return err
+		}
+	}
+	u.bytes += bytesDelta
+	u.files += filesDelta
+	return nil
+}
+
+// release undoes a reservation of a change that failed, or accounts for a change that freed space.
+func (u *usage) release(bytesDelta int64, filesDelta int) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.parent != nil {
+		u.parent.release(bytesDelta, filesDelta)
+	}
+	u.bytes -= bytesDelta
+	u.files -= filesDelta
+}
+
+// add accounts for files that were moved in, they are counted whether or not they fit in the quota.
+func (u *usage) add(bytesDelta int64, filesDelta int) {
+	u.release(-bytesDelta, -filesDelta)
+}
+
+// available returns how many more bytes fit in the quota of the usage and its parent, limited is false if neither
+// limits the bytes.
+func (u *usage) available() (bytes int64, limited bool) {
+	u.mutex.Lock()
+	if u.quota.MaxBytes > 0 {
+		bytes, limited = u.quota.MaxBytes-u.bytes, true
+	}
+	u.mutex.Unlock()
+	if u.parent != nil {
+		parentBytes, parentLimited := u.parent.available()
+		if parentLimited && (!limited || parentBytes < bytes) {
+			bytes, limited = parentBytes, true
+		}
+	}
+	return bytes, limited
+}
+
+func (u *usage) setQuota(quota models.Quota) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.quota = quota
+}
+
+func (u *usage) get() models.Usage {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return models.Usage{
+		Bytes: u.bytes,
+		Files: u.files,
+		Quota: u.quota,
+	}
+}
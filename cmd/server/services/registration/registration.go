@@ -0,0 +1,172 @@
+package registration
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"maps"
+	"sync"
+	"time"
+)
+
+// InviteSize is the length of an invite token.
+const InviteSize = 32
+
+var (
+	ErrInvalidInvite = errors.New("invalid invite")
+	ErrInviteExpired = errors.New("invite expired")
+)
+
+// Policy decides who may register new users.
+type Policy string
+
+const (
+	// PolicyOpen lets anyone register.
+	PolicyOpen Policy = "open"
+	// PolicyInvite requires an invite token generated by an admin.
+	PolicyInvite Policy = "invite"
+	// PolicyDisabled rejects every registration.
+	PolicyDisabled Policy = "disabled"
+)
+
+type Config struct {
+	Policy Policy
+	// InviteTTL is how long an invite token can be redeemed after it was created.
+	InviteTTL time.Duration
+	// Path is the store file the invites are persisted to.
+	Path string
+}
+
+type Service interface {
+	// GetPolicy returns the registration policy.
+	GetPolicy() Policy
+	// CreateInvite creates a single use invite token.
+	CreateInvite() (token string, expires time.Time, err error)
+	// RedeemInvite consumes the invite token.
+	RedeemInvite(token string) (err error)
+}
+
+type concreteService struct {
+	config *Config
+	// invites maps the hash of an invite token to its expiry.
+	invites map[string]time.Time
+	mutex   sync.Mutex
+	// path is the store file the invites are persisted to, the invites only live in memory if it is empty.
+	path string
+}
+
+// New returns a registration service that keeps the invites in memory.
+func New(config *Config) (Service, error) {
+	err := validatePolicy(config.Policy)
+	if err != nil {
+		return nil, err
+	}
+	return &concreteService{
+		config:  config,
+		invites: make(map[string]time.Time),
+	}, nil
+}
+
+// Open returns a registration service that persists the invites to the store file of the config, loading the
+// invites it already holds, so invites survive a restart.
+func Open(config *Config) (Service, error) {
+	err := validatePolicy(config.Policy)
+	if err != nil {
+		return nil, err
+	}
+	invites, err := load(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Loaded %d invites from %s", len(invites), config.Path)
+	return &concreteService{
+		config:  config,
+		invites: invites,
+		path:    config.Path,
+	}, nil
+}
+
+// validatePolicy returns an error if the policy is unknown.
+func validatePolicy(policy Policy) error {
+	switch policy {
+	case PolicyOpen, PolicyInvite, PolicyDisabled:
+		return nil
+	default:
+		return fmt.Errorf("invalid registration policy: %s", policy)
+	}
+}
+
+func (r *concreteService) GetPolicy() Policy {
+	return r.config.Policy
+}
+
+func (r *concreteService) CreateInvite() (token string, expires time.Time, err error) {
+	tokenBytes := make([]byte, InviteSize/2)
+	_, err = rand.Read(tokenBytes)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	token = hex.EncodeToString(tokenBytes)
+	expires = time.Now().Add(r.config.InviteTTL)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	previous := maps.Clone(r.invites)
+	r.pruneExpired()
+	r.invites[inviteHash(token)] = expires
+	err = r.persist()
+	if err != nil {
+		r.invites = previous
+		return "", time.Time{}, err
+	}
+	return token, expires, nil
+}
+
+func (r *concreteService) RedeemInvite(token string) (err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	hash := inviteHash(token)
+	expires, found := r.invites[hash]
+	if !found {
+		return ErrInvalidInvite
+	}
+	delete(r.invites, hash)
+	// The invite is single use, it is only redeemed once its removal is stored.
+	err = r.persist()
+	if err != nil {
+		r.invites[hash] = expires
+		return err
+	}
+	if time.Now().After(expires) {
+		return ErrInviteExpired
+	}
+	return nil
+}
+
+// persist writes the invites to the store file, the caller holds the mutex so concurrent changes are serialised.
+func (r *concreteService) persist() error {
+	if r.path == "" {
+		return nil
+	}
+	return save(r.path, r.invites)
+}
+
+// inviteHash returns the key of the invite token in the store, so the store file does not hold redeemable tokens.
+func inviteHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// pruneExpired removes the expired invites. Must be called with the mutex held.
+func (r *concreteService) pruneExpired() {
+	now := time.Now()
+	for token, expires := range r.invites {
+		if now.After(expires) {
+			delete(r.invites, token)
+		}
+	}
+}
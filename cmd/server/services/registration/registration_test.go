@@ -0,0 +1,80 @@
+package registration_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"server/services/registration"
+	"testing"
+	"time"
+)
+
+func TestNew_InvalidPolicy(t *testing.T) {
+	_, err := registration.New(&registration.Config{Policy: "anyone"})
+	assert.Error(t, err)
+}
+
+func TestRedeemInvite(t *testing.T) {
+	registrationService, err := registration.New(&registration.Config{
+		Policy:    registration.PolicyInvite,
+		InviteTTL: time.Hour,
+	})
+	assert.NoError(t, err)
+
+	token, expires, err := registrationService.CreateInvite()
+	assert.NoError(t, err)
+	assert.Len(t, token, registration.InviteSize)
+	assert.True(t, expires.After(time.Now()))
+
+	assert.NoError(t, registrationService.RedeemInvite(token))
+	assert.ErrorIs(t, registrationService.RedeemInvite(token), registration.ErrInvalidInvite, "Expected invite to be single use")
+}
+
+func TestRedeemInvite_Expired(t *testing.T) {
+	registrationService, err := registration.New(&registration.Config{
+		Policy:    registration.PolicyInvite,
+		InviteTTL: -time.Second,
+	})
+	assert.NoError(t, err)
+
+	token, _, err := registrationService.CreateInvite()
+	assert.NoError(t, err)
+	assert.ErrorIs(t, registrationService.RedeemInvite(token), registration.ErrInviteExpired)
+}
+
+func TestRedeemInvite_Unknown(t *testing.T) {
+	registrationService, err := registration.New(&registration.Config{Policy: registration.PolicyInvite})
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, registrationService.RedeemInvite("unknown"), registration.ErrInvalidInvite)
+}
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invites.json")
+	config := &registration.Config{
+		Policy:    registration.PolicyInvite,
+		InviteTTL: time.Hour,
+		Path:      path,
+	}
+	registrationService, err := registration.Open(config)
+	assert.NoError(t, err)
+	invite, _, err := registrationService.CreateInvite()
+	assert.NoError(t, err)
+	redeemed, _, err := registrationService.CreateInvite()
+	assert.NoError(t, err)
+	assert.NoError(t, registrationService.RedeemInvite(redeemed))
+
+	stored, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(stored), invite, "Expected the store not to hold redeemable invites")
+
+	// A restarted server still accepts the invite and rejects the redeemed one.
+	reopened, err := registration.Open(config)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, reopened.RedeemInvite(redeemed), registration.ErrInvalidInvite)
+	assert.NoError(t, reopened.RedeemInvite(invite))
+
+	reopened, err = registration.Open(config)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, reopened.RedeemInvite(invite), registration.ErrInvalidInvite, "Expected a redeemed invite to stay redeemed")
+}
@@ -0,0 +1,57 @@
+package registration
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"server/pkg/atomicfile"
+	"time"
+)
+
+// schemaVersion is the version of the store file written by this server.
+const schemaVersion = 1
+
+// storeFile is the on-disk format of the invite store.
+type storeFile struct {
+	Version int
+	// Invites maps the hash of an invite token to its expiry, the tokens themselves are not kept.
+	Invites map[string]time.Time
+}
+
+// load reads the store file at path. A missing file is an empty store.
+func load(path string) (invites map[string]time.Time, err error) {
+	invites = make(map[string]time.Time)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return invites, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stored storeFile
+	err = json.Unmarshal(data, &stored)
+	if err != nil {
+		return nil, fmt.Errorf("invite store %s: %w", path, err)
+	}
+	if stored.Version != schemaVersion {
+		return nil, fmt.Errorf("invite store %s: unsupported schema version %d", path, stored.Version)
+	}
+	for hash, expires := range stored.Invites {
+		invites[hash] = expires
+	}
+	return invites, nil
+}
+
+// save replaces the store file at path, a crash leaves either the old or the new store.
+func save(path string, invites map[string]time.Time) error {
+	data, err := json.Marshal(storeFile{
+		Version: schemaVersion,
+		Invites: invites,
+	})
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,334 @@
+package share
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"filesync/enums"
+	"filesync/models"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"maps"
+	"server/services/file"
+	"server/services/user"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxNameSize bounds the length of the name of a shared library.
+const MaxNameSize = 256
+
+var (
+	ErrShareNotFound = errors.New("share not found")
+	ErrNotOwner      = errors.New("only the owner can manage the share")
+)
+
+type Service interface {
+	// Create creates an empty shared library owned by the user.
+	Create(owner string, name string) (share models.ShareInfo, err error)
+	// Get returns the shared library with the given ID.
+	Get(id string) (share models.ShareInfo, found bool)
+	// List returns the shared libraries the user owns or is a member of.
+	List(username string) []models.ShareInfo
+	// Delete deletes the shared library of the owner and its files.
+	Delete(owner string, id string) (err error)
+	// SetMember grants the user access to the shared library of the owner, replacing the access it had.
+	SetMember(owner string, member models.ShareMember) (err error)
+	// RemoveMember revokes the access of the member to the shared library. The owner removes any member,
+	// a member only removes itself.
+	RemoveMember(username string, id string, member string) (err error)
+	// RemoveUser deletes the shared libraries the user owns with their files and removes the user from the others.
+	RemoveUser(username string) (err error)
+	// Access returns the access of the user to the shared library, found is false if the user has none.
+	// The owner has read and write access.
+	Access(username string, id string) (access enums.Access, found bool)
+	// GetFileService returns the file service of the files of the shared library. The caller closes it.
+	GetFileService(id string) (fileService file.Service, err error)
+}
+
+// record is a shared library in the store.
+type record struct {
+	info models.ShareInfo
+	// storageID names the data directory of the shared library in the data directory of the owner.
+	storageID string
+}
+
+type concreteService struct {
+	shares             map[string]*record
+	mutex              sync.RWMutex
+	userService        user.Service
+	fileServiceFactory file.Factory
+	// path is the store file the shares are persisted to, the shares only live in memory if it is empty.
+	path string
+}
+
+// New returns a share service that keeps the shares in memory.
+func New(userService user.Service, fileServiceFactory file.Factory) Service {
+	return &concreteService{
+		shares:             make(map[string]*record),
+		userService:        userService,
+		fileServiceFactory: fileServiceFactory,
+	}
+}
+
+// Open returns a share service that persists the shares to the store file at path, loading the shares it already
+// holds.
+func Open(path string, userService user.Service, fileServiceFactory file.Factory) (Service, error) {
+	shares, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Loaded %d shares from %s", len(shares), path)
+	// Shares used to be stored next to the data directories of the users, where they did not count against the
+	// quota of the owner.
+	for _, shareRecord := range shares {
+		if !fileServiceFactory.Exists(shareRecord.storageID) {
+			continue
+		}
+		ownerDir, found := userService.GetStorageID(shareRecord.info.Owner)
+		if !found {
+			continue
+		}
+		err = fileServiceFactory.MoveShare(shareRecord.storageID, ownerDir, shareRecord.storageID)
+		if err != nil {
+			return nil, fmt.Errorf("moving share %s: %w", shareRecord.info.ID, err)
+		}
+	}
+	return &concreteService{
+		shares:             shares,
+		userService:        userService,
+		fileServiceFactory: fileServiceFactory,
+		path:               path,
+	}, nil
+}
+
+func (s *concreteService) Create(owner string, name string) (share models.ShareInfo, err error) {
+	if name == "" || len(name) > MaxNameSize {
+		return models.ShareInfo{}, fmt.Errorf("share name must have 1 to %d bytes", MaxNameSize)
+	}
+	random := make([]byte, 24)
+	_, err = rand.Read(random)
+	if err != nil {
+		return models.ShareInfo{}, err
+	}
+	shareRecord := &record{
+		info: models.ShareInfo{
+			ID:      hex.EncodeToString(random[:8]),
+			Name:    name,
+			Owner:   owner,
+			Members: make(map[string]enums.Access),
+			Created: time.Now(),
+		},
+		storageID: hex.EncodeToString(random[8:]),
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.shares[shareRecord.info.ID] = shareRecord
+	err = s.persist()
+	if err != nil {
+		delete(s.shares, shareRecord.info.ID)
+		return models.ShareInfo{}, err
+	}
+	return copyInfo(shareRecord.info), nil
+}
+
+func (s *concreteService) Get(id string) (share models.ShareInfo, found bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	shareRecord, found := s.shares[id]
+	if !found {
+		return models.ShareInfo{}, false
+	}
+	return copyInfo(shareRecord.info), true
+}
+
+func (s *concreteService) List(username string) []models.ShareInfo {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	shares := make([]models.ShareInfo, 0)
+	for _, shareRecord := range s.shares {
+		if _, member := shareRecord.info.Members[username]; member || shareRecord.info.Owner == username {
+			shares = append(shares, copyInfo(shareRecord.info))
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].Created.Before(shares[j].Created)
+	})
+	return shares
+}
+
+func (s *concreteService) Delete(owner string, id string) (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	shareRecord, err := s.owned(owner, id)
+	if err != nil {
+		return err
+	}
+	delete(s.shares, id)
+	err = s.persist()
+	if err != nil {
+		s.shares[id] = shareRecord
+		return err
+	}
+	return s.removeFiles(shareRecord)
+}
+
+func (s *concreteService) SetMember(owner string, member models.ShareMember) (err error) {
+	if member.Access > enums.ReadWriteAccess {
+		return fmt.Errorf("invalid access: %d", member.Access)
+	}
+	if member.Username == owner {
+		return fmt.Errorf("the owner is not a member")
+	}
+	if _, found := s.userService.GetStorageID(member.Username); !found {
+		return fmt.Errorf("user not found")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	shareRecord, err := s.owned(owner, member.ShareID)
+	if err != nil {
+		return err
+	}
+	previous, wasMember := shareRecord.info.Members[member.Username]
+	shareRecord.info.Members[member.Username] = member.Access
+	err = s.persist()
+	if err != nil {
+		if wasMember {
+			shareRecord.info.Members[member.Username] = previous
+		} else {
+			delete(shareRecord.info.Members, member.Username)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *concreteService) RemoveMember(username string, id string, member string) (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	shareRecord, found := s.shares[id]
+	if !found {
+		return ErrShareNotFound
+	}
+	if username != shareRecord.info.Owner && username != member {
+		return ErrNotOwner
+	}
+	access, found := shareRecord.info.Members[member]
+	if !found {
+		return fmt.Errorf("member not found")
+	}
+	delete(shareRecord.info.Members, member)
+	err = s.persist()
+	if err != nil {
+		shareRecord.info.Members[member] = access
+		return err
+	}
+	return nil
+}
+
+func (s *concreteService) RemoveUser(username string) (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var owned []*record
+	memberships := make(map[string]enums.Access)
+	for id, shareRecord := range s.shares {
+		if shareRecord.info.Owner == username {
+			owned = append(owned, shareRecord)
+			delete(s.shares, id)
+		} else if access, found := shareRecord.info.Members[username]; found {
+			memberships[id] = access
+			delete(shareRecord.info.Members, username)
+		}
+	}
+	if len(owned) == 0 && len(memberships) == 0 {
+		return nil
+	}
+	err = s.persist()
+	if err != nil {
+		for _, shareRecord := range owned {
+			s.shares[shareRecord.info.ID] = shareRecord
+		}
+		for id, access := range memberships {
+			s.shares[id].info.Members[username] = access
+		}
+		return err
+	}
+	for _, shareRecord := range owned {
+		err = errors.Join(err, s.removeFiles(shareRecord))
+	}
+	return err
+}
+
+func (s *concreteService) Access(username string, id string) (access enums.Access, found bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	shareRecord, found := s.shares[id]
+	if !found {
+		return 0, false
+	}
+	if shareRecord.info.Owner == username {
+		return enums.ReadWriteAccess, true
+	}
+	access, found = shareRecord.info.Members[username]
+	return access, found
+}
+
+func (s *concreteService) GetFileService(id string) (fileService file.Service, err error) {
+	s.mutex.RLock()
+	shareRecord, found := s.shares[id]
+	s.mutex.RUnlock()
+	if !found {
+		return nil, ErrShareNotFound
+	}
+	owner := shareRecord.info.Owner
+	ownerDir, found := s.userService.GetStorageID(owner)
+	if !found {
+		return nil, fmt.Errorf("owner not found")
+	}
+	// Opening the files of the owner applies the quota of the owner, which the share counts against.
+	ownerFiles, err := s.userService.GetFileService(owner)
+	if err != nil {
+		return nil, err
+	}
+	ownerFiles.Close()
+	return s.fileServiceFactory.NewShare(ownerDir, shareRecord.storageID)
+}
+
+// removeFiles deletes the files of the share. The files of a share whose owner is gone were deleted with the data
+// directory of the owner.
+func (s *concreteService) removeFiles(shareRecord *record) error {
+	ownerDir, found := s.userService.GetStorageID(shareRecord.info.Owner)
+	if !found {
+		return nil
+	}
+	return s.fileServiceFactory.RemoveShare(ownerDir, shareRecord.storageID)
+}
+
+// owned returns the share with the given ID if it is owned by the user, the caller holds the lock.
+func (s *concreteService) owned(owner string, id string) (*record, error) {
+	shareRecord, found := s.shares[id]
+	if !found {
+		return nil, ErrShareNotFound
+	}
+	if shareRecord.info.Owner != owner {
+		return nil, ErrNotOwner
+	}
+	return shareRecord, nil
+}
+
+// persist writes the shares to the store file, the caller holds the write lock so concurrent changes are serialised.
+func (s *concreteService) persist() error {
+	if s.path == "" {
+		return nil
+	}
+	return save(s.path, s.shares)
+}
+
+// copyInfo returns a copy of the share description that does not share its members with the store.
+func copyInfo(info models.ShareInfo) models.ShareInfo {
+	info.Members = maps.Clone(info.Members)
+	return info
+}
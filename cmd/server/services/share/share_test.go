@@ -0,0 +1,144 @@
+package share_test
+
+import (
+	"filesync/enums"
+	"filesync/models"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"server/pkg/_mocks"
+	"server/services/file"
+	"server/services/share"
+	"server/services/user"
+	"testing"
+)
+
+const (
+	owner  = "alice"
+	member = "bob"
+)
+
+func newTestService(t *testing.T, path string) (share.Service, file.Factory) {
+	factory := file.NewFactory(t.TempDir(), &_mocks.MockCache{}, &_mocks.MockCache{})
+	userService := user.New(factory)
+	assert.NoError(t, userService.Create(owner, []byte("secret1")))
+	assert.NoError(t, userService.Create(member, []byte("secret2")))
+	assert.NoError(t, userService.Create("carol", []byte("secret3")))
+	if path == "" {
+		return share.New(userService, factory), factory
+	}
+	shareService, err := share.Open(path, userService, factory)
+	assert.NoError(t, err)
+	return shareService, factory
+}
+
+func TestMembers(t *testing.T) {
+	shareService, _ := newTestService(t, "")
+	created, err := shareService.Create(owner, "team")
+	assert.NoError(t, err)
+	_, err = shareService.Create(owner, "")
+	assert.Error(t, err)
+
+	access, found := shareService.Access(owner, created.ID)
+	assert.True(t, found)
+	assert.Equal(t, enums.ReadWriteAccess, access)
+	_, found = shareService.Access(member, created.ID)
+	assert.False(t, found)
+
+	assert.NoError(t, shareService.SetMember(owner, models.ShareMember{ShareID: created.ID, Username: member, Access: enums.ReadAccess}))
+	access, found = shareService.Access(member, created.ID)
+	assert.True(t, found)
+	assert.Equal(t, enums.ReadAccess, access)
+	assert.Len(t, shareService.List(member), 1)
+	assert.Empty(t, shareService.List("carol"))
+
+	assert.ErrorIs(t, shareService.SetMember(member, models.ShareMember{ShareID: created.ID, Username: "carol"}), share.ErrNotOwner)
+	assert.Error(t, shareService.SetMember(owner, models.ShareMember{ShareID: created.ID, Username: "missing"}))
+	assert.Error(t, shareService.SetMember(owner, models.ShareMember{ShareID: created.ID, Username: member, Access: 7}))
+	assert.NoError(t, shareService.SetMember(owner, models.ShareMember{ShareID: created.ID, Username: "carol", Access: enums.ReadWriteAccess}))
+
+	// A member can leave, but not remove other members.
+	assert.ErrorIs(t, shareService.RemoveMember(member, created.ID, "carol"), share.ErrNotOwner)
+	assert.NoError(t, shareService.RemoveMember(member, created.ID, member))
+	assert.NoError(t, shareService.RemoveMember(owner, created.ID, "carol"))
+	info, _ := shareService.Get(created.ID)
+	assert.Empty(t, info.Members)
+}
+
+func TestDelete(t *testing.T) {
+	shareService, _ := newTestService(t, "")
+	created, err := shareService.Create(owner, "team")
+	assert.NoError(t, err)
+	fileService, err := shareService.GetFileService(created.ID)
+	assert.NoError(t, err)
+	assert.NoError(t, fileService.CreateFile("hash", "checksum", []byte("content")))
+
+	assert.ErrorIs(t, shareService.Delete(member, created.ID), share.ErrNotOwner)
+	assert.NoError(t, shareService.Delete(owner, created.ID))
+	_, found := shareService.Get(created.ID)
+	assert.False(t, found)
+	_, err = shareService.GetFileService(created.ID)
+	assert.ErrorIs(t, err, share.ErrShareNotFound)
+	assert.ErrorIs(t, shareService.Delete(owner, created.ID), share.ErrShareNotFound)
+}
+
+func TestRemoveUser(t *testing.T) {
+	shareService, _ := newTestService(t, "")
+	owned, err := shareService.Create(owner, "team")
+	assert.NoError(t, err)
+	other, err := shareService.Create("carol", "family")
+	assert.NoError(t, err)
+	assert.NoError(t, shareService.SetMember("carol", models.ShareMember{ShareID: other.ID, Username: owner, Access: enums.ReadAccess}))
+	assert.NoError(t, shareService.SetMember("carol", models.ShareMember{ShareID: other.ID, Username: member, Access: enums.ReadAccess}))
+
+	assert.NoError(t, shareService.RemoveUser(owner))
+	_, found := shareService.Get(owned.ID)
+	assert.False(t, found, "Expected the shares of the user to be deleted")
+	_, found = shareService.Access(owner, other.ID)
+	assert.False(t, found, "Expected the user to be removed from other shares")
+	_, found = shareService.Access(member, other.ID)
+	assert.True(t, found)
+	assert.Empty(t, shareService.List(owner))
+}
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shares.json")
+	shareService, factory := newTestService(t, path)
+	created, err := shareService.Create(owner, "team")
+	assert.NoError(t, err)
+	assert.NoError(t, shareService.SetMember(owner, models.ShareMember{ShareID: created.ID, Username: member, Access: enums.ReadWriteAccess}))
+
+	// A restarted server finds the shares and their members.
+	reopened, err := share.Open(path, user.New(factory), factory)
+	assert.NoError(t, err)
+	info, found := reopened.Get(created.ID)
+	assert.True(t, found)
+	assert.Equal(t, owner, info.Owner)
+	assert.Equal(t, "team", info.Name)
+	assert.Equal(t, map[string]enums.Access{member: enums.ReadWriteAccess}, info.Members)
+}
+
+func TestQuota(t *testing.T) {
+	factory := file.NewFactory(t.TempDir(), &_mocks.MockCache{}, &_mocks.MockCache{})
+	userService := user.New(factory)
+	assert.NoError(t, userService.Create(owner, []byte("secret1")))
+	assert.NoError(t, userService.Create(member, []byte("secret2")))
+	assert.NoError(t, userService.SetQuota(owner, &models.Quota{MaxFiles: 1}))
+	shareService := share.New(userService, factory)
+	created, err := shareService.Create(owner, "team")
+	assert.NoError(t, err)
+
+	// The files a member writes to the share count against the quota of the owner.
+	fileService, err := shareService.GetFileService(created.ID)
+	assert.NoError(t, err)
+	assert.NoError(t, fileService.CreateFile("hash", "checksum", []byte("content")))
+	assert.ErrorIs(t, fileService.CreateFile("other", "checksum", []byte("content")), file.ErrQuotaExceeded)
+	ownerFiles, err := userService.GetFileService(owner)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, ownerFiles.Usage().Files)
+	assert.ErrorIs(t, ownerFiles.CreateFile("hash", "checksum", []byte("content")), file.ErrQuotaExceeded)
+
+	// Deleting the share frees the quota of the owner.
+	assert.NoError(t, shareService.Delete(owner, created.ID))
+	assert.Equal(t, 0, ownerFiles.Usage().Files)
+	assert.NoError(t, ownerFiles.CreateFile("hash", "checksum", []byte("content")))
+}
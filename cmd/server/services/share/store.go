@@ -0,0 +1,89 @@
+package share
+
+import (
+	"encoding/json"
+	"errors"
+	"filesync/enums"
+	"filesync/models"
+	"fmt"
+	"os"
+	"server/pkg/atomicfile"
+	"time"
+)
+
+// schemaVersion is the version of the store file written by this server.
+const schemaVersion = 1
+
+// storeFile is the on-disk format of the share store.
+type storeFile struct {
+	Version int
+	Shares  map[string]storedShare
+}
+
+type storedShare struct {
+	Name      string
+	Owner     string
+	StorageID string
+	Members   map[string]enums.Access
+	Created   time.Time
+}
+
+// load reads the store file at path. A missing file is an empty store.
+func load(path string) (shares map[string]*record, err error) {
+	shares = make(map[string]*record)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return shares, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stored storeFile
+	err = json.Unmarshal(data, &stored)
+	if err != nil {
+		return nil, fmt.Errorf("share store %s: %w", path, err)
+	}
+	if stored.Version != schemaVersion {
+		return nil, fmt.Errorf("share store %s: unsupported schema version %d", path, stored.Version)
+	}
+	for id, s := range stored.Shares {
+		members := s.Members
+		if members == nil {
+			members = make(map[string]enums.Access)
+		}
+		shares[id] = &record{
+			info: models.ShareInfo{
+				ID:      id,
+				Name:    s.Name,
+				Owner:   s.Owner,
+				Members: members,
+				Created: s.Created,
+			},
+			storageID: s.StorageID,
+		}
+	}
+	return shares, nil
+}
+
+// save replaces the store file at path, a crash leaves either the old or the new store.
+func save(path string, shares map[string]*record) error {
+	stored := storeFile{
+		Version: schemaVersion,
+		Shares:  make(map[string]storedShare, len(shares)),
+	}
+	for id, r := range shares {
+		stored.Shares[id] = storedShare{
+			Name:      r.info.Name,
+			Owner:     r.info.Owner,
+			StorageID: r.storageID,
+			Members:   r.info.Members,
+			Created:   r.info.Created,
+		}
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, data, 0600)
+}
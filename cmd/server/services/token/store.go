@@ -0,0 +1,99 @@
+package token
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"filesync/enums"
+	"filesync/models"
+	"fmt"
+	"os"
+	"server/pkg/atomicfile"
+	"time"
+)
+
+// schemaVersion is the version of the store file written by this server.
+const schemaVersion = 1
+
+// storeFile is the on-disk format of the token store.
+type storeFile struct {
+	Version int
+	// Tokens maps a token ID to the token.
+	Tokens map[string]storedToken
+}
+
+// storedToken is a token in the store file, only the hash of its secret is kept.
+type storedToken struct {
+	Name       string
+	Username   string
+	Scopes     []enums.Scope
+	Library    string
+	Created    time.Time
+	Expires    time.Time
+	SecretHash string
+}
+
+// load reads the store file at path. A missing file is an empty store.
+func load(path string) (tokens map[string]*record, err error) {
+	tokens = make(map[string]*record)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return tokens, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stored storeFile
+	err = json.Unmarshal(data, &stored)
+	if err != nil {
+		return nil, fmt.Errorf("token store %s: %w", path, err)
+	}
+	if stored.Version != schemaVersion {
+		return nil, fmt.Errorf("token store %s: unsupported schema version %d", path, stored.Version)
+	}
+	for id, t := range stored.Tokens {
+		tokenRecord := &record{
+			info: models.TokenInfo{
+				ID:       id,
+				Name:     t.Name,
+				Username: t.Username,
+				Scopes:   t.Scopes,
+				Library:  t.Library,
+				Created:  t.Created,
+				Expires:  t.Expires,
+			},
+		}
+		secretHash, err := hex.DecodeString(t.SecretHash)
+		if err != nil || len(secretHash) != len(tokenRecord.secretHash) {
+			return nil, fmt.Errorf("token store %s: invalid secret hash of token %s", path, id)
+		}
+		copy(tokenRecord.secretHash[:], secretHash)
+		tokens[id] = tokenRecord
+	}
+	return tokens, nil
+}
+
+// save replaces the store file at path, a crash leaves either the old or the new store.
+func save(path string, tokens map[string]*record) error {
+	stored := storeFile{
+		Version: schemaVersion,
+		Tokens:  make(map[string]storedToken, len(tokens)),
+	}
+	for id, r := range tokens {
+		stored.Tokens[id] = storedToken{
+			Name:       r.info.Name,
+			Username:   r.info.Username,
+			Scopes:     r.info.Scopes,
+			Library:    r.info.Library,
+			Created:    r.info.Created,
+			Expires:    r.info.Expires,
+			SecretHash: hex.EncodeToString(r.secretHash[:]),
+		}
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,202 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"filesync/enums"
+	"filesync/models"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// idSize and secretSize are the sizes in bytes of the two halves of a token, which is formatted as "id.secret".
+	idSize     = 8
+	secretSize = 32
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+type Service interface {
+	// Create mints a named token for the user with the given scopes. It returns the token, which is not stored.
+	Create(username string, request models.TokenRequest) (token string, info models.TokenInfo, err error)
+	// Validate returns the description of the token.
+	Validate(token string) (info models.TokenInfo, err error)
+	// List returns the tokens of the user.
+	List(username string) []models.TokenInfo
+	// Revoke deletes the token with the given ID of the user.
+	Revoke(username string, id string) (err error)
+	// RemoveUser deletes every token of the user.
+	RemoveUser(username string) (err error)
+}
+
+// record is a token in the store, only the hash of its secret is kept.
+type record struct {
+	info       models.TokenInfo
+	secretHash [sha256.Size]byte
+}
+
+type concreteService struct {
+	tokens map[string]*record
+	mutex  sync.RWMutex
+	// path is the store file the tokens are persisted to, the tokens only live in memory if it is empty.
+	path string
+}
+
+// New returns a token service that keeps the tokens in memory.
+func New() Service {
+	return &concreteService{
+		tokens: make(map[string]*record),
+	}
+}
+
+// Open returns a token service that persists the tokens to the store file at path, loading the tokens it already
+// holds, so tokens survive a restart.
+func Open(path string) (Service, error) {
+	tokens, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Loaded %d tokens from %s", len(tokens), path)
+	return &concreteService{
+		tokens: tokens,
+		path:   path,
+	}, nil
+}
+
+func (t *concreteService) Create(username string, request models.TokenRequest) (token string, info models.TokenInfo, err error) {
+	if request.Name == "" {
+		return "", models.TokenInfo{}, fmt.Errorf("token name is required")
+	}
+	if len(request.Scopes) == 0 {
+		return "", models.TokenInfo{}, fmt.Errorf("token needs at least one scope")
+	}
+	for _, scope := range request.Scopes {
+		if scope > enums.DeleteScope {
+			return "", models.TokenInfo{}, fmt.Errorf("invalid scope: %d", scope)
+		}
+	}
+
+	random := make([]byte, idSize+secretSize)
+	_, err = rand.Read(random)
+	if err != nil {
+		return "", models.TokenInfo{}, err
+	}
+	id := hex.EncodeToString(random[:idSize])
+	secret := hex.EncodeToString(random[idSize:])
+
+	info = models.TokenInfo{
+		ID:       id,
+		Name:     request.Name,
+		Username: username,
+		Scopes:   append([]enums.Scope{}, request.Scopes...),
+		Library:  request.Library,
+		Created:  time.Now(),
+	}
+	if request.TTL > 0 {
+		info.Expires = info.Created.Add(request.TTL)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.tokens[id] = &record{info, sha256.Sum256([]byte(secret))}
+	err = t.persist()
+	if err != nil {
+		delete(t.tokens, id)
+		return "", models.TokenInfo{}, err
+	}
+	return id + "." + secret, info, nil
+}
+
+func (t *concreteService) Validate(token string) (info models.TokenInfo, err error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok {
+		return models.TokenInfo{}, ErrInvalidToken
+	}
+
+	t.mutex.RLock()
+	tokenRecord, found := t.tokens[id]
+	t.mutex.RUnlock()
+	if !found {
+		return models.TokenInfo{}, ErrInvalidToken
+	}
+	secretHash := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(secretHash[:], tokenRecord.secretHash[:]) != 1 {
+		return models.TokenInfo{}, ErrInvalidToken
+	}
+	if !tokenRecord.info.Expires.IsZero() && time.Now().After(tokenRecord.info.Expires) {
+		return models.TokenInfo{}, ErrTokenExpired
+	}
+	return tokenRecord.info, nil
+}
+
+func (t *concreteService) List(username string) []models.TokenInfo {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	infos := make([]models.TokenInfo, 0)
+	for _, tokenRecord := range t.tokens {
+		if tokenRecord.info.Username == username {
+			infos = append(infos, tokenRecord.info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Created.Before(infos[j].Created)
+	})
+	return infos
+}
+
+func (t *concreteService) Revoke(username string, id string) (err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tokenRecord, found := t.tokens[id]
+	if !found || tokenRecord.info.Username != username {
+		return fmt.Errorf("token not found")
+	}
+	delete(t.tokens, id)
+	err = t.persist()
+	if err != nil {
+		t.tokens[id] = tokenRecord
+	}
+	return err
+}
+
+func (t *concreteService) RemoveUser(username string) (err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	removed := make(map[string]*record)
+	for id, tokenRecord := range t.tokens {
+		if tokenRecord.info.Username == username {
+			removed[id] = tokenRecord
+			delete(t.tokens, id)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	err = t.persist()
+	if err != nil {
+		for id, tokenRecord := range removed {
+			t.tokens[id] = tokenRecord
+		}
+	}
+	return err
+}
+
+// persist writes the tokens to the store file, the caller holds the write lock so concurrent changes are
+// serialised.
+func (t *concreteService) persist() error {
+	if t.path == "" {
+		return nil
+	}
+	return save(t.path, t.tokens)
+}
@@ -0,0 +1,115 @@
+package token_test
+
+import (
+	"filesync/enums"
+	"filesync/models"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"server/services/token"
+	"testing"
+	"time"
+)
+
+const testUser = "test1"
+
+func TestValidate(t *testing.T) {
+	tokenService := token.New()
+	apiToken, info, err := tokenService.Create(testUser, models.TokenRequest{
+		Name:   "backup",
+		Scopes: []enums.Scope{enums.ReadScope},
+	})
+	assert.NoError(t, err)
+	assert.True(t, info.Expires.IsZero())
+
+	validated, err := tokenService.Validate(apiToken)
+	assert.NoError(t, err)
+	assert.Equal(t, info, validated)
+
+	_, err = tokenService.Validate(info.ID + ".wrong")
+	assert.ErrorIs(t, err, token.ErrInvalidToken)
+	_, err = tokenService.Validate("malformed")
+	assert.ErrorIs(t, err, token.ErrInvalidToken)
+}
+
+func TestValidate_Expired(t *testing.T) {
+	tokenService := token.New()
+	apiToken, _, err := tokenService.Create(testUser, models.TokenRequest{
+		Name:   "camera",
+		Scopes: []enums.Scope{enums.UploadScope},
+		TTL:    time.Nanosecond,
+	})
+	assert.NoError(t, err)
+
+	time.Sleep(time.Millisecond)
+	_, err = tokenService.Validate(apiToken)
+	assert.ErrorIs(t, err, token.ErrTokenExpired)
+}
+
+func TestCreate_Invalid(t *testing.T) {
+	tokenService := token.New()
+
+	_, _, err := tokenService.Create(testUser, models.TokenRequest{Scopes: []enums.Scope{enums.ReadScope}})
+	assert.Error(t, err, "Expected error for token without name")
+	_, _, err = tokenService.Create(testUser, models.TokenRequest{Name: "empty"})
+	assert.Error(t, err, "Expected error for token without scopes")
+}
+
+func TestRevoke(t *testing.T) {
+	tokenService := token.New()
+	apiToken, info, err := tokenService.Create(testUser, models.TokenRequest{
+		Name:   "backup",
+		Scopes: []enums.Scope{enums.ReadScope},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, tokenService.List(testUser), 1)
+	assert.Empty(t, tokenService.List("test2"))
+
+	assert.Error(t, tokenService.Revoke("test2", info.ID), "Expected other users not to revoke the token")
+	assert.NoError(t, tokenService.Revoke(testUser, info.ID))
+	assert.Empty(t, tokenService.List(testUser))
+	_, err = tokenService.Validate(apiToken)
+	assert.ErrorIs(t, err, token.ErrInvalidToken)
+}
+
+func TestRemoveUser(t *testing.T) {
+	tokenService := token.New()
+	apiToken, _, err := tokenService.Create(testUser, models.TokenRequest{Name: "backup", Scopes: []enums.Scope{enums.ReadScope}})
+	assert.NoError(t, err)
+	_, _, err = tokenService.Create("test2", models.TokenRequest{Name: "backup", Scopes: []enums.Scope{enums.ReadScope}})
+	assert.NoError(t, err)
+
+	assert.NoError(t, tokenService.RemoveUser(testUser))
+	_, err = tokenService.Validate(apiToken)
+	assert.ErrorIs(t, err, token.ErrInvalidToken)
+	assert.Len(t, tokenService.List("test2"), 1)
+}
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	tokenService, err := token.Open(path)
+	assert.NoError(t, err)
+	apiToken, info, err := tokenService.Create(testUser, models.TokenRequest{
+		Name:    "camera",
+		Scopes:  []enums.Scope{enums.UploadScope},
+		Library: "photos",
+		TTL:     time.Hour,
+	})
+	assert.NoError(t, err)
+	revokedToken, revokedInfo, err := tokenService.Create(testUser, models.TokenRequest{Name: "backup", Scopes: []enums.Scope{enums.ReadScope}})
+	assert.NoError(t, err)
+	assert.NoError(t, tokenService.Revoke(testUser, revokedInfo.ID))
+
+	// A restarted server still accepts the token and rejects the revoked one.
+	reopened, err := token.Open(path)
+	assert.NoError(t, err)
+	validated, err := reopened.Validate(apiToken)
+	assert.NoError(t, err)
+	assert.Equal(t, info.ID, validated.ID)
+	assert.Equal(t, "photos", validated.Library)
+	assert.Equal(t, []enums.Scope{enums.UploadScope}, validated.Scopes)
+	assert.True(t, validated.Expires.Equal(info.Expires))
+	_, err = reopened.Validate(revokedToken)
+	assert.ErrorIs(t, err, token.ErrInvalidToken)
+	_, err = reopened.Validate(info.ID + ".wrong")
+	assert.ErrorIs(t, err, token.ErrInvalidToken)
+}
@@ -0,0 +1,145 @@
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"filesync/models"
+	"fmt"
+	"os"
+	"server/pkg/atomicfile"
+	"time"
+)
+
+// schemaVersion is the version of the store file written by this server.
+const schemaVersion = 1
+
+// migrations upgrade the raw store file of version i+1 to version i+2, they run in order on load.
+var migrations []func(raw map[string]json.RawMessage) error
+
+// storeFile is the on-disk format of the user store.
+type storeFile struct {
+	Version int
+	Users   map[string]storedUser
+}
+
+type storedUser struct {
+	SharedKey []byte
+	StorageID string
+	Salt      []byte
+	Verifier  []byte
+	Provider  string `json:",omitempty"`
+	Disabled  bool
+	Quota     *models.Quota            `json:",omitempty"`
+	Libraries map[string]storedLibrary `json:",omitempty"`
+	Deleted   *time.Time               `json:",omitempty"`
+}
+
+type storedLibrary struct {
+	KeyID   string        `json:",omitempty"`
+	Quota   *models.Quota `json:",omitempty"`
+	Created time.Time
+}
+
+// load reads the store file at path, migrating older schema versions. A missing file is an empty store.
+func load(path string) (users map[string]*record, disabled map[string]bool, err error) {
+	users = make(map[string]*record)
+	disabled = make(map[string]bool)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return users, disabled, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var raw map[string]json.RawMessage
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("user store %s: %w", path, err)
+	}
+	var version int
+	err = json.Unmarshal(raw["Version"], &version)
+	if err != nil {
+		return nil, nil, fmt.Errorf("user store %s: invalid version: %w", path, err)
+	}
+	if version < 1 || version > schemaVersion {
+		return nil, nil, fmt.Errorf("user store %s: unsupported schema version %d", path, version)
+	}
+	for ; version < schemaVersion; version++ {
+		err = migrations[version-1](raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("user store %s: migrating from version %d: %w", path, version, err)
+		}
+	}
+
+	var stored map[string]storedUser
+	err = json.Unmarshal(raw["Users"], &stored)
+	if err != nil {
+		return nil, nil, fmt.Errorf("user store %s: %w", path, err)
+	}
+	for username, s := range stored {
+		users[username] = &record{
+			sharedKey: s.SharedKey,
+			storageID: s.StorageID,
+			salt:      s.Salt,
+			verifier:  s.Verifier,
+			provider:  s.Provider,
+			quota:     s.Quota,
+			libraries: make(map[string]models.LibraryInfo, len(s.Libraries)),
+		}
+		for name, library := range s.Libraries {
+			users[username].libraries[name] = models.LibraryInfo{
+				Name:    name,
+				KeyID:   library.KeyID,
+				Quota:   library.Quota,
+				Created: library.Created,
+			}
+		}
+		if s.Deleted != nil {
+			users[username].deleted = *s.Deleted
+		}
+		if s.Disabled {
+			disabled[username] = true
+		}
+	}
+	return users, disabled, nil
+}
+
+// save replaces the store file at path, a crash leaves either the old or the new store.
+func save(path string, users map[string]*record, disabled map[string]bool) (err error) {
+	stored := storeFile{
+		Version: schemaVersion,
+		Users:   make(map[string]storedUser, len(users)),
+	}
+	for username, r := range users {
+		storedRecord := storedUser{
+			SharedKey: r.sharedKey,
+			StorageID: r.storageID,
+			Salt:      r.salt,
+			Verifier:  r.verifier,
+			Provider:  r.provider,
+			Disabled:  disabled[username],
+			Quota:     r.quota,
+		}
+		if !r.deleted.IsZero() {
+			deleted := r.deleted
+			storedRecord.Deleted = &deleted
+		}
+		if len(r.libraries) > 0 {
+			storedRecord.Libraries = make(map[string]storedLibrary, len(r.libraries))
+			for name, library := range r.libraries {
+				storedRecord.Libraries[name] = storedLibrary{
+					KeyID:   library.KeyID,
+					Quota:   library.Quota,
+					Created: library.Created,
+				}
+			}
+		}
+		stored.Users[username] = storedRecord
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, data, 0600)
+}
@@ -1,60 +1,617 @@
 package user
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"filesync/models"
 	"fmt"
+	log "github.com/sirupsen/logrus"
 	"server/services/file"
+	"sort"
+	"sync"
+	"time"
 )
 
 type Service interface {
 	// Create creates a new user with the given username and shared key.
 	Create(username string, sharedKey []byte) (err error)
+	// CreateWithVerifier creates a new user that logs in with a password, storing only the salt and SRP verifier.
+	CreateWithVerifier(username string, salt []byte, verifier []byte) (err error)
+	// Provision creates a new user with the given shared key for an identity the named provider vouches for, e.g. an
+	// authentication backend.
+	Provision(username string, sharedKey []byte, provider string) (err error)
+	// GetProvider returns the provider that provisioned the user, it is empty for users that registered themselves.
+	GetProvider(username string) (provider string, found bool)
+	// GetVerifier returns the salt and SRP verifier of the user, found is false if the user has no password.
+	GetVerifier(username string) (salt []byte, verifier []byte, found bool)
+	// SetVerifier replaces the salt and SRP verifier of a user that logs in with a password.
+	SetVerifier(username string, salt []byte, verifier []byte) (err error)
 	// GetSharedKey returns the shared key of the user with the given username.
 	GetSharedKey(username string) (sharedKey []byte, found bool)
-	// Delete deletes the user with the given username.
-	Delete(username string)
-	// GetFileService returns the file service of the user with the given username.
+	// SetSharedKey replaces the shared key of the user, the storage ID and so the files of the user are kept.
+	SetSharedKey(username string, sharedKey []byte) (err error)
+	// GetStorageID returns the name of the data directory of the user with the given username.
+	GetStorageID(username string) (storageID string, found bool)
+	// List returns the usernames of all users in order.
+	List() []string
+	// Delete disables the user at once and keeps its data for the grace period, after which Purge removes it.
+	Delete(username string) (err error)
+	// Restore undoes the deletion of a user whose grace period has not ended yet.
+	Restore(username string) (err error)
+	// DeletedAt returns when the user was deleted, found is false unless the user waits to be purged.
+	DeletedAt(username string) (deleted time.Time, found bool)
+	// Purge removes the users whose grace period ended before now, with their data directory and libraries.
+	// It returns the purged usernames, so the caller can remove the metadata other services keep about them.
+	Purge(now time.Time) (purged []string, err error)
+	// GetFileService returns the file service of the user with the given username, limited by the quota of the user.
+	// The caller closes it.
 	GetFileService(username string) (fileService file.Service, err error)
+	// SetQuota overrides the default quota of the user, a nil quota restores the default.
+	SetQuota(username string, quota *models.Quota) (err error)
+	// CreateLibrary creates a named library of the user.
+	CreateLibrary(username string, request models.LibraryRequest) (library models.LibraryInfo, err error)
+	// GetLibrary returns the library of the user with the given name.
+	GetLibrary(username string, name string) (library models.LibraryInfo, found bool)
+	// ListLibraries returns the libraries of the user in order of their names, with their usage.
+	ListLibraries(username string) (libraries []models.LibraryInfo, err error)
+	// DeleteLibrary deletes the library of the user and its files.
+	DeleteLibrary(username string, name string) (err error)
+	// GetLibraryService returns the file service of the library of the user. The files of the library count against
+	// the quota of the user and the quota of the library. The caller closes it.
+	GetLibraryService(username string, name string) (fileService file.Service, err error)
+	// Disable prevents the user with the given username from authenticating.
+	Disable(username string) (err error)
+	// Enable allows a disabled user to authenticate again.
+	Enable(username string) (err error)
+	// IsDisabled returns whether the user with the given username is disabled or deleted.
+	IsDisabled(username string) bool
+}
+
+// record is a user in the store.
+type record struct {
+	sharedKey []byte
+	// storageID names the data directory of the user, it never changes.
+	storageID string
+	salt      []byte
+	verifier  []byte
+	// provider is the provider that provisioned the user, it is empty for users that registered themselves.
+	provider string
+	// quota overrides the default quota if it is set.
+	quota *models.Quota
+	// libraries are the named libraries of the user by name, without their usage.
+	libraries map[string]models.LibraryInfo
+	// deleted is when the user was deleted, it is zero unless the user waits to be purged.
+	deleted time.Time
+	// purging is set while the data directory of the user is removed, the user can no longer be restored.
+	purging bool
+}
+
+type Config struct {
+	// Path is the store file the users are persisted to.
+	Path string
+	// DefaultQuota limits the storage of users without a quota of their own.
+	DefaultQuota models.Quota
+	// GracePeriod is how long the data of a deleted user is kept before it can be purged.
+	GracePeriod time.Duration
 }
 
 type concreteService struct {
-	userMap            map[string][]byte
+	userMap            map[string]*record
+	disabled           map[string]bool
+	mutex              sync.RWMutex
 	fileServiceFactory file.Factory
+	// path is the store file the users are persisted to, the users only live in memory if it is empty.
+	path         string
+	defaultQuota models.Quota
+	gracePeriod  time.Duration
 }
 
+// New returns a user service that keeps the users in memory.
 func New(fileServiceFactory file.Factory) Service {
 	return &concreteService{
-		make(map[string][]byte),
-		fileServiceFactory,
+		userMap:            make(map[string]*record),
+		disabled:           make(map[string]bool),
+		fileServiceFactory: fileServiceFactory,
+	}
+}
+
+// Open returns a user service that persists the users to the store file of the config, loading the users it already
+// holds.
+func Open(config *Config, fileServiceFactory file.Factory) (Service, error) {
+	userMap, disabled, err := load(config.Path)
+	if err != nil {
+		return nil, err
 	}
+	log.Infof("Loaded %d users from %s", len(userMap), config.Path)
+	return &concreteService{
+		userMap:            userMap,
+		disabled:           disabled,
+		fileServiceFactory: fileServiceFactory,
+		path:               config.Path,
+		defaultQuota:       config.DefaultQuota,
+		gracePeriod:        config.GracePeriod,
+	}, nil
 }
 
 func (u *concreteService) Create(username string, sharedKey []byte) (err error) {
+	return u.create(username, &record{sharedKey: sharedKey})
+}
+
+func (u *concreteService) CreateWithVerifier(username string, salt []byte, verifier []byte) (err error) {
+	return u.create(username, &record{salt: salt, verifier: verifier})
+}
+
+func (u *concreteService) Provision(username string, sharedKey []byte, provider string) (err error) {
+	if provider == "" {
+		return fmt.Errorf("provider is required")
+	}
+	return u.create(username, &record{sharedKey: sharedKey, provider: provider})
+}
+
+func (u *concreteService) GetProvider(username string) (provider string, found bool) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	userRecord, found := u.userMap[username]
+	if !found {
+		return "", false
+	}
+	return userRecord.provider, true
+}
+
+func (u *concreteService) GetVerifier(username string) (salt []byte, verifier []byte, found bool) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	userRecord, found := u.userMap[username]
+	if !found || userRecord.verifier == nil {
+		return nil, nil, false
+	}
+	return userRecord.salt, userRecord.verifier, true
+}
+
+func (u *concreteService) SetVerifier(username string, salt []byte, verifier []byte) (err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	userRecord, found := u.userMap[username]
+	if !found {
+		return fmt.Errorf("user not found")
+	}
+	if userRecord.verifier == nil {
+		return fmt.Errorf("user has no password")
+	}
+	previousSalt, previousVerifier := userRecord.salt, userRecord.verifier
+	userRecord.salt, userRecord.verifier = salt, verifier
+	err = u.persist()
+	if err != nil {
+		userRecord.salt, userRecord.verifier = previousSalt, previousVerifier
+		return err
+	}
+	return nil
+}
+
+func (u *concreteService) create(username string, userRecord *record) (err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
 	_, exists := u.userMap[username]
 	if exists {
 		return fmt.Errorf("user already exists")
 	}
-	u.userMap[username] = sharedKey
+	// The storage ID is chosen under the lock, so two users cannot adopt the same legacy directory.
+	userRecord.storageID, err = u.newStorageID(userRecord.sharedKey)
+	if err != nil {
+		return err
+	}
+	u.userMap[username] = userRecord
+	err = u.persist()
+	if err != nil {
+		delete(u.userMap, username)
+		return err
+	}
 	return nil
 }
 
 func (u *concreteService) GetSharedKey(username string) (sharedKey []byte, found bool) {
-	sharedKey, found = u.userMap[username]
-	return sharedKey, found
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	userRecord, found := u.userMap[username]
+	if !found {
+		return nil, false
+	}
+	return userRecord.sharedKey, true
+}
+
+func (u *concreteService) SetSharedKey(username string, sharedKey []byte) (err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	userRecord, found := u.userMap[username]
+	if !found {
+		return fmt.Errorf("user not found")
+	}
+	previousKey := userRecord.sharedKey
+	userRecord.sharedKey = sharedKey
+	err = u.persist()
+	if err != nil {
+		userRecord.sharedKey = previousKey
+		return err
+	}
+	return nil
+}
+
+func (u *concreteService) GetStorageID(username string) (storageID string, found bool) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	userRecord, found := u.userMap[username]
+	if !found {
+		return "", false
+	}
+	return userRecord.storageID, true
+}
+
+func (u *concreteService) List() []string {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	usernames := make([]string, 0, len(u.userMap))
+	for username := range u.userMap {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+func (u *concreteService) Delete(username string) (err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	userRecord, found := u.userMap[username]
+	if !found {
+		return fmt.Errorf("user not found")
+	}
+	if !userRecord.deleted.IsZero() {
+		return fmt.Errorf("user already deleted")
+	}
+	userRecord.deleted = time.Now()
+	err = u.persist()
+	if err != nil {
+		userRecord.deleted = time.Time{}
+		return err
+	}
+	return nil
+}
+
+func (u *concreteService) Restore(username string) (err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	userRecord, found := u.userMap[username]
+	if !found {
+		return fmt.Errorf("user not found")
+	}
+	if userRecord.deleted.IsZero() {
+		return fmt.Errorf("user is not deleted")
+	}
+	if userRecord.purging {
+		return fmt.Errorf("user is being purged")
+	}
+	deleted := userRecord.deleted
+	userRecord.deleted = time.Time{}
+	err = u.persist()
+	if err != nil {
+		userRecord.deleted = deleted
+		return err
+	}
+	return nil
+}
+
+func (u *concreteService) DeletedAt(username string) (deleted time.Time, found bool) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	userRecord, found := u.userMap[username]
+	if !found || userRecord.deleted.IsZero() {
+		return time.Time{}, false
+	}
+	return userRecord.deleted, true
+}
+
+func (u *concreteService) Purge(now time.Time) (purged []string, err error) {
+	u.mutex.Lock()
+	due := make(map[string]string)
+	for username, userRecord := range u.userMap {
+		if userRecord.deleted.IsZero() || userRecord.purging || now.Sub(userRecord.deleted) < u.gracePeriod {
+			continue
+		}
+		userRecord.purging = true
+		due[username] = userRecord.storageID
+	}
+	u.mutex.Unlock()
+	if len(due) == 0 {
+		return nil, nil
+	}
+
+	// The directories are removed without the lock, which would block every login meanwhile. The data goes first,
+	// a failed removal keeps the user so the next purge tries again.
+	for username, storageID := range due {
+		removeErr := u.fileServiceFactory.Remove(storageID)
+		if removeErr != nil {
+			err = errors.Join(err, fmt.Errorf("purging user %s: %w", username, removeErr))
+			continue
+		}
+		purged = append(purged, username)
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	for username := range due {
+		u.userMap[username].purging = false
+	}
+	if len(purged) == 0 {
+		return nil, err
+	}
+	for _, username := range purged {
+		delete(u.userMap, username)
+		delete(u.disabled, username)
+	}
+	sort.Strings(purged)
+	persistErr := u.persist()
+	if persistErr != nil {
+		// The data is gone already. The store file drops the users with the next change that persists, or the next
+		// purge finds them again after a restart.
+		log.Errorf("Error persisting the purge of users %v: %s", purged, persistErr)
+		err = errors.Join(err, persistErr)
+	}
+	return purged, err
+}
+
+func (u *concreteService) Disable(username string) (err error) {
+	return u.setDisabled(username, true)
+}
+
+func (u *concreteService) Enable(username string) (err error) {
+	return u.setDisabled(username, false)
 }
 
-func (u *concreteService) Delete(username string) {
-	delete(u.userMap, username)
+func (u *concreteService) IsDisabled(username string) bool {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	if userRecord, found := u.userMap[username]; found && !userRecord.deleted.IsZero() {
+		return true
+	}
+	return u.disabled[username]
+}
+
+func (u *concreteService) setDisabled(username string, disabled bool) (err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if _, exists := u.userMap[username]; !exists {
+		return fmt.Errorf("user not found")
+	}
+	wasDisabled := u.disabled[username]
+	if disabled {
+		u.disabled[username] = true
+	} else {
+		delete(u.disabled, username)
+	}
+	err = u.persist()
+	if err != nil {
+		if wasDisabled {
+			u.disabled[username] = true
+		} else {
+			delete(u.disabled, username)
+		}
+		return err
+	}
+	return nil
+}
+
+// persist writes the users to the store file, the caller holds the write lock so concurrent changes are serialised.
+func (u *concreteService) persist() error {
+	if u.path == "" {
+		return nil
+	}
+	return save(u.path, u.userMap, u.disabled)
 }
 
 func (u *concreteService) GetFileService(username string) (fileService file.Service, err error) {
-	sharedKey, found := u.GetSharedKey(username)
+	u.mutex.RLock()
+	userRecord, found := u.userMap[username]
 	if !found {
+		u.mutex.RUnlock()
 		return nil, fmt.Errorf("user not found")
 	}
+	storageID := userRecord.storageID
+	quota := u.defaultQuota
+	if userRecord.quota != nil {
+		quota = *userRecord.quota
+	}
+	u.mutex.RUnlock()
 
-	return u.fileServiceFactory.New(generateHash(sharedKey))
+	fileService, err = u.fileServiceFactory.New(storageID)
+	if err != nil {
+		return nil, err
+	}
+	// The quota is shared by every file service of the user, so this also applies to the open sessions.
+	fileService.SetQuota(quota)
+	return fileService, nil
+}
+
+func (u *concreteService) SetQuota(username string, quota *models.Quota) (err error) {
+	if quota != nil && (quota.MaxBytes < 0 || quota.MaxFiles < 0) {
+		return fmt.Errorf("quota must not be negative")
+	}
+	u.mutex.Lock()
+	userRecord, found := u.userMap[username]
+	if !found {
+		u.mutex.Unlock()
+		return fmt.Errorf("user not found")
+	}
+	previousQuota := userRecord.quota
+	userRecord.quota = quota
+	err = u.persist()
+	if err != nil {
+		userRecord.quota = previousQuota
+	}
+	u.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Apply the quota to the sessions of the user.
+	fileService, err := u.GetFileService(username)
+	if err != nil {
+		return err
+	}
+	fileService.Close()
+	return nil
+}
+
+func (u *concreteService) CreateLibrary(username string, request models.LibraryRequest) (library models.LibraryInfo, err error) {
+	err = file.ValidateLibraryName(request.Name)
+	if err != nil {
+		return models.LibraryInfo{}, err
+	}
+	if request.Quota != nil && (request.Quota.MaxBytes < 0 || request.Quota.MaxFiles < 0) {
+		return models.LibraryInfo{}, fmt.Errorf("quota must not be negative")
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	userRecord, found := u.userMap[username]
+	if !found {
+		return models.LibraryInfo{}, fmt.Errorf("user not found")
+	}
+	if _, exists := userRecord.libraries[request.Name]; exists {
+		return models.LibraryInfo{}, fmt.Errorf("library already exists")
+	}
+	library = models.LibraryInfo{
+		Name:    request.Name,
+		KeyID:   request.KeyID,
+		Quota:   request.Quota,
+		Created: time.Now(),
+	}
+	if userRecord.libraries == nil {
+		userRecord.libraries = make(map[string]models.LibraryInfo)
+	}
+	userRecord.libraries[request.Name] = library
+	err = u.persist()
+	if err != nil {
+		delete(userRecord.libraries, request.Name)
+		return models.LibraryInfo{}, err
+	}
+	return library, nil
+}
+
+func (u *concreteService) GetLibrary(username string, name string) (library models.LibraryInfo, found bool) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	userRecord, found := u.userMap[username]
+	if !found {
+		return models.LibraryInfo{}, false
+	}
+	library, found = userRecord.libraries[name]
+	return library, found
+}
+
+func (u *concreteService) ListLibraries(username string) (libraries []models.LibraryInfo, err error) {
+	u.mutex.RLock()
+	userRecord, found := u.userMap[username]
+	if !found {
+		u.mutex.RUnlock()
+		return nil, fmt.Errorf("user not found")
+	}
+	libraries = make([]models.LibraryInfo, 0, len(userRecord.libraries))
+	for _, library := range userRecord.libraries {
+		libraries = append(libraries, library)
+	}
+	u.mutex.RUnlock()
+
+	sort.Slice(libraries, func(i, j int) bool {
+		return libraries[i].Name < libraries[j].Name
+	})
+	for i := range libraries {
+		var fileService file.Service
+		fileService, err = u.GetLibraryService(username, libraries[i].Name)
+		if err != nil {
+			return nil, err
+		}
+		libraries[i].Usage = fileService.Usage()
+		fileService.Close()
+	}
+	return libraries, nil
+}
+
+func (u *concreteService) DeleteLibrary(username string, name string) (err error) {
+	u.mutex.Lock()
+	userRecord, found := u.userMap[username]
+	if !found {
+		u.mutex.Unlock()
+		return fmt.Errorf("user not found")
+	}
+	library, found := userRecord.libraries[name]
+	if !found {
+		u.mutex.Unlock()
+		return fmt.Errorf("library not found")
+	}
+	delete(userRecord.libraries, name)
+	err = u.persist()
+	if err != nil {
+		userRecord.libraries[name] = library
+	}
+	storageID := userRecord.storageID
+	u.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return u.fileServiceFactory.RemoveLibrary(storageID, name)
+}
+
+func (u *concreteService) GetLibraryService(username string, name string) (fileService file.Service, err error) {
+	library, found := u.GetLibrary(username, name)
+	if !found {
+		return nil, fmt.Errorf("library not found")
+	}
+	// Opening the files of the user applies the quota of the user, which the library counts against.
+	userFiles, err := u.GetFileService(username)
+	if err != nil {
+		return nil, err
+	}
+	userFiles.Close()
+	storageID, _ := u.GetStorageID(username)
+	fileService, err = u.fileServiceFactory.NewLibrary(storageID, name)
+	if err != nil {
+		return nil, err
+	}
+	var quota models.Quota
+	if library.Quota != nil {
+		quota = *library.Quota
+	}
+	fileService.SetQuota(quota)
+	return fileService, nil
+}
+
+// storageIDInUse returns whether a user owns the data directory with the given storage ID, the caller holds the lock.
+func (u *concreteService) storageIDInUse(storageID string) bool {
+	for _, userRecord := range u.userMap {
+		if userRecord.storageID == storageID {
+			return true
+		}
+	}
+	return false
+}
+
+// newStorageID returns a random storage ID, or the hash of the shared key if a directory with that name exists that
+// no other user owns. Data directories used to be named by the hash of the shared key, existing ones are adopted.
+// The caller holds the write lock.
+func (u *concreteService) newStorageID(sharedKey []byte) (storageID string, err error) {
+	if len(sharedKey) > 0 {
+		legacyID := generateHash(sharedKey)
+		if u.fileServiceFactory.Exists(legacyID) && !u.storageIDInUse(legacyID) {
+			return legacyID, nil
+		}
+	}
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
 }
 
 func generateHash(data []byte) (hash string) {
@@ -1 +1,344 @@
 package user_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"filesync/models"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"server/pkg/_mocks"
+	"server/services/file"
+	"server/services/user"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testBaseDir = "testdata"
+	testUser    = "test1"
+)
+
+var testSecret = []byte("secret1")
+
+// testChecksum has the size of the checksums the file service stores.
+const testChecksum = "checksum123456789012345678901234"
+
+func newTestService() user.Service {
+	return user.New(file.NewFactory(testBaseDir, &_mocks.MockCache{}, &_mocks.MockCache{}))
+}
+
+func TestDisable(t *testing.T) {
+	userService := newTestService()
+	err := userService.Create(testUser, testSecret)
+	assert.NoError(t, err)
+	assert.False(t, userService.IsDisabled(testUser))
+
+	err = userService.Disable(testUser)
+	assert.NoError(t, err)
+	assert.True(t, userService.IsDisabled(testUser))
+
+	err = userService.Enable(testUser)
+	assert.NoError(t, err)
+	assert.False(t, userService.IsDisabled(testUser))
+}
+
+func TestDisable_NotFound(t *testing.T) {
+	userService := newTestService()
+
+	err := userService.Disable(testUser)
+	assert.Error(t, err)
+	assert.False(t, userService.IsDisabled(testUser))
+}
+
+func TestSetSharedKey(t *testing.T) {
+	userService := user.New(file.NewFactory(t.TempDir(), &_mocks.MockCache{}, &_mocks.MockCache{}))
+	err := userService.Create(testUser, testSecret)
+	assert.NoError(t, err)
+	storageID, found := userService.GetStorageID(testUser)
+	assert.True(t, found)
+
+	newSecret := []byte("secret2")
+	err = userService.SetSharedKey(testUser, newSecret)
+	assert.NoError(t, err)
+	sharedKey, _ := userService.GetSharedKey(testUser)
+	assert.Equal(t, newSecret, sharedKey)
+	rotatedID, _ := userService.GetStorageID(testUser)
+	assert.Equal(t, storageID, rotatedID, "Expected the storage ID to survive the key rotation")
+
+	assert.Error(t, userService.SetSharedKey("unknown", newSecret))
+}
+
+func TestGetStorageID_Legacy(t *testing.T) {
+	baseDir := t.TempDir()
+	hash := sha256.Sum256(testSecret)
+	legacyID := hex.EncodeToString(hash[:])
+	assert.NoError(t, os.Mkdir(filepath.Join(baseDir, legacyID), 0700))
+	userService := user.New(file.NewFactory(baseDir, &_mocks.MockCache{}, &_mocks.MockCache{}))
+
+	assert.NoError(t, userService.Create(testUser, testSecret))
+	storageID, _ := userService.GetStorageID(testUser)
+	assert.Equal(t, legacyID, storageID, "Expected the existing data directory to be adopted")
+
+	// Another user with the same shared key gets a directory of its own.
+	assert.NoError(t, userService.Create("test3", testSecret))
+	storageID, _ = userService.GetStorageID("test3")
+	assert.NotEqual(t, legacyID, storageID, "Expected the adopted directory not to be shared")
+
+	assert.NoError(t, userService.Create("test2", []byte("secret2")))
+	storageID, _ = userService.GetStorageID("test2")
+	assert.NotEqual(t, legacyID, storageID)
+	assert.Len(t, storageID, 32)
+}
+
+func TestCreateWithVerifier(t *testing.T) {
+	userService := user.New(file.NewFactory(t.TempDir(), &_mocks.MockCache{}, &_mocks.MockCache{}))
+	salt, verifier := []byte("salt"), []byte("verifier")
+
+	assert.NoError(t, userService.CreateWithVerifier(testUser, salt, verifier))
+	storedSalt, storedVerifier, found := userService.GetVerifier(testUser)
+	assert.True(t, found)
+	assert.Equal(t, salt, storedSalt)
+	assert.Equal(t, verifier, storedVerifier)
+	sharedKey, found := userService.GetSharedKey(testUser)
+	assert.True(t, found)
+	assert.Empty(t, sharedKey, "Expected password users to have no shared key")
+
+	assert.NoError(t, userService.Create("test2", testSecret))
+	_, _, found = userService.GetVerifier("test2")
+	assert.False(t, found, "Expected shared key users to have no verifier")
+	assert.Error(t, userService.CreateWithVerifier("test2", salt, verifier))
+
+	assert.NoError(t, userService.SetVerifier(testUser, []byte("salt2"), []byte("verifier2")))
+	storedSalt, storedVerifier, _ = userService.GetVerifier(testUser)
+	assert.Equal(t, []byte("salt2"), storedSalt)
+	assert.Equal(t, []byte("verifier2"), storedVerifier)
+	assert.Error(t, userService.SetVerifier("test2", salt, verifier), "Expected shared key users to get no verifier")
+	assert.Equal(t, []string{testUser, "test2"}, userService.List())
+}
+
+func TestProvision(t *testing.T) {
+	userService := user.New(file.NewFactory(t.TempDir(), &_mocks.MockCache{}, &_mocks.MockCache{}))
+	assert.NoError(t, userService.Provision(testUser, testSecret, "ldap"))
+	assert.NoError(t, userService.Create("test2", testSecret))
+
+	provider, found := userService.GetProvider(testUser)
+	assert.True(t, found)
+	assert.Equal(t, "ldap", provider)
+	provider, found = userService.GetProvider("test2")
+	assert.True(t, found)
+	assert.Empty(t, provider, "Expected registered users to have no provider")
+	_, found = userService.GetProvider("nobody")
+	assert.False(t, found)
+
+	assert.Error(t, userService.Provision(testUser, testSecret, "htpasswd"), "Expected an existing user not to be provisioned again")
+	assert.Error(t, userService.Provision("test3", testSecret, ""), "Expected a provider to be required")
+}
+
+func TestOpen(t *testing.T) {
+	factory := file.NewFactory(t.TempDir(), &_mocks.MockCache{}, &_mocks.MockCache{})
+	path := filepath.Join(t.TempDir(), "users.json")
+	userService, err := user.Open(&user.Config{Path: path}, factory)
+	assert.NoError(t, err)
+	assert.NoError(t, userService.Create(testUser, testSecret))
+	assert.NoError(t, userService.CreateWithVerifier("test2", []byte("salt"), []byte("verifier")))
+	assert.NoError(t, userService.SetSharedKey(testUser, []byte("rotated")))
+	assert.NoError(t, userService.Disable("test2"))
+	assert.NoError(t, userService.Provision("test4", testSecret, "ldap"))
+	assert.NoError(t, userService.Create("test3", testSecret))
+	assert.NoError(t, userService.Delete("test3"))
+	purged, err := userService.Purge(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test3"}, purged)
+	storageID, _ := userService.GetStorageID(testUser)
+
+	// A restarted server finds the users it registered before.
+	reopened, err := user.Open(&user.Config{Path: path}, factory)
+	assert.NoError(t, err)
+	sharedKey, found := reopened.GetSharedKey(testUser)
+	assert.True(t, found)
+	assert.Equal(t, []byte("rotated"), sharedKey)
+	reopenedID, _ := reopened.GetStorageID(testUser)
+	assert.Equal(t, storageID, reopenedID, "Expected the storage ID to survive a restart")
+	salt, verifier, found := reopened.GetVerifier("test2")
+	assert.True(t, found)
+	assert.Equal(t, []byte("salt"), salt)
+	assert.Equal(t, []byte("verifier"), verifier)
+	assert.True(t, reopened.IsDisabled("test2"))
+	provider, found := reopened.GetProvider("test4")
+	assert.True(t, found)
+	assert.Equal(t, "ldap", provider)
+	_, found = reopened.GetSharedKey("test3")
+	assert.False(t, found, "Expected the deleted user to stay deleted")
+
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err), "Expected no temporary file to be left behind")
+}
+
+func TestOpen_UnsupportedVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"Version":99,"Users":{}}`), 0600))
+
+	_, err := user.Open(&user.Config{Path: path}, file.NewFactory(t.TempDir(), &_mocks.MockCache{}, &_mocks.MockCache{}))
+	assert.ErrorContains(t, err, "unsupported schema version")
+}
+
+func TestOpen_ConcurrentCreate(t *testing.T) {
+	factory := file.NewFactory(t.TempDir(), &_mocks.MockCache{}, &_mocks.MockCache{})
+	path := filepath.Join(t.TempDir(), "users.json")
+	userService, err := user.Open(&user.Config{Path: path}, factory)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	var created atomic.Int32
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, userService.Create(fmt.Sprintf("user%d", i), testSecret))
+		}()
+		go func() {
+			defer wg.Done()
+			if userService.Create("contested", testSecret) == nil {
+				created.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), created.Load(), "Expected exactly one registration of the same username to succeed")
+
+	reopened, err := user.Open(&user.Config{Path: path}, factory)
+	assert.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		_, found := reopened.GetSharedKey(fmt.Sprintf("user%d", i))
+		assert.True(t, found)
+	}
+}
+
+func TestSetQuota(t *testing.T) {
+	factory := file.NewFactory(t.TempDir(), &_mocks.MockCache{}, &_mocks.MockCache{})
+	path := filepath.Join(t.TempDir(), "users.json")
+	defaultQuota := models.Quota{MaxBytes: 1024, MaxFiles: 10}
+	userService, err := user.Open(&user.Config{Path: path, DefaultQuota: defaultQuota}, factory)
+	assert.NoError(t, err)
+	assert.NoError(t, userService.Create(testUser, testSecret))
+
+	fileService, err := userService.GetFileService(testUser)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultQuota, fileService.Usage().Quota)
+
+	// The override applies to the file services the user already has.
+	quota := models.Quota{MaxFiles: 1}
+	assert.NoError(t, userService.SetQuota(testUser, &quota))
+	assert.Equal(t, quota, fileService.Usage().Quota)
+	assert.Error(t, userService.SetQuota("missing", &quota))
+	assert.Error(t, userService.SetQuota(testUser, &models.Quota{MaxBytes: -1}))
+
+	reopened, err := user.Open(&user.Config{Path: path, DefaultQuota: defaultQuota}, factory)
+	assert.NoError(t, err)
+	fileService, err = reopened.GetFileService(testUser)
+	assert.NoError(t, err)
+	assert.Equal(t, quota, fileService.Usage().Quota, "Expected the quota to survive a restart")
+
+	assert.NoError(t, reopened.SetQuota(testUser, nil))
+	assert.Equal(t, defaultQuota, fileService.Usage().Quota)
+}
+
+func TestLibraries(t *testing.T) {
+	factory := file.NewFactory(t.TempDir(), &_mocks.MockCache{}, &_mocks.MockCache{})
+	path := filepath.Join(t.TempDir(), "users.json")
+	userService, err := user.Open(&user.Config{Path: path, DefaultQuota: models.Quota{MaxFiles: 10}}, factory)
+	assert.NoError(t, err)
+	assert.NoError(t, userService.Create(testUser, testSecret))
+
+	quota := models.Quota{MaxFiles: 1}
+	library, err := userService.CreateLibrary(testUser, models.LibraryRequest{Name: "photos", KeyID: "key2", Quota: &quota})
+	assert.NoError(t, err)
+	assert.Equal(t, "key2", library.KeyID)
+	_, err = userService.CreateLibrary(testUser, models.LibraryRequest{Name: "photos"})
+	assert.Error(t, err)
+	_, err = userService.CreateLibrary(testUser, models.LibraryRequest{Name: "../photos"})
+	assert.Error(t, err)
+	_, err = userService.CreateLibrary(testUser, models.LibraryRequest{Name: "work"})
+	assert.NoError(t, err)
+
+	photos, err := userService.GetLibraryService(testUser, "photos")
+	assert.NoError(t, err)
+	assert.NoError(t, photos.CreateFile("hash", testChecksum, []byte("content")))
+	assert.ErrorIs(t, photos.CreateFile("other", testChecksum, []byte("content")), file.ErrQuotaExceeded)
+
+	reopened, err := user.Open(&user.Config{Path: path, DefaultQuota: models.Quota{MaxFiles: 10}}, factory)
+	assert.NoError(t, err)
+	libraries, err := reopened.ListLibraries(testUser)
+	assert.NoError(t, err)
+	assert.Len(t, libraries, 2)
+	assert.Equal(t, "photos", libraries[0].Name)
+	assert.Equal(t, &quota, libraries[0].Quota)
+	assert.Equal(t, 1, libraries[0].Usage.Files)
+	assert.Equal(t, "work", libraries[1].Name)
+	fileService, err := reopened.GetFileService(testUser)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fileService.Usage().Files, "Expected the files of the libraries to count against the quota of the user")
+
+	assert.NoError(t, reopened.DeleteLibrary(testUser, "photos"))
+	assert.Error(t, reopened.DeleteLibrary(testUser, "photos"))
+	_, err = reopened.GetLibraryService(testUser, "photos")
+	assert.Error(t, err)
+	assert.Equal(t, 0, fileService.Usage().Files)
+}
+
+func TestDelete(t *testing.T) {
+	baseDir := t.TempDir()
+	factory := file.NewFactory(baseDir, &_mocks.MockCache{}, &_mocks.MockCache{})
+	path := filepath.Join(t.TempDir(), "users.json")
+	config := &user.Config{Path: path, GracePeriod: time.Hour}
+	userService, err := user.Open(config, factory)
+	assert.NoError(t, err)
+	assert.NoError(t, userService.Create(testUser, testSecret))
+	assert.NoError(t, userService.Create("test2", testSecret))
+	fileService, err := userService.GetFileService(testUser)
+	assert.NoError(t, err)
+	assert.NoError(t, fileService.CreateFile("hash", testChecksum, []byte("content")))
+	storageID, _ := userService.GetStorageID(testUser)
+
+	assert.NoError(t, userService.Delete(testUser))
+	assert.True(t, userService.IsDisabled(testUser), "Expected a deleted user to be disabled at once")
+	assert.Error(t, userService.Delete(testUser))
+	assert.NoError(t, userService.Enable(testUser))
+	assert.True(t, userService.IsDisabled(testUser), "Expected enabling to keep the user deleted")
+	deleted, found := userService.DeletedAt(testUser)
+	assert.True(t, found)
+
+	// A restarted server keeps the deletion, the data stays during the grace period.
+	userService, err = user.Open(config, factory)
+	assert.NoError(t, err)
+	reopenedDeleted, found := userService.DeletedAt(testUser)
+	assert.True(t, found)
+	assert.True(t, deleted.Equal(reopenedDeleted))
+	purged, err := userService.Purge(deleted.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Empty(t, purged)
+	_, err = os.Stat(filepath.Join(baseDir, storageID))
+	assert.NoError(t, err)
+
+	assert.NoError(t, userService.Restore(testUser))
+	assert.False(t, userService.IsDisabled(testUser))
+	assert.Error(t, userService.Restore(testUser))
+
+	assert.NoError(t, userService.Delete(testUser))
+	purged, err = userService.Purge(time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{testUser}, purged)
+	_, found = userService.GetStorageID(testUser)
+	assert.False(t, found)
+	_, err = os.Stat(filepath.Join(baseDir, storageID))
+	assert.True(t, os.IsNotExist(err), "Expected the data directory to be purged")
+	assert.False(t, userService.IsDisabled("test2"))
+
+	userService, err = user.Open(config, factory)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test2"}, userService.List())
+}
@@ -0,0 +1,15 @@
+package enums
+
+// Access is the access a member has to a shared library.
+type Access uint8
+
+const (
+	// ReadAccess allows listing, downloading and subscribing to changes.
+	ReadAccess Access = iota
+	// ReadWriteAccess also allows creating and deleting files.
+	ReadWriteAccess
+)
+
+func (a Access) String() string {
+	return [...]string{"ReadAccess", "ReadWriteAccess"}[a]
+}
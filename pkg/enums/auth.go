@@ -6,8 +6,19 @@ const (
 	Authenticated AuthResult = iota
 	NewUser
 	Unauthorized
+	ServerFull
+	TooManyConnections
+	RateLimited
+	ResumeRejected
+	Disabled
+	RegistrationDisabled
+	InviteRequired
+	InvalidInvite
+	InviteExpired
+	LockedOut
+	DeviceRevoked
 )
 
 func (c AuthResult) String() string {
-	return [...]string{"Authenticated", "NewUser", "Unauthorized"}[c]
+	return [...]string{"Authenticated", "NewUser", "Unauthorized", "ServerFull", "TooManyConnections", "RateLimited", "ResumeRejected", "Disabled", "RegistrationDisabled", "InviteRequired", "InvalidInvite", "InviteExpired", "LockedOut", "DeviceRevoked"}[c]
 }
@@ -0,0 +1,16 @@
+package enums
+
+type ErrorCode uint8
+
+const (
+	InternalError ErrorCode = iota
+	BadRequest
+	NotFound
+	Cancelled
+	Forbidden
+	QuotaExceeded
+)
+
+func (e ErrorCode) String() string {
+	return [...]string{"InternalError", "BadRequest", "NotFound", "Cancelled", "Forbidden", "QuotaExceeded"}[e]
+}
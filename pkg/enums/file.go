@@ -13,3 +13,15 @@ const (
 func (f FileStatus) String() string {
 	return [...]string{"Unknown", "Stale", "Dirty", "Syncing", "Synced"}[f]
 }
+
+type FileOperation uint8
+
+const (
+	FileCreated FileOperation = iota
+	FileDeleted
+	ResyncNeeded
+)
+
+func (f FileOperation) String() string {
+	return [...]string{"FileCreated", "FileDeleted", "ResyncNeeded"}[f]
+}
@@ -0,0 +1,55 @@
+package enums
+
+type MessageType uint8
+
+const (
+	Auth MessageType = iota
+	Status
+	Download
+	Upload
+	Delete
+	Chunk
+	List
+	Echo
+	Cancel
+	Subscribe
+	Unsubscribe
+	Notify
+	Resume
+	Error
+	RotateKey
+	Password
+	Token
+	CreateToken
+	ListTokens
+	RevokeToken
+	Login
+	Device
+	ListDevices
+	RevokeDevice
+	CreateShare
+	ListShares
+	DeleteShare
+	SetShareMember
+	RemoveShareMember
+	SelectShare
+	CreateLibrary
+	ListLibraries
+	DeleteLibrary
+	SelectLibrary
+)
+
+func (m MessageType) String() string {
+	return [...]string{"Auth", "Status", "Download", "Upload", "Delete", "Chunk", "List", "Echo", "Cancel", "Subscribe", "Unsubscribe", "Notify", "Resume", "Error", "RotateKey", "Password", "Token", "CreateToken", "ListTokens", "RevokeToken", "Login", "Device", "ListDevices", "RevokeDevice", "CreateShare", "ListShares", "DeleteShare", "SetShareMember", "RemoveShareMember", "SelectShare", "CreateLibrary", "ListLibraries", "DeleteLibrary", "SelectLibrary"}[m]
+}
+
+type Sender uint8
+
+const (
+	Client Sender = iota
+	Server
+)
+
+func (s Sender) String() string {
+	return [...]string{"Client", "Server"}[s]
+}
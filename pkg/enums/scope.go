@@ -0,0 +1,17 @@
+package enums
+
+// Scope is a permission granted to an API token.
+type Scope uint8
+
+const (
+	// ReadScope allows listing, downloading and subscribing to changes.
+	ReadScope Scope = iota
+	// UploadScope allows creating files.
+	UploadScope
+	// DeleteScope allows deleting files.
+	DeleteScope
+)
+
+func (s Scope) String() string {
+	return [...]string{"ReadScope", "UploadScope", "DeleteScope"}[s]
+}
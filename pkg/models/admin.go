@@ -0,0 +1,77 @@
+package models
+
+import "time"
+
+// SessionInfo describes an active session on the admin interface.
+type SessionInfo struct {
+	ID           string
+	Username     string
+	RemoteAddr   string
+	StartTime    time.Time
+	BytesIn      uint64
+	BytesOut     uint64
+	Transactions []TransactionInfo
+}
+
+// TransactionInfo describes an in-flight request of a session on the admin interface.
+type TransactionInfo struct {
+	ID        string
+	Action    string
+	StartTime time.Time
+}
+
+// CacheStats describes the usage of a cache on the admin interface.
+type CacheStats struct {
+	Size     int
+	Capacity int
+	Hits     uint64
+	Misses   uint64
+}
+
+// ServerStats describes the state of the server on the admin interface.
+type ServerStats struct {
+	ActiveConnections int64
+	RejectedGlobal    uint64
+	RejectedPerIP     uint64
+	RejectedRate      uint64
+	Caches            map[string]CacheStats
+}
+
+// Invite is a registration invite created on the admin interface.
+type Invite struct {
+	Token   string
+	Expires time.Time
+}
+
+// LockoutInfo describes the failed authentication attempts of a username or remote address on the admin interface.
+type LockoutInfo struct {
+	Kind         string
+	Key          string
+	Failures     int
+	LastFailure  time.Time
+	BlockedUntil time.Time
+}
+
+// UserInfo describes a user on the admin interface.
+type UserInfo struct {
+	Username string
+	Disabled bool
+	// Password is whether the user logs in with a password instead of a shared key.
+	Password bool
+	// Deleted is when the user was deleted, it is zero unless the user waits to be purged.
+	Deleted time.Time
+	Usage   Usage
+}
+
+// UserRequest asks the admin interface to create a user with a generated password or shared key.
+type UserRequest struct {
+	Username string
+	Password bool
+}
+
+// Credential is a generated credential of a user, only one of Password and SharedKey is set.
+type Credential struct {
+	Username  string
+	Password  string
+	SharedKey []byte
+}
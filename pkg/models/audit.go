@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// AuditEntry is a line of the audit log.
+type AuditEntry struct {
+	Time       time.Time
+	Event      string
+	Username   string
+	Device     string
+	RemoteAddr string
+	// Method is the authentication method of login events.
+	Method string
+	Detail string
+	// PrevHash and Hash chain the entries of a tamper evident log, they are empty otherwise.
+	PrevHash string
+	Hash     string
+}
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// DeviceInfo describes a device that connected on behalf of a user.
+type DeviceInfo struct {
+	ID            string
+	Name          string
+	Username      string
+	ClientVersion string
+	FirstSeen     time.Time
+	LastSeen      time.Time
+	// RevokedAt is the zero time for devices that may connect.
+	RevokedAt time.Time
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"encoding/binary"
+	"filesync/enums"
 	"time"
 )
 
@@ -63,3 +64,21 @@ func (f *FileInfo) FromBytes(fileInfoBytes *FileInfoBytes) {
 	f.Checksum = fileInfoBytes.GetChecksum()
 	f.Timestamp = fileInfoBytes.GetTimestamp()
 }
+
+// FileChange describes a committed change to a user's files.
+type FileChange struct {
+	Hash      string
+	Checksum  string
+	Operation enums.FileOperation
+	// Share is the ID of the shared library and Library the name of the library of the user the change was made in,
+	// both are empty for the user's default files.
+	Share   string
+	Library string
+}
+
+// StreamOffset is the number of content bytes of a stream. The server acknowledges the chunks of an upload with the
+// offset it received so far, and a client resumes the upload after a reconnect from the offset it last saw
+// acknowledged.
+type StreamOffset struct {
+	Offset int64
+}
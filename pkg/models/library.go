@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// LibraryInfo describes a named library of a user, a set of files separate from the user's default files.
+type LibraryInfo struct {
+	Name string
+	// KeyID identifies the key the client encrypts the files of the library with, it is empty if the library uses
+	// the key of the user's default files. The server never sees the key.
+	KeyID string
+	// Quota limits the library in addition to the quota of the user, nil if only the quota of the user applies.
+	Quota   *Quota
+	Created time.Time
+	Usage   Usage
+}
+
+// LibraryRequest asks to create a library.
+type LibraryRequest struct {
+	Name  string
+	KeyID string
+	Quota *Quota
+}
@@ -1 +1,9 @@
 package models
+
+import "filesync/enums"
+
+// ErrorResponse is the body of an error response to a request.
+type ErrorResponse struct {
+	Code    enums.ErrorCode
+	Message string
+}
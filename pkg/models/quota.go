@@ -0,0 +1,14 @@
+package models
+
+// Quota limits the storage of a user, zero fields are unlimited.
+type Quota struct {
+	MaxBytes int64
+	MaxFiles int
+}
+
+// Usage describes the storage of a user and the quota it counts against.
+type Usage struct {
+	Bytes int64
+	Files int
+	Quota Quota
+}
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"filesync/enums"
+	"time"
+)
+
+// ShareInfo describes a library owned by one user and shared with its members.
+type ShareInfo struct {
+	ID      string
+	Name    string
+	Owner   string
+	Members map[string]enums.Access
+	Created time.Time
+}
+
+// ShareMember grants a user access to a shared library.
+type ShareMember struct {
+	ShareID  string
+	Username string
+	Access   enums.Access
+}
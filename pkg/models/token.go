@@ -0,0 +1,36 @@
+package models
+
+import (
+	"filesync/enums"
+	"time"
+)
+
+// TokenRequest is the body of a request to create an API token.
+type TokenRequest struct {
+	Name   string
+	Scopes []enums.Scope
+	// Library restricts the token to the library of the user with this name, an empty library allows the default
+	// files of the user and every library and share.
+	Library string
+	// TTL is how long the token is valid, zero creates a token that does not expire.
+	TTL time.Duration
+}
+
+// TokenInfo describes an API token without its secret.
+type TokenInfo struct {
+	ID       string
+	Name     string
+	Username string
+	Scopes   []enums.Scope
+	// Library is the only library the token can access, it is empty for tokens that are not restricted to one.
+	Library string
+	Created time.Time
+	// Expires is the zero time for tokens that do not expire.
+	Expires time.Time
+}
+
+// NewToken is the response to a request to create an API token, the token is only ever sent once.
+type NewToken struct {
+	TokenInfo
+	Token string
+}
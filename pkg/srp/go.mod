@@ -0,0 +1,3 @@
+module filesync/srp
+
+go 1.22.1
@@ -0,0 +1,218 @@
+// Package srp implements the SRP-6a password authenticated key exchange of RFC 5054 with SHA-256 and the
+// 2048-bit group. The server only stores a salt and a verifier and never learns the password.
+package srp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"math/big"
+)
+
+const (
+	// SaltSize is the size of a salt in bytes.
+	SaltSize = 16
+	// KeySize is the size of the padded public keys and verifiers in bytes.
+	KeySize = 256
+	// ProofSize is the size of the client and server proofs in bytes.
+	ProofSize = sha256.Size
+	// secretSize is the size of the private ephemeral values in bytes.
+	secretSize = 32
+)
+
+var (
+	ErrInvalidPublicKey = errors.New("invalid public key")
+	ErrInvalidProof     = errors.New("invalid proof")
+)
+
+// groupN is the 2048-bit safe prime of RFC 5054 appendix A.
+const groupN = "AC6BDB41324A9A9BF166DE5E1389582FAF72B6651987EE07FC3192943DB56050A37329CBB4A099ED8193E0757767A13DD52312AB4B03310DCD7F48A9DA04FD50E8083969EDB767B0CF6095179A163AB3661A05FBD5FAAAE82918A9962F0B93B855F97993EC975EEAA80D740ADBF4FF747359D041D5C33EA71D281E446B14773BCA97B43A23FB801676BD207A436C6481F1D2B9078717461A5B9D32E688F87748544523B524B0D57D5EA77A2775D2ECFA032CFBDBF52FB3786160279004E57AE6AF874E7303CE53299CCC041C7BC308D82A5698F3A8D0C38271AE35F8E9DBFBB694B5C803D89F7AE435DE236D525F54759B65E372FCD68EF20FA7111F9E4AFF73"
+
+var (
+	n, _ = new(big.Int).SetString(groupN, 16)
+	g    = big.NewInt(2)
+	// k is the multiplier parameter H(N | PAD(g)).
+	k = hashInt(n.Bytes(), pad(g))
+)
+
+// NewVerifier generates a random salt and the verifier of the password, which is all the server stores.
+func NewVerifier(username string, password string) (salt []byte, verifier []byte, err error) {
+	salt = make([]byte, SaltSize)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return salt, ComputeVerifier(username, password, salt), nil
+}
+
+// ComputeVerifier returns the verifier g^x of the password with the salt.
+func ComputeVerifier(username string, password string, salt []byte) []byte {
+	return pad(new(big.Int).Exp(g, privateKey(username, password, salt), n))
+}
+
+// Client is the client side of a single exchange.
+type Client struct {
+	username  string
+	password  string
+	a         *big.Int
+	publicKey *big.Int
+	key       []byte
+	m2        []byte
+}
+
+func NewClient(username string, password string) (*Client, error) {
+	a, err := randomSecret()
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		username:  username,
+		password:  password,
+		a:         a,
+		publicKey: new(big.Int).Exp(g, a, n),
+	}, nil
+}
+
+// PublicKey returns the public key A the client sends to the server.
+func (c *Client) PublicKey() []byte {
+	return pad(c.publicKey)
+}
+
+// Proof computes the session key from the salt and the public key B of the server and returns the proof M1
+// the client sends to the server.
+func (c *Client) Proof(salt []byte, serverPublicKey []byte) ([]byte, error) {
+	b := new(big.Int).SetBytes(serverPublicKey)
+	if new(big.Int).Mod(b, n).Sign() == 0 {
+		return nil, ErrInvalidPublicKey
+	}
+	u := hashInt(pad(c.publicKey), pad(b))
+	if u.Sign() == 0 {
+		return nil, ErrInvalidPublicKey
+	}
+	x := privateKey(c.username, c.password, salt)
+
+	// S = (B - k * g^x) ^ (a + u * x) mod N
+	base := new(big.Int).Mul(k, new(big.Int).Exp(g, x, n))
+	base.Sub(b, base).Mod(base, n)
+	exp := new(big.Int).Mul(u, x)
+	exp.Add(exp, c.a)
+	s := new(big.Int).Exp(base, exp, n)
+
+	c.key = hash(pad(s))
+	m1 := clientProof(c.username, salt, c.publicKey, b, c.key)
+	c.m2 = hash(pad(c.publicKey), m1, c.key)
+	return m1, nil
+}
+
+// VerifyServer returns whether the proof M2 shows that the server knows the verifier.
+func (c *Client) VerifyServer(proof []byte) bool {
+	return c.m2 != nil && subtle.ConstantTimeCompare(c.m2, proof) == 1
+}
+
+// SessionKey returns the shared session key K, it is nil before Proof succeeded.
+func (c *Client) SessionKey() []byte {
+	return c.key
+}
+
+// Server is the server side of a single exchange.
+type Server struct {
+	publicKey *big.Int
+	key       []byte
+	m1        []byte
+	m2        []byte
+}
+
+// NewServer starts the exchange with the public key A of the client and the stored salt and verifier.
+func NewServer(username string, salt []byte, verifier []byte, clientPublicKey []byte) (*Server, error) {
+	a := new(big.Int).SetBytes(clientPublicKey)
+	if new(big.Int).Mod(a, n).Sign() == 0 {
+		return nil, ErrInvalidPublicKey
+	}
+	b, err := randomSecret()
+	if err != nil {
+		return nil, err
+	}
+	v := new(big.Int).SetBytes(verifier)
+
+	// B = (k * v + g^b) mod N
+	publicKey := new(big.Int).Mul(k, v)
+	publicKey.Add(publicKey, new(big.Int).Exp(g, b, n)).Mod(publicKey, n)
+	u := hashInt(pad(a), pad(publicKey))
+	if u.Sign() == 0 {
+		return nil, ErrInvalidPublicKey
+	}
+
+	// S = (A * v^u) ^ b mod N
+	s := new(big.Int).Exp(v, u, n)
+	s.Mul(s, a).Mod(s, n)
+	s.Exp(s, b, n)
+
+	key := hash(pad(s))
+	m1 := clientProof(username, salt, a, publicKey, key)
+	return &Server{
+		publicKey: publicKey,
+		key:       key,
+		m1:        m1,
+		m2:        hash(pad(a), m1, key),
+	}, nil
+}
+
+// PublicKey returns the public key B the server sends to the client.
+func (s *Server) PublicKey() []byte {
+	return pad(s.publicKey)
+}
+
+// Verify checks the proof M1 of the client and returns the proof M2 the server sends back.
+func (s *Server) Verify(clientProof []byte) ([]byte, error) {
+	if subtle.ConstantTimeCompare(s.m1, clientProof) != 1 {
+		return nil, ErrInvalidProof
+	}
+	return s.m2, nil
+}
+
+// SessionKey returns the shared session key K. It must only be used after Verify succeeded.
+func (s *Server) SessionKey() []byte {
+	return s.key
+}
+
+// privateKey returns x = H(s | H(I | ":" | P)).
+func privateKey(username string, password string, salt []byte) *big.Int {
+	return hashInt(salt, hash([]byte(username+":"+password)))
+}
+
+// clientProof returns M1 = H(H(N) xor H(g) | H(I) | s | A | B | K).
+func clientProof(username string, salt []byte, a *big.Int, b *big.Int, key []byte) []byte {
+	hn := hash(n.Bytes())
+	hg := hash(g.Bytes())
+	for i := range hn {
+		hn[i] ^= hg[i]
+	}
+	return hash(hn, hash([]byte(username)), salt, pad(a), pad(b), key)
+}
+
+func randomSecret() (*big.Int, error) {
+	secret := make([]byte, secretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(secret), nil
+}
+
+func hash(parts ...[]byte) []byte {
+	hasher := sha256.New()
+	for _, part := range parts {
+		hasher.Write(part)
+	}
+	return hasher.Sum(nil)
+}
+
+func hashInt(parts ...[]byte) *big.Int {
+	return new(big.Int).SetBytes(hash(parts...))
+}
+
+// pad returns the value as a big-endian byte slice of KeySize bytes.
+func pad(value *big.Int) []byte {
+	return value.FillBytes(make([]byte, KeySize))
+}
@@ -0,0 +1,54 @@
+package srp_test
+
+import (
+	"filesync/srp"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const (
+	testUser     = "test1"
+	testPassword = "correct horse battery staple"
+)
+
+func exchange(t *testing.T, password string) (*srp.Client, *srp.Server, []byte) {
+	salt, verifier, err := srp.NewVerifier(testUser, testPassword)
+	assert.NoError(t, err)
+	assert.Len(t, salt, srp.SaltSize)
+	assert.Len(t, verifier, srp.KeySize)
+
+	client, err := srp.NewClient(testUser, password)
+	assert.NoError(t, err)
+	server, err := srp.NewServer(testUser, salt, verifier, client.PublicKey())
+	assert.NoError(t, err)
+
+	proof, err := client.Proof(salt, server.PublicKey())
+	assert.NoError(t, err)
+	assert.Len(t, proof, srp.ProofSize)
+	return client, server, proof
+}
+
+func TestExchange(t *testing.T) {
+	client, server, proof := exchange(t, testPassword)
+
+	serverProof, err := server.Verify(proof)
+	assert.NoError(t, err)
+	assert.True(t, client.VerifyServer(serverProof))
+	assert.Equal(t, client.SessionKey(), server.SessionKey())
+}
+
+func TestExchange_WrongPassword(t *testing.T) {
+	client, server, proof := exchange(t, "wrong password")
+
+	_, err := server.Verify(proof)
+	assert.ErrorIs(t, err, srp.ErrInvalidProof)
+	assert.NotEqual(t, client.SessionKey(), server.SessionKey())
+}
+
+func TestNewServer_InvalidPublicKey(t *testing.T) {
+	salt, verifier, err := srp.NewVerifier(testUser, testPassword)
+	assert.NoError(t, err)
+
+	_, err = srp.NewServer(testUser, salt, verifier, make([]byte, srp.KeySize))
+	assert.ErrorIs(t, err, srp.ErrInvalidPublicKey)
+}